@@ -14,24 +14,24 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/moby/buildkit/client"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/grpc"
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
-	"k8s.io/client-go/dynamic"
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog"
 
 	"github.com/tsuru/deploy-agent/pkg/build"
-	"github.com/tsuru/deploy-agent/pkg/build/buildkit"
-	"github.com/tsuru/deploy-agent/pkg/build/buildkit/autodiscovery"
+	"github.com/tsuru/deploy-agent/pkg/build/backend"
+	"github.com/tsuru/deploy-agent/pkg/build/buildkit/metrics"
+	"github.com/tsuru/deploy-agent/pkg/build/buildkit/pool"
 	buildpb "github.com/tsuru/deploy-agent/pkg/build/grpc_build_v1"
+	"github.com/tsuru/deploy-agent/pkg/config"
 	"github.com/tsuru/deploy-agent/pkg/health"
-	"github.com/tsuru/deploy-agent/pkg/repository"
+	"github.com/tsuru/deploy-agent/pkg/keda"
+	kedapb "github.com/tsuru/deploy-agent/pkg/keda/externalscaler"
 )
 
 const (
@@ -40,24 +40,47 @@ const (
 )
 
 var cfg struct {
+	ConfigPath                                                string
+	BuilderBackend                                            string
+	DockerHost                                                string
 	BuildkitAddress                                           string
+	BuildkitAddresses                                         string
 	BuildkitTmpDir                                            string
 	BuildKitAutoDiscoveryKubernetesPodSelector                string
+	BuildKitAutoDiscoveryDNSName                              string
 	BuildKitAutoDiscoveryKubernetesNamespace                  string
 	BuildKitAutoDiscoveryKubernetesLeasePrefix                string
 	BuildKitAutoDiscoveryStatefulset                          string
 	KubernetesConfig                                          string
 	RemoteRepositoryPath                                      string
+	RemoteRepositoryRetentionKeepLast                         int
 	BuildKitAutoDiscoveryTimeout                              time.Duration
+	BuildKitAutoDiscoveryAffinityWait                         time.Duration
+	BuildKitAutoDiscoveryLeaseDuration                        time.Duration
+	BuildKitAutoDiscoveryLeaseRenewDeadline                   time.Duration
+	BuildKitAutoDiscoveryLeaseRetryPeriod                     time.Duration
+	BuildKitHealthCheckInterval                               time.Duration
+	BuildKitRetryBackoff                                      time.Duration
+	BuildKitRetryMaxAttempts                                  int
 	BuildKitAutoDiscoveryKubernetesPort                       int
 	Port                                                      int
 	MetricsPort                                               int
 	ServerMaxRecvMsgSize                                      int
 	ServerMaxSendMsgSize                                      int
 	BuildKitAutoDiscoveryScaleGracefulPeriod                  time.Duration
+	BuildKitAutoDiscoveryScaleOutThreshold                    time.Duration
+	BuildKitAutoDiscoveryScaleMaxReplicas                     int
+	BuildKitAutoDiscoveryKubernetesBuildRunsHistoryLimit      int
+	BuildKitAutoDiscoveryScaleInterval                        time.Duration
 	BuildKitAutoDiscovery                                     bool
+	BuildKitAutoDiscoveryLoadAware                            bool
+	KEDAExternalScaler                                        bool
+	MetricsTeamLabel                                          bool
+	BuildKitAutoDiscoveryAbortOnLeaseLoss                     bool
 	BuildKitAutoDiscoveryKubernetesSetTsuruAppLabels          bool
 	BuildKitAutoDiscoveryKubernetesUseSameNamespaceAsTsuruApp bool
+	BuildKitAutoDiscoveryKubernetesBuildEvents                bool
+	BuildKitAutoDiscoveryKubernetesBuildRuns                  bool
 	DisableCache                                              bool
 
 	// BuildKitDetectCPUArch could be use with caution only on local development
@@ -70,59 +93,103 @@ var cfg struct {
 func main() {
 	klog.InitFlags(flag.CommandLine)
 
+	flag.StringVar(&cfg.ConfigPath, "config", getEnvOrDefault("DEPLOY_AGENT_CONFIG", ""), "Path to the YAML configuration file (flags set explicitly take precedence over it)")
+
 	flag.IntVar(&cfg.Port, "port", 8080, "Server TCP port")
 	flag.IntVar(&cfg.MetricsPort, "metrics-port", 9090, "Metrics server TCP port")
+	flag.BoolVar(&cfg.MetricsTeamLabel, "metrics-team-label", false, "Whether should label build metrics with the Tsuru app (or job) team, which increases their cardinality")
 	flag.IntVar(&cfg.ServerMaxRecvMsgSize, "max-receiving-message-size", DefaultServerMaxRecvMsgSize, "Max message size in bytes that server can receive")
 	flag.IntVar(&cfg.ServerMaxSendMsgSize, "max-sending-message-size", DefaultServerMaxSendMsgSize, "Max message size in bytes that server can send")
+	flag.BoolVar(&cfg.KEDAExternalScaler, "keda-external-scaler", false, "Whether should serve the KEDA External Scaler API, reporting the builds waiting for and running on BuildKit by namespace (requires a single agent replica)")
 
 	flag.StringVar(&cfg.KubernetesConfig, "kubeconfig", getEnvOrDefault("KUBECONFIG", ""), "Path to kubeconfig file")
 
+	flag.StringVar(&cfg.BuilderBackend, "builder-backend", getEnvOrDefault("DEPLOY_AGENT_BUILDER_BACKEND", "buildkit"), "Build backend to use (buildkit or docker)")
+	flag.StringVar(&cfg.DockerHost, "docker-host", "", "Docker Engine daemon address used by the docker backend (defaults to DOCKER_HOST env var)")
+
 	flag.StringVar(&cfg.BuildkitAddress, "buildkit-addr", getEnvOrDefault("BUILDKIT_HOST", ""), "Buildkit server address")
+	flag.StringVar(&cfg.BuildkitAddresses, "buildkit-addrs", getEnvOrDefault("BUILDKIT_HOSTS", ""), "Comma-separated list of BuildKit server addresses to load balance builds across (mutually exclusive with -buildkit-addr)")
+	flag.DurationVar(&cfg.BuildKitHealthCheckInterval, "buildkit-health-check-interval", pool.DefaultHealthCheckInterval, "Interval between health checks of the BuildKit servers set in -buildkit-addrs")
+	flag.IntVar(&cfg.BuildKitRetryMaxAttempts, "buildkit-retry-max-attempts", 1, "Max times a build is tried when failing for transient BuildKit reasons (e.g. its pod evicted mid-build), discovering BuildKit again before each retry")
+	flag.DurationVar(&cfg.BuildKitRetryBackoff, "buildkit-retry-backoff", (5 * time.Second), "Wait before the first retry of a build, doubling on every retry")
 	flag.StringVar(&cfg.BuildkitTmpDir, "buildkit-tmp-dir", os.TempDir(), "Directory path to store temp files during container image builds")
 
 	flag.StringVar(&cfg.RemoteRepositoryPath, "remote-repository-path", getEnvOrDefault("REMOTE_REPOSITORY_PATH", ""), "Remote image repository providers config path")
+	flag.IntVar(&cfg.RemoteRepositoryRetentionKeepLast, "remote-repository-retention-keep-last", 0, "Number of latest versions of an app's (or job's) images kept after pushing a new one, besides the ones in use, on registries whose provider supports it (zero disables it)")
 
-	flag.BoolVar(&cfg.BuildKitAutoDiscovery, "buildkit-autodiscovery", false, "Whether should dynamically discover the BuildKit service based on Tsuru app (if any)")
+	flag.BoolVar(&cfg.BuildKitAutoDiscovery, "buildkit-autodiscovery", false, "Whether should dynamically discover the BuildKit service based on Tsuru app, job or platform (if any)")
 	flag.DurationVar(&cfg.BuildKitAutoDiscoveryTimeout, "buildkit-autodiscovery-timeout", (5 * time.Minute), "Max duration to discover an available BuildKit")
+	flag.DurationVar(&cfg.BuildKitAutoDiscoveryAffinityWait, "buildkit-autodiscovery-affinity-wait", 0, "Max duration to wait for the BuildKit pod which last built the app (and likely has its cache) before using any other pod (zero disables it)")
+	flag.DurationVar(&cfg.BuildKitAutoDiscoveryLeaseDuration, "buildkit-autodiscovery-lease-duration", (5 * time.Second), "Duration that other agents wait before taking over the lease of a BuildKit pod which was not renewed")
+	flag.DurationVar(&cfg.BuildKitAutoDiscoveryLeaseRenewDeadline, "buildkit-autodiscovery-lease-renew-deadline", (2 * time.Second), "Max duration to keep retrying the renewal of a BuildKit pod's lease before giving it up")
+	flag.DurationVar(&cfg.BuildKitAutoDiscoveryLeaseRetryPeriod, "buildkit-autodiscovery-lease-retry-period", (500 * time.Millisecond), "Duration between attempts to acquire or renew the lease of a BuildKit pod")
+	flag.BoolVar(&cfg.BuildKitAutoDiscoveryAbortOnLeaseLoss, "buildkit-autodiscovery-abort-on-lease-loss", false, "Whether should abort builds which lost the lease of their BuildKit pod (otherwise they go on with a warning)")
+	flag.BoolVar(&cfg.BuildKitAutoDiscoveryLoadAware, "buildkit-autodiscovery-load-aware", false, "Whether should prefer the BuildKit pods with more free cache space, fewer recent builds and no node pressure")
+	flag.StringVar(&cfg.BuildKitAutoDiscoveryDNSName, "buildkit-autodiscovery-dns-name", "", "DNS name (e.g. headless Service) resolving to BuildKit endpoints, as SRV records when in _service._proto.name form or A/AAAA records otherwise, to discover BuildKit without the Kubernetes API")
 	flag.StringVar(&cfg.BuildKitAutoDiscoveryKubernetesPodSelector, "buildkit-autodiscovery-kubernetes-pod-selector", "", "Label selector of BuildKit's pods on Kubernetes")
 	flag.StringVar(&cfg.BuildKitAutoDiscoveryKubernetesNamespace, "buildkit-autodiscovery-kubernetes-namespace", "", "Namespace of BuildKit's pods on Kubernetes")
 	flag.StringVar(&cfg.BuildKitAutoDiscoveryKubernetesLeasePrefix, "buildkit-autodiscovery-kubernetes-lease-prefix", "deploy-agent", "Prefix name for Lease resources")
 	flag.IntVar(&cfg.BuildKitAutoDiscoveryKubernetesPort, "buildkit-autodiscovery-kubernetes-port", 80, "TCP port number which BuldKit's service is listening")
-	flag.BoolVar(&cfg.BuildKitAutoDiscoveryKubernetesSetTsuruAppLabels, "buildkit-autodiscovery-kubernetes-set-tsuru-app-labels", false, "Whether should set the Tsuru app labels in the selected BuildKit pod")
-	flag.BoolVar(&cfg.BuildKitAutoDiscoveryKubernetesUseSameNamespaceAsTsuruApp, "buildkit-autodiscovery-kubernetes-use-same-namespace-as-tsuru-app", false, "Whether should look for BuildKit in the Tsuru app's namespace")
+	flag.BoolVar(&cfg.BuildKitAutoDiscoveryKubernetesSetTsuruAppLabels, "buildkit-autodiscovery-kubernetes-set-tsuru-app-labels", false, "Whether should set the Tsuru app (or job, platform) labels in the selected BuildKit pod")
+	flag.BoolVar(&cfg.BuildKitAutoDiscoveryKubernetesUseSameNamespaceAsTsuruApp, "buildkit-autodiscovery-kubernetes-use-same-namespace-as-tsuru-app", false, "Whether should look for BuildKit in the Tsuru app's (or job's) namespace")
+	flag.BoolVar(&cfg.BuildKitAutoDiscoveryKubernetesBuildEvents, "buildkit-autodiscovery-kubernetes-build-events", false, "Whether should record Kubernetes Events of each build on its BuildKit pod and on the Tsuru app (or job) resource")
+	flag.BoolVar(&cfg.BuildKitAutoDiscoveryKubernetesBuildRuns, "buildkit-autodiscovery-kubernetes-build-runs", false, "Whether should create a BuildRun resource for each Tsuru app (or job) build in its namespace")
+	flag.IntVar(&cfg.BuildKitAutoDiscoveryKubernetesBuildRunsHistoryLimit, "buildkit-autodiscovery-kubernetes-build-runs-history-limit", 10, "Number of finished BuildRuns kept for each Tsuru app (or job), zero keeps them all")
 	flag.StringVar(&cfg.BuildKitAutoDiscoveryStatefulset, "buildkit-autodiscovery-scale-statefulset", "", "Name of statefulset of buildkit that scale from zero")
 	flag.DurationVar(&cfg.BuildKitAutoDiscoveryScaleGracefulPeriod, "buildkit-autodiscovery-scale-graceful-period", (2 * time.Hour), "how long time after a build to retain buildkit running")
+	flag.IntVar(&cfg.BuildKitAutoDiscoveryScaleMaxReplicas, "buildkit-autodiscovery-scale-max-replicas", 0, "Max replicas of the buildkit statefulset when scaling out due to waiting builds (zero disables the horizontal scaling)")
+	flag.DurationVar(&cfg.BuildKitAutoDiscoveryScaleOutThreshold, "buildkit-autodiscovery-scale-out-threshold", (30 * time.Second), "how long a build waits for a free buildkit before scaling out the statefulset")
+	flag.DurationVar(&cfg.BuildKitAutoDiscoveryScaleInterval, "buildkit-autodiscovery-scale-interval", (5 * time.Minute), "Interval between downscaler runs, which happen only on the elected deploy-agent replica")
 
 	flag.BoolVar(&cfg.DisableCache, "disable-cache", false, "Disable BuildKit cache during container image builds")
 	flag.BoolVar(&cfg.BuildKitDetectCPUArch, "buildkit-detect-cpu-arch", getBoolEnvOrDefault("BUILDKIT_DETECT_CPU_ARCH", false), "Whether to detect CPU architecture of the host machine and use it to pass to BuildKit")
 
 	flag.Parse()
 
-	l, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.Port))
+	c, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", c.Server.Port))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "failed to listen: %v", err)
 		os.Exit(1)
 	}
 
-	bk, err := newBuildKit()
+	b, err := backend.New(c)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to create BuildKit: %v", err)
+		fmt.Fprintf(os.Stderr, "failed to create %s builder backend: %v", c.Builder.Backend, err)
 		os.Exit(1)
 	}
-	defer bk.Close()
+	defer b.Close()
 
 	serverOpts := []grpc.ServerOption{
-		grpc.MaxRecvMsgSize(cfg.ServerMaxRecvMsgSize),
-		grpc.MaxSendMsgSize(cfg.ServerMaxSendMsgSize),
+		grpc.MaxRecvMsgSize(c.Server.MaxRecvMsgSize),
+		grpc.MaxSendMsgSize(c.Server.MaxSendMsgSize),
 	}
 
 	s := grpc.NewServer(serverOpts...)
-	buildpb.RegisterBuildServer(s, build.NewServer(bk))
+	buildpb.RegisterBuildServer(s, build.NewServer(b))
 	healthpb.RegisterHealthServer(s, health.NewServer())
 
-	go startMetricsServer(cfg.MetricsPort)
+	if c.Server.KEDAExternalScaler {
+		kedapb.RegisterExternalScalerServer(s, keda.NewServer(metrics.Builds))
+	}
+
+	metrics.TeamLabel.Store(c.Server.MetricsTeamLabel)
+	go startMetricsServer(c.Server.MetricsPort)
 	go handleGracefulTermination(s)
 
+	if cfg.ConfigPath != "" {
+		w := &config.Watcher{
+			Paths:    []string{cfg.ConfigPath, c.Repository.Path},
+			OnChange: func() { c = reloadConfig(b, c) },
+		}
+		go w.Run(context.Background())
+	}
+
 	fmt.Println("Starting gRPC server at", l.Addr().String())
 
 	if err := s.Serve(l); err != nil {
@@ -177,68 +244,181 @@ func getBoolEnvOrDefault(env string, def bool) bool {
 	return def
 }
 
-func newBuildKit() (*buildkit.BuildKit, error) {
-	opts := buildkit.BuildKitOptions{
-		TempDir:                      cfg.BuildkitTmpDir,
-		DiscoverBuildKitClientForApp: cfg.BuildKitAutoDiscovery,
-		DisableCache:                 cfg.DisableCache,
-		DetectCPUArch:                cfg.BuildKitDetectCPUArch,
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// loadConfig merges the settings from flags (and env vars), configuration file
+// and explicitly set flags, in this order of precedence (the last wins),
+// validating them.
+func loadConfig() (*config.Config, error) {
+	c, err := readConfig()
+	if err != nil {
+		return nil, err
 	}
 
-	var c *client.Client
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
 
-	if cfg.BuildkitAddress != "" {
-		bc, err := client.New(context.Background(), cfg.BuildkitAddress, client.WithFailFast())
-		if err != nil {
-			return nil, fmt.Errorf("failed to create buildkit client: %w", err)
-		}
+	return c, nil
+}
 
-		c = bc
-	}
+// readConfig merges the settings just like loadConfig, without validating
+// them.
+func readConfig() (*config.Config, error) {
+	c := configFromFlags()
 
-	if cfg.RemoteRepositoryPath != "" {
-		repositoryData, err := os.ReadFile(cfg.RemoteRepositoryPath)
+	if cfg.ConfigPath != "" {
+		var err error
+		c, err = config.Load(cfg.ConfigPath, *c)
 		if err != nil {
 			return nil, err
 		}
-		opts.RemoteRepository, err = repository.NewRemoteRepository(repositoryData)
-		if err != nil {
-			return nil, fmt.Errorf("failed to handle remote repository cfg: %w", err)
-		}
+
+		applyExplicitFlags(c)
 	}
 
-	b := buildkit.NewBuildKit(c, opts)
+	return c, nil
+}
 
-	if cfg.BuildKitAutoDiscovery {
-		config, err := clientcmd.BuildConfigFromFlags("", cfg.KubernetesConfig)
-		if err != nil {
-			return nil, err
-		}
+func configFromFlags() *config.Config {
+	c := &config.Config{Version: config.Version}
+	flag.VisitAll(func(f *flag.Flag) { applyFlag(c, f.Name) })
+	return c
+}
 
-		cs, err := kubernetes.NewForConfig(config)
-		if err != nil {
-			return nil, err
-		}
+func applyExplicitFlags(c *config.Config) {
+	flag.Visit(func(f *flag.Flag) { applyFlag(c, f.Name) })
+}
 
-		dcs, err := dynamic.NewForConfig(config)
-		if err != nil {
-			return nil, err
-		}
+func applyFlag(c *config.Config, name string) {
+	switch name {
+	case "port":
+		c.Server.Port = cfg.Port
+	case "metrics-port":
+		c.Server.MetricsPort = cfg.MetricsPort
+	case "metrics-team-label":
+		c.Server.MetricsTeamLabel = cfg.MetricsTeamLabel
+	case "max-receiving-message-size":
+		c.Server.MaxRecvMsgSize = cfg.ServerMaxRecvMsgSize
+	case "max-sending-message-size":
+		c.Server.MaxSendMsgSize = cfg.ServerMaxSendMsgSize
+	case "keda-external-scaler":
+		c.Server.KEDAExternalScaler = cfg.KEDAExternalScaler
+	case "kubeconfig":
+		c.Discovery.KubeConfig = cfg.KubernetesConfig
+	case "builder-backend":
+		c.Builder.Backend = cfg.BuilderBackend
+	case "docker-host":
+		c.Builder.Docker.Host = cfg.DockerHost
+	case "buildkit-addr":
+		c.BuildKit.Address = cfg.BuildkitAddress
+	case "buildkit-addrs":
+		c.BuildKit.Addresses = splitList(cfg.BuildkitAddresses)
+	case "buildkit-health-check-interval":
+		c.BuildKit.HealthCheckInterval = config.Duration(cfg.BuildKitHealthCheckInterval)
+	case "buildkit-retry-max-attempts":
+		c.BuildKit.Retry.MaxAttempts = cfg.BuildKitRetryMaxAttempts
+	case "buildkit-retry-backoff":
+		c.BuildKit.Retry.Backoff = config.Duration(cfg.BuildKitRetryBackoff)
+	case "buildkit-tmp-dir":
+		c.BuildKit.TmpDir = cfg.BuildkitTmpDir
+	case "buildkit-detect-cpu-arch":
+		c.BuildKit.DetectCPUArch = cfg.BuildKitDetectCPUArch
+	case "remote-repository-path":
+		c.Repository.Path = cfg.RemoteRepositoryPath
+	case "remote-repository-retention-keep-last":
+		c.Repository.Retention.KeepLast = cfg.RemoteRepositoryRetentionKeepLast
+	case "buildkit-autodiscovery":
+		c.Discovery.Enabled = cfg.BuildKitAutoDiscovery
+	case "buildkit-autodiscovery-timeout":
+		c.Discovery.Timeout = config.Duration(cfg.BuildKitAutoDiscoveryTimeout)
+	case "buildkit-autodiscovery-affinity-wait":
+		c.Discovery.AffinityWait = config.Duration(cfg.BuildKitAutoDiscoveryAffinityWait)
+	case "buildkit-autodiscovery-lease-duration":
+		c.Discovery.Lease.Duration = config.Duration(cfg.BuildKitAutoDiscoveryLeaseDuration)
+	case "buildkit-autodiscovery-lease-renew-deadline":
+		c.Discovery.Lease.RenewDeadline = config.Duration(cfg.BuildKitAutoDiscoveryLeaseRenewDeadline)
+	case "buildkit-autodiscovery-lease-retry-period":
+		c.Discovery.Lease.RetryPeriod = config.Duration(cfg.BuildKitAutoDiscoveryLeaseRetryPeriod)
+	case "buildkit-autodiscovery-abort-on-lease-loss":
+		c.Discovery.Lease.AbortOnLoss = cfg.BuildKitAutoDiscoveryAbortOnLeaseLoss
+	case "buildkit-autodiscovery-load-aware":
+		c.Discovery.LoadAware = cfg.BuildKitAutoDiscoveryLoadAware
+	case "buildkit-autodiscovery-dns-name":
+		c.Discovery.DNSName = cfg.BuildKitAutoDiscoveryDNSName
+	case "buildkit-autodiscovery-kubernetes-pod-selector":
+		c.Discovery.PodSelector = cfg.BuildKitAutoDiscoveryKubernetesPodSelector
+	case "buildkit-autodiscovery-kubernetes-namespace":
+		c.Discovery.Namespace = cfg.BuildKitAutoDiscoveryKubernetesNamespace
+	case "buildkit-autodiscovery-kubernetes-lease-prefix":
+		c.Discovery.LeasePrefix = cfg.BuildKitAutoDiscoveryKubernetesLeasePrefix
+	case "buildkit-autodiscovery-kubernetes-port":
+		c.Discovery.Port = cfg.BuildKitAutoDiscoveryKubernetesPort
+	case "buildkit-autodiscovery-kubernetes-set-tsuru-app-labels":
+		c.Discovery.SetTsuruAppLabels = cfg.BuildKitAutoDiscoveryKubernetesSetTsuruAppLabels
+	case "buildkit-autodiscovery-kubernetes-use-same-namespace-as-tsuru-app":
+		c.Discovery.UseSameNamespaceAsApp = cfg.BuildKitAutoDiscoveryKubernetesUseSameNamespaceAsTsuruApp
+	case "buildkit-autodiscovery-kubernetes-build-events":
+		c.Discovery.BuildEvents = cfg.BuildKitAutoDiscoveryKubernetesBuildEvents
+	case "buildkit-autodiscovery-kubernetes-build-runs":
+		c.Discovery.BuildRuns = cfg.BuildKitAutoDiscoveryKubernetesBuildRuns
+	case "buildkit-autodiscovery-kubernetes-build-runs-history-limit":
+		c.Discovery.BuildRunsHistoryLimit = cfg.BuildKitAutoDiscoveryKubernetesBuildRunsHistoryLimit
+	case "buildkit-autodiscovery-scale-statefulset":
+		c.Scaler.Statefulset = cfg.BuildKitAutoDiscoveryStatefulset
+	case "buildkit-autodiscovery-scale-graceful-period":
+		c.Scaler.GracefulPeriod = config.Duration(cfg.BuildKitAutoDiscoveryScaleGracefulPeriod)
+	case "buildkit-autodiscovery-scale-max-replicas":
+		c.Scaler.MaxReplicas = int32(cfg.BuildKitAutoDiscoveryScaleMaxReplicas) //nolint
+	case "buildkit-autodiscovery-scale-out-threshold":
+		c.Scaler.ScaleOutThreshold = config.Duration(cfg.BuildKitAutoDiscoveryScaleOutThreshold)
+	case "buildkit-autodiscovery-scale-interval":
+		c.Scaler.Interval = config.Duration(cfg.BuildKitAutoDiscoveryScaleInterval)
+	case "disable-cache":
+		c.Policies.DisableCache = cfg.DisableCache
+	}
+}
 
-		kdopts := autodiscovery.KubernertesDiscoveryOptions{
-			Timeout:               cfg.BuildKitAutoDiscoveryTimeout,
-			PodSelector:           cfg.BuildKitAutoDiscoveryKubernetesPodSelector,
-			Namespace:             cfg.BuildKitAutoDiscoveryKubernetesNamespace,
-			Port:                  cfg.BuildKitAutoDiscoveryKubernetesPort,
-			SetTsuruAppLabel:      cfg.BuildKitAutoDiscoveryKubernetesSetTsuruAppLabels,
-			UseSameNamespaceAsApp: cfg.BuildKitAutoDiscoveryKubernetesUseSameNamespaceAsTsuruApp,
-			LeasePrefix:           cfg.BuildKitAutoDiscoveryKubernetesLeasePrefix,
-			Statefulset:           cfg.BuildKitAutoDiscoveryStatefulset,
-			ScaleGracefulPeriod:   cfg.BuildKitAutoDiscoveryScaleGracefulPeriod,
-		}
+// reloadConfig loads the configuration again, applying the reloadable
+// settings into b once they're valid along with the settings in use. It
+// returns the configuration in use afterwards.
+func reloadConfig(b backend.Backend, current *config.Config) *config.Config {
+	c, err := readConfig()
+	if err != nil {
+		klog.Errorf("failed to reload configuration, keeping the current one: %s", err)
+		return current
+	}
+
+	if changed := config.RestartRequired(current, c); len(changed) > 0 {
+		klog.Warningf("configuration settings changed but require a restart to take effect: %s", strings.Join(changed, ", "))
+	}
+
+	// only the reloadable settings take effect, so the next reload is
+	// compared against the ones in use
+	next := current.WithReloadable(c)
+	if err = next.Validate(); err != nil {
+		klog.Errorf("failed to reload configuration, keeping the current one: %s", err)
+		return current
+	}
 
-		return b.WithKubernetesDiscovery(cs, dcs, kdopts), nil
+	if err = c.Validate(); err != nil {
+		klog.Warningf("configuration is invalid, the agent would fail to restart with it: %s", err)
 	}
 
-	return b, nil
+	if err = b.Reload(next); err != nil {
+		klog.Errorf("failed to reload configuration, keeping the current one: %s", err)
+		return current
+	}
+
+	klog.Infoln("Configuration reloaded")
+
+	return next
 }
@@ -0,0 +1,69 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package backend holds the registry of build backends. The backend used by
+// deploy-agent is selected by name through the builder.backend setting.
+package backend
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/tsuru/deploy-agent/pkg/build"
+	"github.com/tsuru/deploy-agent/pkg/config"
+)
+
+type Backend interface {
+	build.Builder
+	io.Closer
+
+	// Reload applies the reloadable settings of c into the backend.
+	Reload(c *config.Config) error
+}
+
+type Factory func(c *config.Config) (Backend, error)
+
+var (
+	factories = map[string]Factory{
+		"buildkit": newBuildKit,
+		"docker":   newDocker,
+	}
+	factoriesMu sync.RWMutex
+)
+
+// Register makes a backend available by name, replacing any previous one.
+func Register(name string, f Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	factories[name] = f
+}
+
+// Names returns the names of registered backends, sorted.
+func Names() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates the backend set in c.
+func New(c *config.Config) (Backend, error) {
+	factoriesMu.RLock()
+	f, found := factories[c.Builder.Backend]
+	factoriesMu.RUnlock()
+
+	if !found {
+		return nil, fmt.Errorf("unknown builder backend: %s (available: %v)", c.Builder.Backend, Names())
+	}
+
+	return f(c)
+}
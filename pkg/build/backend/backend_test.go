@@ -0,0 +1,71 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tsuru/deploy-agent/pkg/build/fake"
+	pb "github.com/tsuru/deploy-agent/pkg/build/grpc_build_v1"
+	"github.com/tsuru/deploy-agent/pkg/config"
+)
+
+type fakeBackend struct {
+	fake.FakeBuilder
+	reloaded *config.Config
+}
+
+func (f *fakeBackend) Close() error { return nil }
+
+func (f *fakeBackend) Reload(c *config.Config) error {
+	f.reloaded = c
+	return nil
+}
+
+func TestNew(t *testing.T) {
+	Register("fake", func(c *config.Config) (Backend, error) {
+		return &fakeBackend{FakeBuilder: fake.FakeBuilder{
+			OnBuild: func(ctx context.Context, r *pb.BuildRequest, w io.Writer) (*pb.TsuruConfig, error) {
+				return &pb.TsuruConfig{Procfile: "web: " + c.BuildKit.TmpDir}, nil
+			},
+		}}, nil
+	})
+	t.Cleanup(func() {
+		factoriesMu.Lock()
+		delete(factories, "fake")
+		factoriesMu.Unlock()
+	})
+
+	assert.Equal(t, []string{"buildkit", "docker", "fake"}, Names())
+
+	c := &config.Config{Builder: config.BuilderConfig{Backend: "fake"}, BuildKit: config.BuildKitConfig{TmpDir: "/tmp"}}
+	b, err := New(c)
+	require.NoError(t, err)
+
+	tc, err := b.Build(context.TODO(), &pb.BuildRequest{}, io.Discard)
+	require.NoError(t, err)
+	assert.Equal(t, "web: /tmp", tc.Procfile)
+
+	require.NoError(t, b.Reload(c))
+	assert.Equal(t, c, b.(*fakeBackend).reloaded)
+}
+
+func TestNew_UnknownBackend(t *testing.T) {
+	_, err := New(&config.Config{Builder: config.BuilderConfig{Backend: "kaniko"}})
+	assert.EqualError(t, err, "unknown builder backend: kaniko (available: [buildkit docker])")
+}
+
+func TestNew_Docker(t *testing.T) {
+	b, err := New(&config.Config{Builder: config.BuilderConfig{Backend: "docker", Docker: config.DockerConfig{Host: "tcp://127.0.0.1:2375"}}})
+	require.NoError(t, err)
+	defer b.Close()
+
+	assert.IsType(t, &dockerBackend{}, b)
+}
@@ -0,0 +1,172 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/moby/buildkit/client"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog"
+
+	"github.com/tsuru/deploy-agent/pkg/build/buildkit"
+	"github.com/tsuru/deploy-agent/pkg/build/buildkit/autodiscovery"
+	"github.com/tsuru/deploy-agent/pkg/build/buildkit/pool"
+	"github.com/tsuru/deploy-agent/pkg/build/buildkit/scaler"
+	"github.com/tsuru/deploy-agent/pkg/config"
+)
+
+type buildKitBackend struct {
+	*buildkit.BuildKit
+}
+
+func (b *buildKitBackend) Reload(c *config.Config) error {
+	opts, err := buildKitOptions(c)
+	if err != nil {
+		return err
+	}
+
+	b.BuildKit.Reload(opts, kubernetesDiscoveryOptions(c))
+	return nil
+}
+
+func newBuildKit(conf *config.Config) (Backend, error) {
+	opts, err := buildKitOptions(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	var c *client.Client
+
+	if conf.BuildKit.Address != "" {
+		bc, err := client.New(context.Background(), conf.BuildKit.Address, client.WithFailFast())
+		if err != nil {
+			return nil, fmt.Errorf("failed to create buildkit client: %w", err)
+		}
+
+		c = bc
+	}
+
+	b := buildkit.NewBuildKit(c, opts)
+
+	if len(conf.BuildKit.Addresses) > 0 {
+		p, err := pool.New(context.Background(), conf.BuildKit.Addresses, pool.Options{
+			HealthCheckInterval: conf.BuildKit.HealthCheckInterval.Duration(),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		b = b.WithPool(p)
+	}
+
+	if conf.Discovery.Enabled && !conf.Discovery.IsKubernetes() {
+		b = b.WithDiscovery(autodiscovery.NewDNSDiscoverer(conf.Discovery.DNSName), kubernetesDiscoveryOptions(conf))
+	}
+
+	if conf.Discovery.IsKubernetes() {
+		restConfig, err := clientcmd.BuildConfigFromFlags("", conf.Discovery.KubeConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		cs, err := kubernetes.NewForConfig(restConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		dcs, err := dynamic.NewForConfig(restConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		b, err = b.WithKubernetesDiscovery(cs, dcs, kubernetesDiscoveryOptions(conf))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &buildKitBackend{BuildKit: b}, nil
+}
+
+func buildKitOptions(c *config.Config) (buildkit.BuildKitOptions, error) {
+	opts := buildkit.BuildKitOptions{
+		TempDir:                c.BuildKit.TmpDir,
+		DiscoverBuildKitClient: c.Discovery.Enabled,
+		DisableCache:           c.Policies.DisableCache,
+		DetectCPUArch:          c.BuildKit.DetectCPUArch,
+		Routes:                 c.BuildKit.Routes,
+		RetentionKeepLast:      c.Repository.Retention.KeepLast,
+		Retry: buildkit.RetryPolicy{
+			MaxAttempts: c.BuildKit.Retry.MaxAttempts,
+			Backoff:     c.BuildKit.Retry.Backoff.Duration(),
+		},
+	}
+
+	remoteRepository, err := c.Repositories()
+	if err != nil {
+		return opts, fmt.Errorf("failed to handle remote repository cfg: %w", err)
+	}
+	opts.RemoteRepository = remoteRepository
+
+	return opts, nil
+}
+
+func kubernetesDiscoveryOptions(c *config.Config) autodiscovery.KubernertesDiscoveryOptions {
+	return autodiscovery.KubernertesDiscoveryOptions{
+		Timeout:               c.Discovery.Timeout.Duration(),
+		AffinityWait:          c.Discovery.AffinityWait.Duration(),
+		LoadAware:             c.Discovery.LoadAware,
+		LeaseDuration:         c.Discovery.Lease.Duration.Duration(),
+		LeaseRenewDeadline:    c.Discovery.Lease.RenewDeadline.Duration(),
+		LeaseRetryPeriod:      c.Discovery.Lease.RetryPeriod.Duration(),
+		AbortOnLeaseLoss:      c.Discovery.Lease.AbortOnLoss,
+		PodSelector:           c.Discovery.PodSelector,
+		Namespace:             c.Discovery.Namespace,
+		Port:                  c.Discovery.Port,
+		SetTsuruAppLabel:      c.Discovery.SetTsuruAppLabels,
+		UseSameNamespaceAsApp: c.Discovery.UseSameNamespaceAsApp,
+		LeasePrefix:           c.Discovery.LeasePrefix,
+		BuildEvents:           c.Discovery.BuildEvents,
+		BuildRuns:             c.Discovery.BuildRuns,
+		BuildRunsHistoryLimit: c.Discovery.BuildRunsHistoryLimit,
+		Statefulset:           c.Scaler.Statefulset,
+		ScaleGracefulPeriod:   c.Scaler.GracefulPeriod.Duration(),
+		ScaleMaxReplicas:      c.Scaler.MaxReplicas,
+		ScaleOutThreshold:     c.Scaler.ScaleOutThreshold.Duration(),
+		ScaleInterval:         c.Scaler.Interval.Duration(),
+		ScaleWindows:          scaleWindows(c),
+	}
+}
+
+func scaleWindows(c *config.Config) []scaler.Window {
+	var windows []scaler.Window
+	for _, s := range c.Scaler.Schedules {
+		schedule, err := scaler.ParseWindowSchedule(s.Cron)
+		if err != nil { // not expected after config validation
+			klog.Errorf("Ignoring scaler schedule %q: %s", s.Name, err)
+			continue
+		}
+
+		statefulset := s.Statefulset
+		if statefulset == "" {
+			statefulset = c.Scaler.Statefulset
+		}
+
+		windows = append(windows, scaler.Window{
+			Name:        s.Name,
+			Namespace:   s.Namespace,
+			StatefulSet: statefulset,
+			Schedule:    schedule,
+			Duration:    s.Duration.Duration(),
+			MinReplicas: s.MinReplicas,
+		})
+	}
+
+	return windows
+}
@@ -0,0 +1,57 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"fmt"
+
+	"github.com/tsuru/deploy-agent/pkg/build/docker"
+	"github.com/tsuru/deploy-agent/pkg/config"
+)
+
+type dockerBackend struct {
+	*docker.Docker
+}
+
+func (d *dockerBackend) Reload(c *config.Config) error {
+	opts, err := dockerOptions(c)
+	if err != nil {
+		return err
+	}
+
+	d.Docker.Reload(opts)
+	return nil
+}
+
+func newDocker(c *config.Config) (Backend, error) {
+	opts, err := dockerOptions(c)
+	if err != nil {
+		return nil, err
+	}
+
+	cli, err := docker.NewClient(c.Builder.Docker.Host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create docker client: %w", err)
+	}
+
+	return &dockerBackend{Docker: docker.NewDocker(cli, opts)}, nil
+}
+
+func dockerOptions(c *config.Config) (docker.DockerOptions, error) {
+	opts := docker.DockerOptions{
+		TempDir:           c.BuildKit.TmpDir,
+		DisableCache:      c.Policies.DisableCache,
+		DetectCPUArch:     c.BuildKit.DetectCPUArch,
+		RetentionKeepLast: c.Repository.Retention.KeepLast,
+	}
+
+	remoteRepository, err := c.Repositories()
+	if err != nil {
+		return opts, fmt.Errorf("failed to handle remote repository cfg: %w", err)
+	}
+	opts.RemoteRepository = remoteRepository
+
+	return opts, nil
+}
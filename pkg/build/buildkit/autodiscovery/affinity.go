@@ -0,0 +1,153 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autodiscovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	"github.com/tsuru/deploy-agent/pkg/build/buildkit/metrics"
+	"github.com/tsuru/deploy-agent/pkg/build/metadata"
+)
+
+// maxRecentBuilds bounds how many owners are remembered by each BuildKit pod.
+const maxRecentBuilds = 50
+
+// recentBuilds maps the owners (e.g. app/my-app) recently built on a pod to
+// the unix time of their last build.
+type recentBuilds map[string]int64
+
+func (o *buildOwner) affinityKey() string {
+	return fmt.Sprintf("%s/%s", o.kind, o.name)
+}
+
+func recentBuildsFromPod(pod *corev1.Pod) recentBuilds {
+	rb := make(recentBuilds)
+
+	data, found := pod.Annotations[metadata.DeployAgentRecentBuildsAnnotationKey]
+	if !found || data == "" {
+		return rb
+	}
+
+	if err := json.Unmarshal([]byte(data), &rb); err != nil {
+		klog.Warningf("Ignoring malformed recent builds annotation in pod %s/%s: %s", pod.Namespace, pod.Name, err)
+		return make(recentBuilds)
+	}
+
+	return rb
+}
+
+// preferredBuildKitPod returns the ready pod which most recently built the
+// owner, which likely holds its warm cache. Returns an empty name if there's
+// none.
+func preferredBuildKitPod(pods []corev1.Pod, owner *buildOwner) string {
+	var (
+		preferred string
+		lastBuild int64
+	)
+
+	key := owner.affinityKey()
+	for i := range pods {
+		pod := &pods[i]
+		if pod.DeletionTimestamp != nil || !isPodReady(pod) {
+			continue
+		}
+
+		if at, found := recentBuildsFromPod(pod)[key]; found && at > lastBuild {
+			preferred, lastBuild = pod.Name, at
+		}
+	}
+
+	return preferred
+}
+
+// recordBuildAffinity remembers that the owner was built on the pod. It must
+// be called only by the pod's lease holder, so no other agent writes the
+// annotation concurrently.
+func recordBuildAffinity(ctx context.Context, cs kubernetes.Interface, podName, namespace string, owner *buildOwner) error {
+	pod, err := cs.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	rb := recentBuildsFromPod(pod)
+	rb[owner.affinityKey()] = time.Now().Unix()
+	rb.trim(maxRecentBuilds)
+
+	data, err := json.Marshal(rb)
+	if err != nil {
+		return err
+	}
+
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]string{
+				metadata.DeployAgentRecentBuildsAnnotationKey: string(data),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = cs.CoreV1().Pods(namespace).Patch(ctx, podName, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// since counts the builds after t.
+func (rb recentBuilds) since(t time.Time) int {
+	var n int
+	for _, at := range rb {
+		if at >= t.Unix() {
+			n++
+		}
+	}
+	return n
+}
+
+// trim drops the oldest builds, keeping up to limit.
+func (rb recentBuilds) trim(limit int) {
+	if len(rb) <= limit {
+		return
+	}
+
+	keys := make([]string, 0, len(rb))
+	for k := range rb {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if rb[keys[i]] == rb[keys[j]] {
+			return keys[i] < keys[j]
+		}
+		return rb[keys[i]] < rb[keys[j]]
+	})
+
+	for _, k := range keys[:len(keys)-limit] {
+		delete(rb, k)
+	}
+}
+
+func observeAffinity(namespace, preferred, leased string) {
+	result := "none"
+	switch {
+	case preferred == "":
+	case preferred == leased:
+		result = "hit"
+	default:
+		result = "miss"
+	}
+
+	metrics.BuildKitAffinity.WithLabelValues(namespace, result).Inc()
+}
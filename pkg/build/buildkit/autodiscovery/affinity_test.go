@@ -0,0 +1,169 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autodiscovery
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	fakeDynamic "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	kuberntesTesting "k8s.io/client-go/testing"
+
+	"github.com/tsuru/deploy-agent/pkg/build/buildkit/metrics"
+	"github.com/tsuru/deploy-agent/pkg/build/grpc_build_v1"
+	"github.com/tsuru/deploy-agent/pkg/build/metadata"
+)
+
+func newAffinityTestPod(name string, ready bool, rb recentBuilds) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "tsuru",
+			Labels:      map[string]string{"app": "buildkit"},
+			Annotations: map[string]string{},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodPending},
+	}
+
+	if ready {
+		pod.Status = corev1.PodStatus{
+			Phase:      corev1.PodRunning,
+			PodIP:      "127.0.0.1",
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+		}
+	}
+
+	if rb != nil {
+		data, _ := json.Marshal(rb)
+		pod.Annotations[metadata.DeployAgentRecentBuildsAnnotationKey] = string(data)
+	}
+
+	return pod
+}
+
+func TestRecentBuilds_Trim(t *testing.T) {
+	rb := recentBuilds{"app/a": 3, "app/b": 1, "job/c": 2, "app/d": 4}
+	rb.trim(2)
+	assert.Equal(t, recentBuilds{"app/a": 3, "app/d": 4}, rb)
+
+	rb.trim(10)
+	assert.Len(t, rb, 2)
+}
+
+func TestRecordBuildAffinity(t *testing.T) {
+	pod := newAffinityTestPod("buildkit-0", true, recentBuilds{"app/other": 10})
+	fakeClient := fake.NewSimpleClientset(pod)
+
+	owner := &buildOwner{kind: "job", name: "my-job"}
+	require.NoError(t, recordBuildAffinity(context.TODO(), fakeClient, "buildkit-0", "tsuru", owner))
+
+	existingPod, err := fakeClient.CoreV1().Pods("tsuru").Get(context.TODO(), "buildkit-0", metav1.GetOptions{})
+	require.NoError(t, err)
+
+	rb := recentBuildsFromPod(existingPod)
+	assert.Equal(t, int64(10), rb["app/other"])
+	assert.InDelta(t, time.Now().Unix(), rb["job/my-job"], 5)
+}
+
+func TestPreferredBuildKitPod(t *testing.T) {
+	malformed := newAffinityTestPod("buildkit-3", true, nil)
+	malformed.Annotations[metadata.DeployAgentRecentBuildsAnnotationKey] = "not-json"
+
+	deleted := newAffinityTestPod("buildkit-4", true, recentBuilds{"app/my-app": 40})
+	deleted.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+
+	notReady := newAffinityTestPod("buildkit-5", false, recentBuilds{"app/my-app": 50})
+
+	pods := []corev1.Pod{
+		*newAffinityTestPod("buildkit-0", true, recentBuilds{"app/my-app": 10}),
+		*newAffinityTestPod("buildkit-1", true, recentBuilds{"app/my-app": 20, "app/other": 30}),
+		*newAffinityTestPod("buildkit-2", true, nil),
+		*malformed,
+		*deleted,
+		*notReady,
+	}
+
+	assert.Equal(t, "buildkit-1", preferredBuildKitPod(pods, &buildOwner{kind: "app", name: "my-app"}))
+	assert.Equal(t, "", preferredBuildKitPod(pods, &buildOwner{kind: "job", name: "my-app"}))
+	assert.Equal(t, "", preferredBuildKitPod(nil, &buildOwner{kind: "app", name: "my-app"}))
+}
+
+func TestK8sDiscoverer_DiscoverWithAffinity(t *testing.T) {
+	tests := map[string]struct {
+		preferredReady bool
+		// preferredWatchedReady is whether the preferred pod is still ready
+		// once it's watched, after being ranked.
+		preferredWatchedReady bool
+		expectedPod           string
+		expectedResult        string
+	}{
+		"preferred pod is free": {
+			preferredReady:        true,
+			preferredWatchedReady: true,
+			expectedPod:           "buildkit-1",
+			expectedResult:        "hit",
+		},
+		"preferred pod does not become free in time": {
+			preferredReady:        true,
+			preferredWatchedReady: false,
+			expectedPod:           "buildkit-0",
+			expectedResult:        "miss",
+		},
+		"preferred pod is not ready": {
+			preferredReady:        false,
+			preferredWatchedReady: false,
+			expectedPod:           "buildkit-0",
+			expectedResult:        "none",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			anyPod := newAffinityTestPod("buildkit-0", true, nil)
+			preferredPod := newAffinityTestPod("buildkit-1", tt.preferredReady, recentBuilds{"app/my-app": time.Now().Add(-time.Hour).Unix()})
+
+			fakeClient := fake.NewSimpleClientset(anyPod, preferredPod)
+			fakeClient.PrependWatchReactor("*", func(action kuberntesTesting.Action) (handled bool, ret watch.Interface, err error) {
+				watcher := watch.NewFakeWithChanSize(2, false)
+				watcher.Add(anyPod)
+				watcher.Add(newAffinityTestPod(preferredPod.Name, tt.preferredWatchedReady, nil))
+				return true, watcher, nil
+			})
+
+			discoverer := K8sDiscoverer{
+				KubernetesInterface: fakeClient,
+				DynamicInterface:    fakeDynamic.NewSimpleDynamicClient(runtime.NewScheme()),
+			}
+
+			before := testutil.ToFloat64(metrics.BuildKitAffinity.WithLabelValues("tsuru", tt.expectedResult))
+
+			_, cleanup, _, err := discoverer.Discover(context.TODO(), KubernertesDiscoveryOptions{
+				PodSelector:  "app=buildkit",
+				Namespace:    "tsuru",
+				Timeout:      5 * time.Second,
+				AffinityWait: 500 * time.Millisecond,
+			}, &grpc_build_v1.BuildRequest{App: &grpc_build_v1.TsuruApp{Name: "my-app"}}, os.Stdout)
+			require.NoError(t, err)
+			defer cleanup()
+
+			assert.Equal(t, before+1, testutil.ToFloat64(metrics.BuildKitAffinity.WithLabelValues("tsuru", tt.expectedResult)))
+
+			leasedPod, err := fakeClient.CoreV1().Pods("tsuru").Get(context.TODO(), tt.expectedPod, metav1.GetOptions{})
+			require.NoError(t, err)
+			assert.InDelta(t, time.Now().Unix(), recentBuildsFromPod(leasedPod)["app/my-app"], 5, "build must be recorded on %s", tt.expectedPod)
+		})
+	}
+}
@@ -0,0 +1,22 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autodiscovery
+
+import (
+	"context"
+	"io"
+
+	"github.com/moby/buildkit/client"
+
+	pb "github.com/tsuru/deploy-agent/pkg/build/grpc_build_v1"
+)
+
+// Discoverer finds a BuildKit to run the build exclusively.
+type Discoverer interface {
+	// Discover returns the client of the BuildKit found along with its
+	// namespace (used on metrics) and the function releasing it once the
+	// build finishes. Progress messages are written to w.
+	Discover(ctx context.Context, opts KubernertesDiscoveryOptions, req *pb.BuildRequest, w io.Writer) (*client.Client, func(), string, error)
+}
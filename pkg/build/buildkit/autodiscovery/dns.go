@@ -0,0 +1,167 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autodiscovery
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	"golang.org/x/sync/semaphore"
+	"k8s.io/klog"
+
+	"github.com/tsuru/deploy-agent/pkg/build/buildkit/metrics"
+	pb "github.com/tsuru/deploy-agent/pkg/build/grpc_build_v1"
+)
+
+// dnsRetryPeriod is the interval between lookups while every endpoint is busy.
+var dnsRetryPeriod = 500 * time.Millisecond
+
+// Resolver looks up DNS records, net.Resolver implements it.
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+var _ Discoverer = &DNSDiscoverer{}
+
+// DNSDiscoverer finds BuildKit endpoints by resolving a DNS name, e.g. the
+// headless Service in front of BuildKit pods. Since it needs no access to the
+// Kubernetes API, exclusivity is coordinated by an in-process semaphore per
+// endpoint, so it only holds among the builds of a single agent.
+//
+// Only Timeout, Port and Namespace options apply to it.
+type DNSDiscoverer struct {
+	// Name is resolved as SRV records when in the _service._proto.name
+	// form (e.g. _buildkit._tcp.buildkit.tsuru-system.svc.cluster.local),
+	// otherwise as A/AAAA records whose endpoints listen on the port option.
+	Name string
+	// Resolver defaults to net.DefaultResolver.
+	Resolver Resolver
+
+	m    sync.Mutex
+	sems map[string]*semaphore.Weighted
+}
+
+func NewDNSDiscoverer(name string) *DNSDiscoverer {
+	return &DNSDiscoverer{Name: name}
+}
+
+func (d *DNSDiscoverer) Discover(ctx context.Context, opts KubernertesDiscoveryOptions, req *pb.BuildRequest, w io.Writer) (*client.Client, func(), string, error) {
+	ns := opts.Namespace
+
+	addr, release, err := d.acquire(ctx, opts, w)
+	if err != nil {
+		return nil, noopCleaner, ns, err
+	}
+
+	c, err := client.New(ctx, fmt.Sprintf("tcp://%s", addr), client.WithFailFast())
+	if err != nil {
+		release()
+		return nil, noopCleaner, ns, err
+	}
+
+	klog.V(4).Infoln("Connecting to BuildKit at", addr)
+
+	return c, func() {
+		klog.V(4).Infoln("Closing connection with BuildKit at", addr)
+		c.Close()
+		release()
+	}, ns, nil
+}
+
+// acquire waits until any endpoint is free, returning its address.
+func (d *DNSDiscoverer) acquire(ctx context.Context, opts KubernertesDiscoveryOptions, w io.Writer) (string, func(), error) {
+	metrics.Builds.AddWaiting(opts.Namespace, 1)
+	defer metrics.Builds.AddWaiting(opts.Namespace, -1)
+
+	timeout := time.After(opts.Timeout)
+
+	var warned bool
+	for {
+		endpoints, err := d.lookup(ctx, opts.Port)
+		if err != nil {
+			klog.Warningf("Failed to resolve BuildKit endpoints at %s: %s", d.Name, err)
+		}
+
+		for _, addr := range endpoints {
+			sem := d.semaphore(addr)
+			if sem.TryAcquire(1) {
+				klog.V(4).Infof("Selected BuildKit endpoint: %s", addr)
+				return addr, func() { sem.Release(1) }, nil
+			}
+		}
+
+		if !warned && len(endpoints) > 0 {
+			fmt.Fprintf(w, "All BuildKit endpoints at %s are busy, waiting for a free one...\n", d.Name)
+			warned = true
+		}
+
+		select {
+		case <-time.After(dnsRetryPeriod):
+		case <-timeout:
+			return "", nil, fmt.Errorf("max deadline of %s exceeded to discover BuildKit endpoint", opts.Timeout)
+		case <-ctx.Done():
+			return "", nil, ctx.Err()
+		}
+	}
+}
+
+func (d *DNSDiscoverer) lookup(ctx context.Context, port int) ([]string, error) {
+	r := d.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+
+	if strings.HasPrefix(d.Name, "_") {
+		// records come sorted by priority and randomized by weight
+		_, records, err := r.LookupSRV(ctx, "", "", d.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		endpoints := make([]string, 0, len(records))
+		for _, srv := range records {
+			endpoints = append(endpoints, net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))))
+		}
+
+		return endpoints, nil
+	}
+
+	hosts, err := r.LookupHost(ctx, d.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		endpoints = append(endpoints, net.JoinHostPort(h, strconv.Itoa(port)))
+	}
+
+	return endpoints, nil
+}
+
+func (d *DNSDiscoverer) semaphore(addr string) *semaphore.Weighted {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if d.sems == nil {
+		d.sems = make(map[string]*semaphore.Weighted)
+	}
+
+	sem, found := d.sems[addr]
+	if !found {
+		sem = semaphore.NewWeighted(1)
+		d.sems[addr] = sem
+	}
+
+	return sem
+}
@@ -0,0 +1,138 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autodiscovery
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tsuru/deploy-agent/pkg/build/grpc_build_v1"
+)
+
+type fakeResolver struct {
+	m     sync.Mutex
+	srv   map[string][]*net.SRV
+	hosts map[string][]string
+}
+
+func (r *fakeResolver) LookupSRV(_ context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	records, found := r.srv[name]
+	if !found {
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return name, records, nil
+}
+
+func (r *fakeResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	hosts, found := r.hosts[host]
+	if !found {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return hosts, nil
+}
+
+func (r *fakeResolver) setHosts(host string, addrs []string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.hosts[host] = addrs
+}
+
+func TestDNSDiscoverer_Lookup(t *testing.T) {
+	r := &fakeResolver{
+		srv: map[string][]*net.SRV{
+			"_buildkit._tcp.buildkit.tsuru-system.svc.cluster.local": {
+				{Target: "buildkit-0.buildkit.tsuru-system.svc.cluster.local.", Port: 1234},
+				{Target: "buildkit-1.buildkit.tsuru-system.svc.cluster.local.", Port: 1234},
+			},
+		},
+		hosts: map[string][]string{
+			"buildkit.tsuru-system.svc.cluster.local": {"10.0.0.1", "fd00::1"},
+		},
+	}
+
+	d := &DNSDiscoverer{Name: "_buildkit._tcp.buildkit.tsuru-system.svc.cluster.local", Resolver: r}
+	endpoints, err := d.lookup(context.TODO(), 80)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"buildkit-0.buildkit.tsuru-system.svc.cluster.local:1234", "buildkit-1.buildkit.tsuru-system.svc.cluster.local:1234"}, endpoints)
+
+	d = &DNSDiscoverer{Name: "buildkit.tsuru-system.svc.cluster.local", Resolver: r}
+	endpoints, err = d.lookup(context.TODO(), 80)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1:80", "[fd00::1]:80"}, endpoints)
+
+	d = &DNSDiscoverer{Name: "unknown.tsuru-system.svc.cluster.local", Resolver: r}
+	_, err = d.lookup(context.TODO(), 80)
+	var dnsErr *net.DNSError
+	assert.True(t, errors.As(err, &dnsErr))
+}
+
+func TestDNSDiscoverer_Discover(t *testing.T) {
+	r := &fakeResolver{hosts: map[string][]string{"buildkit": {"127.0.0.1", "127.0.0.2"}}}
+	d := &DNSDiscoverer{Name: "buildkit", Resolver: r}
+
+	opts := KubernertesDiscoveryOptions{Namespace: "tsuru-system", Port: 1234, Timeout: 5 * time.Second}
+	req := &grpc_build_v1.BuildRequest{App: &grpc_build_v1.TsuruApp{Name: "my-app"}}
+
+	c1, cleanup1, ns, err := d.Discover(context.TODO(), opts, req, &bytes.Buffer{})
+	require.NoError(t, err)
+	require.NotNil(t, c1)
+	assert.Equal(t, "tsuru-system", ns)
+
+	c2, cleanup2, _, err := d.Discover(context.TODO(), opts, req, &bytes.Buffer{})
+	require.NoError(t, err)
+	require.NotNil(t, c2)
+
+	t.Run("every endpoint busy until timeout", func(t *testing.T) {
+		var w bytes.Buffer
+		_, _, _, err := d.Discover(context.TODO(), KubernertesDiscoveryOptions{Port: 1234, Timeout: 2 * dnsRetryPeriod}, req, &w)
+		assert.EqualError(t, err, "max deadline of 1s exceeded to discover BuildKit endpoint")
+		assert.Contains(t, w.String(), "All BuildKit endpoints at buildkit are busy, waiting for a free one...")
+	})
+
+	t.Run("endpoint released meanwhile", func(t *testing.T) {
+		go func() {
+			time.Sleep(dnsRetryPeriod)
+			cleanup1()
+		}()
+
+		c3, cleanup3, _, err := d.Discover(context.TODO(), opts, req, &bytes.Buffer{})
+		require.NoError(t, err)
+		require.NotNil(t, c3)
+		cleanup3()
+	})
+
+	t.Run("endpoint added meanwhile", func(t *testing.T) {
+		c4, cleanup4, _, err := d.Discover(context.TODO(), opts, req, &bytes.Buffer{})
+		require.NoError(t, err, "released endpoint must be free")
+		defer cleanup4()
+
+		go func() {
+			time.Sleep(dnsRetryPeriod)
+			r.setHosts("buildkit", []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"})
+		}()
+
+		c5, cleanup5, _, err := d.Discover(context.TODO(), opts, req, &bytes.Buffer{})
+		require.NoError(t, err)
+		require.NotNil(t, c4)
+		require.NotNil(t, c5)
+		cleanup5()
+	})
+
+	cleanup2()
+}
@@ -4,8 +4,8 @@
 
 // Package autodiscovery is responsible for discovering BuildKit instances running in Kubernetes clusters,
 // by watching for pods with specific labels and acquiring a lease on them to ensure exclusive access.
-// It also handles setting and unsetting Tsuru app labels on the discovered BuildKit pods,
-// allowing for better integration with Tsuru's app management.
+// It also handles setting and unsetting Tsuru labels (of the app, job or platform being built) on the
+// discovered BuildKit pods, allowing for better integration with Tsuru's app management.
 // The discovery process includes a timeout mechanism to prevent indefinite waiting for a BuildKit pod to become available.
 package autodiscovery
 
@@ -16,7 +16,7 @@ import (
 	"io"
 	"os"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/moby/buildkit/client"
@@ -31,6 +31,7 @@ import (
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog"
 )
 
@@ -42,8 +43,58 @@ var (
 		Version:  "v1",
 		Resource: "apps",
 	}
+
+	tsuruJobGVR = schema.GroupVersionResource{
+		Group:    "tsuru.io",
+		Version:  "v1",
+		Resource: "jobs",
+	}
 )
 
+// buildOwner is the Tsuru object (app, job or platform) which the build is for.
+type buildOwner struct {
+	// gvr is the resource holding the namespace where the owner runs on, if any.
+	gvr          *schema.GroupVersionResource
+	kind         string
+	name         string
+	team         string
+	nameLabelKey string
+	teamLabelKey string
+}
+
+func newBuildOwner(req *pb.BuildRequest) (*buildOwner, error) {
+	switch {
+	case req.App != nil:
+		return &buildOwner{
+			gvr:          &tsuruAppGVR,
+			kind:         "app",
+			name:         req.App.Name,
+			team:         req.App.Team,
+			nameLabelKey: metadata.TsuruAppNameLabelKey,
+			teamLabelKey: metadata.TsuruAppTeamLabelKey,
+		}, nil
+
+	case req.Job != nil:
+		return &buildOwner{
+			gvr:          &tsuruJobGVR,
+			kind:         "job",
+			name:         req.Job.Name,
+			team:         req.Job.Team,
+			nameLabelKey: metadata.TsuruJobNameLabelKey,
+			teamLabelKey: metadata.TsuruJobTeamLabelKey,
+		}, nil
+
+	case req.Platform != nil:
+		return &buildOwner{
+			kind:         "platform",
+			name:         req.Platform.Name,
+			nameLabelKey: metadata.TsuruPlatformNameLabelKey,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("there's only support for discovering BuildKit pods from Tsuru apps, jobs and platforms")
+}
+
 type KubernertesDiscoveryOptions struct {
 	PodSelector           string
 	Namespace             string
@@ -53,32 +104,101 @@ type KubernertesDiscoveryOptions struct {
 	UseSameNamespaceAsApp bool
 	SetTsuruAppLabel      bool
 	ScaleGracefulPeriod   time.Duration
-	Timeout               time.Duration
+	// ScaleMaxReplicas is up to how many replicas Statefulset is scaled out
+	// when builds wait longer than ScaleOutThreshold. Zero disables it.
+	ScaleMaxReplicas  int32
+	ScaleOutThreshold time.Duration
+	// ScaleInterval is the interval between downscaler runs.
+	ScaleInterval time.Duration
+	// ScaleWindows hold minimum replicas on schedule.
+	ScaleWindows []scaler.Window
+	Timeout      time.Duration
+	// AffinityWait is how long to wait for the pod which last built the app
+	// (or job, platform) to become free before falling back to any other pod.
+	// Zero disables the cache affinity.
+	AffinityWait time.Duration
+	// LoadAware ranks the pods by their free cache space, recent builds and
+	// node pressure, so the best ranked ones are leased first.
+	LoadAware bool
+	// LeaseDuration, LeaseRenewDeadline and LeaseRetryPeriod tune the leases
+	// on BuildKit pods (see leaderelection.LeaderElectionConfig), defaults
+	// apply to the unset ones.
+	LeaseDuration      time.Duration
+	LeaseRenewDeadline time.Duration
+	LeaseRetryPeriod   time.Duration
+	// AbortOnLeaseLoss aborts the build when the lease on its pod is lost
+	// (see OnLeaseLost), otherwise the build goes on with a warning.
+	AbortOnLeaseLoss bool
+	// OnLeaseLost is called with ErrLeaseLost to abort the build when the
+	// lease on its pod is lost and AbortOnLeaseLoss is set.
+	OnLeaseLost func(err error)
+	// OnPodLeased is called with the BuildKit pod leased for the build, if
+	// set.
+	OnPodLeased func(pod *corev1.Pod)
+	// BuildEvents and BuildRuns leave a trace of each build in Kubernetes,
+	// see package buildrun.
+	BuildEvents bool
+	BuildRuns   bool
+	// BuildRunsHistoryLimit is the number of finished BuildRuns kept for
+	// each app (or job), zero keeps them all.
+	BuildRunsHistoryLimit int
 }
 
+func (o KubernertesDiscoveryOptions) leaseTimings() (duration, renew, retry time.Duration) {
+	duration, renew, retry = leaseDuration, renewDeadline, retryPeriod
+	if o.LeaseDuration > 0 {
+		duration = o.LeaseDuration
+	}
+
+	if o.LeaseRenewDeadline > 0 {
+		renew = o.LeaseRenewDeadline
+	}
+
+	if o.LeaseRetryPeriod > 0 {
+		retry = o.LeaseRetryPeriod
+	}
+
+	return duration, renew, retry
+}
+
+var _ Discoverer = &K8sDiscoverer{}
+
+// K8sDiscoverer finds BuildKit pods by label selector, leasing them through
+// Kubernetes Leases so each pod runs a single build across all agents.
 type K8sDiscoverer struct {
 	KubernetesInterface kubernetes.Interface
 	DynamicInterface    dynamic.Interface
+	// EventRecorder records the scaling decisions, if set.
+	EventRecorder record.EventRecorder
+
+	// queryStats gets the cache usage of BuildKit at addr, defaults to
+	// queryBuildKitStats.
+	queryStats func(ctx context.Context, addr string) (*buildKitStats, error)
+
+	// stats caches the last stats of each BuildKit address.
+	stats  map[string]cachedStats
+	statsM sync.Mutex
 }
 
 func (d *K8sDiscoverer) Discover(ctx context.Context, opts KubernertesDiscoveryOptions, req *pb.BuildRequest, w io.Writer) (*client.Client, func(), string, error) {
-	if req.App == nil {
-		return nil, noopCleaner, "", fmt.Errorf("there's only support for discovering BuildKit pods from Tsuru apps")
+	owner, err := newBuildOwner(req)
+	if err != nil {
+		return nil, noopCleaner, "", err
 	}
 
-	ns, err := d.buildkitPodNamespace(ctx, opts, req.App.Name)
+	ns, err := d.buildkitPodNamespace(ctx, opts, owner)
 	if err != nil {
 		return nil, noopCleaner, "", err
 	}
 
-	client, cleaner, err := d.discoverBuildKitClientFromApp(ctx, opts, req.App, ns, w)
+	client, cleaner, err := d.discoverBuildKitClient(ctx, opts, owner, leaseAnnotations(req, owner), ns, w)
 	if err != nil {
 		return nil, noopCleaner, ns, err
 	}
 	return client, cleaner, ns, nil
 }
 
-func (d *K8sDiscoverer) discoverBuildKitClientFromApp(ctx context.Context, opts KubernertesDiscoveryOptions, app *pb.TsuruApp, namespace string, w io.Writer) (*client.Client, func(), error) {
+func (d *K8sDiscoverer) discoverBuildKitClient(ctx context.Context, opts KubernertesDiscoveryOptions, owner *buildOwner, annotations map[string]string, namespace string, w io.Writer) (*client.Client, func(), error) {
 	leaderCtx, leaderCancel := context.WithCancel(ctx)
 	cfns := []func(){
 		func() {
@@ -87,24 +207,34 @@ func (d *K8sDiscoverer) discoverBuildKitClientFromApp(ctx context.Context, opts
 		},
 	}
 
-	pod, err := d.discoverBuildKitPod(leaderCtx, opts, namespace, w)
+	pod, err := d.discoverBuildKitPod(leaderCtx, opts, namespace, owner, annotations, w)
 	if err != nil {
 		return nil, cleanUps(cfns...), err
 	}
 
+	if opts.OnPodLeased != nil {
+		opts.OnPodLeased(pod)
+	}
+
+	if opts.AffinityWait > 0 || opts.LoadAware {
+		if err = recordBuildAffinity(ctx, d.KubernetesInterface, pod.Name, pod.Namespace, owner); err != nil {
+			klog.Warningf("Failed to record the %s %s build on pod %s: %s", owner.kind, owner.name, pod.Name, err)
+		}
+	}
+
 	if opts.SetTsuruAppLabel {
-		klog.V(4).Infoln("Setting Tsuru app labels in the pod", pod.Name)
+		klog.V(4).Infof("Setting Tsuru %s labels in the pod %s", owner.kind, pod.Name)
 
-		err = setTsuruAppLabelOnBuildKitPod(ctx, d.KubernetesInterface, pod.Name, pod.Namespace, app)
+		err = setTsuruLabelsOnBuildKitPod(ctx, d.KubernetesInterface, pod.Name, pod.Namespace, owner)
 		if err != nil {
-			return nil, cleanUps(cfns...), fmt.Errorf("failed to set Tsuru app labels on BuildKit's pod: %w", err)
+			return nil, cleanUps(cfns...), fmt.Errorf("failed to set Tsuru %s labels on BuildKit's pod: %w", owner.kind, err)
 		}
 
 		cfns = append(cfns, func() {
-			klog.V(4).Infoln("Removing Tsuru app labels in the pod", pod.Name)
-			nerr := unsetTsuruAppLabelOnBuildKitPod(ctx, d.KubernetesInterface, pod.Name, pod.Namespace)
+			klog.V(4).Infof("Removing Tsuru %s labels in the pod %s", owner.kind, pod.Name)
+			nerr := unsetTsuruLabelsOnBuildKitPod(ctx, d.KubernetesInterface, pod.Name, pod.Namespace, owner)
 			if nerr != nil {
-				klog.Errorf("failed to unset Tsuru app labels: %s", nerr)
+				klog.Errorf("failed to unset Tsuru %s labels: %s", owner.kind, nerr)
 			}
 		})
 	}
@@ -126,46 +256,57 @@ func (d *K8sDiscoverer) discoverBuildKitClientFromApp(ctx context.Context, opts
 	return c, cleanUps(cfns...), nil
 }
 
-func (d *K8sDiscoverer) buildkitPodNamespace(ctx context.Context, opts KubernertesDiscoveryOptions, app string) (string, error) {
-	if !opts.UseSameNamespaceAsApp {
+func (d *K8sDiscoverer) buildkitPodNamespace(ctx context.Context, opts KubernertesDiscoveryOptions, owner *buildOwner) (string, error) {
+	// platforms are not bound to any namespace
+	if !opts.UseSameNamespaceAsApp || owner.gvr == nil {
 		return opts.Namespace, nil
 	}
 
-	klog.V(4).Infof("Discovering the namespace where app %s is running on...", app)
+	klog.V(4).Infof("Discovering the namespace where %s %s is running on...", owner.kind, owner.name)
 
-	tsuruApp, err := d.DynamicInterface.Resource(tsuruAppGVR).Namespace(metadata.TsuruAppNamespace).Get(ctx, app, metav1.GetOptions{})
+	obj, err := d.DynamicInterface.Resource(*owner.gvr).Namespace(metadata.TsuruAppNamespace).Get(ctx, owner.name, metav1.GetOptions{})
 	if err != nil {
 		return "", err
 	}
 
 	// See more about App resource at: https://github.com/tsuru/tsuru/blob/main/provision/kubernetes/pkg/apis/tsuru/v1/types.go#L24
-	ns, found, err := unstructured.NestedString(tsuruApp.Object, "spec", "namespaceName")
+	// Job resource holds the namespace in the same field.
+	ns, found, err := unstructured.NestedString(obj.Object, "spec", "namespaceName")
 	if err != nil {
 		return "", err
 	}
 
 	if !found {
-		return "", fmt.Errorf("failed to fetch namespace in the App resource")
+		return "", fmt.Errorf("failed to fetch namespace in the %s resource", obj.GetKind())
 	}
 
-	klog.V(4).Infof("App %s is running on namespace %s...", app, ns)
+	klog.V(4).Infof("%s %s is running on namespace %s...", owner.kind, owner.name, ns)
 
 	return ns, nil
 }
 
-func (d *K8sDiscoverer) discoverBuildKitPod(ctx context.Context, opts KubernertesDiscoveryOptions, namespace string, w io.Writer) (*corev1.Pod, error) {
-	metrics.BuildsWaitingForLease.WithLabelValues(namespace).Inc()
-	defer metrics.BuildsWaitingForLease.WithLabelValues(namespace).Dec()
+func (d *K8sDiscoverer) discoverBuildKitPod(ctx context.Context, opts KubernertesDiscoveryOptions, namespace string, owner *buildOwner, annotations map[string]string, w io.Writer) (*corev1.Pod, error) {
+	metrics.Builds.AddWaiting(namespace, 1)
+	defer metrics.Builds.AddWaiting(namespace, -1)
 
+	watchCtx, watchCancel := context.WithCancel(ctx)
+	defer watchCancel()
+
+	var progress <-chan progressUpdate
 	if opts.Statefulset != "" {
-		err := scaler.MayUpscale(ctx, d.KubernetesInterface, namespace, opts.Statefulset, w)
+		scaledTo, err := scaler.MayUpscale(ctx, d.KubernetesInterface, namespace, opts.Statefulset, w)
 		if err != nil {
 			return nil, fmt.Errorf("failed trying upscale BuildKit statefulset(%s - %s): %w", namespace, opts.Statefulset, err)
 		}
+
+		if scaledTo > 0 {
+			// no other pod may become free, so there's no point in waiting
+			// for pods which cannot start
+			progress = d.followScaledPods(watchCtx, opts, namespace, 0, scaledTo, true)
+		}
 	}
 
-	watchCtx, watchCancel := context.WithCancel(ctx)
-	defer watchCancel()
+	schedule, preferredPod := d.planLeases(ctx, opts, namespace, owner)
 
 	podWatcher, err := d.KubernetesInterface.CoreV1().Pods(namespace).Watch(watchCtx, metav1.ListOptions{
 		LabelSelector: opts.PodSelector,
@@ -187,24 +328,117 @@ func (d *K8sDiscoverer) discoverBuildKitPod(ctx context.Context, opts Kubernerte
 	if err != nil {
 		return nil, fmt.Errorf("failed to create pod leaser: %w", err)
 	}
+	leaser.schedule = schedule
+	leaser.annotations = annotations
+	leaser.onLost = func(pod *corev1.Pod) { d.leaseLost(opts, pod, w) }
 	go leaser.acquireLeaseForAllPods(ctx, opts)
 
+	var scaleOut <-chan time.Time
+	if opts.Statefulset != "" && opts.ScaleMaxReplicas > 0 {
+		scaleOut = time.After(opts.ScaleOutThreshold)
+	}
+
+	timeout := time.After(opts.Timeout)
 	for {
 		select {
-		case <-time.After(opts.Timeout):
+		case <-timeout:
 			leaser.releaseAll()
 			return nil, fmt.Errorf("max deadline of %s exceeded to discover BuildKit pod", opts.Timeout)
+		case <-scaleOut:
+			scaleOut = nil // every waiting build asks for one more replica at most
+			scaledTo, err := scaler.ScaleOut(ctx, d.KubernetesInterface, d.EventRecorder, namespace, opts.Statefulset, opts.ScaleMaxReplicas, opts.ScaleOutThreshold, w)
+			if err != nil {
+				klog.Warningf("Failed to scale out BuildKit statefulset %s/%s: %s", namespace, opts.Statefulset, err)
+			}
+
+			if scaledTo > 0 && progress == nil {
+				progress = d.followScaledPods(watchCtx, opts, namespace, scaledTo-1, scaledTo, false)
+			}
+		case u, ok := <-progress:
+			if !ok {
+				progress = nil
+				continue
+			}
+
+			if u.err != nil {
+				leaser.releaseAll()
+				return nil, u.err
+			}
+
+			fmt.Fprintln(w, u.message)
 		case leasedPod, ok := <-leasedPodsCh:
 			if !ok {
 				leaser.releaseAll()
 				return nil, fmt.Errorf("leased pods channel was closed before acquiring any lease")
 			}
 			leaser.releaseAll(releaseOptions{except: leasedPod.Name})
+			if opts.AffinityWait > 0 {
+				observeAffinity(namespace, preferredPod, leasedPod.Name)
+			}
 			return leasedPod, nil
 		}
 	}
 }
 
+// followScaledPods follows the progress of the statefulset pods with ordinals
+// from first up to replicas, which were just scaled up.
+func (d *K8sDiscoverer) followScaledPods(ctx context.Context, opts KubernertesDiscoveryOptions, namespace string, first, replicas int32, failFast bool) <-chan progressUpdate {
+	var names []string
+	for i := first; i < replicas; i++ {
+		names = append(names, fmt.Sprintf("%s-%d", opts.Statefulset, i))
+	}
+
+	progress, err := d.followPods(ctx, namespace, opts.PodSelector, names, failFast)
+	if err != nil {
+		klog.Warningf("Failed to follow the progress of BuildKit pods %v: %s", names, err)
+		return nil
+	}
+
+	return progress
+}
+
+// leaseLost warns the build that its pod may run other builds from now on,
+// aborting it if so configured.
+func (d *K8sDiscoverer) leaseLost(opts KubernertesDiscoveryOptions, pod *corev1.Pod, w io.Writer) {
+	metrics.BuildKitLeasesLost.WithLabelValues(pod.Namespace).Inc()
+
+	if opts.AbortOnLeaseLoss && opts.OnLeaseLost != nil {
+		fmt.Fprintf(w, "Lost the lease on BuildKit pod %s/%s, aborting the build...\n", pod.Namespace, pod.Name)
+		opts.OnLeaseLost(ErrLeaseLost)
+		return
+	}
+
+	fmt.Fprintf(w, "WARNING: lost the lease on BuildKit pod %s/%s, other builds may run on it concurrently\n", pod.Namespace, pod.Name)
+}
+
+// leaseAnnotations returns the build metadata recorded in the leases.
+// leaseAnnotationKeys are all the keys leaseAnnotations may set.
+var leaseAnnotationKeys = []string{
+	metadata.DeployAgentBuildOwnerAnnotationKey,
+	metadata.DeployAgentBuildKindAnnotationKey,
+	metadata.DeployAgentBuildStartedAtAnnotationKey,
+	metadata.DeployAgentBuildTeamAnnotationKey,
+	metadata.DeployAgentBuildImageAnnotationKey,
+}
+
+func leaseAnnotations(req *pb.BuildRequest, owner *buildOwner) map[string]string {
+	annotations := map[string]string{
+		metadata.DeployAgentBuildOwnerAnnotationKey:     owner.affinityKey(),
+		metadata.DeployAgentBuildKindAnnotationKey:      req.Kind.String(),
+		metadata.DeployAgentBuildStartedAtAnnotationKey: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	if owner.team != "" {
+		annotations[metadata.DeployAgentBuildTeamAnnotationKey] = owner.team
+	}
+
+	if len(req.DestinationImages) > 0 {
+		annotations[metadata.DeployAgentBuildImageAnnotationKey] = req.DestinationImages[0]
+	}
+
+	return annotations
+}
+
 func getHolderName() (string, error) {
 	holderName := os.Getenv("POD_NAME")
 	if holderName == "" {
@@ -231,35 +465,35 @@ func isPodReady(pod *corev1.Pod) bool {
 	return pod.Status.Phase == corev1.PodRunning && pod.Status.PodIP != "" && ready
 }
 
-func setTsuruAppLabelOnBuildKitPod(ctx context.Context, cs kubernetes.Interface, pod, ns string, app *pb.TsuruApp) error {
+func setTsuruLabelsOnBuildKitPod(ctx context.Context, cs kubernetes.Interface, pod, ns string, owner *buildOwner) error {
 	changes := []any{
 		map[string]any{
 			"op":    "replace",
-			"path":  fmt.Sprintf("/metadata/labels/%s", normalizeAppLabelForJSONPatch(metadata.TsuruAppNameLabelKey)),
-			"value": app.Name,
+			"path":  fmt.Sprintf("/metadata/labels/%s", metadata.EscapeJSONPointer(owner.nameLabelKey)),
+			"value": owner.name,
 		},
 		map[string]any{
 			"op":    "replace",
-			"path":  fmt.Sprintf("/metadata/labels/%s", normalizeAppLabelForJSONPatch(metadata.TsuruIsBuildLabelKey)),
+			"path":  fmt.Sprintf("/metadata/labels/%s", metadata.EscapeJSONPointer(metadata.TsuruIsBuildLabelKey)),
 			"value": strconv.FormatBool(true),
 		},
 		map[string]any{
 			"op":    "replace",
-			"path":  fmt.Sprintf("/metadata/annotations/%s", normalizeAppLabelForJSONPatch(metadata.DeployAgentLastBuildEndingTimeLabelKey)),
+			"path":  fmt.Sprintf("/metadata/annotations/%s", metadata.EscapeJSONPointer(metadata.DeployAgentLastBuildEndingTimeLabelKey)),
 			"value": "", // set annotation value to empty rather than removing it, since it might not exist at first run
 		},
 		map[string]any{
 			"op":    "replace",
-			"path":  fmt.Sprintf("/metadata/annotations/%s", normalizeAppLabelForJSONPatch(metadata.DeployAgentLastBuildStartingLabelKey)),
+			"path":  fmt.Sprintf("/metadata/annotations/%s", metadata.EscapeJSONPointer(metadata.DeployAgentLastBuildStartingLabelKey)),
 			"value": strconv.FormatInt(time.Now().Unix(), 10),
 		},
 	}
 
-	if app.Team != "" {
+	if owner.team != "" && owner.teamLabelKey != "" {
 		changes = append(changes, map[string]any{
 			"op":    "replace",
-			"path":  fmt.Sprintf("/metadata/labels/%s", normalizeAppLabelForJSONPatch(metadata.TsuruAppTeamLabelKey)),
-			"value": app.Team,
+			"path":  fmt.Sprintf("/metadata/labels/%s", metadata.EscapeJSONPointer(owner.teamLabelKey)),
+			"value": owner.team,
 		})
 	}
 
@@ -272,26 +506,34 @@ func setTsuruAppLabelOnBuildKitPod(ctx context.Context, cs kubernetes.Interface,
 	return err
 }
 
-func unsetTsuruAppLabelOnBuildKitPod(ctx context.Context, cs kubernetes.Interface, pod, ns string) error {
-	patch, err := json.Marshal([]any{
+func unsetTsuruLabelsOnBuildKitPod(ctx context.Context, cs kubernetes.Interface, pod, ns string, owner *buildOwner) error {
+	changes := []any{
 		map[string]any{
 			"op":   "remove",
-			"path": fmt.Sprintf("/metadata/labels/%s", normalizeAppLabelForJSONPatch(metadata.TsuruAppNameLabelKey)),
+			"path": fmt.Sprintf("/metadata/labels/%s", metadata.EscapeJSONPointer(owner.nameLabelKey)),
 		},
-		map[string]any{
+	}
+
+	if owner.teamLabelKey != "" {
+		changes = append(changes, map[string]any{
 			"op":   "remove",
-			"path": fmt.Sprintf("/metadata/labels/%s", normalizeAppLabelForJSONPatch(metadata.TsuruAppTeamLabelKey)),
-		},
+			"path": fmt.Sprintf("/metadata/labels/%s", metadata.EscapeJSONPointer(owner.teamLabelKey)),
+		})
+	}
+
+	changes = append(changes,
 		map[string]any{
 			"op":   "remove",
-			"path": fmt.Sprintf("/metadata/labels/%s", normalizeAppLabelForJSONPatch(metadata.TsuruIsBuildLabelKey)),
+			"path": fmt.Sprintf("/metadata/labels/%s", metadata.EscapeJSONPointer(metadata.TsuruIsBuildLabelKey)),
 		},
 		map[string]any{
 			"op":    "replace",
-			"path":  fmt.Sprintf("/metadata/annotations/%s", normalizeAppLabelForJSONPatch(metadata.DeployAgentLastBuildEndingTimeLabelKey)),
+			"path":  fmt.Sprintf("/metadata/annotations/%s", metadata.EscapeJSONPointer(metadata.DeployAgentLastBuildEndingTimeLabelKey)),
 			"value": strconv.FormatInt(time.Now().Unix(), 10),
 		},
-	})
+	)
+
+	patch, err := json.Marshal(changes)
 	if err != nil {
 		return err
 	}
@@ -300,12 +542,6 @@ func unsetTsuruAppLabelOnBuildKitPod(ctx context.Context, cs kubernetes.Interfac
 	return err
 }
 
-func normalizeAppLabelForJSONPatch(s string) string {
-	// Replaces ~ and / by ~0 and ~1, respectively
-	// See: https://datatracker.ietf.org/doc/html/rfc6902/#appendix-A.14
-	return strings.ReplaceAll(strings.ReplaceAll(s, "~", "~0"), "/", "~1")
-}
-
 func cleanUps(fns ...func()) func() {
 	return func() {
 		for i := range fns {
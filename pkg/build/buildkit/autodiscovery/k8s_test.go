@@ -172,6 +172,7 @@ func TestK8sDiscoverer_Discover(t *testing.T) {
 		DynamicInterface:    fakeDynamicClient,
 	}
 
+	var leased string
 	_, _, _, err := discoverer.Discover(
 		context.TODO(),
 		KubernertesDiscoveryOptions{
@@ -179,6 +180,7 @@ func TestK8sDiscoverer_Discover(t *testing.T) {
 			Namespace:        "tsuru",
 			Timeout:          time.Second * 2,
 			SetTsuruAppLabel: true,
+			OnPodLeased:      func(pod *corev1.Pod) { leased = pod.Name },
 		},
 		&grpc_build_v1.BuildRequest{
 			App: &grpc_build_v1.TsuruApp{
@@ -189,6 +191,7 @@ func TestK8sDiscoverer_Discover(t *testing.T) {
 		os.Stdout,
 	)
 	assert.NoError(t, err)
+	assert.Equal(t, "test-app", leased)
 
 	existingPod, err := fakeClient.CoreV1().Pods("tsuru").Get(context.TODO(), "test-app", metav1.GetOptions{})
 	assert.NoError(t, err)
@@ -204,6 +207,108 @@ func TestK8sDiscoverer_Discover(t *testing.T) {
 	assert.NotEqual(t, "", existingPod.Annotations["deploy-agent.tsuru.io/last-build-starting-time"])
 }
 
+func TestK8sDiscoverer_DiscoverJobsAndPlatforms(t *testing.T) {
+	tests := map[string]struct {
+		req            *grpc_build_v1.BuildRequest
+		namespace      string
+		expectedLabels map[string]string
+	}{
+		"job": {
+			req: &grpc_build_v1.BuildRequest{
+				Kind: grpc_build_v1.BuildKind_BUILD_KIND_JOB_DEPLOY_WITH_CONTAINER_FILE,
+				Job:  &grpc_build_v1.TsuruJob{Name: "test-job", Team: "test-team"},
+			},
+			namespace: "tsuru-jobs",
+			expectedLabels: map[string]string{
+				"app":               "buildkit",
+				"tsuru.io/job-name": "test-job",
+				"tsuru.io/job-team": "test-team",
+				"tsuru.io/is-build": "true",
+			},
+		},
+		"platform": {
+			req: &grpc_build_v1.BuildRequest{
+				Kind:     grpc_build_v1.BuildKind_BUILD_KIND_PLATFORM_WITH_CONTAINER_FILE,
+				Platform: &grpc_build_v1.TsuruPlatform{Name: "python"},
+			},
+			namespace: "tsuru",
+			expectedLabels: map[string]string{
+				"app":                    "buildkit",
+				"tsuru.io/platform-name": "python",
+				"tsuru.io/is-build":      "true",
+			},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			buildKitPod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "buildkit-0",
+					Namespace:   tt.namespace,
+					Labels:      map[string]string{"app": "buildkit"},
+					Annotations: map[string]string{"foo": "bar"},
+				},
+				Status: corev1.PodStatus{
+					Phase:      corev1.PodRunning,
+					PodIP:      "127.0.0.1",
+					Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+				},
+			}
+			fakeClient := fake.NewSimpleClientset(buildKitPod)
+
+			fakeClient.PrependWatchReactor("*", func(action kuberntesTesting.Action) (handled bool, ret watch.Interface, err error) {
+				watcher := watch.NewFake()
+
+				go func() {
+					time.Sleep(time.Millisecond * 100)
+					watcher.Add(buildKitPod)
+				}()
+				return true, watcher, nil
+			})
+
+			tsuruJob := &unstructured.Unstructured{
+				Object: map[string]interface{}{
+					"apiVersion": "tsuru.io/v1",
+					"kind":       "Job",
+					"metadata": map[string]interface{}{
+						"name":      "test-job",
+						"namespace": "tsuru",
+					},
+					"spec": map[string]interface{}{
+						"namespaceName": "tsuru-jobs",
+					},
+				},
+			}
+
+			discoverer := K8sDiscoverer{
+				KubernetesInterface: fakeClient,
+				DynamicInterface:    fakeDynamic.NewSimpleDynamicClient(runtime.NewScheme(), tsuruJob),
+			}
+
+			_, cleanup, ns, err := discoverer.Discover(
+				context.TODO(),
+				KubernertesDiscoveryOptions{
+					PodSelector:           "app=buildkit",
+					Namespace:             "tsuru",
+					Timeout:               time.Second * 2,
+					SetTsuruAppLabel:      true,
+					UseSameNamespaceAsApp: true,
+				},
+				tt.req,
+				os.Stdout,
+			)
+			require.NoError(t, err)
+			defer cleanup()
+			assert.Equal(t, tt.namespace, ns)
+
+			existingPod, err := fakeClient.CoreV1().Pods(tt.namespace).Get(context.TODO(), "buildkit-0", metav1.GetOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedLabels, existingPod.Labels)
+		})
+	}
+}
+
 func TestK8sDiscoverer_DiscoverWithoutApp(t *testing.T) {
 	discoverer := K8sDiscoverer{
 		KubernetesInterface: fake.NewSimpleClientset(),
@@ -309,7 +414,7 @@ func TestK8sDiscoverer_DiscoverWithStatefulsetInitialUpscale(t *testing.T) {
 		fakeClient := fake.NewSimpleClientset(buildKitPod, statefulset)
 
 		fakeClient.PrependWatchReactor("*", func(action kuberntesTesting.Action) (handled bool, ret watch.Interface, err error) {
-			watcher := watch.NewFake()
+			watcher := watch.NewRaceFreeFake()
 			go func() {
 				time.Sleep(time.Millisecond * 100)
 				watcher.Add(buildKitPod)
@@ -502,7 +607,7 @@ func TestK8sDiscoverer_BuildkitPodNamespace(t *testing.T) {
 			DynamicInterface:    fakeDynamic.NewSimpleDynamicClient(runtime.NewScheme()),
 		}
 
-		ns, err := discoverer.buildkitPodNamespace(context.TODO(), opts, "test-app")
+		ns, err := discoverer.buildkitPodNamespace(context.TODO(), opts, &buildOwner{gvr: &tsuruAppGVR, kind: "app", name: "test-app"})
 
 		assert.NoError(t, err)
 		assert.Equal(t, "default", ns)
@@ -532,12 +637,59 @@ func TestK8sDiscoverer_BuildkitPodNamespace(t *testing.T) {
 			DynamicInterface:    fakeDynamic.NewSimpleDynamicClient(runtime.NewScheme(), tsuruApp),
 		}
 
-		ns, err := discoverer.buildkitPodNamespace(context.TODO(), opts, "test-app")
+		ns, err := discoverer.buildkitPodNamespace(context.TODO(), opts, &buildOwner{gvr: &tsuruAppGVR, kind: "app", name: "test-app"})
 
 		assert.NoError(t, err)
 		assert.Equal(t, "custom-namespace", ns)
 	})
 
+	t.Run("discover namespace from tsuru job", func(t *testing.T) {
+		tsuruJob := &unstructured.Unstructured{
+			Object: map[string]interface{}{
+				"apiVersion": "tsuru.io/v1",
+				"kind":       "Job",
+				"metadata": map[string]interface{}{
+					"name":      "test-job",
+					"namespace": "tsuru",
+				},
+				"spec": map[string]interface{}{
+					"namespaceName": "custom-job-namespace",
+				},
+			},
+		}
+
+		opts := KubernertesDiscoveryOptions{
+			UseSameNamespaceAsApp: true,
+		}
+
+		discoverer := K8sDiscoverer{
+			KubernetesInterface: fake.NewSimpleClientset(),
+			DynamicInterface:    fakeDynamic.NewSimpleDynamicClient(runtime.NewScheme(), tsuruJob),
+		}
+
+		ns, err := discoverer.buildkitPodNamespace(context.TODO(), opts, &buildOwner{gvr: &tsuruJobGVR, kind: "job", name: "test-job"})
+
+		assert.NoError(t, err)
+		assert.Equal(t, "custom-job-namespace", ns)
+	})
+
+	t.Run("use provided namespace for platforms", func(t *testing.T) {
+		opts := KubernertesDiscoveryOptions{
+			Namespace:             "default",
+			UseSameNamespaceAsApp: true,
+		}
+
+		discoverer := K8sDiscoverer{
+			KubernetesInterface: fake.NewSimpleClientset(),
+			DynamicInterface:    fakeDynamic.NewSimpleDynamicClient(runtime.NewScheme()),
+		}
+
+		ns, err := discoverer.buildkitPodNamespace(context.TODO(), opts, &buildOwner{kind: "platform", name: "python"})
+
+		assert.NoError(t, err)
+		assert.Equal(t, "default", ns)
+	})
+
 	t.Run("error when tsuru app not found", func(t *testing.T) {
 		opts := KubernertesDiscoveryOptions{
 			UseSameNamespaceAsApp: true,
@@ -548,7 +700,7 @@ func TestK8sDiscoverer_BuildkitPodNamespace(t *testing.T) {
 			DynamicInterface:    fakeDynamic.NewSimpleDynamicClient(runtime.NewScheme()),
 		}
 
-		_, err := discoverer.buildkitPodNamespace(context.TODO(), opts, "nonexistent-app")
+		_, err := discoverer.buildkitPodNamespace(context.TODO(), opts, &buildOwner{gvr: &tsuruAppGVR, kind: "app", name: "nonexistent-app"})
 
 		assert.Error(t, err)
 	})
@@ -641,33 +793,6 @@ func TestIsPodReady(t *testing.T) {
 	})
 }
 
-func TestNormalizeAppLabelForJSONPatch(t *testing.T) {
-	t.Run("string with forward slash", func(t *testing.T) {
-		result := normalizeAppLabelForJSONPatch("tsuru.io/app-name")
-		assert.Equal(t, "tsuru.io~1app-name", result)
-	})
-
-	t.Run("string with tilde", func(t *testing.T) {
-		result := normalizeAppLabelForJSONPatch("test~app")
-		assert.Equal(t, "test~0app", result)
-	})
-
-	t.Run("string with both tilde and slash", func(t *testing.T) {
-		result := normalizeAppLabelForJSONPatch("test~/app")
-		assert.Equal(t, "test~0~1app", result)
-	})
-
-	t.Run("string without special characters", func(t *testing.T) {
-		result := normalizeAppLabelForJSONPatch("simple-label")
-		assert.Equal(t, "simple-label", result)
-	})
-
-	t.Run("empty string", func(t *testing.T) {
-		result := normalizeAppLabelForJSONPatch("")
-		assert.Equal(t, "", result)
-	})
-}
-
 func TestSetTsuruAppLabelOnBuildKitPod(t *testing.T) {
 	pod := &corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
@@ -687,12 +812,15 @@ func TestSetTsuruAppLabelOnBuildKitPod(t *testing.T) {
 
 	fakeClient := fake.NewSimpleClientset(pod)
 
-	app := &grpc_build_v1.TsuruApp{
-		Name: "test-app",
-		Team: "test-team",
-	}
+	owner, err := newBuildOwner(&grpc_build_v1.BuildRequest{
+		App: &grpc_build_v1.TsuruApp{
+			Name: "test-app",
+			Team: "test-team",
+		},
+	})
+	require.NoError(t, err)
 
-	err := setTsuruAppLabelOnBuildKitPod(context.TODO(), fakeClient, pod.Name, pod.Namespace, app)
+	err = setTsuruLabelsOnBuildKitPod(context.TODO(), fakeClient, pod.Name, pod.Namespace, owner)
 	require.NoError(t, err)
 
 	actions := fakeClient.Actions()
@@ -758,7 +886,10 @@ func TestUnsetTsuruAppLabelOnBuildKitPod(t *testing.T) {
 
 	fakeClient := fake.NewSimpleClientset(pod)
 
-	err := unsetTsuruAppLabelOnBuildKitPod(context.TODO(), fakeClient, pod.Name, pod.Namespace)
+	owner, err := newBuildOwner(&grpc_build_v1.BuildRequest{App: &grpc_build_v1.TsuruApp{Name: "test-app"}})
+	require.NoError(t, err)
+
+	err = unsetTsuruLabelsOnBuildKitPod(context.TODO(), fakeClient, pod.Name, pod.Namespace, owner)
 	require.NoError(t, err)
 
 	actions := fakeClient.Actions()
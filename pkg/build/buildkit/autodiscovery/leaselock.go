@@ -0,0 +1,113 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autodiscovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coordinationv1client "k8s.io/client-go/kubernetes/typed/coordination/v1"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/utils/ptr"
+)
+
+var _ resourcelock.Interface = &annotatedLeaseLock{}
+
+// annotatedLeaseLock works like resourcelock.LeaseLock, besides recording the
+// build metadata in the Lease annotations while it's held, so operators can
+// tell which build is running on each BuildKit pod.
+type annotatedLeaseLock struct {
+	leaseMeta   metav1.ObjectMeta
+	client      coordinationv1client.LeasesGetter
+	identity    string
+	annotations map[string]string
+	lease       *coordinationv1.Lease
+}
+
+func (l *annotatedLeaseLock) Get(ctx context.Context) (*resourcelock.LeaderElectionRecord, []byte, error) {
+	lease, err := l.client.Leases(l.leaseMeta.Namespace).Get(ctx, l.leaseMeta.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	l.lease = lease
+
+	record := resourcelock.LeaseSpecToLeaderElectionRecord(&lease.Spec)
+	data, err := json.Marshal(*record)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return record, data, nil
+}
+
+func (l *annotatedLeaseLock) Create(ctx context.Context, ler resourcelock.LeaderElectionRecord) error {
+	lease, err := l.client.Leases(l.leaseMeta.Namespace).Create(ctx, &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        l.leaseMeta.Name,
+			Namespace:   l.leaseMeta.Namespace,
+			Annotations: l.annotations,
+		},
+		Spec: resourcelock.LeaderElectionRecordToLeaseSpec(&ler),
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+
+	l.lease = lease
+	return nil
+}
+
+func (l *annotatedLeaseLock) Update(ctx context.Context, ler resourcelock.LeaderElectionRecord) error {
+	if l.lease == nil {
+		return errors.New("lease not initialized, call get or create first")
+	}
+
+	lease := l.lease.DeepCopy()
+	lease.Spec = resourcelock.LeaderElectionRecordToLeaseSpec(&ler)
+
+	// the lease is released by updating it without holder
+	released := ler.HolderIdentity == ""
+
+	// a previous holder (e.g. a crashed agent) may have left annotations
+	// which don't apply to this build
+	if released || ptr.Deref(l.lease.Spec.HolderIdentity, "") != ler.HolderIdentity {
+		for _, k := range leaseAnnotationKeys {
+			delete(lease.Annotations, k)
+		}
+	}
+
+	if !released {
+		if lease.Annotations == nil {
+			lease.Annotations = make(map[string]string, len(l.annotations))
+		}
+
+		for k, v := range l.annotations {
+			lease.Annotations[k] = v
+		}
+	}
+
+	lease, err := l.client.Leases(l.leaseMeta.Namespace).Update(ctx, lease, metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+
+	l.lease = lease
+	return nil
+}
+
+func (l *annotatedLeaseLock) RecordEvent(string) {}
+
+func (l *annotatedLeaseLock) Describe() string {
+	return fmt.Sprintf("%s/%s", l.leaseMeta.Namespace, l.leaseMeta.Name)
+}
+
+func (l *annotatedLeaseLock) Identity() string {
+	return l.identity
+}
@@ -6,25 +6,32 @@ package autodiscovery
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/leaderelection"
-	"k8s.io/client-go/tools/leaderelection/resourcelock"
 	"k8s.io/klog"
 )
 
+// Default lease timings, used when KubernertesDiscoveryOptions leaves them
+// unset.
 var (
 	leaseDuration = 5 * time.Second
 	renewDeadline = 2 * time.Second
 	retryPeriod   = 500 * time.Millisecond
 )
 
+// ErrLeaseLost is the cause of builds aborted since the lease on their
+// BuildKit pod was lost, so other builds may run on it concurrently.
+var ErrLeaseLost = errors.New("lost the lease on the BuildKit pod during the build")
+
 type leaser struct {
 	kubernetesInterface kubernetes.Interface
 	leasablePodsCh      <-chan *corev1.Pod
@@ -33,6 +40,36 @@ type leaser struct {
 	leaseCancelByPod    map[string]context.CancelFunc
 	leaseCancelMutex    *sync.Mutex
 	holderName          string
+	// schedule delays the lease acquisition of some pods, if set.
+	schedule *leaseSchedule
+	// annotations are recorded in the leases while they're held.
+	annotations map[string]string
+	// onLost is called when the lease of a pod handed over on leasedPodsCh
+	// is lost before being released, if set.
+	onLost func(pod *corev1.Pod)
+}
+
+// leaseSchedule holds how long after start each pod waits before trying to
+// acquire its lease, so the pods better suited to the build (e.g. with a warm
+// cache or more free disk) win whenever they're free.
+type leaseSchedule struct {
+	start  time.Time
+	delays map[string]time.Duration
+	// fallback is the delay of pods missing in delays.
+	fallback time.Duration
+}
+
+func (s *leaseSchedule) wait(pod string) time.Duration {
+	if s == nil {
+		return 0
+	}
+
+	delay, found := s.delays[pod]
+	if !found {
+		delay = s.fallback
+	}
+
+	return time.Until(s.start.Add(delay))
 }
 
 func newLeaser(kubernetesInterface kubernetes.Interface, leasablePodsCh <-chan *corev1.Pod, holderName string) (*leaser, <-chan *corev1.Pod, error) {
@@ -90,6 +127,9 @@ func (l *leaser) acquireLeaseForAllPods(ctx context.Context, opts KubernertesDis
 		l.leaseAcquiringWg.Add(1)
 		go func() {
 			defer l.leaseAcquiringWg.Done()
+			if !l.waitForSchedule(leaseCtx, leasablePod) {
+				return
+			}
 			l.acquireLeaseForPod(leaseCtx, leasablePod, opts)
 		}()
 	}
@@ -97,37 +137,70 @@ func (l *leaser) acquireLeaseForAllPods(ctx context.Context, opts KubernertesDis
 	close(l.leasedPodsCh)
 }
 
+// waitForSchedule delays the lease acquisition of the pod as set in the lease
+// schedule. It returns false if the context is canceled meanwhile.
+func (l *leaser) waitForSchedule(ctx context.Context, pod *corev1.Pod) bool {
+	wait := l.schedule.wait(pod.Name)
+	if wait <= 0 {
+		return true
+	}
+
+	klog.V(4).Infof("Waiting %s for better suited pods before leasing pod %s/%s", wait, pod.Namespace, pod.Name)
+
+	select {
+	case <-time.After(wait):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
 // acquireLeaseForPod tries to acquire a lease for the given pod.
 // it is a blocking call and only returns after the lease is lost or the given context is canceled.
 // it should always be used in a separate goroutine.
 func (l *leaser) acquireLeaseForPod(ctx context.Context, pod *corev1.Pod, opts KubernertesDiscoveryOptions) {
 	klog.V(4).Infof("Attempting to acquire the lease for pod %s/%s under holder name %s", pod.Namespace, pod.Name, l.holderName)
+
+	duration, renew, retry := opts.leaseTimings()
+
+	var handedOver atomic.Bool
 	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
-		Lock: &resourcelock.LeaseLock{
-			LeaseMeta: metav1.ObjectMeta{
+		Lock: &annotatedLeaseLock{
+			leaseMeta: metav1.ObjectMeta{
 				Name:      fmt.Sprintf("%s-%s", strings.TrimRight(opts.LeasePrefix, "-"), pod.Name),
 				Namespace: pod.Namespace,
 			},
-			Client: l.kubernetesInterface.CoordinationV1(),
-			LockConfig: resourcelock.ResourceLockConfig{
-				Identity: l.holderName,
-			},
+			client:      l.kubernetesInterface.CoordinationV1(),
+			identity:    l.holderName,
+			annotations: l.annotations,
 		},
 		ReleaseOnCancel: true,
-		LeaseDuration:   leaseDuration,
-		RenewDeadline:   renewDeadline,
-		RetryPeriod:     retryPeriod,
+		LeaseDuration:   duration,
+		RenewDeadline:   renew,
+		RetryPeriod:     retry,
 		Callbacks: leaderelection.LeaderCallbacks{
 			OnStartedLeading: func(_ context.Context) {
 				select {
 				case l.leasedPodsCh <- pod:
+					handedOver.Store(true)
 					klog.V(4).Infof("Selected BuildKit pod: %s/%s under holder name %s", pod.Namespace, pod.Name, l.holderName)
 
 				case <-ctx.Done():
 					klog.V(4).Infof("Received context cancellation: %s/%s", pod.Namespace, pod.Name)
 				}
 			},
-			OnStoppedLeading: func() {},
+			OnStoppedLeading: func() {
+				// leases are released by canceling ctx, otherwise the lease
+				// could not be renewed in time (e.g. API server unavailable)
+				if !handedOver.Load() || ctx.Err() != nil {
+					return
+				}
+
+				klog.Warningf("Lost the lease for pod %s/%s under holder name %s", pod.Namespace, pod.Name, l.holderName)
+				if l.onLost != nil {
+					l.onLost(pod)
+				}
+			},
 		},
 	})
 	klog.V(4).Infof("Shutting off the lease acquirer for %s/%s pod under holder name %s", pod.Namespace, pod.Name, l.holderName)
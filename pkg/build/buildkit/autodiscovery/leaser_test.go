@@ -6,13 +6,24 @@ package autodiscovery
 
 import (
 	"context"
+	"errors"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	coordinationv1 "k8s.io/api/coordination/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes/fake"
+	kuberntesTesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/utils/ptr"
+
+	"github.com/tsuru/deploy-agent/pkg/build/grpc_build_v1"
+	"github.com/tsuru/deploy-agent/pkg/build/metadata"
 )
 
 // TestLeaser_ConcurrentMapAccess tests for concurrent map access race conditions.
@@ -70,3 +81,149 @@ func TestLeaser_ConcurrentMapAccess(t *testing.T) {
 		<-done
 	}
 }
+
+func TestLeaser_LeaseLost(t *testing.T) {
+	tests := map[string]struct {
+		failRenewals bool
+		expectedLost bool
+	}{
+		"lease released by the holder": {},
+		"lease renewal failing": {
+			failRenewals: true,
+			expectedLost: true,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			kubeClient := fake.NewSimpleClientset()
+
+			var failRenewals atomic.Bool
+			kubeClient.PrependReactor("update", "leases", func(action kuberntesTesting.Action) (bool, runtime.Object, error) {
+				if failRenewals.Load() {
+					return true, nil, errors.New("api server unavailable")
+				}
+				return false, nil, nil
+			})
+
+			leasablePodsCh := make(chan *corev1.Pod, 1)
+			leaser, leasedPodsCh, err := newLeaser(kubeClient, leasablePodsCh, "test-holder")
+			require.NoError(t, err)
+
+			leaser.annotations = map[string]string{metadata.DeployAgentBuildOwnerAnnotationKey: "app/my-app"}
+
+			lostCh := make(chan *corev1.Pod, 1)
+			leaser.onLost = func(pod *corev1.Pod) { lostCh <- pod }
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			go leaser.acquireLeaseForAllPods(ctx, KubernertesDiscoveryOptions{
+				LeasePrefix:        "test",
+				LeaseDuration:      400 * time.Millisecond,
+				LeaseRenewDeadline: 200 * time.Millisecond,
+				LeaseRetryPeriod:   50 * time.Millisecond,
+			})
+
+			leasablePodsCh <- &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "buildkit-0", Namespace: "tsuru"}}
+			close(leasablePodsCh)
+
+			select {
+			case pod := <-leasedPodsCh:
+				require.Equal(t, "buildkit-0", pod.Name)
+			case <-time.After(5 * time.Second):
+				require.Fail(t, "pod was not leased in time")
+			}
+
+			lease, err := kubeClient.CoordinationV1().Leases("tsuru").Get(context.TODO(), "test-buildkit-0", metav1.GetOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, "app/my-app", lease.Annotations[metadata.DeployAgentBuildOwnerAnnotationKey])
+
+			if tt.failRenewals {
+				failRenewals.Store(true)
+			} else {
+				leaser.releaseAll()
+			}
+
+			select {
+			case pod := <-lostCh:
+				assert.True(t, tt.expectedLost, "lease must not be reported as lost")
+				assert.Equal(t, "buildkit-0", pod.Name)
+			case <-time.After(2 * time.Second):
+				assert.False(t, tt.expectedLost, "lease loss was not reported")
+			}
+
+			if tt.expectedLost {
+				return
+			}
+
+			lease, err = kubeClient.CoordinationV1().Leases("tsuru").Get(context.TODO(), "test-buildkit-0", metav1.GetOptions{})
+			require.NoError(t, err)
+			assert.NotContains(t, lease.Annotations, metadata.DeployAgentBuildOwnerAnnotationKey, "released leases must not keep the build annotations")
+		})
+	}
+}
+
+func TestAnnotatedLeaseLock_UpdateTakeover(t *testing.T) {
+	kubeClient := fake.NewSimpleClientset(&coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-buildkit-0",
+			Namespace: "tsuru",
+			Annotations: map[string]string{
+				metadata.DeployAgentBuildOwnerAnnotationKey: "app/crashed-app",
+				metadata.DeployAgentBuildTeamAnnotationKey:  "crashed-team",
+				metadata.DeployAgentBuildImageAnnotationKey: "registry.example.com/tsuru/app-crashed-app:v1",
+				"example.com/unrelated":                     "kept",
+			},
+		},
+		Spec: coordinationv1.LeaseSpec{HolderIdentity: ptr.To("crashed-agent")},
+	})
+
+	lock := &annotatedLeaseLock{
+		leaseMeta:   metav1.ObjectMeta{Name: "test-buildkit-0", Namespace: "tsuru"},
+		client:      kubeClient.CoordinationV1(),
+		identity:    "agent",
+		annotations: map[string]string{metadata.DeployAgentBuildOwnerAnnotationKey: "platform/python"},
+	}
+
+	_, _, err := lock.Get(context.TODO())
+	require.NoError(t, err)
+	require.NoError(t, lock.Update(context.TODO(), resourcelock.LeaderElectionRecord{HolderIdentity: "agent"}))
+
+	lease, err := kubeClient.CoordinationV1().Leases("tsuru").Get(context.TODO(), "test-buildkit-0", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		metadata.DeployAgentBuildOwnerAnnotationKey: "platform/python",
+		"example.com/unrelated":                     "kept",
+	}, lease.Annotations)
+
+	// renewals keep the annotations
+	require.NoError(t, lock.Update(context.TODO(), resourcelock.LeaderElectionRecord{HolderIdentity: "agent"}))
+	assert.Equal(t, "platform/python", lock.lease.Annotations[metadata.DeployAgentBuildOwnerAnnotationKey])
+}
+
+func TestLeaseAnnotations(t *testing.T) {
+	req := &grpc_build_v1.BuildRequest{
+		Kind:              grpc_build_v1.BuildKind_BUILD_KIND_APP_BUILD_WITH_CONTAINER_FILE,
+		App:               &grpc_build_v1.TsuruApp{Name: "my-app", Team: "my-team"},
+		DestinationImages: []string{"registry.example.com/tsuru/app-my-app:v1", "registry.example.com/tsuru/app-my-app:latest"},
+	}
+
+	owner, err := newBuildOwner(req)
+	require.NoError(t, err)
+
+	annotations := leaseAnnotations(req, owner)
+	assert.Equal(t, "app/my-app", annotations[metadata.DeployAgentBuildOwnerAnnotationKey])
+	assert.Equal(t, "my-team", annotations[metadata.DeployAgentBuildTeamAnnotationKey])
+	assert.Equal(t, "BUILD_KIND_APP_BUILD_WITH_CONTAINER_FILE", annotations[metadata.DeployAgentBuildKindAnnotationKey])
+	assert.Equal(t, "registry.example.com/tsuru/app-my-app:v1", annotations[metadata.DeployAgentBuildImageAnnotationKey])
+
+	startedAt, err := time.Parse(time.RFC3339, annotations[metadata.DeployAgentBuildStartedAtAnnotationKey])
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), startedAt, 5*time.Second)
+
+	platform := &grpc_build_v1.BuildRequest{Platform: &grpc_build_v1.TsuruPlatform{Name: "python"}}
+	owner, err = newBuildOwner(platform)
+	require.NoError(t, err)
+	assert.NotContains(t, leaseAnnotations(platform, owner), metadata.DeployAgentBuildTeamAnnotationKey)
+}
@@ -0,0 +1,323 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autodiscovery
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+
+	"github.com/tsuru/deploy-agent/pkg/build/buildkit/scaler"
+	"github.com/tsuru/deploy-agent/pkg/build/metadata"
+)
+
+const (
+	// loadQueryTimeout bounds the time spent querying each BuildKit pod.
+	loadQueryTimeout = 2 * time.Second
+	// loadStatsTTL is how long the stats of a BuildKit pod are reused before
+	// querying it again.
+	loadStatsTTL = 30 * time.Second
+	// loadRankStep is the head start of each pod over the next ranked one.
+	loadRankStep = 250 * time.Millisecond
+	// loadAvoidDelay is the extra delay of pods which should not receive
+	// builds, unless there's no other pod free.
+	loadAvoidDelay = 10 * time.Second
+	// minFreeCacheRatio is the free cache space below which BuildKit is
+	// about to evict its cache.
+	minFreeCacheRatio = 0.1
+	// recentBuildsWindow is how far back builds count as recent.
+	recentBuildsWindow = time.Hour
+)
+
+// buildKitStats is the cache usage reported by BuildKit.
+type buildKitStats struct {
+	// usedBytes is the size of all cache records.
+	usedBytes int64
+	// keepBytes is the cache size kept by the garbage collector, zero if
+	// there's no limit.
+	keepBytes int64
+}
+
+type cachedStats struct {
+	stats *buildKitStats
+	at    time.Time
+}
+
+// buildKitStats returns the stats of the BuildKit at addr, querying it only
+// when the cached ones are older than loadStatsTTL. Busy pods are never
+// queried, so the builds they run aren't slowed down: they keep their last
+// stats, if any.
+func (d *K8sDiscoverer) buildKitStats(ctx context.Context, addr string, busy bool) (*buildKitStats, error) {
+	now := time.Now()
+
+	d.statsM.Lock()
+	cached, found := d.stats[addr]
+	d.statsM.Unlock()
+
+	if found && (busy || now.Sub(cached.at) < loadStatsTTL) {
+		return cached.stats, nil
+	}
+
+	if busy {
+		return nil, nil
+	}
+
+	query := d.queryStats
+	if query == nil {
+		query = queryBuildKitStats
+	}
+
+	qctx, cancel := context.WithTimeout(ctx, loadQueryTimeout)
+	defer cancel()
+
+	stats, err := query(qctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	d.statsM.Lock()
+	defer d.statsM.Unlock()
+
+	if d.stats == nil {
+		d.stats = make(map[string]cachedStats)
+	}
+
+	// addresses of pods long gone (or busy for long) are forgotten
+	for a, c := range d.stats {
+		if now.Sub(c.at) > recentBuildsWindow {
+			delete(d.stats, a)
+		}
+	}
+
+	d.stats[addr] = cachedStats{stats: stats, at: now}
+	return stats, nil
+}
+
+func queryBuildKitStats(ctx context.Context, addr string) (*buildKitStats, error) {
+	c, err := client.New(ctx, addr, client.WithFailFast())
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	usage, err := c.DiskUsage(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get disk usage: %w", err)
+	}
+
+	workers, err := c.ListWorkers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list workers: %w", err)
+	}
+
+	var stats buildKitStats
+	for _, u := range usage {
+		stats.usedBytes += u.Size
+	}
+
+	for _, w := range workers {
+		for _, p := range w.GCPolicy {
+			if p.KeepBytes > stats.keepBytes {
+				stats.keepBytes = p.KeepBytes
+			}
+		}
+	}
+
+	return &stats, nil
+}
+
+type podScore struct {
+	pod            string
+	freeCacheRatio float64
+	recentBuilds   int
+	nodePressure   bool
+}
+
+// avoid tells whether builds on the pod are likely to evict its cache or to
+// fail on disk pressure.
+func (s podScore) avoid() bool {
+	return s.nodePressure || s.freeCacheRatio < minFreeCacheRatio
+}
+
+func (s podScore) value() float64 {
+	return 100*s.freeCacheRatio - 10*float64(s.recentBuilds)
+}
+
+// rankBuildKitPods scores the ready pods (except the one to skip), returning
+// them from the best suited to run builds to the worst.
+func (d *K8sDiscoverer) rankBuildKitPods(ctx context.Context, opts KubernertesDiscoveryOptions, pods []corev1.Pod, skip string) []podScore {
+	nodes := d.nodesUnderPressure(ctx, pods)
+	leased := d.leasedPods(ctx, opts, pods)
+
+	var (
+		scores []podScore
+		m      sync.Mutex
+		wg     sync.WaitGroup
+	)
+
+	for i := range pods {
+		pod := &pods[i]
+		if pod.Name == skip || pod.DeletionTimestamp != nil || !isPodReady(pod) {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			score := podScore{
+				pod:            pod.Name,
+				freeCacheRatio: 1,
+				recentBuilds:   recentBuildsFromPod(pod).since(time.Now().Add(-recentBuildsWindow)),
+				nodePressure:   nodes[pod.Spec.NodeName],
+			}
+
+			stats, err := d.buildKitStats(ctx, fmt.Sprintf("tcp://%s:%d", pod.Status.PodIP, opts.Port), leased[pod.Name] || podBuilding(pod))
+			if err != nil {
+				klog.Warningf("Failed to query BuildKit pod %s/%s load: %s", pod.Namespace, pod.Name, err)
+			} else if stats != nil && stats.keepBytes > 0 {
+				score.freeCacheRatio = max(0, float64(stats.keepBytes-stats.usedBytes)/float64(stats.keepBytes))
+			}
+
+			m.Lock()
+			scores = append(scores, score)
+			m.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].avoid() != scores[j].avoid() {
+			return !scores[i].avoid()
+		}
+
+		if scores[i].value() != scores[j].value() {
+			return scores[i].value() > scores[j].value()
+		}
+
+		return scores[i].pod < scores[j].pod
+	})
+
+	return scores
+}
+
+// leasedPods returns whether an agent holds the Lease on each of the pods,
+// which live in the same namespace.
+func (d *K8sDiscoverer) leasedPods(ctx context.Context, opts KubernertesDiscoveryOptions, pods []corev1.Pod) map[string]bool {
+	leased := make(map[string]bool)
+	if len(pods) == 0 {
+		return leased
+	}
+
+	leases, err := d.KubernetesInterface.CoordinationV1().Leases(pods[0].Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		klog.V(4).Infof("Failed to list the leases on BuildKit pods: %s", err)
+		return leased
+	}
+
+	prefix := strings.TrimRight(opts.LeasePrefix, "-") + "-"
+	now := time.Now()
+	for i := range leases.Items {
+		lease := &leases.Items[i]
+		if strings.HasPrefix(lease.Name, prefix) && scaler.LeaseHeld(lease, now) {
+			leased[strings.TrimPrefix(lease.Name, prefix)] = true
+		}
+	}
+
+	return leased
+}
+
+// podBuilding tells whether the pod is marked as running a build, i.e. as
+// starting one which didn't end yet. The marks are only written along with
+// the tsuru labels (see SetTsuruAppLabel).
+func podBuilding(pod *corev1.Pod) bool {
+	return pod.Annotations[metadata.DeployAgentLastBuildStartingLabelKey] != "" &&
+		pod.Annotations[metadata.DeployAgentLastBuildEndingTimeLabelKey] == ""
+}
+
+// nodesUnderPressure returns whether the nodes running the pods have any
+// disk, memory or PID pressure condition.
+func (d *K8sDiscoverer) nodesUnderPressure(ctx context.Context, pods []corev1.Pod) map[string]bool {
+	pressure := make(map[string]bool)
+
+	for _, pod := range pods {
+		name := pod.Spec.NodeName
+		if _, found := pressure[name]; found || name == "" {
+			continue
+		}
+
+		pressure[name] = false
+
+		node, err := d.KubernetesInterface.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			klog.V(4).Infof("Failed to get node %s conditions: %s", name, err)
+			continue
+		}
+
+		for _, c := range node.Status.Conditions {
+			switch c.Type {
+			case corev1.NodeDiskPressure, corev1.NodeMemoryPressure, corev1.NodePIDPressure:
+				if c.Status == corev1.ConditionTrue {
+					pressure[name] = true
+				}
+			}
+		}
+	}
+
+	return pressure
+}
+
+// planLeases lists the candidate pods to build the owner, delaying the lease
+// acquisition of the worst suited ones. It returns the pod preferred by cache
+// affinity as well, if any.
+func (d *K8sDiscoverer) planLeases(ctx context.Context, opts KubernertesDiscoveryOptions, namespace string, owner *buildOwner) (*leaseSchedule, string) {
+	if opts.AffinityWait <= 0 && !opts.LoadAware {
+		return nil, ""
+	}
+
+	pods, err := d.KubernetesInterface.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: opts.PodSelector})
+	if err != nil {
+		klog.Warningf("Failed to list BuildKit pods to rank them: %s", err)
+		return nil, ""
+	}
+
+	schedule := &leaseSchedule{start: time.Now(), delays: make(map[string]time.Duration)}
+
+	var preferred string
+	if opts.AffinityWait > 0 {
+		preferred = preferredBuildKitPod(pods.Items, owner)
+		if preferred != "" {
+			klog.V(4).Infof("Preferring BuildKit pod %s/%s which last built %s %s", namespace, preferred, owner.kind, owner.name)
+			schedule.delays[preferred] = 0
+			schedule.fallback = opts.AffinityWait
+		}
+	}
+
+	if opts.LoadAware {
+		base := schedule.fallback
+		ranked := d.rankBuildKitPods(ctx, opts, pods.Items, preferred)
+		for i, score := range ranked {
+			delay := base + time.Duration(i)*loadRankStep
+			if score.avoid() {
+				delay += loadAvoidDelay
+			}
+
+			klog.V(4).Infof("BuildKit pod %s/%s ranked #%d (free cache: %.2f, recent builds: %d, node pressure: %t)", namespace, score.pod, i+1, score.freeCacheRatio, score.recentBuilds, score.nodePressure)
+			schedule.delays[score.pod] = delay
+		}
+
+		schedule.fallback = base + time.Duration(len(ranked))*loadRankStep
+	}
+
+	return schedule, preferred
+}
@@ -0,0 +1,256 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autodiscovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	fakeDynamic "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	kuberntesTesting "k8s.io/client-go/testing"
+	"k8s.io/utils/ptr"
+
+	"github.com/tsuru/deploy-agent/pkg/build/grpc_build_v1"
+	"github.com/tsuru/deploy-agent/pkg/build/metadata"
+)
+
+func newLoadTestPod(name, node, ip string, rb recentBuilds) *corev1.Pod {
+	pod := newAffinityTestPod(name, true, rb)
+	pod.Spec.NodeName = node
+	pod.Status.PodIP = ip
+	return pod
+}
+
+func newLoadTestNode(name string, pressure corev1.NodeConditionType) *corev1.Node {
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	if pressure != "" {
+		node.Status.Conditions = []corev1.NodeCondition{{Type: pressure, Status: corev1.ConditionTrue}}
+	}
+	return node
+}
+
+// fakeQueryStats returns the used bytes by pod IP out of 100 kept bytes.
+func fakeQueryStats(usedByIP map[string]int64) func(context.Context, string) (*buildKitStats, error) {
+	return func(_ context.Context, addr string) (*buildKitStats, error) {
+		for ip, used := range usedByIP {
+			if addr == fmt.Sprintf("tcp://%s:0", ip) {
+				return &buildKitStats{usedBytes: used, keepBytes: 100}, nil
+			}
+		}
+		return nil, errors.New("connection refused")
+	}
+}
+
+func TestK8sDiscoverer_RankBuildKitPods(t *testing.T) {
+	recent := time.Now().Add(-time.Minute).Unix()
+	old := time.Now().Add(-2 * recentBuildsWindow).Unix()
+
+	pods := []corev1.Pod{
+		*newLoadTestPod("full-cache", "node-a", "10.0.0.1", nil),
+		*newLoadTestPod("busy", "node-a", "10.0.0.2", recentBuilds{"app/a": recent, "app/b": recent, "app/c": old}),
+		*newLoadTestPod("idle", "node-a", "10.0.0.3", recentBuilds{"app/c": old}),
+		*newLoadTestPod("disk-pressure", "node-b", "10.0.0.4", nil),
+		*newLoadTestPod("unreachable", "node-a", "10.0.0.5", nil),
+		*newLoadTestPod("skipped", "node-a", "10.0.0.6", nil),
+		*newAffinityTestPod("not-ready", false, nil),
+	}
+
+	d := &K8sDiscoverer{
+		KubernetesInterface: fake.NewSimpleClientset(newLoadTestNode("node-a", ""), newLoadTestNode("node-b", corev1.NodeDiskPressure)),
+		queryStats: fakeQueryStats(map[string]int64{
+			"10.0.0.1": 95,
+			"10.0.0.2": 20,
+			"10.0.0.3": 30,
+			"10.0.0.4": 0,
+			"10.0.0.6": 0,
+		}),
+	}
+
+	scores := d.rankBuildKitPods(context.TODO(), KubernertesDiscoveryOptions{}, pods, "skipped")
+
+	var ranked []string
+	for _, s := range scores {
+		ranked = append(ranked, s.pod)
+	}
+	assert.Equal(t, []string{"unreachable", "idle", "busy", "disk-pressure", "full-cache"}, ranked)
+
+	assert.False(t, scores[2].avoid())
+	assert.Equal(t, 2, scores[2].recentBuilds)
+	assert.InDelta(t, 0.8, scores[2].freeCacheRatio, 0.001)
+	assert.True(t, scores[3].nodePressure)
+	assert.True(t, scores[4].avoid())
+}
+
+func TestK8sDiscoverer_RankBuildKitPodsCachesStats(t *testing.T) {
+	building := newLoadTestPod("building", "", "10.0.0.2", nil)
+	building.Annotations[metadata.DeployAgentLastBuildStartingLabelKey] = strconv.FormatInt(time.Now().Unix(), 10)
+
+	// leased by a build which doesn't mark its pods
+	leased := newLoadTestPod("leased", "", "10.0.0.3", nil)
+
+	pods := []corev1.Pod{*newLoadTestPod("idle", "", "10.0.0.1", nil), *building, *leased}
+
+	queried := make(map[string]int)
+	var m sync.Mutex
+
+	query := fakeQueryStats(map[string]int64{"10.0.0.1": 50, "10.0.0.2": 95, "10.0.0.3": 95})
+	d := &K8sDiscoverer{
+		KubernetesInterface: fake.NewSimpleClientset(&coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: "deploy-agent-leased", Namespace: "tsuru"},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       ptr.To("agent-a"),
+				LeaseDurationSeconds: ptr.To(int32(60)),
+				RenewTime:            &metav1.MicroTime{Time: time.Now()},
+			},
+		}),
+		queryStats: func(ctx context.Context, addr string) (*buildKitStats, error) {
+			m.Lock()
+			queried[addr]++
+			m.Unlock()
+			return query(ctx, addr)
+		},
+	}
+
+	for range 3 {
+		d.rankBuildKitPods(context.TODO(), KubernertesDiscoveryOptions{LeasePrefix: "deploy-agent"}, pods, "")
+	}
+	assert.Equal(t, map[string]int{"tcp://10.0.0.1:0": 1}, queried, "busy pods are never queried")
+
+	// the stats of pods which were queried before getting busy are kept
+	d.stats["tcp://10.0.0.1:0"] = cachedStats{stats: d.stats["tcp://10.0.0.1:0"].stats, at: time.Now().Add(-2 * loadStatsTTL)}
+	pods[0].Annotations[metadata.DeployAgentLastBuildStartingLabelKey] = strconv.FormatInt(time.Now().Unix(), 10)
+
+	scores := d.rankBuildKitPods(context.TODO(), KubernertesDiscoveryOptions{LeasePrefix: "deploy-agent"}, pods, "")
+	assert.Equal(t, map[string]int{"tcp://10.0.0.1:0": 1}, queried)
+	require.Len(t, scores, 3)
+	assert.Equal(t, []string{"building", "leased"}, []string{scores[0].pod, scores[1].pod})
+	assert.InDelta(t, 0.5, scores[2].freeCacheRatio, 0.001)
+
+	// the stale stats are queried again once the pod is free
+	pods[0].Annotations[metadata.DeployAgentLastBuildEndingTimeLabelKey] = strconv.FormatInt(time.Now().Unix(), 10)
+	d.rankBuildKitPods(context.TODO(), KubernertesDiscoveryOptions{LeasePrefix: "deploy-agent"}, pods, "")
+	assert.Equal(t, map[string]int{"tcp://10.0.0.1:0": 2}, queried)
+}
+
+func TestK8sDiscoverer_PlanLeases(t *testing.T) {
+	fakeClient := fake.NewSimpleClientset(
+		newLoadTestPod("buildkit-0", "node-a", "10.0.0.1", nil),
+		newLoadTestPod("buildkit-1", "node-a", "10.0.0.2", recentBuilds{"app/my-app": time.Now().Unix()}),
+		newLoadTestPod("buildkit-2", "node-a", "10.0.0.3", nil),
+		newLoadTestNode("node-a", ""),
+	)
+
+	d := &K8sDiscoverer{
+		KubernetesInterface: fakeClient,
+		queryStats: fakeQueryStats(map[string]int64{
+			"10.0.0.1": 50,
+			"10.0.0.2": 0,
+			"10.0.0.3": 99,
+		}),
+	}
+
+	owner := &buildOwner{kind: "app", name: "my-app"}
+
+	t.Run("disabled", func(t *testing.T) {
+		schedule, preferred := d.planLeases(context.TODO(), KubernertesDiscoveryOptions{PodSelector: "app=buildkit"}, "tsuru", owner)
+		assert.Nil(t, schedule)
+		assert.Equal(t, "", preferred)
+	})
+
+	t.Run("load aware", func(t *testing.T) {
+		schedule, preferred := d.planLeases(context.TODO(), KubernertesDiscoveryOptions{PodSelector: "app=buildkit", LoadAware: true}, "tsuru", owner)
+		require.NotNil(t, schedule)
+		assert.Equal(t, "", preferred)
+		assert.Equal(t, map[string]time.Duration{
+			"buildkit-1": 0,
+			"buildkit-0": loadRankStep,
+			"buildkit-2": 2*loadRankStep + loadAvoidDelay,
+		}, schedule.delays)
+		assert.Equal(t, 3*loadRankStep, schedule.fallback)
+	})
+
+	t.Run("load aware with cache affinity", func(t *testing.T) {
+		schedule, preferred := d.planLeases(context.TODO(), KubernertesDiscoveryOptions{PodSelector: "app=buildkit", LoadAware: true, AffinityWait: time.Second}, "tsuru", owner)
+		require.NotNil(t, schedule)
+		assert.Equal(t, "buildkit-1", preferred)
+		assert.Equal(t, map[string]time.Duration{
+			"buildkit-1": 0,
+			"buildkit-0": time.Second,
+			"buildkit-2": time.Second + loadRankStep + loadAvoidDelay,
+		}, schedule.delays)
+		assert.Equal(t, time.Second+2*loadRankStep, schedule.fallback)
+	})
+}
+
+func TestLeaseSchedule_Wait(t *testing.T) {
+	var nilSchedule *leaseSchedule
+	assert.Equal(t, time.Duration(0), nilSchedule.wait("buildkit-0"))
+
+	s := &leaseSchedule{
+		start:    time.Now(),
+		delays:   map[string]time.Duration{"buildkit-0": 0, "buildkit-1": time.Minute},
+		fallback: time.Hour,
+	}
+	assert.LessOrEqual(t, s.wait("buildkit-0"), time.Duration(0))
+	assert.InDelta(t, time.Minute, s.wait("buildkit-1"), float64(time.Second))
+	assert.InDelta(t, time.Hour, s.wait("buildkit-2"), float64(time.Second))
+}
+
+func TestK8sDiscoverer_DiscoverLoadAware(t *testing.T) {
+	pods := []*corev1.Pod{
+		newLoadTestPod("buildkit-0", "node-a", "10.0.0.1", nil),
+		newLoadTestPod("buildkit-1", "node-b", "10.0.0.2", nil),
+		newLoadTestPod("buildkit-2", "node-a", "10.0.0.3", nil),
+	}
+
+	fakeClient := fake.NewSimpleClientset(pods[0], pods[1], pods[2], newLoadTestNode("node-a", ""), newLoadTestNode("node-b", corev1.NodeMemoryPressure))
+	fakeClient.PrependWatchReactor("*", func(action kuberntesTesting.Action) (handled bool, ret watch.Interface, err error) {
+		watcher := watch.NewFake()
+
+		go func() {
+			for _, pod := range pods {
+				watcher.Add(pod)
+			}
+		}()
+		return true, watcher, nil
+	})
+
+	discoverer := K8sDiscoverer{
+		KubernetesInterface: fakeClient,
+		DynamicInterface:    fakeDynamic.NewSimpleDynamicClient(runtime.NewScheme()),
+		queryStats: fakeQueryStats(map[string]int64{
+			"10.0.0.1": 70,
+			"10.0.0.2": 0,
+			"10.0.0.3": 10,
+		}),
+	}
+
+	_, cleanup, _, err := discoverer.Discover(context.TODO(), KubernertesDiscoveryOptions{
+		PodSelector: "app=buildkit",
+		Namespace:   "tsuru",
+		Timeout:     5 * time.Second,
+		LoadAware:   true,
+	}, &grpc_build_v1.BuildRequest{App: &grpc_build_v1.TsuruApp{Name: "my-app"}}, os.Stdout)
+	require.NoError(t, err)
+	defer cleanup()
+
+	leasedPod, err := fakeClient.CoreV1().Pods("tsuru").Get(context.TODO(), "buildkit-2", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.InDelta(t, time.Now().Unix(), recentBuildsFromPod(leasedPod)["app/my-app"], 5, "build must run on the pod with most free cache space")
+}
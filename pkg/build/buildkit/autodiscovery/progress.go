@@ -0,0 +1,203 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autodiscovery
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/klog"
+)
+
+// fatalWaitingReasons are the container waiting reasons which won't go away
+// without fixing the statefulset, so waiting for the pod is pointless.
+var fatalWaitingReasons = map[string]bool{
+	"InvalidImageName":           true,
+	"ErrImageNeverPull":          true,
+	"CreateContainerConfigError": true,
+}
+
+// blockingWaitingReasons are the container waiting reasons which hold the
+// pod back, though they may go away by themselves.
+var blockingWaitingReasons = map[string]bool{
+	"ErrImagePull":     true,
+	"ImagePullBackOff": true,
+	"CrashLoopBackOff": true,
+}
+
+// progressUpdate is either a line for the build output or, when err is set,
+// a fatal condition of a followed pod.
+type progressUpdate struct {
+	message string
+	err     error
+}
+
+// podProgress follows the lifecycle of the BuildKit pods coming up after a
+// scale up (scheduled, pulling image, started and ready), besides what's
+// holding them back, so builds don't wait in silence.
+type podProgress struct {
+	pods     map[string]bool
+	reported map[string]bool
+	failFast bool
+}
+
+// followPods streams the progress of the named pods until ctx is done. With
+// failFast, a fatal condition of any pod ends the stream with an error update.
+func (d *K8sDiscoverer) followPods(ctx context.Context, namespace, podSelector string, names []string, failFast bool) (<-chan progressUpdate, error) {
+	podWatcher, err := d.KubernetesInterface.CoreV1().Pods(namespace).Watch(ctx, metav1.ListOptions{
+		LabelSelector: podSelector,
+		Watch:         true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pod watcher: %w", err)
+	}
+
+	eventWatcher, err := d.KubernetesInterface.CoreV1().Events(namespace).Watch(ctx, metav1.ListOptions{
+		FieldSelector: "involvedObject.kind=Pod",
+		Watch:         true,
+	})
+	if err != nil {
+		podWatcher.Stop()
+		return nil, fmt.Errorf("failed to create event watcher: %w", err)
+	}
+
+	p := &podProgress{
+		pods:     make(map[string]bool, len(names)),
+		reported: make(map[string]bool),
+		failFast: failFast,
+	}
+	for _, name := range names {
+		p.pods[name] = true
+	}
+
+	updates := make(chan progressUpdate)
+
+	go func() {
+		defer close(updates)
+		defer podWatcher.Stop()
+		defer eventWatcher.Stop()
+
+		podEvents, events := podWatcher.ResultChan(), eventWatcher.ResultChan()
+		for podEvents != nil || events != nil {
+			var e watch.Event
+			var ok bool
+
+			select {
+			case e, ok = <-podEvents:
+				if !ok {
+					podEvents = nil
+					continue
+				}
+			case e, ok = <-events:
+				if !ok {
+					events = nil
+					continue
+				}
+			case <-ctx.Done():
+				return
+			}
+
+			if e.Type != watch.Added && e.Type != watch.Modified {
+				continue
+			}
+
+			for _, u := range p.updates(e.Object) {
+				select {
+				case updates <- u:
+				case <-ctx.Done():
+					return
+				}
+
+				if u.err != nil {
+					return
+				}
+			}
+		}
+
+		klog.V(4).Infof("Stopped following BuildKit pods %v: watchers closed", names)
+	}()
+
+	return updates, nil
+}
+
+func (p *podProgress) updates(obj any) []progressUpdate {
+	switch o := obj.(type) {
+	case *corev1.Pod:
+		if p.pods[o.Name] {
+			return p.podUpdates(o)
+		}
+	case *corev1.Event:
+		if p.pods[o.InvolvedObject.Name] {
+			return p.eventUpdates(o)
+		}
+	}
+
+	return nil
+}
+
+func (p *podProgress) podUpdates(pod *corev1.Pod) []progressUpdate {
+	var updates []progressUpdate
+
+	for _, c := range pod.Status.Conditions {
+		switch {
+		case c.Type == corev1.PodScheduled && c.Status == corev1.ConditionTrue:
+			updates = p.report(updates, pod.Name, "scheduled", fmt.Sprintf("BuildKit pod %s scheduled on node %s", pod.Name, pod.Spec.NodeName))
+		case c.Type == corev1.PodScheduled && c.Reason == corev1.PodReasonUnschedulable:
+			updates = p.report(updates, pod.Name, "unschedulable", fmt.Sprintf("WARNING: BuildKit pod %s cannot be scheduled: %s", pod.Name, c.Message))
+		}
+	}
+
+	for _, cs := range pod.Status.ContainerStatuses {
+		switch {
+		case cs.State.Waiting != nil && fatalWaitingReasons[cs.State.Waiting.Reason] && p.failFast:
+			return append(updates, progressUpdate{err: fmt.Errorf("BuildKit pod %s cannot start: %s: %s", pod.Name, cs.State.Waiting.Reason, cs.State.Waiting.Message)})
+		case cs.State.Waiting != nil && (fatalWaitingReasons[cs.State.Waiting.Reason] || blockingWaitingReasons[cs.State.Waiting.Reason]):
+			updates = p.report(updates, pod.Name, cs.State.Waiting.Reason, fmt.Sprintf("WARNING: BuildKit pod %s: %s: %s", pod.Name, cs.State.Waiting.Reason, cs.State.Waiting.Message))
+		case cs.State.Running != nil:
+			updates = p.report(updates, pod.Name, "started", fmt.Sprintf("BuildKit pod %s started", pod.Name))
+		}
+	}
+
+	if isPodReady(pod) {
+		updates = p.report(updates, pod.Name, "ready", fmt.Sprintf("BuildKit pod %s is ready", pod.Name))
+	}
+
+	return updates
+}
+
+func (p *podProgress) eventUpdates(event *corev1.Event) []progressUpdate {
+	name := event.InvolvedObject.Name
+	message := strings.TrimSpace(event.Message)
+
+	switch event.Reason {
+	case "Pulling":
+		return p.report(nil, name, "pulling", fmt.Sprintf("BuildKit pod %s: %s", name, message))
+	case "Pulled":
+		return p.report(nil, name, "pulled", fmt.Sprintf("BuildKit pod %s: %s", name, message))
+	case "FailedScheduling":
+		return p.report(nil, name, "unschedulable", fmt.Sprintf("WARNING: BuildKit pod %s cannot be scheduled: %s", name, message))
+	case "Failed", "BackOff":
+		if event.Type == corev1.EventTypeWarning {
+			return p.report(nil, name, event.Reason, fmt.Sprintf("WARNING: BuildKit pod %s: %s", name, message))
+		}
+	}
+
+	return nil
+}
+
+// report appends the message unless the stage was reported for the pod.
+func (p *podProgress) report(updates []progressUpdate, pod, stage, message string) []progressUpdate {
+	key := pod + "/" + stage
+	if p.reported[key] {
+		return updates
+	}
+
+	p.reported[key] = true
+	return append(updates, progressUpdate{message: message})
+}
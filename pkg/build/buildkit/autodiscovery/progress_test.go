@@ -0,0 +1,191 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autodiscovery
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	fakeDynamic "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	kuberntesTesting "k8s.io/client-go/testing"
+	"k8s.io/utils/ptr"
+
+	"github.com/tsuru/deploy-agent/pkg/build/grpc_build_v1"
+)
+
+func newProgressTestPod(stage string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "buildkit-0",
+			Namespace: "tsuru",
+			Labels:    map[string]string{"app": "buildkit"},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodPending},
+	}
+
+	switch stage {
+	case "unschedulable":
+		pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodScheduled, Status: corev1.ConditionFalse, Reason: corev1.PodReasonUnschedulable, Message: "0/3 nodes are available: 3 Insufficient cpu."}}
+	case "scheduled":
+		pod.Spec.NodeName = "node-a"
+		pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodScheduled, Status: corev1.ConditionTrue}}
+	case "backoff", "invalid-image":
+		reason := map[string]string{"backoff": "ImagePullBackOff", "invalid-image": "InvalidImageName"}[stage]
+		pod.Spec.NodeName = "node-a"
+		pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodScheduled, Status: corev1.ConditionTrue}}
+		pod.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: "buildkitd", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: reason, Message: "cannot pull moby/buildkit:nope"}}}}
+	case "started", "ready":
+		pod.Spec.NodeName = "node-a"
+		pod.Status.Phase = corev1.PodRunning
+		pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodScheduled, Status: corev1.ConditionTrue}}
+		pod.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: "buildkitd", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}}}
+		if stage == "ready" {
+			pod.Status.PodIP = "127.0.0.1"
+			pod.Status.Conditions = append(pod.Status.Conditions, corev1.PodCondition{Type: corev1.PodReady, Status: corev1.ConditionTrue})
+		}
+	}
+
+	return pod
+}
+
+func newProgressTestEvent(reason, eventType, message string) *corev1.Event {
+	return &corev1.Event{
+		ObjectMeta:     metav1.ObjectMeta{Name: "buildkit-0." + reason, Namespace: "tsuru"},
+		InvolvedObject: corev1.ObjectReference{Kind: "Pod", Name: "buildkit-0", Namespace: "tsuru"},
+		Reason:         reason,
+		Type:           eventType,
+		Message:        message,
+	}
+}
+
+func TestPodProgress_Updates(t *testing.T) {
+	p := &podProgress{pods: map[string]bool{"buildkit-0": true}, reported: map[string]bool{}}
+
+	var messages []string
+	for _, obj := range []runtime.Object{
+		newProgressTestPod("unschedulable"),
+		newProgressTestEvent("FailedScheduling", corev1.EventTypeWarning, "0/3 nodes are available: 3 Insufficient cpu."),
+		newProgressTestPod("scheduled"),
+		newProgressTestEvent("Pulling", corev1.EventTypeNormal, `Pulling image "moby/buildkit"`),
+		newProgressTestPod("backoff"),
+		newProgressTestEvent("BackOff", corev1.EventTypeWarning, `Back-off pulling image "moby/buildkit"`),
+		newProgressTestEvent("Pulled", corev1.EventTypeNormal, `Successfully pulled image "moby/buildkit"`),
+		newProgressTestPod("started"),
+		newProgressTestPod("ready"),
+		newProgressTestPod("ready"),
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "buildkit-1"}},
+	} {
+		for _, u := range p.updates(obj) {
+			require.NoError(t, u.err)
+			messages = append(messages, u.message)
+		}
+	}
+
+	assert.Equal(t, []string{
+		"WARNING: BuildKit pod buildkit-0 cannot be scheduled: 0/3 nodes are available: 3 Insufficient cpu.",
+		"BuildKit pod buildkit-0 scheduled on node node-a",
+		`BuildKit pod buildkit-0: Pulling image "moby/buildkit"`,
+		"WARNING: BuildKit pod buildkit-0: ImagePullBackOff: cannot pull moby/buildkit:nope",
+		`WARNING: BuildKit pod buildkit-0: Back-off pulling image "moby/buildkit"`,
+		`BuildKit pod buildkit-0: Successfully pulled image "moby/buildkit"`,
+		"BuildKit pod buildkit-0 started",
+		"BuildKit pod buildkit-0 is ready",
+	}, messages)
+
+	t.Run("fatal conditions", func(t *testing.T) {
+		p := &podProgress{pods: map[string]bool{"buildkit-0": true}, reported: map[string]bool{}}
+		updates := p.updates(newProgressTestPod("invalid-image"))
+		require.Len(t, updates, 2)
+		assert.Equal(t, "WARNING: BuildKit pod buildkit-0: InvalidImageName: cannot pull moby/buildkit:nope", updates[1].message, "reported only without fail fast")
+
+		p = &podProgress{pods: map[string]bool{"buildkit-0": true}, reported: map[string]bool{}, failFast: true}
+		updates = p.updates(newProgressTestPod("invalid-image"))
+		require.Len(t, updates, 2)
+		assert.EqualError(t, updates[1].err, "BuildKit pod buildkit-0 cannot start: InvalidImageName: cannot pull moby/buildkit:nope")
+	})
+}
+
+func newProgressTestDiscoverer(pods []*corev1.Pod, events []*corev1.Event) (*K8sDiscoverer, *fake.Clientset) {
+	fakeClient := fake.NewSimpleClientset(&appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "buildkit", Namespace: "tsuru"},
+		Spec:       appsv1.StatefulSetSpec{Replicas: ptr.To(int32(0))},
+	})
+
+	fakeClient.PrependWatchReactor("*", func(action kuberntesTesting.Action) (handled bool, ret watch.Interface, err error) {
+		watcher := watch.NewRaceFreeFake()
+
+		go func() {
+			if action.GetResource().Resource == "events" {
+				for _, e := range events {
+					watcher.Add(e)
+				}
+				return
+			}
+
+			for _, pod := range pods {
+				time.Sleep(50 * time.Millisecond)
+				watcher.Modify(pod)
+			}
+		}()
+		return true, watcher, nil
+	})
+
+	return &K8sDiscoverer{
+		KubernetesInterface: fakeClient,
+		DynamicInterface:    fakeDynamic.NewSimpleDynamicClient(runtime.NewScheme()),
+	}, fakeClient
+}
+
+func TestK8sDiscoverer_DiscoverReportsUpscaleProgress(t *testing.T) {
+	ready := newProgressTestPod("ready")
+	d, fakeClient := newProgressTestDiscoverer(
+		[]*corev1.Pod{newProgressTestPod("scheduled"), newProgressTestPod("started"), ready},
+		[]*corev1.Event{newProgressTestEvent("Pulling", corev1.EventTypeNormal, `Pulling image "moby/buildkit"`)},
+	)
+	_, err := fakeClient.CoreV1().Pods("tsuru").Create(context.TODO(), ready, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	_, cleanup, _, err := d.Discover(context.TODO(), KubernertesDiscoveryOptions{
+		PodSelector: "app=buildkit",
+		Namespace:   "tsuru",
+		Statefulset: "buildkit",
+		Timeout:     5 * time.Second,
+	}, &grpc_build_v1.BuildRequest{App: &grpc_build_v1.TsuruApp{Name: "my-app"}}, &buf)
+	require.NoError(t, err)
+	defer cleanup()
+
+	assert.Contains(t, buf.String(), "There is no buildkits available, scaling to one replica\n")
+	assert.Contains(t, buf.String(), "BuildKit pod buildkit-0 scheduled on node node-a\n")
+	assert.Contains(t, buf.String(), `BuildKit pod buildkit-0: Pulling image "moby/buildkit"`+"\n")
+	assert.Contains(t, buf.String(), "BuildKit pod buildkit-0 started\n")
+}
+
+func TestK8sDiscoverer_DiscoverFailsFastOnFatalConditions(t *testing.T) {
+	d, _ := newProgressTestDiscoverer([]*corev1.Pod{newProgressTestPod("scheduled"), newProgressTestPod("invalid-image")}, nil)
+
+	start := time.Now()
+
+	var buf bytes.Buffer
+	_, _, _, err := d.Discover(context.TODO(), KubernertesDiscoveryOptions{
+		PodSelector: "app=buildkit",
+		Namespace:   "tsuru",
+		Statefulset: "buildkit",
+		Timeout:     time.Minute,
+	}, &grpc_build_v1.BuildRequest{App: &grpc_build_v1.TsuruApp{Name: "my-app"}}, &buf)
+	assert.EqualError(t, err, "BuildKit pod buildkit-0 cannot start: InvalidImageName: cannot pull moby/buildkit:nope")
+	assert.Less(t, time.Since(start), 10*time.Second)
+	assert.Contains(t, buf.String(), "BuildKit pod buildkit-0 scheduled on node node-a\n")
+}
@@ -16,13 +16,14 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/alessio/shellescape"
 	"github.com/containerd/console"
 	"github.com/docker/cli/cli/config"
 	containerregistryauthn "github.com/google/go-containerregistry/pkg/authn"
 	containerregistryname "github.com/google/go-containerregistry/pkg/name"
+	containerregistryv1 "github.com/google/go-containerregistry/pkg/v1"
 	containerregistrygoogle "github.com/google/go-containerregistry/pkg/v1/google"
 	containerregistryremote "github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/moby/buildkit/client"
@@ -34,17 +35,22 @@ import (
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
-	"sigs.k8s.io/yaml"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog"
 
 	"github.com/tsuru/deploy-agent/pkg/build"
 	"github.com/tsuru/deploy-agent/pkg/build/buildkit/autodiscovery"
+	"github.com/tsuru/deploy-agent/pkg/build/buildkit/buildrun"
+	"github.com/tsuru/deploy-agent/pkg/build/buildkit/failure"
 	"github.com/tsuru/deploy-agent/pkg/build/buildkit/metrics"
+	"github.com/tsuru/deploy-agent/pkg/build/buildkit/pool"
+	"github.com/tsuru/deploy-agent/pkg/build/buildkit/routing"
 	"github.com/tsuru/deploy-agent/pkg/build/buildkit/scaler"
 	pb "github.com/tsuru/deploy-agent/pkg/build/grpc_build_v1"
 	repo "github.com/tsuru/deploy-agent/pkg/repository"
-	"github.com/tsuru/deploy-agent/pkg/util"
 )
 
 const defaultBuildKitNamespace = "tsuru-system"
@@ -52,11 +58,16 @@ const defaultBuildKitNamespace = "tsuru-system"
 var _ build.Builder = (*BuildKit)(nil)
 
 type BuildKitOptions struct {
-	RemoteRepository             map[string]repo.Repository
-	TempDir                      string
-	DiscoverBuildKitClientForApp bool
-	DisableCache                 bool
-	DetectCPUArch                bool
+	RemoteRepository       map[string]repo.Repository
+	TempDir                string
+	Routes                 []routing.Rule
+	DiscoverBuildKitClient bool
+	DisableCache           bool
+	DetectCPUArch          bool
+	Retry                  RetryPolicy
+	// RetentionKeepLast is the number of latest versions of the app's (or
+	// job's) images kept after pushing them, see repo.ApplyRetention.
+	RetentionKeepLast int
 }
 
 func getCurrentPlatform() string {
@@ -64,39 +75,170 @@ func getCurrentPlatform() string {
 }
 
 type BuildKit struct {
-	cli    *client.Client
-	k8s    *kubernetes.Clientset
-	dk8s   dynamic.Interface
-	kdopts *autodiscovery.KubernertesDiscoveryOptions
-	opts   BuildKitOptions
-	m      sync.RWMutex
+	cli        *client.Client
+	pool       *pool.Pool
+	discoverer autodiscovery.Discoverer
+	kdopts     *autodiscovery.KubernertesDiscoveryOptions
+	scaler     *scaler.Worker
+	runs       *buildrun.Tracker
+	opts       BuildKitOptions
+	m          sync.RWMutex
 }
 
 func NewBuildKit(c *client.Client, opts BuildKitOptions) *BuildKit {
 	return &BuildKit{cli: c, opts: opts}
 }
 
-func (b *BuildKit) WithKubernetesDiscovery(cs *kubernetes.Clientset, dcs dynamic.Interface, opts autodiscovery.KubernertesDiscoveryOptions) *BuildKit {
-	b.k8s = cs
-	b.dk8s = dcs
+// WithPool makes builds run on the pool's endpoints rather than on the
+// single BuildKit client, unless they are discovered on Kubernetes.
+func (b *BuildKit) WithPool(p *pool.Pool) *BuildKit {
+	b.pool = p
+	p.Start()
+	return b
+}
+
+// WithDiscovery makes builds run on the BuildKit found by the discoverer.
+func (b *BuildKit) WithDiscovery(d autodiscovery.Discoverer, opts autodiscovery.KubernertesDiscoveryOptions) *BuildKit {
+	b.discoverer = d
 	b.kdopts = &opts
+	return b
+}
+
+// WithKubernetesDiscovery makes builds run on the BuildKit pods discovered on
+// Kubernetes, also starting the downscaler of their statefulset if set and
+// tracking builds as Events and BuildRuns if enabled.
+func (b *BuildKit) WithKubernetesDiscovery(cs *kubernetes.Clientset, dcs dynamic.Interface, opts autodiscovery.KubernertesDiscoveryOptions) (*BuildKit, error) {
+	var recorder record.EventRecorder
+	if opts.Statefulset != "" || opts.BuildEvents {
+		recorder = scaler.NewEventRecorder(cs)
+	}
+
+	if opts.BuildEvents || opts.BuildRuns {
+		b.runs = &buildrun.Tracker{DynamicInterface: dcs, BuildRuns: opts.BuildRuns, HistoryLimit: opts.BuildRunsHistoryLimit}
+		if opts.BuildEvents {
+			b.runs.EventRecorder = recorder
+		}
+	}
+
+	b = b.WithDiscovery(&autodiscovery.K8sDiscoverer{
+		KubernetesInterface: cs,
+		DynamicInterface:    dcs,
+		EventRecorder:       recorder,
+	}, opts)
 
 	if opts.Statefulset != "" {
-		scaler.StartWorker(cs, opts.PodSelector, opts.Statefulset, opts.ScaleGracefulPeriod)
+		w, err := scaler.StartWorker(cs, recorder, workerOptions(opts, b.options().Routes))
+		if err != nil {
+			return nil, fmt.Errorf("failed to start downscaler: %w", err)
+		}
+		b.scaler = w
 	}
 
-	return b
+	return b, nil
+}
+
+func workerOptions(opts autodiscovery.KubernertesDiscoveryOptions, routes []routing.Rule) scaler.WorkerOptions {
+	// the discovery namespace is empty when BuildKit runs along with apps
+	leaseNamespace := opts.Namespace
+	if leaseNamespace == "" {
+		leaseNamespace = os.Getenv("POD_NAMESPACE")
+	}
+	if leaseNamespace == "" {
+		leaseNamespace = metav1.NamespaceDefault
+	}
+
+	namespace := opts.Namespace
+	if opts.UseSameNamespaceAsApp {
+		namespace = ""
+	}
+
+	var targets []scaler.Target
+	for _, r := range routes {
+		if r.Target.IsDiscovery() {
+			targets = append(targets, scaler.Target{Namespace: r.Target.Namespace, PodSelector: r.Target.PodSelector})
+		}
+	}
+
+	return scaler.WorkerOptions{
+		PodSelector:    opts.PodSelector,
+		Namespace:      namespace,
+		Targets:        targets,
+		StatefulSet:    opts.Statefulset,
+		GracefulPeriod: opts.ScaleGracefulPeriod,
+		MaxReplicas:    opts.ScaleMaxReplicas,
+		Interval:       opts.ScaleInterval,
+		Windows:        opts.ScaleWindows,
+		LeaseNamespace: leaseNamespace,
+		LeaseName:      fmt.Sprintf("%s-downscaler", strings.TrimRight(opts.LeasePrefix, "-")),
+		LeasePrefix:    opts.LeasePrefix,
+	}
+}
+
+// Reload applies the settings which are safe to change while builds are
+// running: remote repositories (and their retention), cache policy, routes,
+// BuildKit's pod selector, discovery timeout, affinity wait, load awareness,
+// lease timings and scaler settings (graceful period, max replicas, scale out
+// threshold, interval and windows).
+// Builds already in progress keep the settings they started with.
+func (b *BuildKit) Reload(opts BuildKitOptions, kdopts autodiscovery.KubernertesDiscoveryOptions) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.opts.RemoteRepository = opts.RemoteRepository
+	b.opts.RetentionKeepLast = opts.RetentionKeepLast
+	b.opts.DisableCache = opts.DisableCache
+	b.opts.Routes = opts.Routes
+
+	if b.kdopts == nil {
+		return
+	}
+
+	nkdopts := *b.kdopts
+	nkdopts.PodSelector = kdopts.PodSelector
+	nkdopts.Timeout = kdopts.Timeout
+	nkdopts.AffinityWait = kdopts.AffinityWait
+	nkdopts.LoadAware = kdopts.LoadAware
+	nkdopts.LeaseDuration = kdopts.LeaseDuration
+	nkdopts.LeaseRenewDeadline = kdopts.LeaseRenewDeadline
+	nkdopts.LeaseRetryPeriod = kdopts.LeaseRetryPeriod
+	nkdopts.AbortOnLeaseLoss = kdopts.AbortOnLeaseLoss
+	nkdopts.ScaleGracefulPeriod = kdopts.ScaleGracefulPeriod
+	nkdopts.ScaleMaxReplicas = kdopts.ScaleMaxReplicas
+	nkdopts.ScaleOutThreshold = kdopts.ScaleOutThreshold
+	nkdopts.ScaleInterval = kdopts.ScaleInterval
+	nkdopts.ScaleWindows = kdopts.ScaleWindows
+	b.kdopts = &nkdopts
+
+	if b.scaler != nil {
+		b.scaler.Update(workerOptions(nkdopts, opts.Routes))
+	}
+}
+
+func (b *BuildKit) options() BuildKitOptions {
+	b.m.RLock()
+	defer b.m.RUnlock()
+
+	return b.opts
 }
 
 func (b *BuildKit) Close() error {
 	b.m.Lock()
 	defer b.m.Unlock()
 
-	if b.cli == nil {
-		return nil
+	var errs []error
+	if b.scaler != nil {
+		b.scaler.Stop()
 	}
 
-	return b.cli.Close()
+	if b.pool != nil {
+		errs = append(errs, b.pool.Close())
+	}
+
+	if b.cli != nil {
+		errs = append(errs, b.cli.Close())
+	}
+
+	return errors.Join(errs...)
 }
 
 func (b *BuildKit) Build(ctx context.Context, r *pb.BuildRequest, w io.Writer) (*pb.TsuruConfig, error) {
@@ -109,47 +251,113 @@ func (b *BuildKit) Build(ctx context.Context, r *pb.BuildRequest, w io.Writer) (
 		return nil, errors.New("writer must implement console.File")
 	}
 
-	c, clientCleanUp, buildkitNamespace, err := b.client(ctx, r, w)
+	run := b.runs.Start(ctx, r)
+	o := newBuildObserver(r)
+	finish := func(err error) {
+		o.done(err)
+		run.Finish(err)
+	}
+
+	if b.pool != nil && routing.Route(b.options().Routes, r) == nil && !b.shouldDiscover(r) {
+		o.discovered(defaultBuildKitNamespace)
+		run.Running()
+		tc, err := b.buildOnPool(ctx, o, r, ow)
+		if err == nil {
+			b.applyRetention(ctx, r, ow)
+		}
+		finish(err)
+		return tc, failure.Classify(err)
+	}
+
+	bk, err := newConn(ctx, func(ctx context.Context, abort context.CancelCauseFunc) (*client.Client, clientCleanUp, string, error) {
+		return b.client(ctx, abort, run, r, w)
+	})
 	if err != nil {
-		return nil, err
+		finish(err)
+		return nil, failure.Classify(failure.BuildKitUnavailable(err))
 	}
+	defer bk.close()
 
-	if clientCleanUp != nil {
-		defer clientCleanUp()
+	o.discovered(bk.namespace)
+	run.Running()
+
+	tc, err := b.build(ctx, bk, o, r, ow)
+	if cause := bk.cause(err); cause != err {
+		err = cause
+		tc = nil
+	}
+
+	if err == nil {
+		b.applyRetention(ctx, r, ow)
+	}
+
+	finish(err)
+	return tc, failure.Classify(err)
+}
+
+// buildOnPool runs the build on the pool's endpoint with the least active
+// builds. Whenever the endpoint cannot be reached before the solve starts,
+// solve ejects it from the pool and fails over to another endpoint.
+func (b *BuildKit) buildOnPool(ctx context.Context, o *buildObserver, r *pb.BuildRequest, w console.File) (*pb.TsuruConfig, error) {
+	bk, err := poolConn(ctx, b.pool)
+	if err != nil {
+		return nil, failure.BuildKitUnavailable(err)
 	}
+	defer bk.close()
+
+	return b.build(ctx, bk, o, r, w)
+}
 
+func (b *BuildKit) build(ctx context.Context, bk *conn, o *buildObserver, r *pb.BuildRequest, ow console.File) (*pb.TsuruConfig, error) {
+	buildkitNamespace := o.namespace
 	startTime := time.Now()
-	metrics.BuildsActive.WithLabelValues(buildkitNamespace).Inc()
+	metrics.Builds.AddActive(buildkitNamespace, 1)
 	defer func() {
 		metrics.BuildDuration.WithLabelValues(buildkitNamespace).Observe(time.Since(startTime).Seconds())
-		metrics.BuildsActive.WithLabelValues(buildkitNamespace).Dec()
+		metrics.Builds.AddActive(buildkitNamespace, -1)
 	}()
 	buildKind := pb.BuildKind_name[int32(r.Kind)]
 	metrics.BuildsTotal.WithLabelValues(buildkitNamespace, buildKind).Inc()
+	if len(r.Data) > 0 {
+		metrics.BuildContextBytes.WithLabelValues(buildKind, o.team).Observe(float64(len(r.Data)))
+	}
+
+	o.prepare()
+
 	switch buildKind {
 	case "BUILD_KIND_APP_BUILD_WITH_SOURCE_UPLOAD":
-		return b.buildFromAppSourceFiles(ctx, c, r, ow)
+		return b.buildFromAppSourceFiles(ctx, bk, o, r, ow)
 
 	case "BUILD_KIND_APP_BUILD_WITH_CONTAINER_IMAGE":
-		return b.buildFromContainerImage(ctx, c, r, ow)
+		return b.buildFromContainerImage(ctx, bk, o, r, ow)
 
 	case "BUILD_KIND_JOB_CREATE_WITH_CONTAINER_IMAGE":
-		return b.buildFromContainerImage(ctx, c, r, ow)
+		return b.buildFromContainerImage(ctx, bk, o, r, ow)
 
 	case "BUILD_KIND_APP_BUILD_WITH_CONTAINER_FILE":
-		return b.buildFromContainerFile(ctx, c, r, ow)
+		return b.buildFromContainerFile(ctx, bk, o, r, ow)
 
 	case "BUILD_KIND_JOB_DEPLOY_WITH_CONTAINER_FILE":
-		return b.buildFromContainerFile(ctx, c, r, ow)
+		return b.buildFromContainerFile(ctx, bk, o, r, ow)
 
 	case "BUILD_KIND_PLATFORM_WITH_CONTAINER_FILE":
-		return nil, b.buildPlatform(ctx, c, r, ow)
+		return nil, b.buildPlatform(ctx, bk, o, r, ow)
 	default:
 		return nil, status.Errorf(codes.Unimplemented, "build kind not supported")
 	}
 }
 
-func (b *BuildKit) buildFromAppSourceFiles(ctx context.Context, c *client.Client, r *pb.BuildRequest, w console.File) (*pb.TsuruConfig, error) {
+// endpointUnavailableError means BuildKit could not be reached before the
+// solve started, so the build can safely run somewhere else.
+type endpointUnavailableError struct {
+	err error
+}
+
+func (e *endpointUnavailableError) Error() string { return e.err.Error() }
+
+func (e *endpointUnavailableError) Unwrap() error { return e.err }
+
+func (b *BuildKit) buildFromAppSourceFiles(ctx context.Context, bk *conn, o *buildObserver, r *pb.BuildRequest, w console.File) (*pb.TsuruConfig, error) {
 	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
@@ -160,7 +368,7 @@ func (b *BuildKit) buildFromAppSourceFiles(ctx context.Context, c *client.Client
 	}
 
 	var dockerfile bytes.Buffer
-	tsuruYAML, err := parseTsuruYaml(appFiles.TsuruYaml)
+	tsuruYAML, err := build.ParseTsuruYaml(appFiles.TsuruYaml)
 	if err != nil {
 		return nil, err
 	}
@@ -174,20 +382,20 @@ func (b *BuildKit) buildFromAppSourceFiles(ctx context.Context, c *client.Client
 		envs = r.App.EnvVars
 	}
 
-	tmpDir, cleanFunc, err := generateBuildLocalDir(ctx, b.opts.TempDir, dockerfile.String(), bytes.NewBuffer(r.Data), envs, nil)
+	tmpDir, cleanFunc, err := build.GenerateBuildLocalDir(ctx, b.options().TempDir, dockerfile.String(), bytes.NewBuffer(r.Data), envs, nil)
 	if err != nil {
 		return nil, err
 	}
 	defer cleanFunc()
 
-	if b.opts.RemoteRepository != nil {
+	if b.options().RemoteRepository != nil {
 		err = b.createRemoteRepository(ctx, r)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	if err = b.callBuildKitBuild(ctx, c, tmpDir, r, w); err != nil {
+	if err = b.solve(bk, o, tmpDir, r, w); err != nil {
 		return nil, err
 	}
 
@@ -195,8 +403,9 @@ func (b *BuildKit) buildFromAppSourceFiles(ctx context.Context, c *client.Client
 	// So we need to retrieve the default Procfile from the platform image.
 	if appFiles.Procfile == "" && len(tsuruYAML.Processes) == 0 {
 		fmt.Fprintln(w, "User-defined Procfile/Tsuru YAML Processes not found, trying to extract it from platform's container image")
+		defer o.phase(phaseExtract)()
 
-		tc, err := b.extractTsuruConfigsFromContainerImage(ctx, c, r.DestinationImages[0], build.DefaultTsuruPlatformWorkingDir)
+		tc, err := b.extractTsuruConfigsFromContainerImage(ctx, bk, r.DestinationImages[0], build.DefaultTsuruPlatformWorkingDir)
 		if err != nil {
 			return nil, err
 		}
@@ -207,17 +416,6 @@ func (b *BuildKit) buildFromAppSourceFiles(ctx context.Context, c *client.Client
 	return appFiles, nil
 }
 
-func parseTsuruYaml(tsuruYAMLContent string) (build.TsuruYamlData, error) {
-	var tsuruYAML build.TsuruYamlData
-	if strings.TrimSpace(tsuruYAMLContent) == "" {
-		return build.TsuruYamlData{}, nil
-	}
-	if err := yaml.Unmarshal([]byte(tsuruYAMLContent), &tsuruYAML); err != nil {
-		return build.TsuruYamlData{}, err
-	}
-	return tsuruYAML, nil
-}
-
 func generateContainerfile(w io.Writer, image string, tsuruYamlHooks *build.TsuruYamlHooks) error {
 	var buildHooks []string
 	if tsuruYamlHooks != nil {
@@ -236,47 +434,30 @@ func generateContainerfile(w io.Writer, image string, tsuruYamlHooks *build.Tsur
 	return err
 }
 
-func findAndReadTsuruYaml(tmpDir string) (string, error) {
-	contextDir := filepath.Join(tmpDir, "context")
-
-	// Try all possible Tsuru YAML filenames
-	for _, filename := range build.TsuruYamlNames {
-		tsuruYamlPath := filepath.Join(contextDir, filename)
-		if _, err := os.Stat(tsuruYamlPath); err == nil {
-			tsuruYamlData, err := os.ReadFile(tsuruYamlPath)
-			if err != nil {
-				return "", fmt.Errorf("failed to read %s: %w", filename, err)
-			}
-			return string(tsuruYamlData), nil
-		}
-	}
-
-	// No Tsuru YAML file found, return empty string (not an error)
-	return "", nil
-}
-
-func (b *BuildKit) buildFromContainerImage(ctx context.Context, c *client.Client, r *pb.BuildRequest, w console.File) (*pb.TsuruConfig, error) {
+func (b *BuildKit) buildFromContainerImage(ctx context.Context, bk *conn, o *buildObserver, r *pb.BuildRequest, w console.File) (*pb.TsuruConfig, error) {
 	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
 
-	tmpDir, cleanFunc, err := generateBuildLocalDir(ctx, b.opts.TempDir, fmt.Sprintf("FROM %s", r.SourceImage), nil, nil, nil)
+	tmpDir, cleanFunc, err := build.GenerateBuildLocalDir(ctx, b.options().TempDir, fmt.Sprintf("FROM %s", r.SourceImage), nil, nil, nil)
 	if err != nil {
 		return nil, err
 	}
 	defer cleanFunc()
 
-	if b.opts.RemoteRepository != nil {
+	if b.options().RemoteRepository != nil {
 		err = b.createRemoteRepository(ctx, r)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	if err = b.callBuildKitBuild(ctx, c, tmpDir, r, w); err != nil {
+	if err = b.solve(bk, o, tmpDir, r, w); err != nil {
 		return nil, err
 	}
 
+	defer o.phase(phaseExtract)()
+
 	var insecureRegistry bool
 	if r.PushOptions != nil {
 		insecureRegistry = r.PushOptions.InsecureRegistry
@@ -287,7 +468,7 @@ func (b *BuildKit) buildFromContainerImage(ctx context.Context, c *client.Client
 		return nil, err
 	}
 
-	appFiles, err := callBuildKitToExtractTsuruConfigs(ctx, c, tmpDir, imageConfig.WorkingDir)
+	appFiles, err := callBuildKitToExtractTsuruConfigs(bk.ctx, bk.client, tmpDir, imageConfig.WorkingDir)
 	if err != nil {
 		return nil, err
 	}
@@ -296,33 +477,34 @@ func (b *BuildKit) buildFromContainerImage(ctx context.Context, c *client.Client
 	return appFiles, nil
 }
 
-func (b *BuildKit) extractTsuruConfigsFromContainerImage(ctx context.Context, c *client.Client, image, workingDir string) (*pb.TsuruConfig, error) {
-	tmpDir, cleanFunc, err := generateBuildLocalDir(ctx, b.opts.TempDir, fmt.Sprintf("FROM %s", image), nil, nil, nil)
+func (b *BuildKit) extractTsuruConfigsFromContainerImage(ctx context.Context, bk *conn, image, workingDir string) (*pb.TsuruConfig, error) {
+	tmpDir, cleanFunc, err := build.GenerateBuildLocalDir(ctx, b.options().TempDir, fmt.Sprintf("FROM %s", image), nil, nil, nil)
 	if err != nil {
 		return nil, err
 	}
 	defer cleanFunc()
 
-	return callBuildKitToExtractTsuruConfigs(ctx, c, tmpDir, workingDir)
+	return callBuildKitToExtractTsuruConfigs(bk.ctx, bk.client, tmpDir, workingDir)
 }
 
 func (b *BuildKit) createRemoteRepository(ctx context.Context, r *pb.BuildRequest) error {
-	for _, v := range r.DestinationImages {
-		if provider, ok := b.opts.RemoteRepository[build.GetRegistry(v)]; ok {
-			err := provider.Ensure(ctx, v)
-			if err != nil {
-				return err
-			}
-		}
-	}
-	return nil
+	return repo.EnsureImages(ctx, b.options().RemoteRepository, r.DestinationImages)
 }
 
-func extractContainerImageConfigFromImageManifest(ctx context.Context, imageStr string, insecureRegistry bool) (*pb.ContainerImageConfig, error) {
-	if err := ctx.Err(); err != nil {
-		return nil, err
+// applyRetention deletes the old versions of the app's (or job's) images
+// once pushed. Failing to do so doesn't fail the build.
+func (b *BuildKit) applyRetention(ctx context.Context, r *pb.BuildRequest, w io.Writer) {
+	opts := b.options()
+	if opts.RemoteRepository == nil || opts.RetentionKeepLast <= 0 || (r.App == nil && r.Job == nil) || r.GetPushOptions().GetDisable() {
+		return
 	}
 
+	if err := repo.ApplyRetention(ctx, opts.RemoteRepository, r.DestinationImages, r.ImagesInUse, opts.RetentionKeepLast); err != nil {
+		fmt.Fprintf(w, "Warning: Failed to apply the retention policy: %v\n", err)
+	}
+}
+
+func remoteImage(ctx context.Context, imageStr string, insecureRegistry bool) (containerregistryv1.Image, error) {
 	var nameOpts []containerregistryname.Option
 	if insecureRegistry {
 		nameOpts = append(nameOpts, containerregistryname.Insecure)
@@ -338,111 +520,54 @@ func extractContainerImageConfigFromImageManifest(ctx context.Context, imageStr
 		containerregistryremote.WithAuthFromKeychain(containerregistryauthn.NewMultiKeychain(containerregistryauthn.DefaultKeychain, containerregistrygoogle.Keychain)),
 	}
 
-	image, err := containerregistryremote.Image(ref, remoteOpts...)
+	return containerregistryremote.Image(ref, remoteOpts...)
+}
+
+// imageSize returns the size of the image in the registry, which is the sum
+// of its compressed layers and config.
+func imageSize(ctx context.Context, imageStr string, insecureRegistry bool) (int64, error) {
+	image, err := remoteImage(ctx, imageStr, insecureRegistry)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	cf, err := image.ConfigFile()
+	manifest, err := image.Manifest()
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	return &pb.ContainerImageConfig{
-		Entrypoint:   cf.Config.Entrypoint,
-		Cmd:          cf.Config.Cmd,
-		WorkingDir:   cf.Config.WorkingDir,
-		ExposedPorts: build.SortExposedPorts(cf.Config.ExposedPorts),
-	}, nil
-}
+	size := manifest.Config.Size
+	for _, layer := range manifest.Layers {
+		size += layer.Size
+	}
 
-func generateBuildLocalDir(ctx context.Context, baseDir, dockerfile string, appArchiveData io.Reader, envs map[string]string, files io.Reader) (string, func(), error) {
-	noopFunc := func() {}
+	return size, nil
+}
 
+func extractContainerImageConfigFromImageManifest(ctx context.Context, imageStr string, insecureRegistry bool) (*pb.ContainerImageConfig, error) {
 	if err := ctx.Err(); err != nil {
-		return "", noopFunc, err
+		return nil, err
 	}
 
-	// Layout design
-	//
-	// ./                       # Root dir
-	//   Dockerfile
-	//   secrets/
-	//     envs.sh              # Tsuru app's env vars
-	//   context/
-	//     application.tar.gz   # Tsuru app's deploy data
-	//     ...
-	//     [other files]
-
-	rootDir, err := os.MkdirTemp(baseDir, "deploy-agent-*")
+	image, err := remoteImage(ctx, imageStr, insecureRegistry)
 	if err != nil {
-		return "", noopFunc, status.Errorf(codes.Internal, "failed to create temp dir: %s", err)
-	}
-
-	contextDir := filepath.Join(rootDir, "context")
-	if err = os.Mkdir(contextDir, 0o755); err != nil {
-		return "", noopFunc, err
-	}
-
-	secretsDir := filepath.Join(rootDir, "secrets")
-	if err = os.Mkdir(secretsDir, 0o700); err != nil {
-		return "", noopFunc, err
+		return nil, err
 	}
 
-	eg, nctx := errgroup.WithContext(ctx)
-
-	eg.Go(func() error {
-		d, nerr := os.Create(filepath.Join(rootDir, "Dockerfile"))
-		if nerr != nil {
-			return status.Errorf(codes.Internal, "cannot create Dockerfile in %s: %s", rootDir, nerr)
-		}
-		defer d.Close()
-		_, nerr = io.WriteString(d, dockerfile)
-		return nerr
-	})
-
-	eg.Go(func() error {
-		if appArchiveData == nil { // there's no application.tar.gz file, skipping it
-			return nil
-		}
-		appArchive, nerr := os.Create(filepath.Join(contextDir, "application.tar.gz"))
-		if nerr != nil {
-			return status.Errorf(codes.Internal, "cannot create application archive: %s", nerr)
-		}
-		defer appArchive.Close()
-		_, nerr = io.Copy(appArchive, appArchiveData)
-		return nerr
-	})
-
-	eg.Go(func() error {
-		envsFile, nerr := os.Create(filepath.Join(secretsDir, "envs.sh"))
-		if nerr != nil {
-			return nerr
-		}
-		defer envsFile.Close()
-		fmt.Fprintln(envsFile, "# File containing the env vars of Tsuru app. Generated by deploy-agent.")
-		for k, v := range envs {
-			fmt.Fprintf(envsFile, "export %s=%s\n", k, shellescape.Quote(v))
-		}
-		return nil
-	})
-
-	eg.Go(func() error {
-		if files == nil {
-			return nil
-		}
-
-		return util.ExtractGZIPFileToDir(nctx, files, contextDir)
-	})
-
-	if err = eg.Wait(); err != nil {
-		return "", noopFunc, err
+	cf, err := image.ConfigFile()
+	if err != nil {
+		return nil, err
 	}
 
-	return rootDir, func() { os.RemoveAll(rootDir) }, nil
+	return &pb.ContainerImageConfig{
+		Entrypoint:   cf.Config.Entrypoint,
+		Cmd:          cf.Config.Cmd,
+		WorkingDir:   cf.Config.WorkingDir,
+		ExposedPorts: build.SortExposedPorts(cf.Config.ExposedPorts),
+	}, nil
 }
 
-func (b *BuildKit) buildFromContainerFile(ctx context.Context, c *client.Client, r *pb.BuildRequest, w console.File) (*pb.TsuruConfig, error) {
+func (b *BuildKit) buildFromContainerFile(ctx context.Context, bk *conn, o *buildObserver, r *pb.BuildRequest, w console.File) (*pb.TsuruConfig, error) {
 	var files io.Reader
 	if len(r.Data) > 0 {
 		files = bytes.NewReader(r.Data)
@@ -455,23 +580,25 @@ func (b *BuildKit) buildFromContainerFile(ctx context.Context, c *client.Client,
 		envVars = r.Job.EnvVars
 	}
 
-	tmpDir, cleanFunc, err := generateBuildLocalDir(ctx, b.opts.TempDir, r.Containerfile, nil, envVars, files)
+	tmpDir, cleanFunc, err := build.GenerateBuildLocalDir(ctx, b.options().TempDir, r.Containerfile, nil, envVars, files)
 	if err != nil {
 		return nil, err
 	}
 	defer cleanFunc()
 
-	if b.opts.RemoteRepository != nil {
+	if b.options().RemoteRepository != nil {
 		err = b.createRemoteRepository(ctx, r)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	if err = b.callBuildKitBuild(ctx, c, tmpDir, r, w); err != nil {
+	if err = b.solve(bk, o, tmpDir, r, w); err != nil {
 		return nil, err
 	}
 
+	defer o.phase(phaseExtract)()
+
 	var insecureRegistry bool
 	if r.PushOptions != nil {
 		insecureRegistry = r.PushOptions.InsecureRegistry
@@ -482,13 +609,13 @@ func (b *BuildKit) buildFromContainerFile(ctx context.Context, c *client.Client,
 		return nil, err
 	}
 
-	tc, err := b.extractTsuruConfigsFromContainerImage(ctx, c, r.DestinationImages[0], ic.WorkingDir)
+	tc, err := b.extractTsuruConfigsFromContainerImage(ctx, bk, r.DestinationImages[0], ic.WorkingDir)
 	if err != nil {
 		return nil, err
 	}
 
 	if tc.TsuruYaml == "" {
-		tsuruYamlData, err := findAndReadTsuruYaml(tmpDir)
+		tsuruYamlData, err := build.FindAndReadTsuruYaml(tmpDir)
 		if err != nil {
 			return nil, err
 		}
@@ -502,24 +629,26 @@ func (b *BuildKit) buildFromContainerFile(ctx context.Context, c *client.Client,
 	return tc, nil
 }
 
-func (b *BuildKit) buildPlatform(ctx context.Context, c *client.Client, r *pb.BuildRequest, w console.File) error {
-	tmpDir, cleanFunc, err := generateBuildLocalDir(ctx, b.opts.TempDir, r.Containerfile, nil, nil, nil)
+func (b *BuildKit) buildPlatform(ctx context.Context, bk *conn, o *buildObserver, r *pb.BuildRequest, w console.File) error {
+	tmpDir, cleanFunc, err := build.GenerateBuildLocalDir(ctx, b.options().TempDir, r.Containerfile, nil, nil, nil)
 	if err != nil {
 		return err
 	}
 	defer cleanFunc()
-	if b.opts.RemoteRepository != nil {
+	if b.options().RemoteRepository != nil {
 		err = b.createRemoteRepository(ctx, r)
 		if err != nil {
 			return err
 		}
 	}
-	return b.callBuildKitBuild(ctx, c, tmpDir, r, w)
+	return b.solve(bk, o, tmpDir, r, w)
 }
 
-func (b *BuildKit) callBuildKitBuild(ctx context.Context, c *client.Client, buildContextDir string, r *pb.BuildRequest, w console.File) error {
+func (b *BuildKit) callBuildKitBuild(ctx context.Context, c *client.Client, o *buildObserver, buildContextDir string, r *pb.BuildRequest, w console.File) error {
+	bopts := b.options()
+
 	// Force prune when cache is disabled
-	if b.opts.DisableCache {
+	if bopts.DisableCache {
 		fmt.Fprintln(w, "Cache disabled, performing remote prune before build...")
 		if err := c.Prune(ctx, nil, client.PruneAll); err != nil {
 			fmt.Fprintf(w, "Warning: Failed to prune remote cache: %v\n", err)
@@ -551,28 +680,45 @@ func (b *BuildKit) callBuildKitBuild(ctx context.Context, c *client.Client, buil
 		return err
 	}
 
+	var insecureRegistry bool // disabled by default
+	var pushImage bool = true // enabled by default
+
+	if pots := r.PushOptions; pots != nil {
+		pushImage = !pots.Disable
+		insecureRegistry = pots.InsecureRegistry
+	}
+
+	// solveStarted tells whether BuildKit has reported any progress, which
+	// means it was reachable and the build cannot be moved elsewhere.
+	var solveStarted atomic.Bool
+	statusCh := make(chan *client.SolveStatus)
+	printerCh := progresswriter.ResetTime(pw).Status()
+
+	solved := o.solve()
 	eg, nctx := errgroup.WithContext(ctx)
 
 	eg.Go(func() error {
-		var insecureRegistry bool // disabled by default
-		var pushImage bool = true // enabled by default
-
-		if pots := r.PushOptions; pots != nil {
-			pushImage = !pots.Disable
-			insecureRegistry = pots.InsecureRegistry
+		defer close(printerCh)
+		for s := range statusCh {
+			solveStarted.Store(true)
+			o.observeStatus(s)
+			printerCh <- s
 		}
+		return nil
+	})
 
+	eg.Go(func() error {
 		frontendAttrs := map[string]string{
 			// NOTE: we should always run the deploy's script command as user might
 			// need to regenerate assets, for example.
 			"build-arg:tsuru_deploy_cache": strconv.FormatInt(time.Now().Unix(), 10),
 		}
 
-		if b.opts.DisableCache {
+		if bopts.DisableCache {
 			frontendAttrs["no-cache"] = ""
 		}
 
-		if b.opts.DetectCPUArch {
+		if bopts.DetectCPUArch {
 			frontendAttrs["platform"] = getCurrentPlatform()
 		}
 
@@ -604,7 +750,7 @@ func (b *BuildKit) callBuildKitBuild(ctx context.Context, c *client.Client, buil
 				Frontend:    opts.Frontend,
 				FrontendOpt: opts.FrontendAttrs,
 			})
-		}, progresswriter.ResetTime(pw).Status())
+		}, statusCh)
 		return err
 	})
 
@@ -613,7 +759,50 @@ func (b *BuildKit) callBuildKitBuild(ctx context.Context, c *client.Client, buil
 		return pw.Err()
 	})
 
-	return eg.Wait()
+	err = eg.Wait()
+	solved()
+
+	// BuildKit passes along the failures of registries and frontends, so it's
+	// only unavailable when it fails its health check as well
+	if err != nil && ctx.Err() == nil && unreachable(c) {
+		err = failure.BuildKitUnavailable(err)
+		if !solveStarted.Load() {
+			return &endpointUnavailableError{err: err}
+		}
+	}
+
+	if err == nil && pushImage && len(r.DestinationImages) > 0 {
+		// it's only a metric, so the build doesn't wait for the registry
+		go observeImageSize(context.WithoutCancel(ctx), r.DestinationImages[0], insecureRegistry, o)
+	}
+
+	return err
+}
+
+// imageSizeTimeout bounds the lookup of a pushed image's size.
+const imageSizeTimeout = 30 * time.Second
+
+// observeImageSize records the size of the pushed image, looked up in its
+// registry.
+func observeImageSize(ctx context.Context, image string, insecureRegistry bool, o *buildObserver) {
+	ctx, cancel := context.WithTimeout(ctx, imageSizeTimeout)
+	defer cancel()
+
+	size, err := imageSize(ctx, image, insecureRegistry)
+	if err != nil {
+		klog.Warningf("Failed to get the size of image %s: %s", image, err)
+		return
+	}
+
+	metrics.BuildPushedImageBytes.WithLabelValues(o.kind, o.team).Observe(float64(size))
+}
+
+// unreachable tells whether the c client's BuildKit cannot run builds.
+func unreachable(c *client.Client) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), pool.DefaultHealthCheckTimeout)
+	defer cancel()
+
+	return pool.Check(ctx, c) != nil
 }
 
 func callBuildKitToExtractTsuruConfigs(ctx context.Context, c *client.Client, localContextDir, workingDir string) (*pb.TsuruConfig, error) {
@@ -664,16 +853,60 @@ func callBuildKitToExtractTsuruConfigs(ctx context.Context, c *client.Client, lo
 
 type clientCleanUp func()
 
-func (b *BuildKit) client(ctx context.Context, req *pb.BuildRequest, w io.Writer) (*client.Client, clientCleanUp, string, error) {
-	isBuildForApp := strings.HasPrefix(pb.BuildKind_name[int32(req.Kind)], "BUILD_KIND_APP_")
+func (b *BuildKit) shouldDiscover(req *pb.BuildRequest) bool {
+	return b.options().DiscoverBuildKitClient && (req.App != nil || req.Job != nil || req.Platform != nil)
+}
 
-	if isBuildForApp && b.opts.DiscoverBuildKitClientForApp {
-		d := &autodiscovery.K8sDiscoverer{
-			KubernetesInterface: b.k8s,
-			DynamicInterface:    b.dk8s,
-		}
-		return d.Discover(ctx, *b.kdopts, req, w)
+// client returns the BuildKit client to run the build. Discovered clients
+// call abort if the build must stop since the lease on its pod was lost, and
+// record their pod in run.
+func (b *BuildKit) client(ctx context.Context, abort context.CancelCauseFunc, run *buildrun.Run, req *pb.BuildRequest, w io.Writer) (*client.Client, clientCleanUp, string, error) {
+	b.m.RLock()
+	kdopts, routes := b.kdopts, b.opts.Routes
+	b.m.RUnlock()
+
+	if rule := routing.Route(routes, req); rule != nil {
+		return b.routedClient(ctx, abort, run, rule, kdopts, req, w)
+	}
+
+	if b.shouldDiscover(req) {
+		opts := *kdopts
+		opts.OnLeaseLost = abort
+		opts.OnPodLeased = run.PodLeased
+		return b.discoverer.Discover(ctx, opts, req, w)
 	}
 
 	return b.cli, func() {}, defaultBuildKitNamespace, nil
 }
+
+func (b *BuildKit) routedClient(ctx context.Context, abort context.CancelCauseFunc, run *buildrun.Run, rule *routing.Rule, kdopts *autodiscovery.KubernertesDiscoveryOptions, req *pb.BuildRequest, w io.Writer) (*client.Client, clientCleanUp, string, error) {
+	klog.V(4).Infof("Build matches route %q, using its BuildKit target", rule.Name)
+
+	if !rule.Target.IsDiscovery() {
+		c, err := client.New(ctx, rule.Target.Address, client.WithFailFast())
+		if err != nil {
+			return nil, nil, "", fmt.Errorf("failed to create buildkit client for route %q: %w", rule.Name, err)
+		}
+
+		ns := rule.Target.Namespace
+		if ns == "" {
+			ns = defaultBuildKitNamespace
+		}
+
+		return c, func() { c.Close() }, ns, nil
+	}
+
+	if _, ok := b.discoverer.(*autodiscovery.K8sDiscoverer); !ok || kdopts == nil {
+		return nil, nil, "", fmt.Errorf("route %q requires BuildKit discovery on Kubernetes", rule.Name)
+	}
+
+	opts := *kdopts
+	opts.PodSelector = rule.Target.PodSelector
+	opts.Namespace = rule.Target.Namespace
+	opts.UseSameNamespaceAsApp = false
+	opts.Statefulset = "" // the scaler only handles the default BuildKit
+	opts.OnLeaseLost = abort
+	opts.OnPodLeased = run.PodLeased
+
+	return b.discoverer.Discover(ctx, opts, req, w)
+}
@@ -14,6 +14,7 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	dockertypes "github.com/docker/docker/api/types"
 	dockertypescontainer "github.com/docker/docker/api/types/container"
@@ -21,10 +22,17 @@ import (
 	dockerclient "github.com/docker/docker/client"
 	dockerstdcopy "github.com/docker/docker/pkg/stdcopy"
 	"github.com/moby/buildkit/client"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	. "github.com/tsuru/deploy-agent/pkg/build/buildkit"
+	"github.com/tsuru/deploy-agent/pkg/build/buildkit/metrics"
+	"github.com/tsuru/deploy-agent/pkg/build/buildkit/pool"
 	pb "github.com/tsuru/deploy-agent/pkg/build/grpc_build_v1"
 	"github.com/tsuru/deploy-agent/pkg/repository"
 	"github.com/tsuru/deploy-agent/pkg/repository/fake"
@@ -640,6 +648,100 @@ func TestBuildKit_Build_FromContainerImages(t *testing.T) {
 			},
 		}, appFiles)
 	})
+
+	t.Run("recording build metrics", func(t *testing.T) {
+		kind := pb.BuildKind_BUILD_KIND_APP_DEPLOY_WITH_CONTAINER_IMAGE
+		failed := metrics.BuildsFailed.WithLabelValues(kind.String(), "solve")
+		failedBefore := testutil.ToFloat64(failed)
+
+		req := &pb.BuildRequest{
+			Kind: kind,
+			App: &pb.TsuruApp{
+				Name: "my-app",
+				Team: "my-team",
+			},
+			SourceImage:       "nginx:1.22-alpine",
+			DestinationImages: []string{baseRegistry(t, "app-my-app", "")},
+			PushOptions:       &pb.PushOptions{InsecureRegistry: registryHTTP},
+		}
+
+		_, err := NewBuildKit(bc, BuildKitOptions{TempDir: t.TempDir()}).
+			Build(context.TODO(), req, os.Stdout)
+		require.NoError(t, err)
+
+		for _, phase := range []string{"discover", "prepare", "solve", "push", "extract"} {
+			assert.NotZero(t, histogramSampleCount(t, metrics.BuildPhaseDuration, "tsuru-system", phase, ""), "phase %s", phase)
+		}
+		assert.Eventually(t, func() bool {
+			return histogramSampleCount(t, metrics.BuildPushedImageBytes, kind.String(), "") > 0
+		}, 10*time.Second, 50*time.Millisecond)
+		assert.NotZero(t, histogramSampleCount(t, metrics.BuildCacheHitRatio, "tsuru-system", ""))
+
+		req.SourceImage = baseRegistry(t, "does-not-exist", "latest")
+		_, err = NewBuildKit(bc, BuildKitOptions{TempDir: t.TempDir()}).
+			Build(context.TODO(), req, os.Stdout)
+		require.Error(t, err)
+		assert.Equal(t, failedBefore+1, testutil.ToFloat64(failed))
+	})
+}
+
+func TestBuildKit_Build_RetriesTransientFailures(t *testing.T) {
+	bc, err := client.New(context.TODO(), "tcp://127.0.0.1:1", client.WithFailFast())
+	require.NoError(t, err)
+	defer bc.Close()
+
+	req := &pb.BuildRequest{
+		Kind: pb.BuildKind_BUILD_KIND_APP_DEPLOY_WITH_CONTAINER_IMAGE,
+		App: &pb.TsuruApp{
+			Name: "my-app",
+		},
+		SourceImage:       "nginx:1.22-alpine",
+		DestinationImages: []string{baseRegistry(t, "app-my-app", "")},
+		PushOptions:       &pb.PushOptions{InsecureRegistry: registryHTTP},
+	}
+
+	output, err := os.CreateTemp(t.TempDir(), "output")
+	require.NoError(t, err)
+	defer output.Close()
+
+	_, err = NewBuildKit(bc, BuildKitOptions{TempDir: t.TempDir(), Retry: RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}}).
+		Build(context.TODO(), req, output)
+	require.Error(t, err)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	data, err := os.ReadFile(output.Name())
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "Build failed due to a transient BuildKit error (BUILDKIT_UNAVAILABLE: ")
+	assert.Contains(t, string(data), "retrying it (attempt 2 of 3)...")
+	assert.Contains(t, string(data), "retrying it (attempt 3 of 3)...")
+	assert.NotContains(t, string(data), "attempt 4 of 3")
+}
+
+func TestBuildKit_Build_PoolFailover(t *testing.T) {
+	// the unreachable endpoint comes first, so it's tried first unless the
+	// health check ejects it before
+	p, err := pool.New(context.TODO(), []string{"tcp://127.0.0.1:1", buildkitHost}, pool.Options{HealthCheckInterval: time.Hour})
+	require.NoError(t, err)
+
+	req := &pb.BuildRequest{
+		Kind: pb.BuildKind_BUILD_KIND_APP_DEPLOY_WITH_CONTAINER_IMAGE,
+		App: &pb.TsuruApp{
+			Name: "my-app",
+		},
+		SourceImage:       "nginx:1.22-alpine",
+		DestinationImages: []string{baseRegistry(t, "app-my-app", "")},
+		PushOptions:       &pb.PushOptions{InsecureRegistry: registryHTTP},
+	}
+
+	total := metrics.BuildsTotal.WithLabelValues("tsuru-system", req.Kind.String())
+	totalBefore := testutil.ToFloat64(total)
+
+	b := NewBuildKit(nil, BuildKitOptions{TempDir: t.TempDir()}).WithPool(p)
+	defer b.Close()
+
+	_, err = b.Build(context.TODO(), req, os.Stdout)
+	require.NoError(t, err)
+	assert.Equal(t, totalBefore+1, testutil.ToFloat64(total), "failing over is the same build")
 }
 
 func TestBuildKit_Build_FromContainerFile(t *testing.T) {
@@ -1200,6 +1302,15 @@ func compressGZIP(t *testing.T, path string) []byte {
 	return data.Bytes()
 }
 
+func histogramSampleCount(t *testing.T, h *prometheus.HistogramVec, labels ...string) uint64 {
+	t.Helper()
+
+	var m dto.Metric
+	err := h.WithLabelValues(labels...).(prometheus.Histogram).Write(&m)
+	require.NoError(t, err)
+	return m.GetHistogram().GetSampleCount()
+}
+
 func baseRegistry(t *testing.T, repository, tag string) string {
 	t.Helper()
 
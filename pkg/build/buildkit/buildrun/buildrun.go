@@ -0,0 +1,397 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package buildrun leaves a trace of each build in Kubernetes: Events on the
+// leased BuildKit pod and on the tsuru App/Job resource (build started,
+// finished and failed), and optionally a BuildRun custom resource holding
+// the build status, phases and timestamps in the app (or job) namespace, so
+// `kubectl get buildruns -n <app-ns>` shows the build history.
+package buildrun
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog"
+
+	pb "github.com/tsuru/deploy-agent/pkg/build/grpc_build_v1"
+	"github.com/tsuru/deploy-agent/pkg/build/metadata"
+)
+
+// BuildRunGVR is the resource of BuildRuns, see misc/crds/buildruns.yaml.
+var BuildRunGVR = schema.GroupVersionResource{
+	Group:    "deploy-agent.tsuru.io",
+	Version:  "v1alpha1",
+	Resource: "buildruns",
+}
+
+var (
+	tsuruAppGVR = schema.GroupVersionResource{Group: "tsuru.io", Version: "v1", Resource: "apps"}
+	tsuruJobGVR = schema.GroupVersionResource{Group: "tsuru.io", Version: "v1", Resource: "jobs"}
+)
+
+// Phases of a BuildRun.
+const (
+	PhasePending   = "Pending"
+	PhaseRunning   = "Running"
+	PhaseSucceeded = "Succeeded"
+	PhaseFailed    = "Failed"
+)
+
+// updateTimeout bounds the API calls made once the build is over, since the
+// build context may be canceled by then.
+var updateTimeout = 10 * time.Second
+
+// Tracker starts a Run for each build.
+type Tracker struct {
+	DynamicInterface dynamic.Interface
+	// EventRecorder records the build Events, they're disabled if nil.
+	EventRecorder record.EventRecorder
+	// BuildRuns creates a BuildRun for each app and job build.
+	BuildRuns bool
+	// HistoryLimit is the number of finished BuildRuns kept for each app (or
+	// job), the older ones are deleted as builds finish. Zero keeps them all.
+	HistoryLimit int
+}
+
+// Run is the trace of a single build. Its methods are safe to call on a nil
+// Run, doing nothing.
+type Run struct {
+	t       *Tracker
+	ctx     context.Context
+	req     *pb.BuildRequest
+	subject string
+	owner   *unstructured.Unstructured
+	started time.Time
+
+	m        sync.Mutex
+	pod      *corev1.Pod
+	buildRun *unstructured.Unstructured
+}
+
+// Start begins tracking the build, fetching the App (or Job) resource and
+// creating its BuildRun, if enabled. Failures are only logged since they
+// must not fail the build.
+func (t *Tracker) Start(ctx context.Context, req *pb.BuildRequest) *Run {
+	if t == nil {
+		return nil
+	}
+
+	r := &Run{
+		t:       t,
+		ctx:     context.WithoutCancel(ctx),
+		req:     req,
+		started: time.Now(),
+	}
+
+	gvr, name := ownerResource(req)
+	r.subject = subject(req)
+
+	if gvr == nil {
+		return r
+	}
+
+	owner, err := t.DynamicInterface.Resource(*gvr).Namespace(metadata.TsuruAppNamespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		klog.Warningf("Failed to get the %s resource for build events: %s", r.subject, err)
+		return r
+	}
+	r.owner = owner
+
+	if t.BuildRuns {
+		r.buildRun = r.createBuildRun(ctx)
+	}
+
+	return r
+}
+
+// PodLeased records the BuildKit pod running the build.
+func (r *Run) PodLeased(pod *corev1.Pod) {
+	if r == nil {
+		return
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.pod = pod
+}
+
+// Running records that the build started on BuildKit.
+func (r *Run) Running() {
+	if r == nil {
+		return
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	message := fmt.Sprintf("Build of %s started", r.subject)
+	if r.pod != nil {
+		message = fmt.Sprintf("Build of %s started on BuildKit pod %s/%s", r.subject, r.pod.Namespace, r.pod.Name)
+	}
+	r.event(corev1.EventTypeNormal, "BuildStarted", message)
+
+	now := time.Now()
+	r.updateStatus(func(status map[string]any) {
+		status["phase"] = PhaseRunning
+		status["phases"] = []any{
+			phase("discover", r.started, now),
+			phase("build", now, time.Time{}),
+		}
+
+		if r.pod != nil {
+			status["buildKitPod"] = map[string]any{
+				"name":      r.pod.Name,
+				"namespace": r.pod.Namespace,
+			}
+		}
+	})
+}
+
+// Finish records the build outcome, err being nil when it succeeded.
+func (r *Run) Finish(err error) {
+	if r == nil {
+		return
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	duration := time.Since(r.started).Round(time.Millisecond)
+
+	if err != nil {
+		r.event(corev1.EventTypeWarning, "BuildFailed", fmt.Sprintf("Build of %s failed after %s: %s", r.subject, duration, err))
+	} else {
+		message := fmt.Sprintf("Build of %s finished in %s", r.subject, duration)
+		if images := r.req.DestinationImages; len(images) > 0 {
+			message += fmt.Sprintf(", pushed %s", strings.Join(images, ", "))
+		}
+		r.event(corev1.EventTypeNormal, "BuildSucceeded", message)
+	}
+
+	now := time.Now()
+	r.updateStatus(func(status map[string]any) {
+		status["phase"] = PhaseSucceeded
+		if err != nil {
+			status["phase"] = PhaseFailed
+			status["message"] = err.Error()
+		}
+
+		status["completionTime"] = timestamp(now)
+
+		// builds failing before reaching BuildKit have no build phase
+		phases, _ := status["phases"].([]any)
+		if len(phases) == 0 {
+			phases = []any{phase("discover", r.started, time.Time{})}
+		}
+
+		last := phases[len(phases)-1].(map[string]any)
+		last["completionTime"] = timestamp(now)
+		status["phases"] = phases
+	})
+
+	r.prune()
+}
+
+// event records the Event on the BuildKit pod and the App/Job resource.
+func (r *Run) event(eventType, reason, message string) {
+	if r.t.EventRecorder == nil {
+		return
+	}
+
+	var objs []runtime.Object
+	if r.pod != nil {
+		objs = append(objs, r.pod)
+	}
+	if r.owner != nil {
+		objs = append(objs, r.owner)
+	}
+
+	for _, obj := range objs {
+		r.t.EventRecorder.Event(obj, eventType, reason, message)
+	}
+}
+
+func (r *Run) createBuildRun(ctx context.Context) *unstructured.Unstructured {
+	ns, found, err := unstructured.NestedString(r.owner.Object, "spec", "namespaceName")
+	if err != nil || !found {
+		klog.Warningf("Failed to create BuildRun: missing namespace in the %s resource", r.subject)
+		return nil
+	}
+
+	gvr, name := ownerResource(r.req)
+	nameLabelKey := metadata.TsuruAppNameLabelKey
+	if *gvr == tsuruJobGVR {
+		nameLabelKey = metadata.TsuruJobNameLabelKey
+	}
+
+	images := make([]any, 0, len(r.req.DestinationImages))
+	for _, image := range r.req.DestinationImages {
+		images = append(images, image)
+	}
+
+	obj := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": BuildRunGVR.GroupVersion().String(),
+		"kind":       "BuildRun",
+		"metadata": map[string]any{
+			"generateName": name + "-",
+			"namespace":    ns,
+			"labels": map[string]any{
+				nameLabelKey: name,
+			},
+		},
+		"spec": map[string]any{
+			"kind":              r.req.Kind.String(),
+			"destinationImages": images,
+		},
+	}}
+
+	if image := r.req.SourceImage; image != "" {
+		obj.Object["spec"].(map[string]any)["sourceImage"] = image
+	}
+
+	created, err := r.t.DynamicInterface.Resource(BuildRunGVR).Namespace(ns).Create(ctx, obj, metav1.CreateOptions{})
+	if err != nil {
+		klog.Warningf("Failed to create BuildRun for %s: %s", r.subject, err)
+		return nil
+	}
+
+	// status is a subresource, so it's set apart
+	created.Object["status"] = map[string]any{
+		"phase":     PhasePending,
+		"startTime": timestamp(r.started),
+		"phases":    []any{phase("discover", r.started, time.Time{})},
+	}
+
+	updated, err := r.t.DynamicInterface.Resource(BuildRunGVR).Namespace(ns).UpdateStatus(ctx, created, metav1.UpdateOptions{})
+	if err != nil {
+		klog.Warningf("Failed to update BuildRun %s/%s: %s", ns, created.GetName(), err)
+		return created
+	}
+
+	return updated
+}
+
+// prune deletes the finished BuildRuns of the app (or job) beyond the
+// history limit, oldest first.
+func (r *Run) prune() {
+	if r.buildRun == nil || r.t.HistoryLimit <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.ctx, updateTimeout)
+	defer cancel()
+
+	ns := r.buildRun.GetNamespace()
+	client := r.t.DynamicInterface.Resource(BuildRunGVR).Namespace(ns)
+
+	list, err := client.List(ctx, metav1.ListOptions{LabelSelector: labels.SelectorFromSet(r.buildRun.GetLabels()).String()})
+	if err != nil {
+		klog.Warningf("Failed to list BuildRuns of %s: %s", r.subject, err)
+		return
+	}
+
+	var finished []unstructured.Unstructured
+	for _, item := range list.Items {
+		phase, _, _ := unstructured.NestedString(item.Object, "status", "phase")
+		if phase == PhaseSucceeded || phase == PhaseFailed {
+			finished = append(finished, item)
+		}
+	}
+
+	if len(finished) <= r.t.HistoryLimit {
+		return
+	}
+
+	sort.SliceStable(finished, func(i, j int) bool {
+		ti, tj := finished[i].GetCreationTimestamp(), finished[j].GetCreationTimestamp()
+		return tj.Before(&ti)
+	})
+
+	for _, item := range finished[r.t.HistoryLimit:] {
+		if err := client.Delete(ctx, item.GetName(), metav1.DeleteOptions{}); err != nil {
+			klog.Warningf("Failed to delete BuildRun %s/%s: %s", ns, item.GetName(), err)
+		}
+	}
+}
+
+// updateStatus changes the BuildRun status, if any.
+func (r *Run) updateStatus(change func(status map[string]any)) {
+	if r.buildRun == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.ctx, updateTimeout)
+	defer cancel()
+
+	obj := r.buildRun.DeepCopy()
+	status, _ := obj.Object["status"].(map[string]any)
+	if status == nil {
+		status = map[string]any{"startTime": timestamp(r.started)}
+	}
+	change(status)
+	obj.Object["status"] = status
+
+	updated, err := r.t.DynamicInterface.Resource(BuildRunGVR).Namespace(obj.GetNamespace()).UpdateStatus(ctx, obj, metav1.UpdateOptions{})
+	if err != nil {
+		klog.Warningf("Failed to update BuildRun %s/%s: %s", obj.GetNamespace(), obj.GetName(), err)
+		return
+	}
+
+	r.buildRun = updated
+}
+
+func ownerResource(req *pb.BuildRequest) (*schema.GroupVersionResource, string) {
+	switch {
+	case req.App != nil:
+		return &tsuruAppGVR, req.App.Name
+	case req.Job != nil:
+		return &tsuruJobGVR, req.Job.Name
+	}
+
+	return nil, ""
+}
+
+func subject(req *pb.BuildRequest) string {
+	switch {
+	case req.App != nil:
+		return "app " + req.App.Name
+	case req.Job != nil:
+		return "job " + req.Job.Name
+	case req.Platform != nil:
+		return "platform " + req.Platform.Name
+	}
+
+	return "image"
+}
+
+func phase(name string, start, completion time.Time) map[string]any {
+	p := map[string]any{
+		"name":      name,
+		"startTime": timestamp(start),
+	}
+
+	if !completion.IsZero() {
+		p["completionTime"] = timestamp(completion)
+	}
+
+	return p
+}
+
+func timestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
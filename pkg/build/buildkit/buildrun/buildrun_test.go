@@ -0,0 +1,216 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package buildrun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakeDynamic "k8s.io/client-go/dynamic/fake"
+	kuberntesTesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+
+	pb "github.com/tsuru/deploy-agent/pkg/build/grpc_build_v1"
+)
+
+func newTestTracker(buildRuns bool) (*Tracker, *record.FakeRecorder) {
+	app := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "tsuru.io/v1",
+		"kind":       "App",
+		"metadata": map[string]any{
+			"name":      "my-app",
+			"namespace": "tsuru",
+		},
+		"spec": map[string]any{
+			"namespaceName": "tsuru-apps",
+		},
+	}}
+
+	dynamicClient := fakeDynamic.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		BuildRunGVR: "BuildRunList",
+		tsuruAppGVR: "AppList",
+		tsuruJobGVR: "JobList",
+	}, app)
+
+	// fills in what the API server would, from generateName
+	var created int
+	dynamicClient.PrependReactor("create", "buildruns", func(action kuberntesTesting.Action) (bool, runtime.Object, error) {
+		obj := action.(kuberntesTesting.CreateAction).GetObject().(*unstructured.Unstructured)
+		created++
+		obj.SetName(fmt.Sprintf("%s%05d", obj.GetGenerateName(), created))
+		obj.SetCreationTimestamp(metav1.NewTime(time.Date(2026, 1, 1, 0, 0, created, 0, time.UTC)))
+		return false, nil, nil
+	})
+
+	recorder := &record.FakeRecorder{Events: make(chan string, 10), IncludeObject: true}
+
+	return &Tracker{DynamicInterface: dynamicClient, EventRecorder: recorder, BuildRuns: buildRuns}, recorder
+}
+
+func newTestPod() *corev1.Pod {
+	return &corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "buildkit-0", Namespace: "tsuru-system"},
+	}
+}
+
+func listBuildRuns(t *testing.T, tracker *Tracker) []unstructured.Unstructured {
+	t.Helper()
+
+	list, err := tracker.DynamicInterface.Resource(BuildRunGVR).Namespace("tsuru-apps").List(context.TODO(), metav1.ListOptions{})
+	require.NoError(t, err)
+	return list.Items
+}
+
+func TestRun(t *testing.T) {
+	tracker, recorder := newTestTracker(true)
+
+	req := &pb.BuildRequest{
+		Kind:              pb.BuildKind_BUILD_KIND_APP_BUILD_WITH_CONTAINER_FILE,
+		App:               &pb.TsuruApp{Name: "my-app"},
+		DestinationImages: []string{"registry.example.com/tsuru/app-my-app:v1", "registry.example.com/tsuru/app-my-app:latest"},
+	}
+
+	run := tracker.Start(context.TODO(), req)
+
+	buildRuns := listBuildRuns(t, tracker)
+	require.Len(t, buildRuns, 1)
+	assert.Equal(t, "my-app-", buildRuns[0].GetGenerateName())
+	assert.Equal(t, "my-app-00001", buildRuns[0].GetName())
+	assert.Equal(t, map[string]string{"tsuru.io/app-name": "my-app"}, buildRuns[0].GetLabels())
+	assert.Equal(t, map[string]any{
+		"kind":              "BUILD_KIND_APP_BUILD_WITH_CONTAINER_FILE",
+		"destinationImages": []any{"registry.example.com/tsuru/app-my-app:v1", "registry.example.com/tsuru/app-my-app:latest"},
+	}, buildRuns[0].Object["spec"])
+
+	phase, _, _ := unstructured.NestedString(buildRuns[0].Object, "status", "phase")
+	assert.Equal(t, PhasePending, phase)
+
+	run.PodLeased(newTestPod())
+	run.Running()
+
+	assert.Equal(t, "Normal BuildStarted Build of app my-app started on BuildKit pod tsuru-system/buildkit-0 involvedObject{kind=Pod,apiVersion=v1}", <-recorder.Events)
+	assert.Equal(t, "Normal BuildStarted Build of app my-app started on BuildKit pod tsuru-system/buildkit-0 involvedObject{kind=App,apiVersion=tsuru.io/v1}", <-recorder.Events)
+
+	buildRuns = listBuildRuns(t, tracker)
+	require.Len(t, buildRuns, 1)
+	phase, _, _ = unstructured.NestedString(buildRuns[0].Object, "status", "phase")
+	assert.Equal(t, PhaseRunning, phase)
+	pod, _, _ := unstructured.NestedStringMap(buildRuns[0].Object, "status", "buildKitPod")
+	assert.Equal(t, map[string]string{"name": "buildkit-0", "namespace": "tsuru-system"}, pod)
+
+	run.Finish(nil)
+
+	assert.Regexp(t, `^Normal BuildSucceeded Build of app my-app finished in \S+, pushed registry.example.com/tsuru/app-my-app:v1, registry.example.com/tsuru/app-my-app:latest involvedObject\{kind=Pod,apiVersion=v1\}$`, <-recorder.Events)
+	assert.Regexp(t, `^Normal BuildSucceeded Build of app my-app finished in \S+, pushed .+ involvedObject\{kind=App,apiVersion=tsuru.io/v1\}$`, <-recorder.Events)
+
+	buildRuns = listBuildRuns(t, tracker)
+	require.Len(t, buildRuns, 1)
+
+	status := buildRuns[0].Object["status"].(map[string]any)
+	assert.Equal(t, PhaseSucceeded, status["phase"])
+	assert.NotEmpty(t, status["startTime"])
+	assert.NotEmpty(t, status["completionTime"])
+
+	phases := status["phases"].([]any)
+	require.Len(t, phases, 2)
+	for i, name := range []string{"discover", "build"} {
+		p := phases[i].(map[string]any)
+		assert.Equal(t, name, p["name"])
+		assert.NotEmpty(t, p["startTime"])
+		assert.NotEmpty(t, p["completionTime"])
+	}
+}
+
+func TestRun_FailedBeforeBuildKit(t *testing.T) {
+	tracker, recorder := newTestTracker(true)
+
+	run := tracker.Start(context.TODO(), &pb.BuildRequest{App: &pb.TsuruApp{Name: "my-app"}})
+	run.Finish(errors.New("max deadline of 5m0s exceeded to discover BuildKit pod"))
+
+	assert.Regexp(t, `^Warning BuildFailed Build of app my-app failed after \S+: max deadline of 5m0s exceeded to discover BuildKit pod involvedObject\{kind=App,apiVersion=tsuru.io/v1\}$`, <-recorder.Events)
+	assert.Empty(t, recorder.Events)
+
+	buildRuns := listBuildRuns(t, tracker)
+	require.Len(t, buildRuns, 1)
+
+	status := buildRuns[0].Object["status"].(map[string]any)
+	assert.Equal(t, PhaseFailed, status["phase"])
+	assert.Equal(t, "max deadline of 5m0s exceeded to discover BuildKit pod", status["message"])
+
+	phases := status["phases"].([]any)
+	require.Len(t, phases, 1)
+	assert.Equal(t, "discover", phases[0].(map[string]any)["name"])
+	assert.NotEmpty(t, phases[0].(map[string]any)["completionTime"])
+}
+
+func TestRun_HistoryLimit(t *testing.T) {
+	tracker, _ := newTestTracker(true)
+	tracker.EventRecorder = nil
+	tracker.HistoryLimit = 2
+
+	req := &pb.BuildRequest{App: &pb.TsuruApp{Name: "my-app"}}
+	for range 3 {
+		tracker.Start(context.TODO(), req).Finish(nil)
+	}
+
+	// running builds are never pruned
+	running := tracker.Start(context.TODO(), req)
+	running.Running()
+
+	tracker.Start(context.TODO(), req).Finish(errors.New("build failed"))
+
+	var names []string
+	for _, buildRun := range listBuildRuns(t, tracker) {
+		names = append(names, buildRun.GetName())
+	}
+	assert.ElementsMatch(t, []string{"my-app-00003", "my-app-00004", "my-app-00005"}, names)
+}
+
+func TestRun_WithoutBuildRuns(t *testing.T) {
+	tracker, recorder := newTestTracker(false)
+
+	run := tracker.Start(context.TODO(), &pb.BuildRequest{App: &pb.TsuruApp{Name: "my-app"}})
+	run.Running()
+	run.Finish(nil)
+
+	assert.Len(t, recorder.Events, 2)
+	assert.Empty(t, listBuildRuns(t, tracker))
+}
+
+func TestRun_Platform(t *testing.T) {
+	tracker, recorder := newTestTracker(true)
+
+	run := tracker.Start(context.TODO(), &pb.BuildRequest{Platform: &pb.TsuruPlatform{Name: "python"}})
+	run.PodLeased(newTestPod())
+	run.Running()
+	run.Finish(nil)
+
+	assert.Equal(t, "Normal BuildStarted Build of platform python started on BuildKit pod tsuru-system/buildkit-0 involvedObject{kind=Pod,apiVersion=v1}", <-recorder.Events)
+	assert.Regexp(t, `^Normal BuildSucceeded Build of platform python finished in \S+ involvedObject\{kind=Pod,apiVersion=v1\}$`, <-recorder.Events)
+	assert.Empty(t, recorder.Events)
+	assert.Empty(t, listBuildRuns(t, tracker))
+}
+
+func TestRun_Nil(t *testing.T) {
+	var tracker *Tracker
+
+	run := tracker.Start(context.TODO(), &pb.BuildRequest{App: &pb.TsuruApp{Name: "my-app"}})
+	assert.Nil(t, run)
+
+	run.PodLeased(newTestPod())
+	run.Running()
+	run.Finish(nil)
+}
@@ -0,0 +1,317 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package failure classifies build failures into user errors (e.g. a RUN
+// step exiting non-zero, an invalid Containerfile or a missing source image)
+// and infrastructure errors (e.g. BuildKit going away or the registry
+// refusing the push), so the caller can tell which builds are worth retrying.
+//
+// Classified errors carry a gRPC status whose code depends on the failure,
+// along with an errdetails.ErrorInfo detail holding its reason and metadata:
+//
+//   - category: either "user" or "infrastructure", see Category;
+//   - step: the Containerfile instruction (or command) which failed, if any;
+//   - exitCode: the exit code of the failed step, if any.
+package failure
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/remotes/docker"
+	remoteserrors "github.com/containerd/containerd/remotes/errors"
+	cerrdefs "github.com/containerd/errdefs"
+	gatewaypb "github.com/moby/buildkit/frontend/gateway/pb"
+	"github.com/moby/buildkit/solver/errdefs"
+	"github.com/moby/buildkit/util/grpcerrors"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/tsuru/deploy-agent/pkg/build/buildkit/autodiscovery"
+)
+
+// Domain is the domain of the ErrorInfo details.
+const Domain = "deploy-agent.tsuru.io"
+
+// Category tells who is to blame for a failure.
+type Category string
+
+const (
+	// User failures are caused by the build input, so retrying won't help.
+	User Category = "user"
+	// Infrastructure failures are caused by BuildKit, the registry or the
+	// agent itself, so the build may succeed when retried.
+	Infrastructure Category = "infrastructure"
+)
+
+// Reasons of the ErrorInfo details.
+const (
+	ReasonStepFailed              = "STEP_FAILED"
+	ReasonInvalidContainerfile    = "INVALID_CONTAINERFILE"
+	ReasonSourceImageNotFound     = "SOURCE_IMAGE_NOT_FOUND"
+	ReasonSourceImageUnauthorized = "SOURCE_IMAGE_UNAUTHORIZED"
+	ReasonRegistryUnauthorized    = "REGISTRY_UNAUTHORIZED"
+	ReasonRegistryUnavailable     = "REGISTRY_UNAVAILABLE"
+	ReasonBuildKitUnavailable     = "BUILDKIT_UNAVAILABLE"
+	ReasonLeaseLost               = "LEASE_LOST"
+)
+
+// Metadata keys of the ErrorInfo details.
+const (
+	MetadataCategory = "category"
+	MetadataStep     = "step"
+	MetadataExitCode = "exitCode"
+)
+
+// Error is a classified build failure. It keeps the original error, so
+// errors.Is and errors.As still see through it.
+type Error struct {
+	st  *status.Status
+	err error
+}
+
+func (e *Error) Error() string { return e.err.Error() }
+
+func (e *Error) Unwrap() error { return e.err }
+
+// GRPCStatus returns the status sent back to the client.
+func (e *Error) GRPCStatus() *status.Status { return e.st }
+
+// unavailableError marks errors which mean BuildKit could not be reached. A
+// gRPC Unavailable status alone isn't enough, since BuildKit passes along the
+// ones of registries and frontends.
+type unavailableError struct {
+	error
+}
+
+func (e *unavailableError) Unwrap() error { return e.error }
+
+// BuildKitUnavailable marks err as BuildKit being unreachable, e.g. failing
+// to discover a BuildKit pod.
+func BuildKitUnavailable(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &unavailableError{err}
+}
+
+// Classify returns err along with the gRPC status of its failure. Errors
+// which cannot be classified keep their status, if any.
+func Classify(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var classified *Error
+	if errors.As(err, &classified) {
+		return err
+	}
+
+	if errors.Is(err, autodiscovery.ErrLeaseLost) {
+		return newError(codes.Aborted, ReasonLeaseLost, Infrastructure, err, nil)
+	}
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return &Error{st: status.FromContextError(err), err: err}
+	}
+
+	msg := strings.ToLower(err.Error())
+	step := failedStep(err)
+
+	var exitErr *gatewaypb.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode != 0 {
+		return newError(codes.FailedPrecondition, ReasonStepFailed, User, err, map[string]string{
+			MetadataStep:     step,
+			MetadataExitCode: strconv.FormatUint(uint64(exitErr.ExitCode), 10),
+		})
+	}
+
+	switch {
+	case strings.Contains(msg, "failed to resolve source metadata"):
+		switch {
+		case notFound(err):
+			return newError(codes.NotFound, ReasonSourceImageNotFound, User, err, map[string]string{MetadataStep: step})
+		case unauthorized(err):
+			return newError(codes.PermissionDenied, ReasonSourceImageUnauthorized, User, err, map[string]string{MetadataStep: step})
+		}
+
+		return newError(codes.Unavailable, ReasonRegistryUnavailable, Infrastructure, err, map[string]string{MetadataStep: step})
+
+	case strings.Contains(msg, "failed to push"):
+		if unauthorized(err) {
+			return newError(codes.PermissionDenied, ReasonRegistryUnauthorized, Infrastructure, err, nil)
+		}
+
+		return newError(codes.Unavailable, ReasonRegistryUnavailable, Infrastructure, err, nil)
+	}
+
+	if len(errdefs.Sources(err)) > 0 {
+		if strings.Contains(msg, "parse error") || strings.Contains(msg, "unknown instruction") || strings.Contains(msg, "unknown flag") {
+			return newError(codes.InvalidArgument, ReasonInvalidContainerfile, User, err, map[string]string{MetadataStep: step})
+		}
+
+		// e.g. copying files missing from the build context
+		return newError(codes.FailedPrecondition, ReasonStepFailed, User, err, map[string]string{MetadataStep: step})
+	}
+
+	var uerr *unavailableError
+	if errors.As(err, &uerr) {
+		return newError(codes.Unavailable, ReasonBuildKitUnavailable, Infrastructure, err, nil)
+	}
+
+	return err
+}
+
+// Reason returns the reason of the err failure, empty if it cannot be
+// classified.
+func Reason(err error) string {
+	st, ok := status.FromError(Classify(err))
+	if !ok {
+		return ""
+	}
+
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.Domain == Domain {
+			return info.Reason
+		}
+	}
+
+	return ""
+}
+
+// Transient tells whether the build may succeed on another BuildKit, since
+// the one it ran on became unreachable or its lease was lost.
+func Transient(err error) bool {
+	switch Reason(err) {
+	case ReasonBuildKitUnavailable, ReasonLeaseLost:
+		return true
+	}
+
+	return false
+}
+
+func newError(code codes.Code, reason string, category Category, err error, metadata map[string]string) *Error {
+	info := &errdetails.ErrorInfo{
+		Reason:   reason,
+		Domain:   Domain,
+		Metadata: map[string]string{MetadataCategory: string(category)},
+	}
+
+	for k, v := range metadata {
+		if v != "" {
+			info.Metadata[k] = v
+		}
+	}
+
+	st := status.New(code, err.Error())
+	if withDetails, derr := st.WithDetails(info); derr == nil {
+		st = withDetails
+	}
+
+	return &Error{st: st, err: err}
+}
+
+// failedStep returns the Containerfile instruction which failed, falling
+// back to the command of the failed exec.
+func failedStep(err error) string {
+	for _, src := range errdefs.Sources(err) {
+		if step := sourceLines(src); step != "" {
+			return step
+		}
+	}
+
+	var serr *errdefs.SolveError
+	if errors.As(err, &serr) {
+		if exec := serr.Op.GetExec(); exec != nil && exec.Meta != nil {
+			return strings.Join(exec.Meta.Args, " ")
+		}
+	}
+
+	return ""
+}
+
+func sourceLines(src *errdefs.Source) string {
+	if src.Info == nil || len(src.Ranges) == 0 {
+		return ""
+	}
+
+	lines := strings.Split(string(src.Info.Data), "\n")
+	start, end := int(src.Ranges[0].Start.Line), int(src.Ranges[0].End.Line)
+	if end < start {
+		end = start
+	}
+
+	if start < 1 || end > len(lines) {
+		return ""
+	}
+
+	return strings.TrimSpace(strings.Join(lines[start-1:end], "\n"))
+}
+
+// Messages telling the registry refused or could not find an image, matched
+// only on errors which lost their type on the way (e.g. those from BuildKit,
+// which only keep their messages).
+var (
+	notFoundMessage     = regexp.MustCompile(`(?i)(?:: not found|\s404 not found|: manifest unknown)$`)
+	unauthorizedMessage = regexp.MustCompile(`(?i)(?:\s401 unauthorized|\s403 forbidden|: insufficient_scope: authorization failed|: requested access to the resource is denied)$`)
+)
+
+// notFound tells whether err means the image doesn't exist on its registry.
+func notFound(err error) bool {
+	var serr remoteserrors.ErrUnexpectedStatus
+	if errors.As(err, &serr) {
+		return serr.StatusCode == http.StatusNotFound
+	}
+
+	if cerrdefs.IsNotFound(err) || grpcerrors.Code(err) == codes.NotFound {
+		return true
+	}
+
+	return notFoundMessage.MatchString(err.Error())
+}
+
+// unauthorized tells whether err means the registry refused the credentials
+// (or their lack).
+func unauthorized(err error) bool {
+	var serr remoteserrors.ErrUnexpectedStatus
+	if errors.As(err, &serr) {
+		return serr.StatusCode == http.StatusUnauthorized || serr.StatusCode == http.StatusForbidden
+	}
+
+	var derrs docker.Errors
+	if errors.As(err, &derrs) {
+		for _, derr := range derrs {
+			if registryDenied(derr) {
+				return true
+			}
+		}
+	}
+
+	if registryDenied(err) {
+		return true
+	}
+
+	switch grpcerrors.Code(err) {
+	case codes.Unauthenticated, codes.PermissionDenied:
+		return true
+	}
+
+	return unauthorizedMessage.MatchString(err.Error())
+}
+
+// registryDenied tells whether err is a registry API error refusing access.
+func registryDenied(err error) bool {
+	var derr docker.Error
+	if !errors.As(err, &derr) {
+		return false
+	}
+
+	return derr.Code == docker.ErrorCodeUnauthorized || derr.Code == docker.ErrorCodeDenied
+}
@@ -0,0 +1,232 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package failure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/containerd/containerd/remotes/docker"
+	remoteserrors "github.com/containerd/containerd/remotes/errors"
+	gatewaypb "github.com/moby/buildkit/frontend/gateway/pb"
+	"github.com/moby/buildkit/solver/errdefs"
+	solverpb "github.com/moby/buildkit/solver/pb"
+	"github.com/moby/buildkit/util/grpcerrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/tsuru/deploy-agent/pkg/build/buildkit/autodiscovery"
+)
+
+const testDockerfile = `FROM busybox:latest
+COPY . /app
+RUN cd /app && \
+    make build
+`
+
+// fromBuildKit returns err as seen by the BuildKit client.
+func fromBuildKit(err error) error {
+	return grpcerrors.FromGRPC(grpcerrors.ToGRPC(err))
+}
+
+func withSource(err error, line, endLine int32) error {
+	return errdefs.WithSource(err, errdefs.Source{
+		Info: &solverpb.SourceInfo{Filename: "Dockerfile", Data: []byte(testDockerfile)},
+		Ranges: []*solverpb.Range{
+			{Start: solverpb.Position{Line: line}, End: solverpb.Position{Line: endLine}},
+		},
+	})
+}
+
+func TestClassify(t *testing.T) {
+	execErr := errdefs.WithSolveError(
+		fmt.Errorf("process \"/bin/sh -c cd /app && make build\" did not complete successfully: %w", &gatewaypb.ExitError{ExitCode: 2}),
+		nil, nil, nil,
+	)
+	execErr.(*errdefs.SolveError).Op = &solverpb.Op{Op: &solverpb.Op_Exec{Exec: &solverpb.ExecOp{
+		Meta: &solverpb.Meta{Args: []string{"/bin/sh", "-c", "cd /app && make build"}},
+	}}}
+
+	tests := map[string]struct {
+		err              error
+		expectedCode     codes.Code
+		expectedReason   string
+		expectedMetadata map[string]string
+	}{
+		"RUN step exited non-zero": {
+			err:            fromBuildKit(withSource(execErr, 3, 4)),
+			expectedCode:   codes.FailedPrecondition,
+			expectedReason: ReasonStepFailed,
+			expectedMetadata: map[string]string{
+				"category": "user",
+				"step":     "RUN cd /app && \\\n    make build",
+				"exitCode": "2",
+			},
+		},
+		"exec exited non-zero without source": {
+			err:            fromBuildKit(execErr),
+			expectedCode:   codes.FailedPrecondition,
+			expectedReason: ReasonStepFailed,
+			expectedMetadata: map[string]string{
+				"category": "user",
+				"step":     "/bin/sh -c cd /app && make build",
+				"exitCode": "2",
+			},
+		},
+		"Containerfile parse error": {
+			err:              fromBuildKit(withSource(errors.New("dockerfile parse error on line 2: unknown instruction: COPPY"), 2, 2)),
+			expectedCode:     codes.InvalidArgument,
+			expectedReason:   ReasonInvalidContainerfile,
+			expectedMetadata: map[string]string{"category": "user", "step": "COPY . /app"},
+		},
+		"file missing from build context": {
+			err:              fromBuildKit(withSource(errors.New(`failed to compute cache key: "/app" not found`), 2, 2)),
+			expectedCode:     codes.FailedPrecondition,
+			expectedReason:   ReasonStepFailed,
+			expectedMetadata: map[string]string{"category": "user", "step": "COPY . /app"},
+		},
+		"source image not found": {
+			err:              fromBuildKit(withSource(errors.New("failed to resolve source metadata for docker.io/library/busybox:nope: docker.io/library/busybox:nope: not found"), 1, 1)),
+			expectedCode:     codes.NotFound,
+			expectedReason:   ReasonSourceImageNotFound,
+			expectedMetadata: map[string]string{"category": "user", "step": "FROM busybox:latest"},
+		},
+		"private source image": {
+			err:              fromBuildKit(errors.New("failed to resolve source metadata for registry.example.com/private:latest: unexpected status code 401 Unauthorized")),
+			expectedCode:     codes.PermissionDenied,
+			expectedReason:   ReasonSourceImageUnauthorized,
+			expectedMetadata: map[string]string{"category": "user"},
+		},
+		"source image missing from the registry": {
+			err: fmt.Errorf("failed to resolve source metadata for registry.example.com/app:v1: %w", remoteserrors.ErrUnexpectedStatus{
+				Status: "404 Not Found", StatusCode: http.StatusNotFound, RequestMethod: http.MethodHead, RequestURL: "https://registry.example.com/v2/app/manifests/v1",
+			}),
+			expectedCode:     codes.NotFound,
+			expectedReason:   ReasonSourceImageNotFound,
+			expectedMetadata: map[string]string{"category": "user"},
+		},
+		"source image denied by the registry": {
+			err:              fmt.Errorf("failed to resolve source metadata for registry.example.com/app:v1: %w", docker.Errors{docker.ErrorCodeDenied.WithMessage("requested access to the resource is denied")}),
+			expectedCode:     codes.PermissionDenied,
+			expectedReason:   ReasonSourceImageUnauthorized,
+			expectedMetadata: map[string]string{"category": "user"},
+		},
+		"source registry unreachable": {
+			err:              fromBuildKit(errors.New("failed to resolve source metadata for registry.example.com/team-404/denied:latest: dial tcp: i/o timeout")),
+			expectedCode:     codes.Unavailable,
+			expectedReason:   ReasonRegistryUnavailable,
+			expectedMetadata: map[string]string{"category": "infrastructure"},
+		},
+		"source registry unavailable": {
+			err:              fromBuildKit(errors.New("failed to resolve source metadata for registry.example.com/app:latest: unexpected status code 503 Service Unavailable")),
+			expectedCode:     codes.Unavailable,
+			expectedReason:   ReasonRegistryUnavailable,
+			expectedMetadata: map[string]string{"category": "infrastructure"},
+		},
+		"push unauthorized": {
+			err:              fromBuildKit(errors.New("failed to push registry.example.com/tsuru/app-my-app:v1: unexpected status: 401 Unauthorized")),
+			expectedCode:     codes.PermissionDenied,
+			expectedReason:   ReasonRegistryUnauthorized,
+			expectedMetadata: map[string]string{"category": "infrastructure"},
+		},
+		"push forbidden": {
+			err: fmt.Errorf("failed to push registry.example.com/tsuru/app-my-app:v1: %w", remoteserrors.ErrUnexpectedStatus{
+				Status: "403 Forbidden", StatusCode: http.StatusForbidden, RequestMethod: http.MethodPut,
+			}),
+			expectedCode:     codes.PermissionDenied,
+			expectedReason:   ReasonRegistryUnauthorized,
+			expectedMetadata: map[string]string{"category": "infrastructure"},
+		},
+		"push failed": {
+			err:              fromBuildKit(errors.New("failed to push registry.example.com/tsuru/app-my-app:v1: failed to do request: dial tcp: i/o timeout")),
+			expectedCode:     codes.Unavailable,
+			expectedReason:   ReasonRegistryUnavailable,
+			expectedMetadata: map[string]string{"category": "infrastructure"},
+		},
+		"BuildKit connection error": {
+			err:              BuildKitUnavailable(status.Error(codes.Unavailable, "connection error: desc = \"transport: Error while dialing: dial tcp 10.0.0.1:1234: connect: connection refused\"")),
+			expectedCode:     codes.Unavailable,
+			expectedReason:   ReasonBuildKitUnavailable,
+			expectedMetadata: map[string]string{"category": "infrastructure"},
+		},
+		"BuildKit discovery failed": {
+			err:              BuildKitUnavailable(errors.New("max deadline of 5m0s exceeded to discover BuildKit pod")),
+			expectedCode:     codes.Unavailable,
+			expectedReason:   ReasonBuildKitUnavailable,
+			expectedMetadata: map[string]string{"category": "infrastructure"},
+		},
+		"lease lost": {
+			err:              autodiscovery.ErrLeaseLost,
+			expectedCode:     codes.Aborted,
+			expectedReason:   ReasonLeaseLost,
+			expectedMetadata: map[string]string{"category": "infrastructure"},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := Classify(tt.err)
+			require.Error(t, err)
+			assert.ErrorIs(t, err, tt.err)
+			assert.Equal(t, tt.err.Error(), err.Error())
+
+			st, ok := status.FromError(err)
+			require.True(t, ok)
+			assert.Equal(t, tt.expectedCode, st.Code())
+			assert.Equal(t, tt.err.Error(), st.Message())
+
+			require.Len(t, st.Details(), 1)
+			info, ok := st.Details()[0].(*errdetails.ErrorInfo)
+			require.True(t, ok)
+			assert.Equal(t, Domain, info.Domain)
+			assert.Equal(t, tt.expectedReason, info.Reason)
+			assert.Equal(t, tt.expectedMetadata, info.Metadata)
+		})
+	}
+}
+
+func TestClassify_Unclassified(t *testing.T) {
+	assert.NoError(t, Classify(nil))
+
+	err := errors.New("something went wrong")
+	assert.Equal(t, err, Classify(err))
+
+	err = status.Error(codes.Unimplemented, "build kind not supported")
+	assert.Equal(t, err, Classify(err))
+
+	err = fmt.Errorf("build canceled: %w", context.Canceled)
+	cerr := Classify(err)
+	assert.ErrorIs(t, cerr, context.Canceled)
+	assert.Equal(t, codes.Canceled, status.Code(cerr))
+	assert.Empty(t, status.Convert(cerr).Details())
+
+	cerr = Classify(BuildKitUnavailable(context.DeadlineExceeded))
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(cerr))
+
+	classified := Classify(autodiscovery.ErrLeaseLost)
+	assert.Same(t, classified, Classify(classified))
+}
+
+func TestTransient(t *testing.T) {
+	assert.True(t, Transient(BuildKitUnavailable(status.Error(codes.Unavailable, "error reading from server: EOF"))))
+	assert.True(t, Transient(fmt.Errorf("build aborted: %w", autodiscovery.ErrLeaseLost)))
+	assert.True(t, Transient(Classify(BuildKitUnavailable(errors.New("failed to discover BuildKit pod")))))
+
+	assert.False(t, Transient(nil))
+	assert.False(t, Transient(errors.New("something went wrong")))
+	assert.False(t, Transient(context.Canceled))
+	assert.False(t, Transient(status.Error(codes.Unavailable, "upstream frontend unavailable")), "passed along by BuildKit")
+	assert.False(t, Transient(fromBuildKit(&gatewaypb.ExitError{ExitCode: 1})))
+	assert.False(t, Transient(fromBuildKit(errors.New("failed to push registry.example.com/tsuru/app-my-app:v1: unexpected status: 503 Service Unavailable"))))
+
+	assert.Equal(t, ReasonLeaseLost, Reason(autodiscovery.ErrLeaseLost))
+	assert.Equal(t, "", Reason(errors.New("something went wrong")))
+}
@@ -5,6 +5,8 @@
 package metrics
 
 import (
+	"sync/atomic"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -38,4 +40,84 @@ var (
 		Help:    "Duration of builds in seconds",
 		Buckets: prometheus.ExponentialBuckets(10, 2, 10), // 10s, 20s, 40s, 80s, 160s, 320s, 640s, 1280s, 2560s, 5120s
 	}, []string{"namespace"})
+
+	// BuildsFailed counts the failed builds
+	// Labels: kind (build kind), reason (canceled, timeout, lease_lost or the phase which failed)
+	BuildsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "deploy_agent_builds_failed_total",
+		Help: "Total number of failed builds by reason",
+	}, []string{"kind", "reason"})
+
+	// BuildPhaseDuration tracks the duration of each build phase
+	// Labels: namespace (buildkit namespace), phase (discover, prepare, solve, push or extract), team (see TeamLabel)
+	BuildPhaseDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "deploy_agent_build_phase_duration_seconds",
+		Help:    "Duration of build phases (discover, prepare, solve, push and extract) in seconds",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 14), // 0.5s up to ~68m
+	}, []string{"namespace", "phase", "team"})
+
+	// BuildContextBytes tracks the size of the build context received along with build requests
+	// Labels: kind (build kind), team (see TeamLabel)
+	BuildContextBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "deploy_agent_build_context_bytes",
+		Help:    "Size of the build context received in bytes",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 12), // 1KiB up to 4GiB
+	}, []string{"kind", "team"})
+
+	// BuildPushedImageBytes tracks the size of the pushed images (compressed layers and config)
+	// Labels: kind (build kind), team (see TeamLabel)
+	BuildPushedImageBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "deploy_agent_build_pushed_image_bytes",
+		Help:    "Size of the pushed container images in bytes",
+		Buckets: prometheus.ExponentialBuckets(1<<20, 2, 14), // 1MiB up to 8GiB
+	}, []string{"kind", "team"})
+
+	// BuildCacheHitRatio tracks the ratio of build steps found in BuildKit's cache
+	// Labels: namespace (buildkit namespace), team (see TeamLabel)
+	BuildCacheHitRatio = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "deploy_agent_build_cache_hit_ratio",
+		Help:    "Ratio of build steps found in BuildKit's cache",
+		Buckets: prometheus.LinearBuckets(0.1, 0.1, 10),
+	}, []string{"namespace", "team"})
+
+	// BuildRetries tracks the retries of builds failing for transient reasons
+	// Labels: reason (BUILDKIT_UNAVAILABLE or LEASE_LOST)
+	BuildRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "deploy_agent_build_retries_total",
+		Help: "Total number of builds retried due to transient BuildKit failures",
+	}, []string{"reason"})
+
+	// BuildKitEndpointHealthy tracks whether the static BuildKit endpoints are receiving builds (1) or ejected (0)
+	// Labels: address (buildkit endpoint address)
+	BuildKitEndpointHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "deploy_agent_buildkit_endpoint_healthy",
+		Help: "Whether the static BuildKit endpoint is healthy (1) or ejected from the pool (0)",
+	}, []string{"address"})
+
+	// BuildKitAffinity counts the BuildKit pod selections by cache affinity result
+	// Labels: namespace (buildkit namespace), result (hit: leased the pod which last built the app, miss: leased another pod, none: no pod built the app before)
+	BuildKitAffinity = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "deploy_agent_buildkit_affinity_total",
+		Help: "Total number of BuildKit pod selections by cache affinity result (hit, miss or none)",
+	}, []string{"namespace", "result"})
+
+	// BuildKitLeasesLost counts the leases on BuildKit pods lost while builds were still running on them
+	// Labels: namespace (buildkit namespace)
+	BuildKitLeasesLost = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "deploy_agent_buildkit_leases_lost_total",
+		Help: "Total number of leases on BuildKit pods lost during builds",
+	}, []string{"namespace"})
 )
+
+// TeamLabel fills the team label of build metrics, which is left empty
+// otherwise to keep their cardinality bounded.
+var TeamLabel atomic.Bool
+
+// Team returns the team label value of build metrics.
+func Team(team string) string {
+	if !TeamLabel.Load() {
+		return ""
+	}
+
+	return team
+}
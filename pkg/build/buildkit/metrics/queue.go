@@ -0,0 +1,69 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import "sync"
+
+// Builds is the in-memory view of the builds waiting for and running on
+// BuildKit by namespace, it also feeds the BuildsWaitingForLease and
+// BuildsActive gauges.
+var Builds = NewBuildQueue()
+
+// BuildQueue counts the waiting and active builds by BuildKit namespace.
+type BuildQueue struct {
+	m       sync.Mutex
+	waiting map[string]int64
+	active  map[string]int64
+	changed chan struct{}
+}
+
+func NewBuildQueue() *BuildQueue {
+	return &BuildQueue{
+		waiting: make(map[string]int64),
+		active:  make(map[string]int64),
+		changed: make(chan struct{}),
+	}
+}
+
+// AddWaiting adds delta to the builds waiting for a BuildKit in namespace.
+func (q *BuildQueue) AddWaiting(namespace string, delta int64) {
+	BuildsWaitingForLease.WithLabelValues(namespace).Add(float64(delta))
+	q.add(q.waiting, namespace, delta)
+}
+
+// AddActive adds delta to the builds running on a BuildKit in namespace.
+func (q *BuildQueue) AddActive(namespace string, delta int64) {
+	BuildsActive.WithLabelValues(namespace).Add(float64(delta))
+	q.add(q.active, namespace, delta)
+}
+
+// Get returns the waiting and active builds in namespace.
+func (q *BuildQueue) Get(namespace string) (waiting, active int64) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	return q.waiting[namespace], q.active[namespace]
+}
+
+// Changed returns a channel closed on the next change of any namespace.
+func (q *BuildQueue) Changed() <-chan struct{} {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	return q.changed
+}
+
+func (q *BuildQueue) add(counts map[string]int64, namespace string, delta int64) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	counts[namespace] += delta
+	if counts[namespace] == 0 {
+		delete(counts, namespace)
+	}
+
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
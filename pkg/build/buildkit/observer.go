@@ -0,0 +1,203 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package buildkit
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	digest "github.com/opencontainers/go-digest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/tsuru/deploy-agent/pkg/build/buildkit/autodiscovery"
+	"github.com/tsuru/deploy-agent/pkg/build/buildkit/metrics"
+	pb "github.com/tsuru/deploy-agent/pkg/build/grpc_build_v1"
+)
+
+// Build phases, as labeled in the metrics.
+const (
+	phaseDiscover = "discover"
+	phasePrepare  = "prepare"
+	phaseSolve    = "solve"
+	phasePush     = "push"
+	phaseExtract  = "extract"
+)
+
+// buildObserver records the metrics of a single build: how long each of its
+// phases took, which phase it failed on, and its cache hits.
+type buildObserver struct {
+	kind      string
+	team      string
+	namespace string
+	started   time.Time
+
+	m sync.Mutex
+	// current is the phase in progress, the one a failing build fails on.
+	current string
+	// cached holds whether the completed vertexes were cached.
+	cached         map[digest.Digest]bool
+	prepareStarted time.Time
+	pushStarted    time.Time
+	pushCompleted  time.Time
+}
+
+func newBuildObserver(r *pb.BuildRequest) *buildObserver {
+	var team string
+	switch {
+	case r.App != nil:
+		team = r.App.Team
+	case r.Job != nil:
+		team = r.Job.Team
+	}
+
+	return &buildObserver{
+		kind:    pb.BuildKind_name[int32(r.Kind)],
+		team:    metrics.Team(team),
+		started: time.Now(),
+		current: phaseDiscover,
+		cached:  make(map[digest.Digest]bool),
+	}
+}
+
+// discovered ends the discover phase, which lasts from the start of the build
+// until BuildKit is found in namespace.
+func (o *buildObserver) discovered(namespace string) {
+	o.namespace = namespace
+	o.observePhase(phaseDiscover, time.Since(o.started))
+}
+
+// prepare starts the prepare phase (e.g. writing the build context to disk
+// and creating the remote repositories), which ends once the solve starts.
+func (o *buildObserver) prepare() {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	o.current = phasePrepare
+	o.prepareStarted = time.Now()
+}
+
+// phase starts the named phase, returning the function which ends it.
+func (o *buildObserver) phase(name string) func() {
+	o.setCurrent(name)
+
+	start := time.Now()
+	return func() {
+		o.observePhase(name, time.Since(start))
+	}
+}
+
+// solve starts the solve phase, returning the function which ends it. Since
+// BuildKit pushes the image within the solve, the push phase is taken out of
+// it according to the progress seen by observeStatus.
+func (o *buildObserver) solve() func() {
+	start := time.Now()
+
+	o.m.Lock()
+	o.current = phaseSolve
+	o.pushStarted, o.pushCompleted = time.Time{}, time.Time{}
+	prepareStarted := o.prepareStarted
+	o.prepareStarted = time.Time{}
+	o.m.Unlock()
+
+	if !prepareStarted.IsZero() {
+		o.observePhase(phasePrepare, start.Sub(prepareStarted))
+	}
+
+	return func() {
+		elapsed := time.Since(start)
+
+		o.m.Lock()
+		var push time.Duration
+		if !o.pushStarted.IsZero() && o.pushCompleted.After(o.pushStarted) {
+			push = o.pushCompleted.Sub(o.pushStarted)
+		}
+		o.m.Unlock()
+
+		o.observePhase(phaseSolve, elapsed-push)
+		if push > 0 {
+			o.observePhase(phasePush, push)
+		}
+	}
+}
+
+// observeStatus follows the solve progress, noting the cached vertexes and
+// when the image push starts and ends.
+func (o *buildObserver) observeStatus(s *client.SolveStatus) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	for _, v := range s.Vertexes {
+		if v.Completed != nil {
+			o.cached[v.Digest] = v.Cached
+		}
+	}
+
+	for _, vs := range s.Statuses {
+		if !strings.HasPrefix(vs.ID, "pushing ") {
+			continue
+		}
+
+		if vs.Started != nil && (o.pushStarted.IsZero() || vs.Started.Before(o.pushStarted)) {
+			o.pushStarted = *vs.Started
+			o.current = phasePush
+		}
+
+		if vs.Completed != nil && vs.Completed.After(o.pushCompleted) {
+			o.pushCompleted = *vs.Completed
+		}
+	}
+}
+
+// done records the build outcome, err being nil if it succeeded.
+func (o *buildObserver) done(err error) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	if len(o.cached) > 0 {
+		var hits int
+		for _, cached := range o.cached {
+			if cached {
+				hits++
+			}
+		}
+
+		metrics.BuildCacheHitRatio.WithLabelValues(o.namespace, o.team).Observe(float64(hits) / float64(len(o.cached)))
+	}
+
+	if err != nil {
+		metrics.BuildsFailed.WithLabelValues(o.kind, failureReason(err, o.current)).Inc()
+	}
+}
+
+func (o *buildObserver) setCurrent(phase string) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	o.current = phase
+}
+
+func (o *buildObserver) observePhase(phase string, d time.Duration) {
+	metrics.BuildPhaseDuration.WithLabelValues(o.namespace, phase, o.team).Observe(d.Seconds())
+}
+
+// failureReason returns the bounded reason of a failed build: canceled,
+// timeout, lease_lost or the phase it failed on.
+func failureReason(err error, phase string) string {
+	switch {
+	case errors.Is(err, autodiscovery.ErrLeaseLost):
+		return "lease_lost"
+	case errors.Is(err, context.Canceled) || status.Code(err) == codes.Canceled:
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded) || status.Code(err) == codes.DeadlineExceeded:
+		return "timeout"
+	}
+
+	return phase
+}
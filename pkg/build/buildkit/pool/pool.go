@@ -0,0 +1,236 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package pool balances builds across a static list of BuildKit endpoints,
+// which is meant for installations running buildkitd outside Kubernetes
+// (e.g. on VMs).
+// Endpoints are health checked periodically (through BuildKit's ListWorkers
+// API): unhealthy endpoints are ejected from the pool and brought back as
+// soon as they respond again. Builds are sent to the healthy endpoint with
+// the least active builds.
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+
+	"github.com/tsuru/deploy-agent/pkg/build/buildkit/metrics"
+)
+
+const (
+	DefaultHealthCheckInterval = 10 * time.Second
+	DefaultHealthCheckTimeout  = 5 * time.Second
+)
+
+var ErrNoHealthyEndpoint = status.Error(codes.Unavailable, "no healthy BuildKit endpoint available")
+
+type Options struct {
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+}
+
+type Endpoint struct {
+	cli     *client.Client
+	address string
+	active  int
+	healthy bool
+}
+
+func (e *Endpoint) Address() string { return e.address }
+
+func (e *Endpoint) Client() *client.Client { return e.cli }
+
+type Pool struct {
+	// check reports whether the endpoint's BuildKit is able to run builds,
+	// it's replaced on tests.
+	check     func(ctx context.Context, c *client.Client) error
+	cancel    context.CancelFunc
+	endpoints []*Endpoint
+	opts      Options
+	next      int
+	m         sync.Mutex
+}
+
+// New creates a pool with a BuildKit client for each address. Endpoints
+// start as healthy and are checked right away by Start.
+func New(ctx context.Context, addresses []string, opts Options) (*Pool, error) {
+	if len(addresses) == 0 {
+		return nil, errors.New("pool requires at least one BuildKit address")
+	}
+
+	if opts.HealthCheckInterval <= 0 {
+		opts.HealthCheckInterval = DefaultHealthCheckInterval
+	}
+
+	if opts.HealthCheckTimeout <= 0 {
+		opts.HealthCheckTimeout = DefaultHealthCheckTimeout
+	}
+
+	p := &Pool{check: Check, opts: opts}
+
+	for _, addr := range addresses {
+		c, err := client.New(ctx, addr, client.WithFailFast())
+		if err != nil {
+			p.Close()
+			return nil, fmt.Errorf("failed to create buildkit client for %s: %w", addr, err)
+		}
+
+		p.endpoints = append(p.endpoints, &Endpoint{cli: c, address: addr, healthy: true})
+		metrics.BuildKitEndpointHealthy.WithLabelValues(addr).Set(1)
+	}
+
+	return p, nil
+}
+
+// Start runs the health checks until Close is called.
+func (p *Pool) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	p.m.Lock()
+	p.cancel = cancel
+	p.m.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(p.opts.HealthCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			p.CheckHealth(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// CheckHealth checks every endpoint concurrently, updating whether they can
+// receive builds.
+func (p *Pool) CheckHealth(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, e := range p.endpoints {
+		wg.Add(1)
+		go func(e *Endpoint) {
+			defer wg.Done()
+
+			cctx, cancel := context.WithTimeout(ctx, p.opts.HealthCheckTimeout)
+			defer cancel()
+
+			err := p.check(cctx, e.cli)
+			if ctx.Err() != nil {
+				return
+			}
+
+			p.setHealthy(e, err == nil, err)
+		}(e)
+	}
+	wg.Wait()
+}
+
+// Acquire returns the healthy endpoint with the least active builds, skipping
+// the ones in exclude. The returned function must be called once the build
+// finishes.
+func (p *Pool) Acquire(exclude map[string]bool) (*Endpoint, func(), error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	var selected *Endpoint
+	for i := range p.endpoints {
+		// starting from a different endpoint each time spreads the builds
+		// among endpoints with the same number of active builds
+		e := p.endpoints[(p.next+i)%len(p.endpoints)]
+		if !e.healthy || exclude[e.address] {
+			continue
+		}
+
+		if selected == nil || e.active < selected.active {
+			selected = e
+		}
+	}
+
+	if selected == nil {
+		return nil, func() {}, ErrNoHealthyEndpoint
+	}
+
+	p.next = (p.next + 1) % len(p.endpoints)
+	selected.active++
+
+	var once sync.Once
+	return selected, func() {
+		once.Do(func() {
+			p.m.Lock()
+			selected.active--
+			p.m.Unlock()
+		})
+	}, nil
+}
+
+// Eject removes the endpoint from the pool until the next successful health
+// check.
+func (p *Pool) Eject(e *Endpoint, reason error) {
+	p.setHealthy(e, false, reason)
+}
+
+func (p *Pool) setHealthy(e *Endpoint, healthy bool, reason error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if e.healthy == healthy {
+		return
+	}
+
+	e.healthy = healthy
+
+	if healthy {
+		klog.Infof("BuildKit endpoint %s is healthy again, adding it back to the pool", e.address)
+		metrics.BuildKitEndpointHealthy.WithLabelValues(e.address).Set(1)
+		return
+	}
+
+	klog.Warningf("Ejecting BuildKit endpoint %s from the pool: %v", e.address, reason)
+	metrics.BuildKitEndpointHealthy.WithLabelValues(e.address).Set(0)
+}
+
+func (p *Pool) Close() error {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if p.cancel != nil {
+		p.cancel()
+	}
+
+	var errs []error
+	for _, e := range p.endpoints {
+		if err := e.cli.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Check reports whether the c client's BuildKit is able to run builds, i.e.
+// it's reachable and has workers.
+func Check(ctx context.Context, c *client.Client) error {
+	workers, err := c.ListWorkers(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(workers) == 0 {
+		return errors.New("no BuildKit workers available")
+	}
+
+	return nil
+}
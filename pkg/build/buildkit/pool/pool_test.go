@@ -0,0 +1,124 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/moby/buildkit/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestPool(t *testing.T, addresses ...string) *Pool {
+	t.Helper()
+
+	p, err := New(context.TODO(), addresses, Options{})
+	require.NoError(t, err)
+	t.Cleanup(func() { p.Close() })
+
+	return p
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(context.TODO(), nil, Options{})
+	assert.EqualError(t, err, "pool requires at least one BuildKit address")
+
+	p := newTestPool(t, "tcp://buildkit-0:1234", "tcp://buildkit-1:1234")
+	assert.Equal(t, DefaultHealthCheckInterval, p.opts.HealthCheckInterval)
+	assert.Equal(t, DefaultHealthCheckTimeout, p.opts.HealthCheckTimeout)
+	require.Len(t, p.endpoints, 2)
+	assert.Equal(t, "tcp://buildkit-0:1234", p.endpoints[0].Address())
+	assert.NotNil(t, p.endpoints[0].Client())
+}
+
+func TestPool_Acquire_LeastActiveBuilds(t *testing.T) {
+	p := newTestPool(t, "tcp://buildkit-0:1234", "tcp://buildkit-1:1234", "tcp://buildkit-2:1234")
+
+	var releases []func()
+	count := map[string]int{}
+	for i := 0; i < 6; i++ {
+		e, release, err := p.Acquire(nil)
+		require.NoError(t, err)
+		count[e.Address()]++
+		releases = append(releases, release)
+	}
+
+	assert.Equal(t, map[string]int{"tcp://buildkit-0:1234": 2, "tcp://buildkit-1:1234": 2, "tcp://buildkit-2:1234": 2}, count)
+
+	// releasing the builds of one endpoint makes it the least busy
+	for i, release := range releases {
+		if i%3 == 1 {
+			release()
+			release() // must be idempotent
+		}
+	}
+
+	idle := p.endpoints[1]
+	e, release, err := p.Acquire(nil)
+	require.NoError(t, err)
+	defer release()
+	assert.Equal(t, idle, e)
+	assert.Equal(t, 1, idle.active)
+}
+
+func TestPool_Acquire_SkipsEjectedAndExcluded(t *testing.T) {
+	p := newTestPool(t, "tcp://buildkit-0:1234", "tcp://buildkit-1:1234")
+
+	p.Eject(p.endpoints[0], errors.New("connection refused"))
+
+	for i := 0; i < 3; i++ {
+		e, release, err := p.Acquire(nil)
+		require.NoError(t, err)
+		assert.Equal(t, "tcp://buildkit-1:1234", e.Address())
+		release()
+	}
+
+	_, _, err := p.Acquire(map[string]bool{"tcp://buildkit-1:1234": true})
+	assert.ErrorIs(t, err, ErrNoHealthyEndpoint)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestPool_CheckHealth(t *testing.T) {
+	p := newTestPool(t, "tcp://buildkit-0:1234", "tcp://buildkit-1:1234")
+
+	var m sync.Mutex
+	unhealthy := map[*client.Client]bool{p.endpoints[0].cli: true}
+	p.check = func(ctx context.Context, c *client.Client) error {
+		m.Lock()
+		defer m.Unlock()
+
+		if unhealthy[c] {
+			return fmt.Errorf("connection refused")
+		}
+		return nil
+	}
+
+	p.CheckHealth(context.TODO())
+	assert.False(t, p.endpoints[0].healthy)
+	assert.True(t, p.endpoints[1].healthy)
+
+	m.Lock()
+	unhealthy = map[*client.Client]bool{}
+	m.Unlock()
+
+	p.CheckHealth(context.TODO())
+	assert.True(t, p.endpoints[0].healthy, "endpoint must be added back once healthy")
+	assert.True(t, p.endpoints[1].healthy)
+}
+
+func TestCheck(t *testing.T) {
+	c, err := client.New(context.TODO(), "tcp://127.0.0.1:1", client.WithFailFast())
+	require.NoError(t, err)
+	defer c.Close()
+
+	assert.Error(t, Check(context.TODO(), c))
+}
@@ -0,0 +1,184 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package buildkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/containerd/console"
+	"github.com/moby/buildkit/client"
+
+	"github.com/tsuru/deploy-agent/pkg/build/buildkit/autodiscovery"
+	"github.com/tsuru/deploy-agent/pkg/build/buildkit/failure"
+	"github.com/tsuru/deploy-agent/pkg/build/buildkit/metrics"
+	"github.com/tsuru/deploy-agent/pkg/build/buildkit/pool"
+	pb "github.com/tsuru/deploy-agent/pkg/build/grpc_build_v1"
+)
+
+// RetryPolicy retries the solves failing for transient reasons (see
+// failure.Transient), e.g. the BuildKit pod being evicted or its connection
+// resetting mid-solve.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a solve is tried, at most. Solves
+	// aren't retried when it's lower than 2.
+	MaxAttempts int
+	// Backoff is the wait before the first retry, doubling on every retry.
+	Backoff time.Duration
+}
+
+// dialFunc returns the BuildKit client to run the build, which calls abort
+// if the build must stop since the lease on its pod was lost.
+type dialFunc func(ctx context.Context, abort context.CancelCauseFunc) (*client.Client, clientCleanUp, string, error)
+
+// conn is the BuildKit a build runs on. Retries replace it, releasing the
+// previous BuildKit (and the lease on its pod) before dialing a new one.
+type conn struct {
+	parent context.Context
+	dial   dialFunc
+	// pool is set on the conns to pool endpoints, which fail over to other
+	// endpoints when theirs is unavailable before the solve.
+	pool     *pool.Pool
+	endpoint *pool.Endpoint
+	tried    map[string]bool
+
+	// ctx is canceled when the lease on the BuildKit pod is lost.
+	ctx       context.Context
+	abort     context.CancelCauseFunc
+	client    *client.Client
+	namespace string
+	cleanUp   clientCleanUp
+}
+
+func newConn(ctx context.Context, dial dialFunc) (*conn, error) {
+	bk := &conn{parent: ctx, dial: dial}
+	return bk, bk.connect()
+}
+
+func (bk *conn) connect() error {
+	ctx, abort := context.WithCancelCause(bk.parent)
+
+	c, cleanUp, namespace, err := bk.dial(ctx, abort)
+	if err != nil {
+		abort(nil)
+		return err
+	}
+
+	bk.ctx, bk.abort, bk.client, bk.namespace, bk.cleanUp = ctx, abort, c, namespace, cleanUp
+	return nil
+}
+
+func (bk *conn) close() {
+	if bk.cleanUp != nil {
+		bk.cleanUp()
+		bk.cleanUp = nil
+	}
+
+	if bk.abort != nil {
+		bk.abort(nil)
+	}
+}
+
+// cause returns the lost lease which made the build fail with err, if any.
+func (bk *conn) cause(err error) error {
+	if bk.ctx == nil || err == nil {
+		return err
+	}
+
+	if cause := context.Cause(bk.ctx); errors.Is(cause, autodiscovery.ErrLeaseLost) {
+		return cause
+	}
+
+	return err
+}
+
+// solve runs callBuildKitBuild on the conn's BuildKit, retrying it on a new
+// one as set in the retry policy. Retries reuse the build context already
+// written to buildContextDir.
+func (b *BuildKit) solve(bk *conn, o *buildObserver, buildContextDir string, r *pb.BuildRequest, w console.File) error {
+	policy := b.options().Retry
+	backoff := policy.Backoff
+
+	for attempt := 1; ; attempt++ {
+		err := bk.cause(b.callBuildKitBuild(bk.ctx, bk.client, o, buildContextDir, r, w))
+
+		// failing over doesn't count as a retry, since nothing ran
+		var uerr *endpointUnavailableError
+		for bk.pool != nil && errors.As(err, &uerr) && bk.parent.Err() == nil {
+			if ferr := bk.failover(w, uerr.err); ferr != nil {
+				return ferr
+			}
+			err = bk.cause(b.callBuildKitBuild(bk.ctx, bk.client, o, buildContextDir, r, w))
+		}
+
+		if err == nil || attempt >= policy.MaxAttempts || !failure.Transient(err) || bk.parent.Err() != nil {
+			return err
+		}
+
+		reason := failure.Reason(err)
+		metrics.BuildRetries.WithLabelValues(reason).Inc()
+		fmt.Fprintf(w, "\n ---> Build failed due to a transient BuildKit error (%s: %v), retrying it (attempt %d of %d)...\n\n", reason, err, attempt+1, policy.MaxAttempts)
+
+		select {
+		case <-time.After(backoff):
+		case <-bk.parent.Done():
+			return err
+		}
+		backoff *= 2
+
+		bk.close()
+		if err := bk.connect(); err != nil {
+			return failure.BuildKitUnavailable(err)
+		}
+		o.namespace = bk.namespace
+	}
+}
+
+// poolConn returns the conn to the p pool's endpoint with the least active
+// builds, releasing it on close.
+func poolConn(ctx context.Context, p *pool.Pool) (*conn, error) {
+	bk := &conn{parent: ctx, pool: p, tried: make(map[string]bool)}
+	bk.dial = func(context.Context, context.CancelCauseFunc) (*client.Client, clientCleanUp, string, error) {
+		e, release, err := p.Acquire(bk.tried)
+		if err != nil {
+			return nil, nil, "", err
+		}
+
+		bk.endpoint = e
+		return e.Client(), clientCleanUp(release), defaultBuildKitNamespace, nil
+	}
+
+	return bk, bk.connect()
+}
+
+// failover ejects the conn's pool endpoint, which could not be reached
+// (failing with err), connecting to another endpoint. It returns err, marked
+// as BuildKit being unavailable, when there's no other endpoint left.
+func (bk *conn) failover(w io.Writer, err error) error {
+	address := bk.endpoint.Address()
+	bk.pool.Eject(bk.endpoint, err)
+	bk.tried[address] = true
+
+	fmt.Fprintf(w, "BuildKit at %s is unavailable (%v), trying another one...\n", address, err)
+
+	bk.close()
+	if cerr := bk.connect(); cerr != nil {
+		return failure.BuildKitUnavailable(err)
+	}
+
+	return nil
+}
+
+// fixedConn returns the conn to the c client, which retries use again.
+func fixedConn(ctx context.Context, c *client.Client, namespace string) *conn {
+	bk := &conn{parent: ctx, dial: func(context.Context, context.CancelCauseFunc) (*client.Client, clientCleanUp, string, error) {
+		return c, nil, namespace, nil
+	}}
+	bk.connect() //nolint:errcheck // dialing a fixed client never fails
+	return bk
+}
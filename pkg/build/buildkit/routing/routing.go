@@ -0,0 +1,212 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package routing picks which BuildKit should run a build based on rules
+// matching the build request, e.g. to send builds of premium teams to
+// dedicated builders or platform builds to a separate pool.
+// Rules are evaluated in order and the first one matching wins; builds
+// matching no rule go to the default BuildKit.
+package routing
+
+import (
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/tsuru/deploy-agent/pkg/build"
+	pb "github.com/tsuru/deploy-agent/pkg/build/grpc_build_v1"
+)
+
+type Rule struct {
+	// Name identifies the rule on logs and error messages.
+	Name   string `json:"name"`
+	Match  Match  `json:"match"`
+	Target Target `json:"target"`
+}
+
+// Match holds the conditions of a rule. Every condition set must match the
+// request, a condition matches when any of its values does. Except for kinds,
+// values can be shell patterns (e.g. "premium-*").
+type Match struct {
+	Apps       []string `json:"apps,omitempty"`
+	Jobs       []string `json:"jobs,omitempty"`
+	Teams      []string `json:"teams,omitempty"`
+	Pools      []string `json:"pools,omitempty"`
+	Kinds      []string `json:"kinds,omitempty"`
+	Registries []string `json:"registries,omitempty"`
+}
+
+// Target is where the matching builds run: either a static BuildKit
+// address or BuildKit pods discovered on Kubernetes by label selector and
+// namespace.
+type Target struct {
+	Address     string `json:"address,omitempty"`
+	PodSelector string `json:"podSelector,omitempty"`
+	Namespace   string `json:"namespace,omitempty"`
+}
+
+func (t Target) IsDiscovery() bool {
+	return t.PodSelector != ""
+}
+
+// Route returns the first rule matching the request, or nil if none does.
+func Route(rules []Rule, req *pb.BuildRequest) *Rule {
+	for i := range rules {
+		if rules[i].Match.matches(req) {
+			return &rules[i]
+		}
+	}
+
+	return nil
+}
+
+// Validate checks the rules, discoveryEnabled tells whether Kubernetes
+// discovery is available for discovery targets.
+func Validate(rules []Rule, discoveryEnabled bool) error {
+	var errs []error
+
+	names := make(map[string]bool)
+	for i, r := range rules {
+		prefix := fmt.Sprintf("rule[%d]", i)
+		if r.Name != "" {
+			prefix = fmt.Sprintf("rule %q", r.Name)
+
+			if names[r.Name] {
+				errs = append(errs, fmt.Errorf("%s: duplicated name", prefix))
+			}
+			names[r.Name] = true
+		}
+
+		if r.Match.isEmpty() {
+			errs = append(errs, fmt.Errorf("%s: must match at least one condition", prefix))
+		}
+
+		for _, k := range r.Match.Kinds {
+			if _, found := pb.BuildKind_value[k]; !found {
+				errs = append(errs, fmt.Errorf("%s: unknown build kind %q", prefix, k))
+			}
+		}
+
+		for _, p := range r.Match.patterns() {
+			if _, err := path.Match(p, ""); err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid pattern %q: %w", prefix, p, err))
+			}
+		}
+
+		switch {
+		case r.Target.Address == "" && !r.Target.IsDiscovery():
+			errs = append(errs, fmt.Errorf("%s: target must set either address or podSelector", prefix))
+
+		case r.Target.Address != "" && r.Target.IsDiscovery():
+			errs = append(errs, fmt.Errorf("%s: target cannot set both address and podSelector", prefix))
+
+		case r.Target.IsDiscovery() && r.Target.Namespace == "":
+			errs = append(errs, fmt.Errorf("%s: target namespace is required along with podSelector", prefix))
+
+		case r.Target.IsDiscovery() && !discoveryEnabled:
+			errs = append(errs, fmt.Errorf("%s: target podSelector requires discovery on Kubernetes to be enabled", prefix))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (m Match) isEmpty() bool {
+	return len(m.Apps) == 0 && len(m.Jobs) == 0 && len(m.Teams) == 0 &&
+		len(m.Pools) == 0 && len(m.Kinds) == 0 && len(m.Registries) == 0
+}
+
+func (m Match) patterns() []string {
+	var p []string
+	for _, values := range [][]string{m.Apps, m.Jobs, m.Teams, m.Pools, m.Registries} {
+		p = append(p, values...)
+	}
+	return p
+}
+
+func (m Match) matches(req *pb.BuildRequest) bool {
+	if m.isEmpty() {
+		return false
+	}
+
+	if len(m.Apps) > 0 && (req.App == nil || !matchAny(m.Apps, req.App.Name)) {
+		return false
+	}
+
+	if len(m.Jobs) > 0 && (req.Job == nil || !matchAny(m.Jobs, req.Job.Name)) {
+		return false
+	}
+
+	if len(m.Teams) > 0 && !matchAny(m.Teams, team(req)) {
+		return false
+	}
+
+	if len(m.Pools) > 0 && !matchAny(m.Pools, req.Pool) {
+		return false
+	}
+
+	if len(m.Kinds) > 0 && !matchKind(m.Kinds, req.Kind) {
+		return false
+	}
+
+	if len(m.Registries) > 0 && !matchRegistries(m.Registries, req.DestinationImages) {
+		return false
+	}
+
+	return true
+}
+
+func team(req *pb.BuildRequest) string {
+	if req.App != nil {
+		return req.App.Team
+	}
+
+	if req.Job != nil {
+		return req.Job.Team
+	}
+
+	return ""
+}
+
+func matchAny(patterns []string, value string) bool {
+	if value == "" {
+		return false
+	}
+
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, value); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchKind(kinds []string, kind pb.BuildKind) bool {
+	for _, k := range kinds {
+		// kinds have aliases (e.g. BUILD_KIND_APP_BUILD_WITH_SOURCE_UPLOAD and
+		// BUILD_KIND_APP_DEPLOY_WITH_SOURCE_UPLOAD), so compare their values
+		if pb.BuildKind(pb.BuildKind_value[k]) == kind {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchRegistries tells whether every destination image is pushed to one of
+// the registries.
+func matchRegistries(registries, images []string) bool {
+	if len(images) == 0 {
+		return false
+	}
+
+	for _, image := range images {
+		if !matchAny(registries, build.GetRegistry(image)) {
+			return false
+		}
+	}
+
+	return true
+}
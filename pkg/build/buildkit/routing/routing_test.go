@@ -0,0 +1,126 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package routing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	pb "github.com/tsuru/deploy-agent/pkg/build/grpc_build_v1"
+)
+
+func TestRoute(t *testing.T) {
+	rules := []Rule{
+		{
+			Name:   "platforms",
+			Match:  Match{Kinds: []string{"BUILD_KIND_PLATFORM_WITH_CONTAINER_IMAGE", "BUILD_KIND_PLATFORM_WITH_CONTAINER_FILE"}},
+			Target: Target{Address: "tcp://buildkit-platforms:1234"},
+		},
+		{
+			Name:   "premium",
+			Match:  Match{Teams: []string{"premium-*"}, Pools: []string{"prod"}},
+			Target: Target{PodSelector: "app=buildkit-premium", Namespace: "buildkit-premium"},
+		},
+		{
+			Name:   "batch-jobs",
+			Match:  Match{Jobs: []string{"batch-*"}},
+			Target: Target{Address: "tcp://buildkit-batch:1234"},
+		},
+		{
+			Name:   "private-registry",
+			Match:  Match{Apps: []string{"legacy", "other"}, Registries: []string{"*.private.example.com"}},
+			Target: Target{Address: "tcp://buildkit-private:1234"},
+		},
+		{
+			Name:   "source-deploys",
+			Match:  Match{Kinds: []string{"BUILD_KIND_APP_DEPLOY_WITH_SOURCE_UPLOAD"}},
+			Target: Target{Address: "tcp://buildkit-source:1234"},
+		},
+	}
+
+	tests := map[string]struct {
+		req      *pb.BuildRequest
+		expected string
+	}{
+		"platform build": {
+			req:      &pb.BuildRequest{Kind: pb.BuildKind_BUILD_KIND_PLATFORM_WITH_CONTAINER_FILE, Platform: &pb.TsuruPlatform{Name: "python"}},
+			expected: "platforms",
+		},
+		"app from premium team on prod pool": {
+			req:      &pb.BuildRequest{Kind: pb.BuildKind_BUILD_KIND_APP_BUILD_WITH_CONTAINER_IMAGE, App: &pb.TsuruApp{Name: "my-app", Team: "premium-a"}, Pool: "prod"},
+			expected: "premium",
+		},
+		"job from premium team on prod pool": {
+			req:      &pb.BuildRequest{Kind: pb.BuildKind_BUILD_KIND_JOB_CREATE_WITH_CONTAINER_IMAGE, Job: &pb.TsuruJob{Name: "my-job", Team: "premium-b"}, Pool: "prod"},
+			expected: "premium",
+		},
+		"app from premium team on another pool": {
+			req: &pb.BuildRequest{Kind: pb.BuildKind_BUILD_KIND_APP_BUILD_WITH_CONTAINER_IMAGE, App: &pb.TsuruApp{Name: "my-app", Team: "premium-a"}, Pool: "dev"},
+		},
+		"job by name": {
+			req:      &pb.BuildRequest{Kind: pb.BuildKind_BUILD_KIND_JOB_DEPLOY_WITH_CONTAINER_FILE, Job: &pb.TsuruJob{Name: "batch-reports"}},
+			expected: "batch-jobs",
+		},
+		"app named like a job": {
+			req: &pb.BuildRequest{Kind: pb.BuildKind_BUILD_KIND_APP_BUILD_WITH_CONTAINER_IMAGE, App: &pb.TsuruApp{Name: "batch-reports"}},
+		},
+		"app pushing to private registry": {
+			req:      &pb.BuildRequest{Kind: pb.BuildKind_BUILD_KIND_APP_BUILD_WITH_CONTAINER_FILE, App: &pb.TsuruApp{Name: "legacy"}, DestinationImages: []string{"registry.private.example.com/tsuru/app-legacy:v1", "registry.private.example.com/tsuru/app-legacy:latest"}},
+			expected: "private-registry",
+		},
+		"app pushing to private and public registries": {
+			req: &pb.BuildRequest{Kind: pb.BuildKind_BUILD_KIND_APP_BUILD_WITH_CONTAINER_FILE, App: &pb.TsuruApp{Name: "legacy"}, DestinationImages: []string{"registry.private.example.com/tsuru/app-legacy:v1", "tsuru/app-legacy:latest"}},
+		},
+		"kind alias": {
+			req:      &pb.BuildRequest{Kind: pb.BuildKind_BUILD_KIND_APP_BUILD_WITH_SOURCE_UPLOAD, App: &pb.TsuruApp{Name: "my-app"}},
+			expected: "source-deploys",
+		},
+		"no match": {
+			req: &pb.BuildRequest{Kind: pb.BuildKind_BUILD_KIND_APP_BUILD_WITH_CONTAINER_IMAGE, App: &pb.TsuruApp{Name: "my-app", Team: "team-a"}},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := Route(rules, tt.req)
+			if tt.expected == "" {
+				assert.Nil(t, r)
+				return
+			}
+
+			require.NotNil(t, r)
+			assert.Equal(t, tt.expected, r.Name)
+		})
+	}
+
+	assert.Nil(t, Route(nil, &pb.BuildRequest{}))
+}
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, Validate(nil, false))
+	assert.NoError(t, Validate([]Rule{
+		{Name: "a", Match: Match{Teams: []string{"a"}}, Target: Target{Address: "tcp://buildkit-a:1234"}},
+		{Name: "b", Match: Match{Teams: []string{"b"}}, Target: Target{PodSelector: "app=buildkit-b", Namespace: "b"}},
+	}, true))
+
+	err := Validate([]Rule{
+		{Name: "a", Match: Match{Kinds: []string{"BUILD_KIND_UNKNOWN"}}, Target: Target{Address: "tcp://buildkit-a:1234"}},
+		{Name: "a", Match: Match{Teams: []string{"[a"}}, Target: Target{Address: "tcp://buildkit-a:1234", PodSelector: "app=buildkit"}},
+		{Target: Target{}},
+		{Name: "d", Match: Match{Pools: []string{"d"}}, Target: Target{PodSelector: "app=buildkit"}},
+		{Name: "e", Match: Match{Pools: []string{"e"}}, Target: Target{PodSelector: "app=buildkit", Namespace: "e"}},
+	}, false)
+	require.Error(t, err)
+	assert.ErrorContains(t, err, `rule "a": unknown build kind "BUILD_KIND_UNKNOWN"`)
+	assert.ErrorContains(t, err, `rule "a": duplicated name`)
+	assert.ErrorContains(t, err, `rule "a": invalid pattern "[a"`)
+	assert.ErrorContains(t, err, `rule "a": target cannot set both address and podSelector`)
+	assert.ErrorContains(t, err, "rule[2]: must match at least one condition")
+	assert.ErrorContains(t, err, "rule[2]: target must set either address or podSelector")
+	assert.ErrorContains(t, err, `rule "d": target namespace is required along with podSelector`)
+	assert.ErrorContains(t, err, `rule "e": target podSelector requires discovery on Kubernetes to be enabled`)
+}
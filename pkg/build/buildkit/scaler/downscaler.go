@@ -6,31 +6,211 @@ package scaler
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/tsuru/deploy-agent/pkg/build/metadata"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 	"k8s.io/klog"
 )
 
-func StartWorker(clientset *kubernetes.Clientset, podSelector, statefulSet string, graceful time.Duration) {
-	ctx := context.Background()
+// Leader election timings of the downscaler, the same defaults of
+// Kubernetes controllers.
+var (
+	leaderLeaseDuration = 15 * time.Second
+	leaderRenewDeadline = 10 * time.Second
+	leaderRetryPeriod   = 2 * time.Second
+)
+
+type WorkerOptions struct {
+	PodSelector string
+	// Namespace of the BuildKit pods, every namespace when empty (e.g. when
+	// BuildKit runs along with apps).
+	Namespace string
+	// Targets are the other BuildKit pods builds are routed to, whose
+	// orphaned builds and stale Leases are garbage collected as well.
+	Targets        []Target
+	StatefulSet    string
+	GracefulPeriod time.Duration
+	// MaxReplicas greater than zero makes statefulsets be scaled in one
+	// replica at a time as their pods go idle.
+	MaxReplicas int32
+	// Interval between the downscaler runs.
+	Interval time.Duration
+	// Windows hold minimum replicas on schedule, the first open window
+	// matching a statefulset applies.
+	Windows []Window
+	// LeaseNamespace and LeaseName locate the Lease which elects the agent
+	// replica running the downscaler.
+	LeaseNamespace string
+	LeaseName      string
+	// LeasePrefix names the Leases on BuildKit pods, so the stale ones are
+	// garbage collected. It's disabled when empty.
+	LeasePrefix string
+}
+
+type Worker struct {
+	clientset kubernetes.Interface
+	recorder  record.EventRecorder
+	opts      WorkerOptions
+	m         sync.RWMutex
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// StartWorker downscales the BuildKit statefulsets periodically: they're
+// scaled to zero once every pod is idle and, whenever MaxReplicas is greater
+// than zero, scaled in one replica at a time as their pods go idle. Before
+// that, the builds and Leases left behind by agents gone mid-build are
+// garbage collected.
+//
+// Only the agent replica holding the Lease runs the downscaler, the others
+// keep campaigning to take over in case the leader goes away.
+func StartWorker(clientset kubernetes.Interface, recorder record.EventRecorder, opts WorkerOptions) (*Worker, error) {
+	identity, err := holderIdentity()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	w := &Worker{
+		clientset: clientset,
+		recorder:  recorder,
+		opts:      opts,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+
+	le, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  v1.ObjectMeta{Name: opts.LeaseName, Namespace: opts.LeaseNamespace},
+			Client:     clientset.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+		},
+		LeaseDuration:   leaderLeaseDuration,
+		RenewDeadline:   leaderRenewDeadline,
+		RetryPeriod:     leaderRetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            opts.LeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: w.downscale,
+			OnStoppedLeading: func() {
+				klog.V(2).Infof("%s stopped leading the BuildKit downscaler", identity)
+			},
+		},
+	})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
 
 	go func() {
+		defer close(w.done)
+
 		for {
-			err := runDownscaler(ctx, clientset, podSelector, statefulSet, graceful)
-			if err != nil {
-				klog.Errorf("failed to run downscaler tick: %s", err.Error())
+			le.Run(ctx)
+
+			// leadership lost, campaign again unless stopping
+			if ctx.Err() != nil {
+				return
 			}
-			time.Sleep(time.Minute * 5)
 		}
 	}()
+
+	return w, nil
 }
 
-func runDownscaler(ctx context.Context, clientset kubernetes.Interface, podSelector, statefulSet string, graceful time.Duration) (err error) {
+// Stop stops the worker, releasing the Lease if held so another replica
+// takes over right away.
+func (w *Worker) Stop() {
+	w.cancel()
+	<-w.done
+}
+
+// Update changes the pod selector, targets, graceful period, max replicas,
+// interval and windows used from the next run on.
+func (w *Worker) Update(opts WorkerOptions) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	w.opts.PodSelector = opts.PodSelector
+	w.opts.Targets = opts.Targets
+	w.opts.GracefulPeriod = opts.GracefulPeriod
+	w.opts.MaxReplicas = opts.MaxReplicas
+	w.opts.Interval = opts.Interval
+	w.opts.Windows = opts.Windows
+}
+
+func (w *Worker) options() WorkerOptions {
+	w.m.RLock()
+	defer w.m.RUnlock()
+
+	return w.opts
+}
+
+// downscale runs the downscaler every interval until ctx is done, i.e. until
+// leadership is lost or the worker is stopped.
+func (w *Worker) downscale(ctx context.Context) {
+	klog.V(2).Infof("Started leading the BuildKit downscaler")
+
+	for {
+		opts := w.options()
+
+		if err := prewarm(ctx, w.clientset, w.recorder, opts, time.Now()); err != nil {
+			klog.Errorf("failed to pre-warm statefulsets: %s", err.Error())
+		}
+
+		if err := collectGarbage(ctx, w.clientset, w.recorder, opts, time.Now()); err != nil {
+			klog.Errorf("failed to collect stale leases and build marks: %s", err.Error())
+		}
+
+		if err := runDownscaler(ctx, w.clientset, w.recorder, opts, time.Now()); err != nil {
+			klog.Errorf("failed to run downscaler tick: %s", err.Error())
+		}
+
+		// runs right away when a window opens, rather than up to an
+		// interval later
+		wait := opts.Interval
+		if next := nextWindowStart(opts.Windows, time.Now()); !next.IsZero() && time.Until(next) < wait {
+			wait = time.Until(next)
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func holderIdentity() (string, error) {
+	identity := os.Getenv("POD_NAME")
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return "", err
+		}
+		identity = hostname
+	}
+
+	return fmt.Sprintf("%s-%d", identity, time.Now().UnixNano()), nil
+}
+
+func runDownscaler(ctx context.Context, clientset kubernetes.Interface, recorder record.EventRecorder, opts WorkerOptions, now time.Time) (err error) {
 	defer func() {
 		recoverErr := recover()
 		if recoverErr != nil {
@@ -38,16 +218,24 @@ func runDownscaler(ctx context.Context, clientset kubernetes.Interface, podSelec
 		}
 	}()
 
+	statefulSet, graceful := opts.StatefulSet, opts.GracefulPeriod
+
 	buildKitPods, err := clientset.CoreV1().Pods("").List(ctx, v1.ListOptions{
-		LabelSelector: podSelector,
+		LabelSelector: opts.PodSelector,
 	})
 	if err != nil {
 		return err
 	}
 
 	maxEndtimeByNS := map[string]int64{}
+	podsByNS := map[string]map[string]*corev1.Pod{}
+
+	for i, pod := range buildKitPods.Items {
+		if podsByNS[pod.Namespace] == nil {
+			podsByNS[pod.Namespace] = make(map[string]*corev1.Pod)
+		}
+		podsByNS[pod.Namespace][pod.Name] = &buildKitPods.Items[i]
 
-	for _, pod := range buildKitPods.Items {
 		usageAt := int64(-1)
 
 		lastBuildStart := pod.Annotations[metadata.DeployAgentLastBuildStartingLabelKey]
@@ -81,40 +269,172 @@ func runDownscaler(ctx context.Context, clientset kubernetes.Interface, podSelec
 		}
 	}
 
-	now := time.Now().Unix()
 	gracefulPeriod := int64(graceful.Seconds())
-	zero := int32(0)
 
 	for ns, maxEndtime := range maxEndtimeByNS {
-		if maxEndtime == -1 {
-			continue
+		var minReplicas int32
+		window := activeWindow(opts.Windows, ns, statefulSet, now)
+		if window != nil {
+			minReplicas = window.MinReplicas
 		}
 
-		if now-maxEndtime < gracefulPeriod {
+		if maxEndtime == -1 || now.Unix()-maxEndtime < gracefulPeriod {
+			if opts.MaxReplicas > 0 {
+				mayScaleIn(ctx, clientset, recorder, opts, ns, podsByNS[ns], minReplicas, now)
+			}
 			continue
 		}
 
-		statefulset, err := clientset.AppsV1().StatefulSets(ns).Get(ctx, statefulSet, v1.GetOptions{})
+		scaled, replicas, err := scaleStatefulSet(ctx, clientset, ns, statefulSet, func(current int32) (int32, bool) {
+			return minReplicas, current > minReplicas
+		})
 		if err != nil {
-			klog.Errorf("failed to get statefulsets from ns: %s, err: %s", ns, err.Error())
+			klog.Errorf("failed to scale statefulsets from ns: %s, err: %s", ns, err.Error())
 			continue
 		}
 
-		if statefulset.Spec.Replicas != nil {
-			if *statefulset.Spec.Replicas == 0 {
-				continue
+		switch {
+		case scaled == nil:
+		case minReplicas == 0:
+			recordEvent(recorder, scaled, "ScaledToZero", "Scaled in from %d to 0 replicas since every pod is idle for longer than %s", replicas, graceful)
+		default:
+			recordEvent(recorder, scaled, "ScaledIn", "Scaled in from %d to %d replicas since every pod is idle for longer than %s, keeping the minimum of window %q", replicas, minReplicas, graceful, window.Name)
+		}
+	}
+
+	return nil
+}
+
+// mayScaleIn removes one replica of the statefulset whenever its pod with the
+// highest ordinal, which is the one removed by Kubernetes, is idle for longer
+// than the graceful period and no agent holds its Lease (a build may have
+// leased it without marking it yet), keeping at least minReplicas.
+func mayScaleIn(ctx context.Context, clientset kubernetes.Interface, recorder record.EventRecorder, opts WorkerOptions, ns string, pods map[string]*corev1.Pod, minReplicas int32, now time.Time) {
+	statefulSet, graceful := opts.StatefulSet, opts.GracefulPeriod
+
+	var last string
+
+	scaled, replicas, err := scaleStatefulSet(ctx, clientset, ns, statefulSet, func(current int32) (int32, bool) {
+		if current <= max(1, minReplicas) {
+			return current, false
+		}
+
+		last = fmt.Sprintf("%s-%d", statefulSet, current-1)
+
+		pod, found := pods[last]
+		if !found {
+			return current, false
+		}
+
+		idleSince, idle := podIdleSince(pod)
+		if !idle || now.Sub(idleSince) < graceful {
+			return current, false
+		}
+
+		if leased, err := podLeased(ctx, clientset, opts.LeasePrefix, pod, now); err != nil || leased {
+			if err != nil {
+				klog.Errorf("failed to get the lease of pod %s/%s: %s", ns, last, err.Error())
 			}
-			statefulset.Annotations[metadata.DeployAgentLastReplicasAnnotationKey] = fmt.Sprintf("%d", *statefulset.Spec.Replicas)
+			return current, false
 		}
 
-		statefulset.Spec.Replicas = &zero
+		return current - 1, true
+	})
+	if err != nil {
+		klog.Errorf("failed to scale statefulsets from ns: %s, err: %s", ns, err.Error())
+		return
+	}
 
-		_, err = clientset.AppsV1().StatefulSets(ns).Update(ctx, statefulset, v1.UpdateOptions{})
+	if scaled != nil {
+		recordEvent(recorder, scaled, "ScaledIn", "Scaled in from %d to %d replicas since pod %s is idle for longer than %s", replicas, replicas-1, last, graceful)
+	}
+}
+
+// scaleStatefulSet changes the replicas of the statefulset through its Scale
+// subresource, retrying on conflicts with other writers (e.g. builds scaling
+// it up). desired gets the current replicas and returns the wanted ones, or
+// false to keep them. It returns the scaled statefulset, if so, and its
+// previous replicas.
+//
+// Before scaling to zero, the current replicas are saved in the
+// DeployAgentLastReplicasAnnotationKey annotation for MayUpscale.
+func scaleStatefulSet(ctx context.Context, clientset kubernetes.Interface, ns, name string, desired func(current int32) (int32, bool)) (*appsv1.StatefulSet, int32, error) {
+	var (
+		scaled   *appsv1.StatefulSet
+		replicas int32
+	)
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		scaled = nil
+
+		scale, err := clientset.AppsV1().StatefulSets(ns).GetScale(ctx, name, v1.GetOptions{})
 		if err != nil {
-			klog.Errorf("failed to update statefullsets from ns: %s, err: %s", ns, err.Error())
-			continue
+			return err
 		}
+
+		wanted, ok := desired(scale.Spec.Replicas)
+		if !ok {
+			return nil
+		}
+
+		if wanted == 0 {
+			// resourceVersion is a precondition, so the patch conflicts
+			// just like the scale update would
+			patch, err := json.Marshal(map[string]any{
+				"metadata": map[string]any{
+					"resourceVersion": scale.ResourceVersion,
+					"annotations": map[string]string{
+						metadata.DeployAgentLastReplicasAnnotationKey: strconv.Itoa(int(scale.Spec.Replicas)),
+					},
+				},
+			})
+			if err != nil {
+				return err
+			}
+
+			sts, err := clientset.AppsV1().StatefulSets(ns).Patch(ctx, name, types.MergePatchType, patch, v1.PatchOptions{})
+			if err != nil {
+				return err
+			}
+
+			scale.ResourceVersion = sts.ResourceVersion
+		}
+
+		replicas = scale.Spec.Replicas
+		scale.Spec.Replicas = wanted
+
+		updated, err := clientset.AppsV1().StatefulSets(ns).UpdateScale(ctx, name, scale, v1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+
+		scaled = &appsv1.StatefulSet{ObjectMeta: updated.ObjectMeta}
+		return nil
+	})
+
+	return scaled, replicas, err
+}
+
+// podIdleSince returns since when the pod runs no build according to the
+// annotations set by discovery, or false if it's running a build.
+func podIdleSince(pod *corev1.Pod) (time.Time, bool) {
+	lastBuildStart := pod.Annotations[metadata.DeployAgentLastBuildStartingLabelKey]
+	lastBuildEnd := pod.Annotations[metadata.DeployAgentLastBuildEndingTimeLabelKey]
+
+	// pod re-scheduled and losed starting and ending annotations
+	if lastBuildStart == "" && lastBuildEnd == "" {
+		return pod.CreationTimestamp.Time, true
 	}
 
-	return nil
+	if lastBuildEnd == "" {
+		return time.Time{}, false
+	}
+
+	end, err := strconv.ParseInt(lastBuildEnd, 10, 64)
+	if err != nil {
+		klog.Errorf("failed to parseint: %s", err.Error())
+		return time.Time{}, false
+	}
+
+	return time.Unix(end, 0), true
 }
@@ -6,6 +6,7 @@ package scaler
 
 import (
 	"context"
+	"errors"
 	"strconv"
 	"testing"
 	"time"
@@ -14,20 +15,69 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/tsuru/deploy-agent/pkg/build/metadata"
 	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes/fake"
+	k8sTesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/utils/ptr"
 )
 
 var testGraceful = time.Hour * 2
 
+// withScaleSubresource makes the fake clientset serve the Scale subresource
+// of statefulsets, which its object tracker lacks.
+func withScaleSubresource(cli *fake.Clientset) *fake.Clientset {
+	gvr := appsv1.SchemeGroupVersion.WithResource("statefulsets")
+
+	cli.PrependReactor("get", "statefulsets", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "scale" {
+			return false, nil, nil
+		}
+
+		obj, err := cli.Tracker().Get(gvr, action.GetNamespace(), action.(k8sTesting.GetAction).GetName())
+		if err != nil {
+			return true, nil, err
+		}
+
+		sts := obj.(*appsv1.StatefulSet)
+		return true, &autoscalingv1.Scale{ObjectMeta: sts.ObjectMeta, Spec: autoscalingv1.ScaleSpec{Replicas: ptr.Deref(sts.Spec.Replicas, 1)}}, nil
+	})
+
+	cli.PrependReactor("update", "statefulsets", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "scale" {
+			return false, nil, nil
+		}
+
+		scale := action.(k8sTesting.UpdateAction).GetObject().(*autoscalingv1.Scale)
+
+		obj, err := cli.Tracker().Get(gvr, action.GetNamespace(), scale.Name)
+		if err != nil {
+			return true, nil, err
+		}
+
+		sts := obj.(*appsv1.StatefulSet).DeepCopy()
+		sts.Spec.Replicas = ptr.To(scale.Spec.Replicas)
+		if err = cli.Tracker().Update(gvr, sts, action.GetNamespace()); err != nil {
+			return true, nil, err
+		}
+
+		return true, &autoscalingv1.Scale{ObjectMeta: sts.ObjectMeta, Spec: scale.Spec}, nil
+	})
+
+	return cli
+}
+
 func TestRunDownscaler(t *testing.T) {
 	ctx := context.Background()
 
 	lastBuild := time.Now().Add(-3 * time.Hour).Unix()
 
-	cli := fake.NewSimpleClientset(
+	cli := withScaleSubresource(fake.NewSimpleClientset(
 		&corev1.Pod{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      "buildkit-0",
@@ -56,9 +106,9 @@ func TestRunDownscaler(t *testing.T) {
 				Replicas: ptr.To(int32(1)),
 			},
 		},
-	)
+	))
 
-	err := runDownscaler(ctx, cli, "app=buildkit", "buildkit", testGraceful)
+	err := runDownscaler(ctx, cli, nil, WorkerOptions{PodSelector: "app=buildkit", StatefulSet: "buildkit", GracefulPeriod: testGraceful}, time.Now())
 	assert.NoError(t, err)
 
 	rs, err := cli.AppsV1().StatefulSets("").List(ctx, metav1.ListOptions{})
@@ -73,7 +123,7 @@ func TestRunDownscalerWithReplacedBuildkit(t *testing.T) {
 
 	lastBuild := time.Now().Add(-3 * time.Hour)
 
-	cli := fake.NewSimpleClientset(
+	cli := withScaleSubresource(fake.NewSimpleClientset(
 		&corev1.Pod{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      "buildkit-0",
@@ -99,9 +149,9 @@ func TestRunDownscalerWithReplacedBuildkit(t *testing.T) {
 				Replicas: ptr.To(int32(1)),
 			},
 		},
-	)
+	))
 
-	err := runDownscaler(ctx, cli, "app=buildkit", "buildkit", testGraceful)
+	err := runDownscaler(ctx, cli, nil, WorkerOptions{PodSelector: "app=buildkit", StatefulSet: "buildkit", GracefulPeriod: testGraceful}, time.Now())
 	assert.NoError(t, err)
 
 	rs, err := cli.AppsV1().StatefulSets("").List(ctx, metav1.ListOptions{})
@@ -116,7 +166,7 @@ func TestRunDownscalerWithEarlyBuild(t *testing.T) {
 
 	lastBuild := time.Now().Add(-30 * time.Minute).Unix()
 
-	cli := fake.NewSimpleClientset(
+	cli := withScaleSubresource(fake.NewSimpleClientset(
 		&corev1.Pod{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      "buildkit-0",
@@ -145,9 +195,9 @@ func TestRunDownscalerWithEarlyBuild(t *testing.T) {
 				Replicas: ptr.To(int32(1)),
 			},
 		},
-	)
+	))
 
-	err := runDownscaler(ctx, cli, "app=buildkit", "buildkit", testGraceful)
+	err := runDownscaler(ctx, cli, nil, WorkerOptions{PodSelector: "app=buildkit", StatefulSet: "buildkit", GracefulPeriod: testGraceful}, time.Now())
 	assert.NoError(t, err)
 
 	rs, err := cli.AppsV1().StatefulSets("").List(ctx, metav1.ListOptions{})
@@ -162,7 +212,7 @@ func TestRunDownscalerWithOnePodBuilding(t *testing.T) {
 
 	lastBuild := time.Now().Add(-3 * time.Hour).Unix()
 
-	cli := fake.NewSimpleClientset(
+	cli := withScaleSubresource(fake.NewSimpleClientset(
 		&corev1.Pod{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      "buildkit-0",
@@ -204,9 +254,9 @@ func TestRunDownscalerWithOnePodBuilding(t *testing.T) {
 				Replicas: ptr.To(int32(2)),
 			},
 		},
-	)
+	))
 
-	err := runDownscaler(ctx, cli, "app=buildkit", "buildkit", testGraceful)
+	err := runDownscaler(ctx, cli, nil, WorkerOptions{PodSelector: "app=buildkit", StatefulSet: "buildkit", GracefulPeriod: testGraceful}, time.Now())
 	assert.NoError(t, err)
 
 	rs, err := cli.AppsV1().StatefulSets("").List(ctx, metav1.ListOptions{})
@@ -221,7 +271,7 @@ func TestRunDownscalerWithManyPods(t *testing.T) {
 
 	lastBuild := time.Now().Add(-3 * time.Hour).Unix()
 
-	cli := fake.NewSimpleClientset(
+	cli := withScaleSubresource(fake.NewSimpleClientset(
 		&corev1.Pod{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      "buildkit-0",
@@ -265,9 +315,9 @@ func TestRunDownscalerWithManyPods(t *testing.T) {
 				Replicas: ptr.To(int32(2)),
 			},
 		},
-	)
+	))
 
-	err := runDownscaler(ctx, cli, "app=buildkit", "buildkit", testGraceful)
+	err := runDownscaler(ctx, cli, nil, WorkerOptions{PodSelector: "app=buildkit", StatefulSet: "buildkit", GracefulPeriod: testGraceful}, time.Now())
 	assert.NoError(t, err)
 
 	rs, err := cli.AppsV1().StatefulSets("").List(ctx, metav1.ListOptions{})
@@ -282,7 +332,7 @@ func TestRunDownscalerWithManyPods2(t *testing.T) {
 
 	lastBuild := time.Now().Add(-3 * time.Hour).Unix()
 
-	cli := fake.NewSimpleClientset(
+	cli := withScaleSubresource(fake.NewSimpleClientset(
 		&corev1.Pod{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      "buildkit-0",
@@ -325,9 +375,9 @@ func TestRunDownscalerWithManyPods2(t *testing.T) {
 				Replicas: ptr.To(int32(2)),
 			},
 		},
-	)
+	))
 
-	err := runDownscaler(ctx, cli, "app=buildkit", "buildkit", testGraceful)
+	err := runDownscaler(ctx, cli, nil, WorkerOptions{PodSelector: "app=buildkit", StatefulSet: "buildkit", GracefulPeriod: testGraceful}, time.Now())
 	assert.NoError(t, err)
 
 	rs, err := cli.AppsV1().StatefulSets("").List(ctx, metav1.ListOptions{})
@@ -336,3 +386,236 @@ func TestRunDownscalerWithManyPods2(t *testing.T) {
 	require.Len(t, rs.Items, 1)
 	assert.Equal(t, int32(2), *rs.Items[0].Spec.Replicas)
 }
+
+func TestRunDownscalerScaleIn(t *testing.T) {
+	ctx := context.Background()
+
+	now := time.Now()
+	building := strconv.Itoa(int(now.Add(-time.Minute).Unix()))
+	idle := strconv.Itoa(int(now.Add(-3 * time.Hour).Unix()))
+
+	newPod := func(name string, annotations map[string]string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   "default",
+				Labels:      map[string]string{"app": "buildkit"},
+				Annotations: annotations,
+			},
+		}
+	}
+
+	tests := map[string]struct {
+		lastPod          *corev1.Pod
+		lastPodHolder    string
+		maxReplicas      int32
+		elapsed          time.Duration
+		expectedReplicas int32
+		expectedEvent    string
+	}{
+		"last pod idle": {
+			lastPod:          newPod("buildkit-2", map[string]string{metadata.DeployAgentLastBuildStartingLabelKey: idle, metadata.DeployAgentLastBuildEndingTimeLabelKey: idle}),
+			maxReplicas:      5,
+			expectedReplicas: 2,
+			expectedEvent:    "Normal ScaledIn Scaled in from 3 to 2 replicas since pod buildkit-2 is idle for longer than 2h0m0s",
+		},
+		"last pod building": {
+			lastPod:          newPod("buildkit-2", map[string]string{metadata.DeployAgentLastBuildStartingLabelKey: idle}),
+			maxReplicas:      5,
+			expectedReplicas: 3,
+		},
+		"last pod recently idle": {
+			lastPod:          newPod("buildkit-2", map[string]string{metadata.DeployAgentLastBuildStartingLabelKey: building, metadata.DeployAgentLastBuildEndingTimeLabelKey: building}),
+			maxReplicas:      5,
+			expectedReplicas: 3,
+		},
+		"last pod idle by the time of the run": {
+			lastPod:          newPod("buildkit-2", map[string]string{metadata.DeployAgentLastBuildStartingLabelKey: building, metadata.DeployAgentLastBuildEndingTimeLabelKey: building}),
+			maxReplicas:      5,
+			elapsed:          3 * time.Hour,
+			expectedReplicas: 2,
+			expectedEvent:    "Normal ScaledIn Scaled in from 3 to 2 replicas since pod buildkit-2 is idle for longer than 2h0m0s",
+		},
+		"last pod leased before being marked": {
+			lastPod:          newPod("buildkit-2", nil),
+			lastPodHolder:    "agent-a",
+			maxReplicas:      5,
+			expectedReplicas: 3,
+		},
+		"last pod lease released": {
+			lastPod:          newPod("buildkit-2", nil),
+			maxReplicas:      5,
+			expectedReplicas: 2,
+			expectedEvent:    "Normal ScaledIn Scaled in from 3 to 2 replicas since pod buildkit-2 is idle for longer than 2h0m0s",
+		},
+		"scale in disabled": {
+			lastPod:          newPod("buildkit-2", map[string]string{metadata.DeployAgentLastBuildStartingLabelKey: idle, metadata.DeployAgentLastBuildEndingTimeLabelKey: idle}),
+			expectedReplicas: 3,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			cli := withScaleSubresource(fake.NewSimpleClientset(
+				newPod("buildkit-0", map[string]string{metadata.DeployAgentLastBuildStartingLabelKey: building}),
+				newPod("buildkit-1", map[string]string{metadata.DeployAgentLastBuildStartingLabelKey: idle, metadata.DeployAgentLastBuildEndingTimeLabelKey: idle}),
+				tt.lastPod,
+				&appsv1.StatefulSet{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "buildkit",
+						Namespace: "default",
+					},
+					Spec: appsv1.StatefulSetSpec{
+						Replicas: ptr.To(int32(3)),
+					},
+				},
+			))
+
+			lease := newGCTestLease("deploy-agent-buildkit-2", tt.lastPodHolder, now)
+			lease.Namespace = "default"
+			_, err := cli.CoordinationV1().Leases("default").Create(ctx, lease, metav1.CreateOptions{})
+			require.NoError(t, err)
+
+			recorder := record.NewFakeRecorder(10)
+
+			err = runDownscaler(ctx, cli, recorder, WorkerOptions{PodSelector: "app=buildkit", StatefulSet: "buildkit", GracefulPeriod: testGraceful, MaxReplicas: tt.maxReplicas, LeasePrefix: "deploy-agent"}, now.Add(tt.elapsed))
+			require.NoError(t, err)
+
+			sts, err := cli.AppsV1().StatefulSets("default").Get(ctx, "buildkit", metav1.GetOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedReplicas, *sts.Spec.Replicas)
+
+			if tt.expectedEvent == "" {
+				assert.Empty(t, recorder.Events)
+				return
+			}
+			assert.Equal(t, tt.expectedEvent, <-recorder.Events)
+		})
+	}
+}
+
+func newIdleDownscalerTestClient(replicas int32) *fake.Clientset {
+	idle := strconv.Itoa(int(time.Now().Add(-3 * time.Hour).Unix()))
+
+	return withScaleSubresource(fake.NewSimpleClientset(
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "buildkit-0",
+				Namespace: "default",
+				Labels:    map[string]string{"app": "buildkit"},
+				Annotations: map[string]string{
+					metadata.DeployAgentLastBuildStartingLabelKey:   idle,
+					metadata.DeployAgentLastBuildEndingTimeLabelKey: idle,
+				},
+			},
+		},
+		&appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "buildkit",
+				Namespace: "default",
+			},
+			Spec: appsv1.StatefulSetSpec{
+				Replicas: ptr.To(replicas),
+			},
+		},
+	))
+}
+
+func TestRunDownscalerRetriesOnConflict(t *testing.T) {
+	ctx := context.Background()
+
+	cli := newIdleDownscalerTestClient(2)
+
+	var attempts int
+	cli.PrependReactor("update", "statefulsets", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "scale" {
+			return false, nil, nil
+		}
+
+		attempts++
+		if attempts == 1 {
+			return true, nil, apierrors.NewConflict(appsv1.Resource("statefulsets"), "buildkit", errors.New("the object has been modified"))
+		}
+		return false, nil, nil
+	})
+
+	recorder := record.NewFakeRecorder(10)
+
+	err := runDownscaler(ctx, cli, recorder, WorkerOptions{PodSelector: "app=buildkit", StatefulSet: "buildkit", GracefulPeriod: testGraceful}, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+
+	sts, err := cli.AppsV1().StatefulSets("default").Get(ctx, "buildkit", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, int32(0), *sts.Spec.Replicas)
+	assert.Equal(t, "2", sts.Annotations[metadata.DeployAgentLastReplicasAnnotationKey])
+	assert.Equal(t, "Normal ScaledToZero Scaled in from 2 to 0 replicas since every pod is idle for longer than 2h0m0s", <-recorder.Events)
+}
+
+func setTestLeaderElectionTimings(t *testing.T) {
+	leaseDuration, renewDeadline, retryPeriod := leaderLeaseDuration, leaderRenewDeadline, leaderRetryPeriod
+	leaderLeaseDuration, leaderRenewDeadline, leaderRetryPeriod = time.Second, 500*time.Millisecond, 100*time.Millisecond
+
+	t.Cleanup(func() {
+		leaderLeaseDuration, leaderRenewDeadline, leaderRetryPeriod = leaseDuration, renewDeadline, retryPeriod
+	})
+}
+
+func TestWorker_LeaderElection(t *testing.T) {
+	setTestLeaderElectionTimings(t)
+
+	ctx := context.Background()
+
+	opts := WorkerOptions{
+		PodSelector:    "app=buildkit",
+		StatefulSet:    "buildkit",
+		GracefulPeriod: testGraceful,
+		Interval:       time.Minute,
+		LeaseNamespace: "tsuru",
+		LeaseName:      "deploy-agent-downscaler",
+	}
+
+	replicas := func(cli *fake.Clientset) int32 {
+		sts, err := cli.AppsV1().StatefulSets("default").Get(ctx, "buildkit", metav1.GetOptions{})
+		require.NoError(t, err)
+		return *sts.Spec.Replicas
+	}
+
+	t.Run("leader runs the downscaler and releases the lease on stop", func(t *testing.T) {
+		cli := newIdleDownscalerTestClient(1)
+
+		w, err := StartWorker(cli, nil, opts)
+		require.NoError(t, err)
+
+		assert.Eventually(t, func() bool { return replicas(cli) == 0 }, 5*time.Second, 50*time.Millisecond)
+
+		w.Stop()
+
+		lease, err := cli.CoordinationV1().Leases("tsuru").Get(ctx, "deploy-agent-downscaler", metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, "", ptr.Deref(lease.Spec.HolderIdentity, ""))
+	})
+
+	t.Run("lease held by another replica", func(t *testing.T) {
+		cli := newIdleDownscalerTestClient(1)
+
+		_, err := cli.CoordinationV1().Leases("tsuru").Create(ctx, &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: "deploy-agent-downscaler", Namespace: "tsuru"},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       ptr.To("deploy-agent-other"),
+				LeaseDurationSeconds: ptr.To(int32(60)),
+				AcquireTime:          &metav1.MicroTime{Time: time.Now()},
+				RenewTime:            &metav1.MicroTime{Time: time.Now()},
+			},
+		}, metav1.CreateOptions{})
+		require.NoError(t, err)
+
+		w, err := StartWorker(cli, nil, opts)
+		require.NoError(t, err)
+
+		time.Sleep(time.Second)
+		w.Stop()
+
+		assert.Equal(t, int32(1), replicas(cli), "only the leader may downscale")
+	})
+}
@@ -0,0 +1,34 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scaler
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// EventSourceComponent is the source of the Kubernetes Events recorded by
+// the deploy-agent.
+const EventSourceComponent = "deploy-agent"
+
+// NewEventRecorder returns a recorder writing Kubernetes Events, so scaling
+// decisions show up on `kubectl describe statefulset`.
+func NewEventRecorder(cs kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: cs.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: EventSourceComponent})
+}
+
+func recordEvent(recorder record.EventRecorder, obj runtime.Object, reason, messageFmt string, args ...any) {
+	if recorder == nil {
+		return
+	}
+
+	recorder.Eventf(obj, corev1.EventTypeNormal, reason, messageFmt, args...)
+}
@@ -0,0 +1,234 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scaler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tsuru/deploy-agent/pkg/build/metadata"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog"
+)
+
+// buildLabelKeys are the labels set on BuildKit pods while they run a build.
+var buildLabelKeys = []string{
+	metadata.TsuruAppNameLabelKey,
+	metadata.TsuruAppTeamLabelKey,
+	metadata.TsuruJobNameLabelKey,
+	metadata.TsuruJobTeamLabelKey,
+	metadata.TsuruPlatformNameLabelKey,
+	metadata.TsuruIsBuildLabelKey,
+}
+
+// Target is a set of BuildKit pods, found by label selector on the namespace
+// (every namespace when empty).
+type Target struct {
+	Namespace   string
+	PodSelector string
+}
+
+// collectGarbage repairs what's left behind by agents which went away
+// mid-build, so their cleanups never ran:
+//
+//   - pods still marked as building (labels and a starting annotation
+//     without an ending one) whose Lease isn't held, which would otherwise
+//     keep the statefulset from ever scaling in;
+//   - Leases of pods which don't exist anymore and aren't held.
+//
+// Only the pods of opts' targets and the Leases on their namespaces are
+// looked at.
+func collectGarbage(ctx context.Context, clientset kubernetes.Interface, recorder record.EventRecorder, opts WorkerOptions, now time.Time) error {
+	if opts.LeasePrefix == "" {
+		return nil
+	}
+
+	targets := append([]Target{{Namespace: opts.Namespace, PodSelector: opts.PodSelector}}, opts.Targets...)
+
+	// pods are listed before leases: builds mark their pods only after
+	// acquiring the lease, so a marked pod is never seen along with a lease
+	// from before its build
+	var pods []*corev1.Pod
+	podExists := make(map[string]bool)
+	for _, target := range targets {
+		list, err := clientset.CoreV1().Pods(target.Namespace).List(ctx, v1.ListOptions{
+			LabelSelector: target.PodSelector,
+		})
+		if err != nil {
+			return err
+		}
+
+		for i := range list.Items {
+			pod := &list.Items[i]
+			if key := pod.Namespace + "/" + pod.Name; !podExists[key] {
+				podExists[key] = true
+				pods = append(pods, pod)
+			}
+		}
+	}
+
+	prefix := strings.TrimRight(opts.LeasePrefix, "-") + "-"
+
+	leasesByPod := make(map[string]*coordinationv1.Lease)
+	for _, namespace := range watchedNamespaces(targets) {
+		leases, err := clientset.CoordinationV1().Leases(namespace).List(ctx, v1.ListOptions{})
+		if err != nil {
+			return err
+		}
+
+		for i, lease := range leases.Items {
+			if !strings.HasPrefix(lease.Name, prefix) || (lease.Namespace == opts.LeaseNamespace && lease.Name == opts.LeaseName) {
+				continue
+			}
+
+			leasesByPod[lease.Namespace+"/"+strings.TrimPrefix(lease.Name, prefix)] = &leases.Items[i]
+		}
+	}
+
+	for _, pod := range pods {
+		if !orphanedBuild(pod, leasesByPod[pod.Namespace+"/"+pod.Name], now) {
+			continue
+		}
+
+		if err := clearBuildMarks(ctx, clientset, pod, now); err != nil {
+			klog.Errorf("failed to clear the orphaned build of pod %s/%s: %s", pod.Namespace, pod.Name, err.Error())
+			continue
+		}
+
+		klog.Infof("Cleared the orphaned build of pod %s/%s started at %s", pod.Namespace, pod.Name, pod.Annotations[metadata.DeployAgentLastBuildStartingLabelKey])
+		recordEvent(recorder, pod, "OrphanedBuildCleared", "Cleared the build marks since no agent holds the lease on the pod")
+	}
+
+	for key, lease := range leasesByPod {
+		if podExists[key] || LeaseHeld(lease, now) {
+			continue
+		}
+
+		err := clientset.CoordinationV1().Leases(lease.Namespace).Delete(ctx, lease.Name, v1.DeleteOptions{
+			Preconditions: &v1.Preconditions{ResourceVersion: &lease.ResourceVersion},
+		})
+		if err != nil && !apierrors.IsNotFound(err) && !apierrors.IsConflict(err) {
+			klog.Errorf("failed to delete stale lease %s/%s: %s", lease.Namespace, lease.Name, err.Error())
+			continue
+		}
+
+		klog.V(2).Infof("Deleted stale lease %s/%s", lease.Namespace, lease.Name)
+	}
+
+	return nil
+}
+
+// watchedNamespaces returns the namespaces of the targets, which is only the
+// empty one (i.e. every namespace) when any of them has no namespace.
+func watchedNamespaces(targets []Target) []string {
+	var namespaces []string
+	seen := make(map[string]bool)
+	for _, target := range targets {
+		if target.Namespace == "" {
+			return []string{""}
+		}
+
+		if !seen[target.Namespace] {
+			seen[target.Namespace] = true
+			namespaces = append(namespaces, target.Namespace)
+		}
+	}
+	return namespaces
+}
+
+// podLeased returns whether an agent holds the Lease on the pod, always false
+// when the Leases aren't named (i.e. prefix is empty).
+func podLeased(ctx context.Context, clientset kubernetes.Interface, prefix string, pod *corev1.Pod, now time.Time) (bool, error) {
+	if prefix == "" {
+		return false, nil
+	}
+
+	lease, err := clientset.CoordinationV1().Leases(pod.Namespace).Get(ctx, strings.TrimRight(prefix, "-")+"-"+pod.Name, v1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return LeaseHeld(lease, now), nil
+}
+
+// orphanedBuild returns whether the pod is marked as running a build while
+// no agent holds its lease.
+func orphanedBuild(pod *corev1.Pod, lease *coordinationv1.Lease, now time.Time) bool {
+	if pod.Annotations[metadata.DeployAgentLastBuildStartingLabelKey] == "" {
+		return false
+	}
+
+	if pod.Annotations[metadata.DeployAgentLastBuildEndingTimeLabelKey] != "" {
+		return false
+	}
+
+	return lease == nil || !LeaseHeld(lease, now)
+}
+
+// LeaseHeld returns whether the lease has a holder which renewed it within
+// its duration.
+func LeaseHeld(lease *coordinationv1.Lease, now time.Time) bool {
+	spec := lease.Spec
+	if spec.HolderIdentity == nil || *spec.HolderIdentity == "" {
+		return false
+	}
+
+	if spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return true
+	}
+
+	return now.Before(spec.RenewTime.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second))
+}
+
+// clearBuildMarks removes the build labels of the pod and sets its ending
+// annotation, just like the build cleanup would. It fails if another build
+// started on the pod meanwhile.
+func clearBuildMarks(ctx context.Context, clientset kubernetes.Interface, pod *corev1.Pod, now time.Time) error {
+	changes := []any{
+		map[string]any{
+			"op":    "test",
+			"path":  fmt.Sprintf("/metadata/annotations/%s", metadata.EscapeJSONPointer(metadata.DeployAgentLastBuildStartingLabelKey)),
+			"value": pod.Annotations[metadata.DeployAgentLastBuildStartingLabelKey],
+		},
+	}
+
+	for _, key := range buildLabelKeys {
+		if _, found := pod.Labels[key]; !found {
+			continue
+		}
+
+		changes = append(changes, map[string]any{
+			"op":   "remove",
+			"path": fmt.Sprintf("/metadata/labels/%s", metadata.EscapeJSONPointer(key)),
+		})
+	}
+
+	changes = append(changes, map[string]any{
+		"op":    "add",
+		"path":  fmt.Sprintf("/metadata/annotations/%s", metadata.EscapeJSONPointer(metadata.DeployAgentLastBuildEndingTimeLabelKey)),
+		"value": strconv.FormatInt(now.Unix(), 10),
+	})
+
+	patch, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+
+	_, err = clientset.CoreV1().Pods(pod.Namespace).Patch(ctx, pod.Name, types.JSONPatchType, patch, v1.PatchOptions{})
+	return err
+}
@@ -0,0 +1,228 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scaler
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tsuru/deploy-agent/pkg/build/metadata"
+	appsv1 "k8s.io/api/apps/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+)
+
+func newGCTestPod(name string, building bool, started time.Time) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "tsuru",
+			Labels:    map[string]string{"app": "buildkit"},
+			Annotations: map[string]string{
+				metadata.DeployAgentLastBuildStartingLabelKey:   strconv.FormatInt(started.Unix(), 10),
+				metadata.DeployAgentLastBuildEndingTimeLabelKey: strconv.FormatInt(started.Add(time.Minute).Unix(), 10),
+			},
+		},
+	}
+
+	if building {
+		pod.Labels[metadata.TsuruAppNameLabelKey] = "my-app"
+		pod.Labels[metadata.TsuruAppTeamLabelKey] = "my-team"
+		pod.Labels[metadata.TsuruIsBuildLabelKey] = "true"
+		pod.Annotations[metadata.DeployAgentLastBuildEndingTimeLabelKey] = ""
+	}
+
+	return pod
+}
+
+func newGCTestLease(name, holder string, renewed time.Time) *coordinationv1.Lease {
+	return &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "tsuru"},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       ptr.To(holder),
+			LeaseDurationSeconds: ptr.To(int32(5)),
+			RenewTime:            &metav1.MicroTime{Time: renewed},
+		},
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	ctx := context.Background()
+
+	now := time.Now()
+	started := now.Add(-3 * time.Hour)
+
+	cli := withScaleSubresource(fake.NewSimpleClientset(
+		&appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "buildkit", Namespace: "tsuru"},
+			Spec:       appsv1.StatefulSetSpec{Replicas: ptr.To(int32(5))},
+		},
+		newGCTestPod("buildkit-0", true, started),
+		newGCTestPod("buildkit-1", true, started),
+		newGCTestPod("buildkit-2", true, started),
+		newGCTestPod("buildkit-3", true, started),
+		newGCTestPod("buildkit-4", false, started),
+		newGCTestLease("deploy-agent-buildkit-0", "agent-a", now),
+		newGCTestLease("deploy-agent-buildkit-1", "", started),
+		newGCTestLease("deploy-agent-buildkit-3", "agent-b", now.Add(-time.Minute)),
+		newGCTestLease("deploy-agent-buildkit-8", "agent-c", now),
+		newGCTestLease("deploy-agent-buildkit-9", "", started),
+		newGCTestLease("deploy-agent-downscaler", "", started),
+		newGCTestLease("kube-scheduler", "", started),
+	))
+
+	recorder := record.NewFakeRecorder(10)
+
+	opts := WorkerOptions{
+		PodSelector:    "app=buildkit",
+		StatefulSet:    "buildkit",
+		GracefulPeriod: testGraceful,
+		LeaseNamespace: "tsuru",
+		LeaseName:      "deploy-agent-downscaler",
+		LeasePrefix:    "deploy-agent",
+	}
+
+	err := collectGarbage(ctx, cli, recorder, opts, now)
+	require.NoError(t, err)
+
+	building := map[string]bool{"buildkit-0": true, "buildkit-1": false, "buildkit-2": false, "buildkit-3": false, "buildkit-4": false}
+	for name, expected := range building {
+		pod, err := cli.CoreV1().Pods("tsuru").Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+
+		_, labeled := pod.Labels[metadata.TsuruIsBuildLabelKey]
+		assert.Equal(t, expected, labeled, "pod %s", name)
+		assert.Equal(t, expected, pod.Annotations[metadata.DeployAgentLastBuildEndingTimeLabelKey] == "", "pod %s", name)
+		assert.Equal(t, "buildkit", pod.Labels["app"], "pod %s", name)
+	}
+
+	pod, err := cli.CoreV1().Pods("tsuru").Get(ctx, "buildkit-1", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"app": "buildkit"}, pod.Labels)
+	assert.Equal(t, strconv.FormatInt(now.Unix(), 10), pod.Annotations[metadata.DeployAgentLastBuildEndingTimeLabelKey])
+
+	leases, err := cli.CoordinationV1().Leases("tsuru").List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+
+	var names []string
+	for _, l := range leases.Items {
+		names = append(names, l.Name)
+	}
+	assert.ElementsMatch(t, []string{
+		"deploy-agent-buildkit-0",
+		"deploy-agent-buildkit-1",
+		"deploy-agent-buildkit-3",
+		"deploy-agent-buildkit-8",
+		"deploy-agent-downscaler",
+		"kube-scheduler",
+	}, names)
+
+	require.Len(t, recorder.Events, 3)
+	assert.Equal(t, "Normal OrphanedBuildCleared Cleared the build marks since no agent holds the lease on the pod", <-recorder.Events)
+
+	t.Run("downscaler no longer blocked", func(t *testing.T) {
+		cli.CoordinationV1().Leases("tsuru").Delete(ctx, "deploy-agent-buildkit-0", metav1.DeleteOptions{})
+
+		err := collectGarbage(ctx, cli, nil, opts, now)
+		require.NoError(t, err)
+
+		// cleared builds are idle since the garbage collection
+		err = runDownscaler(ctx, cli, nil, opts, now.Add(testGraceful+time.Minute))
+		require.NoError(t, err)
+
+		sts, err := cli.AppsV1().StatefulSets("tsuru").Get(ctx, "buildkit", metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, int32(0), *sts.Spec.Replicas)
+	})
+}
+
+func TestCollectGarbageSkipsBuildStartedMeanwhile(t *testing.T) {
+	ctx := context.Background()
+
+	now := time.Now()
+	pod := newGCTestPod("buildkit-0", true, now.Add(-time.Hour))
+	cli := fake.NewSimpleClientset(pod)
+
+	// another build started on the pod after it was listed
+	stale := pod.DeepCopy()
+	pod.Annotations[metadata.DeployAgentLastBuildStartingLabelKey] = strconv.FormatInt(now.Unix(), 10)
+	_, err := cli.CoreV1().Pods("tsuru").Update(ctx, pod, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	err = clearBuildMarks(ctx, cli, stale, now)
+	require.Error(t, err)
+	assert.False(t, apierrors.IsNotFound(err))
+
+	got, err := cli.CoreV1().Pods("tsuru").Get(ctx, "buildkit-0", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "true", got.Labels[metadata.TsuruIsBuildLabelKey])
+	assert.Equal(t, "", got.Annotations[metadata.DeployAgentLastBuildEndingTimeLabelKey])
+}
+
+func TestCollectGarbageTargets(t *testing.T) {
+	ctx := context.Background()
+
+	now := time.Now()
+	started := now.Add(-time.Hour)
+
+	premium := newGCTestPod("premium-0", true, started)
+	premium.Namespace = "premium"
+	premium.Labels["app"] = "buildkit-premium"
+
+	unwatched := newGCTestLease("deploy-agent-buildkit-0", "", started)
+	unwatched.Namespace = "other"
+
+	premiumLease := newGCTestLease("deploy-agent-premium-0", "", started)
+	premiumLease.Namespace = "premium"
+
+	cli := fake.NewSimpleClientset(
+		newGCTestPod("buildkit-0", true, started),
+		premium,
+		premiumLease,
+		newGCTestLease("deploy-agent-buildkit-9", "", started),
+		unwatched,
+	)
+
+	opts := WorkerOptions{
+		PodSelector: "app=buildkit",
+		Namespace:   "tsuru",
+		Targets:     []Target{{Namespace: "premium", PodSelector: "app=buildkit-premium"}},
+		LeasePrefix: "deploy-agent",
+	}
+
+	err := collectGarbage(ctx, cli, nil, opts, now)
+	require.NoError(t, err)
+
+	for _, pod := range []*corev1.Pod{premium, newGCTestPod("buildkit-0", true, started)} {
+		got, err := cli.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.NotContains(t, got.Labels, metadata.TsuruIsBuildLabelKey, "pod %s/%s", pod.Namespace, pod.Name)
+	}
+
+	// the leases of routed pods are kept while their pods exist
+	_, err = cli.CoordinationV1().Leases("premium").Get(ctx, "deploy-agent-premium-0", metav1.GetOptions{})
+	require.NoError(t, err)
+
+	_, err = cli.CoordinationV1().Leases("tsuru").Get(ctx, "deploy-agent-buildkit-9", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+
+	// leases on namespaces not watched are left alone
+	_, err = cli.CoordinationV1().Leases("other").Get(ctx, "deploy-agent-buildkit-0", metav1.GetOptions{})
+	require.NoError(t, err)
+}
+
+func TestWatchedNamespaces(t *testing.T) {
+	assert.Equal(t, []string{"tsuru", "premium"}, watchedNamespaces([]Target{{Namespace: "tsuru"}, {Namespace: "premium"}, {Namespace: "tsuru"}}))
+	assert.Equal(t, []string{""}, watchedNamespaces([]Target{{Namespace: "tsuru"}, {}}))
+}
@@ -0,0 +1,105 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scaler
+
+import (
+	"context"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog"
+)
+
+// Window holds a minimum number of replicas on the BuildKit statefulsets
+// while it's open, e.g. pre-warming BuildKit before business hours or
+// during release freezes. A minimum of zero allows scaling to zero.
+type Window struct {
+	Name string
+	// Namespace restricts the window to a namespace, empty matches any.
+	Namespace string
+	// StatefulSet is the name of the statefulsets held by the window.
+	StatefulSet string
+	// Schedule opens the window, which is kept open for Duration.
+	Schedule    cron.Schedule
+	Duration    time.Duration
+	MinReplicas int32
+}
+
+// ParseWindowSchedule parses a standard cron expression, optionally
+// prefixed by the time zone (e.g. "CRON_TZ=America/Sao_Paulo 0 8 * * 1-5").
+func ParseWindowSchedule(spec string) (cron.Schedule, error) {
+	return cron.ParseStandard(spec)
+}
+
+func (w *Window) matches(ns, statefulSet string) bool {
+	return (w.Namespace == "" || w.Namespace == ns) && w.StatefulSet == statefulSet
+}
+
+// open returns whether the window opened in the last Duration before now.
+func (w *Window) open(now time.Time) bool {
+	return !w.Schedule.Next(now.Add(-w.Duration)).After(now)
+}
+
+// activeWindow returns the first open window matching the statefulset, if
+// any.
+func activeWindow(windows []Window, ns, statefulSet string, now time.Time) *Window {
+	for i := range windows {
+		if windows[i].matches(ns, statefulSet) && windows[i].open(now) {
+			return &windows[i]
+		}
+	}
+
+	return nil
+}
+
+// nextWindowStart returns when the next window opens after now, or the zero
+// time if there's none.
+func nextWindowStart(windows []Window, now time.Time) time.Time {
+	var next time.Time
+	for _, w := range windows {
+		if start := w.Schedule.Next(now); !start.IsZero() && (next.IsZero() || start.Before(next)) {
+			next = start
+		}
+	}
+
+	return next
+}
+
+// prewarm scales the statefulsets up to the minimum replicas of their open
+// windows.
+func prewarm(ctx context.Context, clientset kubernetes.Interface, recorder record.EventRecorder, opts WorkerOptions, now time.Time) error {
+	if len(opts.Windows) == 0 {
+		return nil
+	}
+
+	statefulSets, err := clientset.AppsV1().StatefulSets("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	for _, sts := range statefulSets.Items {
+		window := activeWindow(opts.Windows, sts.Namespace, sts.Name, now)
+		if window == nil || window.MinReplicas == 0 {
+			continue
+		}
+
+		scaled, replicas, err := scaleStatefulSet(ctx, clientset, sts.Namespace, sts.Name, func(current int32) (int32, bool) {
+			return window.MinReplicas, current < window.MinReplicas
+		})
+		if err != nil {
+			klog.Errorf("failed to scale statefulset %s/%s: %s", sts.Namespace, sts.Name, err.Error())
+			continue
+		}
+
+		if scaled != nil {
+			recordEvent(recorder, scaled, "PreWarmed", "Scaled out from %d to %d replicas since window %q is open", replicas, window.MinReplicas, window.Name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scaler
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+
+	"github.com/tsuru/deploy-agent/pkg/build/metadata"
+)
+
+func newTestWindow(t *testing.T, name, ns, spec string, duration time.Duration, minReplicas int32) Window {
+	t.Helper()
+
+	schedule, err := ParseWindowSchedule(spec)
+	require.NoError(t, err)
+
+	return Window{Name: name, Namespace: ns, StatefulSet: "buildkit", Schedule: schedule, Duration: duration, MinReplicas: minReplicas}
+}
+
+func TestActiveWindow(t *testing.T) {
+	windows := []Window{
+		newTestWindow(t, "freeze", "tsuru", "CRON_TZ=UTC 0 0 20 12 *", 14*24*time.Hour, 3),
+		newTestWindow(t, "business-hours", "", "CRON_TZ=UTC 0 8 * * 1-5", 10*time.Hour, 2),
+	}
+
+	// Monday
+	monday := time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+
+	assert.Nil(t, activeWindow(windows, "tsuru", "buildkit", monday.Add(7*time.Hour+59*time.Minute)))
+	assert.Equal(t, "business-hours", activeWindow(windows, "tsuru", "buildkit", monday.Add(8*time.Hour)).Name)
+	assert.Equal(t, "business-hours", activeWindow(windows, "tsuru", "buildkit", monday.Add(17*time.Hour+59*time.Minute)).Name)
+	assert.Nil(t, activeWindow(windows, "tsuru", "buildkit", monday.Add(18*time.Hour)))
+	assert.Nil(t, activeWindow(windows, "tsuru", "other", monday.Add(9*time.Hour)), "must match the statefulset")
+
+	// Saturday
+	assert.Nil(t, activeWindow(windows, "tsuru", "buildkit", monday.Add(5*24*time.Hour+9*time.Hour)))
+
+	freeze := time.Date(2026, time.December, 22, 9, 0, 0, 0, time.UTC)
+	assert.Equal(t, "freeze", activeWindow(windows, "tsuru", "buildkit", freeze).Name, "first open window wins")
+	assert.Equal(t, "business-hours", activeWindow(windows, "other", "buildkit", freeze).Name)
+}
+
+func TestNextWindowStart(t *testing.T) {
+	windows := []Window{
+		newTestWindow(t, "business-hours", "", "CRON_TZ=UTC 0 8 * * 1-5", 10*time.Hour, 2),
+		newTestWindow(t, "lunch", "", "CRON_TZ=UTC 0 12 * * *", time.Hour, 3),
+	}
+
+	monday := time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, monday.Add(8*time.Hour), nextWindowStart(windows, monday))
+	assert.Equal(t, monday.Add(12*time.Hour), nextWindowStart(windows, monday.Add(9*time.Hour)))
+	assert.True(t, nextWindowStart(nil, monday).IsZero())
+}
+
+func TestPrewarm(t *testing.T) {
+	ctx := context.Background()
+
+	newStatefulSet := func(name, ns string, replicas int32) *appsv1.StatefulSet {
+		return &appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns},
+			Spec:       appsv1.StatefulSetSpec{Replicas: ptr.To(replicas)},
+		}
+	}
+
+	cli := withScaleSubresource(fake.NewSimpleClientset(
+		newStatefulSet("buildkit", "tsuru", 0),
+		newStatefulSet("buildkit", "premium", 3),
+		newStatefulSet("other", "tsuru", 0),
+	))
+
+	monday := time.Date(2026, time.October, 19, 9, 0, 0, 0, time.UTC)
+	opts := WorkerOptions{
+		StatefulSet: "buildkit",
+		Windows:     []Window{newTestWindow(t, "business-hours", "", "CRON_TZ=UTC 0 8 * * 1-5", 10*time.Hour, 2)},
+	}
+
+	recorder := record.NewFakeRecorder(10)
+
+	err := prewarm(ctx, cli, recorder, opts, monday)
+	require.NoError(t, err)
+
+	replicas := func(ns, name string) int32 {
+		sts, err := cli.AppsV1().StatefulSets(ns).Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+		return *sts.Spec.Replicas
+	}
+
+	assert.Equal(t, int32(2), replicas("tsuru", "buildkit"))
+	assert.Equal(t, int32(3), replicas("premium", "buildkit"), "must not scale in")
+	assert.Equal(t, int32(0), replicas("tsuru", "other"))
+	assert.Equal(t, `Normal PreWarmed Scaled out from 0 to 2 replicas since window "business-hours" is open`, <-recorder.Events)
+	assert.Empty(t, recorder.Events)
+}
+
+func TestRunDownscalerKeepsWindowMinimum(t *testing.T) {
+	ctx := context.Background()
+
+	idle := strconv.Itoa(int(time.Now().Add(-3 * time.Hour).Unix()))
+
+	var objs []runtime.Object
+	for i := 0; i < 4; i++ {
+		objs = append(objs, &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "buildkit-" + strconv.Itoa(i),
+				Namespace: "tsuru",
+				Labels:    map[string]string{"app": "buildkit"},
+				Annotations: map[string]string{
+					metadata.DeployAgentLastBuildStartingLabelKey:   idle,
+					metadata.DeployAgentLastBuildEndingTimeLabelKey: idle,
+				},
+			},
+		})
+	}
+
+	cli := withScaleSubresource(fake.NewSimpleClientset(append(objs, &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "buildkit", Namespace: "tsuru"},
+		Spec:       appsv1.StatefulSetSpec{Replicas: ptr.To(int32(4))},
+	})...))
+
+	recorder := record.NewFakeRecorder(10)
+	opts := WorkerOptions{
+		PodSelector:    "app=buildkit",
+		StatefulSet:    "buildkit",
+		GracefulPeriod: testGraceful,
+		Windows:        []Window{newTestWindow(t, "business-hours", "", "CRON_TZ=UTC 0 8 * * 1-5", 10*time.Hour, 2)},
+	}
+
+	err := runDownscaler(ctx, cli, recorder, opts, time.Date(2026, time.October, 19, 9, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+
+	sts, err := cli.AppsV1().StatefulSets("tsuru").Get(ctx, "buildkit", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), *sts.Spec.Replicas)
+	assert.Equal(t, `Normal ScaledIn Scaled in from 4 to 2 replicas since every pod is idle for longer than 2h0m0s, keeping the minimum of window "business-hours"`, <-recorder.Events)
+}
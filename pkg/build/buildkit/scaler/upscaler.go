@@ -9,41 +9,93 @@ import (
 	"fmt"
 	"io"
 	"strconv"
+	"time"
 
 	"github.com/tsuru/deploy-agent/pkg/build/metadata"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-func MayUpscale(ctx context.Context, cs kubernetes.Interface, ns, statefulset string, w io.Writer) error {
-	stfullset, err := cs.AppsV1().StatefulSets(ns).Get(ctx, statefulset, metav1.GetOptions{})
-	if err != nil {
-		return err
-	}
+// MayUpscale scales the statefulset from zero to its last replicas (or one),
+// returning the replicas it was scaled to or zero if it wasn't, e.g. since
+// another build scaled it up meanwhile.
+func MayUpscale(ctx context.Context, cs kubernetes.Interface, ns, statefulset string, w io.Writer) (int32, error) {
+	var scaledTo int32
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		stfullset, err := cs.AppsV1().StatefulSets(ns).Get(ctx, statefulset, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		if stfullset.Spec.Replicas != nil && *stfullset.Spec.Replicas > 0 {
+			return nil
+		}
+
+		wantedReplicas := int32(1)
+
+		if lastReplicas := stfullset.Annotations[metadata.DeployAgentLastReplicasAnnotationKey]; lastReplicas != "" {
+			replicas, err := strconv.ParseInt(lastReplicas, 10, 32)
+			if err != nil {
+				return err
+			}
+			wantedReplicas = int32(replicas) //nolint
+		}
+
+		stfullset.Spec.Replicas = &wantedReplicas
+
+		if _, err := cs.AppsV1().StatefulSets(ns).Update(ctx, stfullset, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+
+		fmt.Fprintln(w, "There is no buildkits available, scaling to one replica")
 
-	if stfullset.Spec.Replicas != nil && *stfullset.Spec.Replicas > 0 {
+		scaledTo = wantedReplicas
 		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
 
-	wantedReplicas := int32(1)
+	return scaledTo, nil
+}
 
-	if lastReplicas := stfullset.Annotations[metadata.DeployAgentLastReplicasAnnotationKey]; lastReplicas != "" {
-		var replicas int64
-		replicas, err = strconv.ParseInt(lastReplicas, 10, 32)
+// ScaleOut adds one replica to the statefulset, up to maxReplicas, since a
+// build is waiting for a free BuildKit for longer than waited. It returns
+// the replicas the statefulset was scaled to or zero if it wasn't.
+func ScaleOut(ctx context.Context, cs kubernetes.Interface, recorder record.EventRecorder, ns, statefulset string, maxReplicas int32, waited time.Duration, w io.Writer) (int32, error) {
+	var scaledTo int32
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		stfullset, err := cs.AppsV1().StatefulSets(ns).Get(ctx, statefulset, metav1.GetOptions{})
 		if err != nil {
 			return err
 		}
-		wantedReplicas = int32(replicas) //nolint
-	}
 
-	fmt.Fprintln(w, "There is no buildkits available, scaling to one replica")
-	stfullset.Spec.Replicas = &wantedReplicas
+		var replicas int32
+		if stfullset.Spec.Replicas != nil {
+			replicas = *stfullset.Spec.Replicas
+		}
+
+		if replicas >= maxReplicas {
+			return nil
+		}
 
-	_, err = cs.AppsV1().StatefulSets(ns).Update(ctx, stfullset, metav1.UpdateOptions{})
-	if err != nil {
-		return err
-	}
+		wantedReplicas := replicas + 1
+		stfullset.Spec.Replicas = &wantedReplicas
+
+		updated, err := cs.AppsV1().StatefulSets(ns).Update(ctx, stfullset, metav1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(w, "All buildkits are busy, scaling out to %d replicas\n", wantedReplicas)
+		recordEvent(recorder, updated, "ScaledOut", "Scaled out from %d to %d replicas since a build waited longer than %s", replicas, wantedReplicas, waited)
+
+		scaledTo = wantedReplicas
+		return nil
+	})
 
-	return nil
+	return scaledTo, err
 }
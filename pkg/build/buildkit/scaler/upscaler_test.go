@@ -6,14 +6,20 @@ package scaler
 import (
 	"bytes"
 	"context"
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/tsuru/deploy-agent/pkg/build/metadata"
 	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes/fake"
+	k8sTesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/utils/ptr"
 )
 
@@ -32,7 +38,7 @@ func TestMayScaleStatefulsetSkipScale(t *testing.T) {
 
 	buf := bytes.Buffer{}
 
-	err := MayUpscale(ctx, cli, "default", "buildkit", &buf)
+	_, err := MayUpscale(ctx, cli, "default", "buildkit", &buf)
 
 	assert.Equal(t, "", buf.String())
 	assert.NoError(t, err)
@@ -52,7 +58,7 @@ func TestMayScaleStatefulsetScale(t *testing.T) {
 
 	buf := bytes.Buffer{}
 
-	err := MayUpscale(ctx, cli, "default", "buildkit", &buf)
+	_, err := MayUpscale(ctx, cli, "default", "buildkit", &buf)
 
 	assert.Equal(t, "There is no buildkits available, scaling to one replica\n", buf.String())
 	assert.NoError(t, err)
@@ -83,10 +89,11 @@ func TestMayScaleStatefulsetScaleFromPreviousReplicas(t *testing.T) {
 
 	buf := bytes.Buffer{}
 
-	err := MayUpscale(ctx, cli, "default", "buildkit", &buf)
+	scaledTo, err := MayUpscale(ctx, cli, "default", "buildkit", &buf)
 
 	assert.Equal(t, "There is no buildkits available, scaling to one replica\n", buf.String())
 	assert.NoError(t, err)
+	assert.Equal(t, int32(3), scaledTo)
 
 	rs, err := cli.AppsV1().StatefulSets("").List(ctx, metav1.ListOptions{})
 	assert.NoError(t, err)
@@ -94,3 +101,83 @@ func TestMayScaleStatefulsetScaleFromPreviousReplicas(t *testing.T) {
 	require.Len(t, rs.Items, 1)
 	assert.Equal(t, int32(3), *rs.Items[0].Spec.Replicas)
 }
+
+func TestMayScaleStatefulsetRetriesOnConflict(t *testing.T) {
+	ctx := context.Background()
+
+	cli := fake.NewSimpleClientset(&appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "buildkit",
+			Namespace: "default",
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas: ptr.To(int32(0)),
+		},
+	})
+
+	var attempts int
+	cli.PrependReactor("update", "statefulsets", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		attempts++
+		if attempts > 1 {
+			return false, nil, nil
+		}
+
+		// another build scaled it up meanwhile
+		sts := action.(k8sTesting.UpdateAction).GetObject().(*appsv1.StatefulSet).DeepCopy()
+		sts.Spec.Replicas = ptr.To(int32(2))
+		if err := cli.Tracker().Update(appsv1.SchemeGroupVersion.WithResource("statefulsets"), sts, "default"); err != nil {
+			return true, nil, err
+		}
+		return true, nil, apierrors.NewConflict(appsv1.Resource("statefulsets"), "buildkit", errors.New("the object has been modified"))
+	})
+
+	buf := bytes.Buffer{}
+
+	scaledTo, err := MayUpscale(ctx, cli, "default", "buildkit", &buf)
+	require.NoError(t, err)
+	assert.Equal(t, int32(0), scaledTo)
+	assert.Equal(t, "", buf.String())
+	assert.Equal(t, 1, attempts)
+
+	sts, err := cli.AppsV1().StatefulSets("default").Get(ctx, "buildkit", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), *sts.Spec.Replicas)
+}
+
+func TestScaleOut(t *testing.T) {
+	ctx := context.Background()
+
+	cli := fake.NewSimpleClientset(&appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "buildkit",
+			Namespace: "default",
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas: ptr.To(int32(2)),
+		},
+	})
+
+	recorder := record.NewFakeRecorder(10)
+	buf := bytes.Buffer{}
+
+	scaledTo, err := ScaleOut(ctx, cli, recorder, "default", "buildkit", 3, time.Minute, &buf)
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), scaledTo)
+	assert.Equal(t, "All buildkits are busy, scaling out to 3 replicas\n", buf.String())
+	assert.Equal(t, "Normal ScaledOut Scaled out from 2 to 3 replicas since a build waited longer than 1m0s", <-recorder.Events)
+
+	sts, err := cli.AppsV1().StatefulSets("default").Get(ctx, "buildkit", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), *sts.Spec.Replicas)
+
+	buf.Reset()
+	scaledTo, err = ScaleOut(ctx, cli, recorder, "default", "buildkit", 3, time.Minute, &buf)
+	require.NoError(t, err)
+	assert.Equal(t, int32(0), scaledTo)
+	assert.Equal(t, "", buf.String(), "must not scale beyond max replicas")
+	assert.Empty(t, recorder.Events)
+
+	sts, err = cli.AppsV1().StatefulSets("default").Get(ctx, "buildkit", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), *sts.Spec.Replicas)
+}
@@ -0,0 +1,599 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package docker implements a build backend driving a Docker Engine daemon
+// through its build and push APIs. Builds run on the daemon's BuildKit builder,
+// so secrets (e.g. Tsuru app's env vars) are mounted the same way as in the
+// BuildKit backend, and the resulting Tsuru configs are the same as well.
+package docker
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/containerd/console"
+	"github.com/docker/cli/cli/config"
+	dockertypes "github.com/docker/docker/api/types"
+	dockertypescontainer "github.com/docker/docker/api/types/container"
+	dockerclient "github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	controlapi "github.com/moby/buildkit/api/services/control"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/session/auth/authprovider"
+	"github.com/moby/buildkit/session/secrets/secretsprovider"
+	"github.com/moby/buildkit/util/progress/progresswriter"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/tsuru/deploy-agent/pkg/build"
+	"github.com/tsuru/deploy-agent/pkg/build/buildkit/metrics"
+	pb "github.com/tsuru/deploy-agent/pkg/build/grpc_build_v1"
+	repo "github.com/tsuru/deploy-agent/pkg/repository"
+	"github.com/tsuru/deploy-agent/pkg/util"
+)
+
+const (
+	// metricsNamespace is the namespace label used in build metrics, since
+	// there is no BuildKit namespace when building on Docker Engine.
+	metricsNamespace = "docker"
+
+	// dockerfileName is the Containerfile name inside the build context sent
+	// to the daemon. It's added into .dockerignore so it cannot be copied.
+	dockerfileName = ".deploy-agent.Dockerfile"
+
+	buildKitTraceID = "moby.buildkit.trace"
+)
+
+var _ build.Builder = (*Docker)(nil)
+
+type DockerOptions struct {
+	RemoteRepository map[string]repo.Repository
+	TempDir          string
+	DisableCache     bool
+	DetectCPUArch    bool
+	// RetentionKeepLast is the number of latest versions of the app's (or
+	// job's) images kept after pushing them, see repo.ApplyRetention.
+	RetentionKeepLast int
+}
+
+type Docker struct {
+	cli  dockerclient.APIClient
+	opts DockerOptions
+	m    sync.RWMutex
+}
+
+func NewDocker(c dockerclient.APIClient, opts DockerOptions) *Docker {
+	return &Docker{cli: c, opts: opts}
+}
+
+// NewClient creates a Docker Engine client for host. When host is empty,
+// the client is configured from the standard DOCKER_* env vars.
+func NewClient(host string) (*dockerclient.Client, error) {
+	opts := []dockerclient.Opt{dockerclient.FromEnv, dockerclient.WithAPIVersionNegotiation()}
+	if host != "" {
+		opts = append(opts, dockerclient.WithHost(host))
+	}
+
+	return dockerclient.NewClientWithOpts(opts...)
+}
+
+// Reload applies the settings which are safe to change while builds are
+// running: remote repositories (and their retention) and cache policy.
+func (d *Docker) Reload(opts DockerOptions) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	d.opts.RemoteRepository = opts.RemoteRepository
+	d.opts.RetentionKeepLast = opts.RetentionKeepLast
+	d.opts.DisableCache = opts.DisableCache
+}
+
+func (d *Docker) options() DockerOptions {
+	d.m.RLock()
+	defer d.m.RUnlock()
+
+	return d.opts
+}
+
+func (d *Docker) Close() error {
+	return d.cli.Close()
+}
+
+func (d *Docker) Build(ctx context.Context, r *pb.BuildRequest, w io.Writer) (*pb.TsuruConfig, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ow, ok := w.(console.File)
+	if !ok {
+		return nil, errors.New("writer must implement console.File")
+	}
+
+	startTime := time.Now()
+	metrics.Builds.AddActive(metricsNamespace, 1)
+	defer func() {
+		metrics.BuildDuration.WithLabelValues(metricsNamespace).Observe(time.Since(startTime).Seconds())
+		metrics.Builds.AddActive(metricsNamespace, -1)
+	}()
+	buildKind := pb.BuildKind_name[int32(r.Kind)]
+	metrics.BuildsTotal.WithLabelValues(metricsNamespace, buildKind).Inc()
+	switch buildKind {
+	case "BUILD_KIND_APP_BUILD_WITH_SOURCE_UPLOAD":
+		return d.buildFromAppSourceFiles(ctx, r, ow)
+
+	case "BUILD_KIND_APP_BUILD_WITH_CONTAINER_IMAGE", "BUILD_KIND_JOB_CREATE_WITH_CONTAINER_IMAGE":
+		return d.buildFromContainerImage(ctx, r, ow)
+
+	case "BUILD_KIND_APP_BUILD_WITH_CONTAINER_FILE", "BUILD_KIND_JOB_DEPLOY_WITH_CONTAINER_FILE":
+		return d.buildFromContainerFile(ctx, r, ow)
+
+	case "BUILD_KIND_PLATFORM_WITH_CONTAINER_FILE":
+		return nil, d.buildPlatform(ctx, r, ow)
+
+	default:
+		return nil, status.Errorf(codes.Unimplemented, "build kind not supported")
+	}
+}
+
+func (d *Docker) buildFromAppSourceFiles(ctx context.Context, r *pb.BuildRequest, w console.File) (*pb.TsuruConfig, error) {
+	appFiles, err := build.ExtractTsuruAppFilesFromAppSourceContext(ctx, bytes.NewBuffer(r.Data))
+	if err != nil {
+		return nil, err
+	}
+
+	tsuruYAML, err := build.ParseTsuruYaml(appFiles.TsuruYaml)
+	if err != nil {
+		return nil, err
+	}
+
+	var buildHooks []string
+	if tsuruYAML.Hooks != nil {
+		buildHooks = tsuruYAML.Hooks.Build
+	}
+
+	dockerfile, err := build.BuildContainerfile(build.BuildContainerfileParams{Image: r.SourceImage, BuildHooks: buildHooks})
+	if err != nil {
+		return nil, err
+	}
+
+	var envs map[string]string
+	if r.App != nil {
+		envs = r.App.EnvVars
+	}
+
+	tmpDir, cleanFunc, err := build.GenerateBuildLocalDir(ctx, d.options().TempDir, dockerfile, bytes.NewBuffer(r.Data), envs, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanFunc()
+
+	if err = d.buildAndPush(ctx, tmpDir, r, w); err != nil {
+		return nil, err
+	}
+
+	// NOTE: same as in the BuildKit backend, some platforms don't require an
+	// user-defined Procfile, so the default one comes from the platform image.
+	if appFiles.Procfile == "" && len(tsuruYAML.Processes) == 0 {
+		fmt.Fprintln(w, "User-defined Procfile/Tsuru YAML Processes not found, trying to extract it from platform's container image")
+
+		tc, err := d.extractTsuruConfigsFromImage(ctx, r.DestinationImages[0], build.DefaultTsuruPlatformWorkingDir)
+		if err != nil {
+			return nil, err
+		}
+
+		appFiles.Procfile = tc.Procfile
+	}
+
+	return appFiles, nil
+}
+
+func (d *Docker) buildFromContainerImage(ctx context.Context, r *pb.BuildRequest, w console.File) (*pb.TsuruConfig, error) {
+	tmpDir, cleanFunc, err := build.GenerateBuildLocalDir(ctx, d.options().TempDir, fmt.Sprintf("FROM %s", r.SourceImage), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanFunc()
+
+	if err = d.buildAndPush(ctx, tmpDir, r, w); err != nil {
+		return nil, err
+	}
+
+	ic, err := d.imageConfig(ctx, r.DestinationImages[0])
+	if err != nil {
+		return nil, err
+	}
+
+	tc, err := d.extractTsuruConfigsFromImage(ctx, r.DestinationImages[0], ic.WorkingDir)
+	if err != nil {
+		return nil, err
+	}
+
+	tc.ImageConfig = ic
+	return tc, nil
+}
+
+func (d *Docker) buildFromContainerFile(ctx context.Context, r *pb.BuildRequest, w console.File) (*pb.TsuruConfig, error) {
+	var files io.Reader
+	if len(r.Data) > 0 {
+		files = bytes.NewReader(r.Data)
+	}
+
+	envVars := map[string]string{}
+	if r.App != nil {
+		envVars = r.App.EnvVars
+	} else if r.Job != nil {
+		envVars = r.Job.EnvVars
+	}
+
+	tmpDir, cleanFunc, err := build.GenerateBuildLocalDir(ctx, d.options().TempDir, r.Containerfile, nil, envVars, files)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanFunc()
+
+	if err = d.buildAndPush(ctx, tmpDir, r, w); err != nil {
+		return nil, err
+	}
+
+	ic, err := d.imageConfig(ctx, r.DestinationImages[0])
+	if err != nil {
+		return nil, err
+	}
+
+	tc, err := d.extractTsuruConfigsFromImage(ctx, r.DestinationImages[0], ic.WorkingDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if tc.TsuruYaml == "" {
+		tsuruYamlData, err := build.FindAndReadTsuruYaml(tmpDir)
+		if err != nil {
+			return nil, err
+		}
+		tc.TsuruYaml = tsuruYamlData
+	}
+
+	tc.ImageConfig = ic
+	return tc, nil
+}
+
+func (d *Docker) buildPlatform(ctx context.Context, r *pb.BuildRequest, w console.File) error {
+	tmpDir, cleanFunc, err := build.GenerateBuildLocalDir(ctx, d.options().TempDir, r.Containerfile, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer cleanFunc()
+
+	return d.buildAndPush(ctx, tmpDir, r, w)
+}
+
+func (d *Docker) buildAndPush(ctx context.Context, buildLocalDir string, r *pb.BuildRequest, w console.File) error {
+	opts := d.options()
+
+	if opts.RemoteRepository != nil {
+		if err := repo.EnsureImages(ctx, opts.RemoteRepository, r.DestinationImages); err != nil {
+			return err
+		}
+	}
+
+	if err := d.build(ctx, opts, buildLocalDir, r, w); err != nil {
+		return err
+	}
+
+	if r.PushOptions != nil && r.PushOptions.Disable {
+		return nil
+	}
+
+	for _, image := range r.DestinationImages {
+		if err := d.push(ctx, image, w); err != nil {
+			return err
+		}
+	}
+
+	d.applyRetention(ctx, opts, r, w)
+	return nil
+}
+
+// applyRetention deletes the old versions of the app's (or job's) images
+// once pushed. Failing to do so doesn't fail the build.
+func (d *Docker) applyRetention(ctx context.Context, opts DockerOptions, r *pb.BuildRequest, w io.Writer) {
+	if opts.RemoteRepository == nil || opts.RetentionKeepLast <= 0 || (r.App == nil && r.Job == nil) {
+		return
+	}
+
+	if err := repo.ApplyRetention(ctx, opts.RemoteRepository, r.DestinationImages, r.ImagesInUse, opts.RetentionKeepLast); err != nil {
+		fmt.Fprintf(w, "Warning: Failed to apply the retention policy: %v\n", err)
+	}
+}
+
+func (d *Docker) build(ctx context.Context, opts DockerOptions, buildLocalDir string, r *pb.BuildRequest, w console.File) error {
+	if opts.DisableCache {
+		fmt.Fprintln(w, "Cache disabled, performing build cache prune before build...")
+		if _, err := d.cli.BuildCachePrune(ctx, dockertypes.BuildCachePruneOptions{All: true}); err != nil {
+			fmt.Fprintf(w, "Warning: Failed to prune build cache: %v\n", err)
+		} else {
+			fmt.Fprintln(w, "Build cache pruned successfully")
+		}
+	}
+
+	if err := addContainerfileToContext(buildLocalDir); err != nil {
+		return err
+	}
+
+	var secretSources []secretsprovider.Source
+	if r.App != nil {
+		secretSources = append(secretSources, secretsprovider.Source{
+			ID:       "tsuru-app-envvars",
+			FilePath: filepath.Join(buildLocalDir, "secrets", "envs.sh"),
+		})
+	} else if r.Job != nil {
+		secretSources = append(secretSources, secretsprovider.Source{
+			ID:       "tsuru-job-envvars",
+			FilePath: filepath.Join(buildLocalDir, "secrets", "envs.sh"),
+		})
+	}
+
+	secrets, err := secretsprovider.NewStore(secretSources)
+	if err != nil {
+		return err
+	}
+
+	s, err := session.NewSession(ctx, "deploy-agent", "")
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	s.Allow(authprovider.NewDockerAuthProvider(config.LoadDefaultConfigFile(os.Stderr)))
+	s.Allow(secretsprovider.NewSecretProvider(secrets))
+
+	pw, err := progresswriter.NewPrinter(context.Background(), w, "plain") //nolint - using an empty context intentionally
+	if err != nil {
+		return err
+	}
+
+	eg, nctx := errgroup.WithContext(ctx)
+
+	eg.Go(func() error {
+		return s.Run(nctx, func(ctx context.Context, proto string, meta map[string][]string) (net.Conn, error) {
+			return d.cli.DialHijack(ctx, "/session", proto, meta)
+		})
+	})
+
+	eg.Go(func() error {
+		defer s.Close() // stops the session once the build is finished
+		defer close(pw.Status())
+
+		pr, pwr := io.Pipe()
+		go func() {
+			pwr.CloseWithError(util.CompressGZIPFile(nctx, pwr, filepath.Join(buildLocalDir, "context")))
+		}()
+		defer pr.Close()
+
+		buildArgs := map[string]*string{
+			// NOTE: we should always run the deploy's script command as user might
+			// need to regenerate assets, for example.
+			"tsuru_deploy_cache": strPtr(strconv.FormatInt(time.Now().Unix(), 10)),
+		}
+
+		var platform string
+		if opts.DetectCPUArch {
+			platform = fmt.Sprintf("%s/%s", runtime.GOOS, runtime.GOARCH)
+		}
+
+		resp, err := d.cli.ImageBuild(nctx, pr, dockertypes.ImageBuildOptions{
+			Version:    dockertypes.BuilderBuildKit,
+			SessionID:  s.ID(),
+			Dockerfile: dockerfileName,
+			Tags:       r.DestinationImages,
+			BuildArgs:  buildArgs,
+			NoCache:    opts.DisableCache,
+			Platform:   platform,
+		})
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		return jsonmessage.DisplayJSONMessagesStream(resp.Body, w, 0, false, func(msg jsonmessage.JSONMessage) {
+			if st, ok := decodeBuildKitTrace(msg); ok {
+				pw.Status() <- st
+			}
+		})
+	})
+
+	eg.Go(func() error {
+		<-pw.Done()
+		return pw.Err()
+	})
+
+	return eg.Wait()
+}
+
+func (d *Docker) push(ctx context.Context, image string, w io.Writer) error {
+	auth, err := registryAuth(build.GetRegistry(image))
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "Pushing %s\n", image)
+
+	rc, err := d.cli.ImagePush(ctx, image, dockertypes.ImagePushOptions{RegistryAuth: auth})
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	return jsonmessage.DisplayJSONMessagesStream(rc, w, 0, false, nil)
+}
+
+func (d *Docker) imageConfig(ctx context.Context, image string) (*pb.ContainerImageConfig, error) {
+	ii, _, err := d.cli.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		return nil, err
+	}
+
+	if ii.Config == nil {
+		return &pb.ContainerImageConfig{}, nil
+	}
+
+	exposedPorts := make(map[string]struct{}, len(ii.Config.ExposedPorts))
+	for p := range ii.Config.ExposedPorts {
+		exposedPorts[string(p)] = struct{}{}
+	}
+
+	return &pb.ContainerImageConfig{
+		Entrypoint:   ii.Config.Entrypoint,
+		Cmd:          ii.Config.Cmd,
+		WorkingDir:   ii.Config.WorkingDir,
+		ExposedPorts: build.SortExposedPorts(exposedPorts),
+	}, nil
+}
+
+// extractTsuruConfigsFromImage exports the filesystem of a (never started)
+// container from image in order to look for Tsuru config files.
+func (d *Docker) extractTsuruConfigsFromImage(ctx context.Context, image, workingDir string) (*pb.TsuruConfig, error) {
+	created, err := d.cli.ContainerCreate(ctx, &dockertypescontainer.Config{
+		Image:      image,
+		Entrypoint: []string{"true"}, // never run, but required when image has neither entrypoint nor cmd
+	}, nil, nil, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if nerr := d.cli.ContainerRemove(context.Background(), created.ID, dockertypes.ContainerRemoveOptions{Force: true}); nerr != nil { //nolint - container must be removed even when ctx is done
+			fmt.Fprintf(os.Stderr, "failed to remove container %s: %v\n", created.ID, nerr)
+		}
+	}()
+
+	rc, err := d.cli.ContainerExport(ctx, created.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return build.ExtractTsuruAppFilesFromContainerImageTarball(ctx, rc, workingDir)
+}
+
+// addContainerfileToContext copies the Containerfile into the context dir,
+// hiding it (and .dockerignore itself) from the build through .dockerignore.
+// It's the same approach taken by Docker CLI when the Containerfile comes
+// from outside of the context.
+func addContainerfileToContext(buildLocalDir string) error {
+	containerfile, err := os.ReadFile(filepath.Join(buildLocalDir, "Dockerfile"))
+	if err != nil {
+		return err
+	}
+
+	contextDir := filepath.Join(buildLocalDir, "context")
+	if err = os.WriteFile(filepath.Join(contextDir, dockerfileName), containerfile, 0o600); err != nil {
+		return err
+	}
+
+	dockerignorePath := filepath.Join(contextDir, ".dockerignore")
+	dockerignore, err := os.ReadFile(dockerignorePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if len(dockerignore) > 0 && !bytes.HasSuffix(dockerignore, []byte("\n")) {
+		dockerignore = append(dockerignore, '\n')
+	}
+
+	dockerignore = append(dockerignore, []byte(".dockerignore\n"+dockerfileName+"\n")...)
+	return os.WriteFile(dockerignorePath, dockerignore, 0o600)
+}
+
+// decodeBuildKitTrace converts the BuildKit progress carried in aux messages of
+// Docker Engine's build output into a solve status.
+func decodeBuildKitTrace(msg jsonmessage.JSONMessage) (*client.SolveStatus, bool) {
+	if msg.ID != buildKitTraceID || msg.Aux == nil {
+		return nil, false
+	}
+
+	var data []byte
+	if err := json.Unmarshal(*msg.Aux, &data); err != nil {
+		return nil, false
+	}
+
+	var resp controlapi.StatusResponse
+	if err := resp.Unmarshal(data); err != nil {
+		return nil, false
+	}
+
+	s := &client.SolveStatus{}
+	for _, v := range resp.Vertexes {
+		s.Vertexes = append(s.Vertexes, &client.Vertex{
+			Digest:    v.Digest,
+			Inputs:    v.Inputs,
+			Name:      v.Name,
+			Started:   v.Started,
+			Completed: v.Completed,
+			Error:     v.Error,
+			Cached:    v.Cached,
+		})
+	}
+
+	for _, v := range resp.Statuses {
+		s.Statuses = append(s.Statuses, &client.VertexStatus{
+			ID:        v.ID,
+			Vertex:    v.Vertex,
+			Name:      v.Name,
+			Total:     v.Total,
+			Current:   v.Current,
+			Timestamp: v.Timestamp,
+			Started:   v.Started,
+			Completed: v.Completed,
+		})
+	}
+
+	for _, v := range resp.Logs {
+		s.Logs = append(s.Logs, &client.VertexLog{
+			Vertex:    v.Vertex,
+			Stream:    int(v.Stream),
+			Data:      v.Msg,
+			Timestamp: v.Timestamp,
+		})
+	}
+
+	return s, true
+}
+
+// registryAuth returns the encoded credentials (as expected by Docker Engine)
+// of registry from Docker's config file.
+func registryAuth(registry string) (string, error) {
+	if registry == "docker.io" {
+		registry = "https://index.docker.io/v1/"
+	}
+
+	ac, err := config.LoadDefaultConfigFile(io.Discard).GetAuthConfig(registry)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(ac)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.URLEncoding.EncodeToString(data), nil
+}
+
+func strPtr(s string) *string {
+	return &s
+}
@@ -0,0 +1,159 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package docker
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+	controlapi "github.com/moby/buildkit/api/services/control"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	pb "github.com/tsuru/deploy-agent/pkg/build/grpc_build_v1"
+	"github.com/tsuru/deploy-agent/pkg/util"
+)
+
+func TestAddContainerfileToContext(t *testing.T) {
+	rootDir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(rootDir, "context"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "Dockerfile"), []byte("FROM alpine\n"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "context", ".dockerignore"), []byte("*.log"), 0o600))
+
+	require.NoError(t, addContainerfileToContext(rootDir))
+
+	containerfile, err := os.ReadFile(filepath.Join(rootDir, "context", dockerfileName))
+	require.NoError(t, err)
+	assert.Equal(t, "FROM alpine\n", string(containerfile))
+
+	dockerignore, err := os.ReadFile(filepath.Join(rootDir, "context", ".dockerignore"))
+	require.NoError(t, err)
+	assert.Equal(t, "*.log\n.dockerignore\n.deploy-agent.Dockerfile\n", string(dockerignore))
+}
+
+func TestDecodeBuildKitTrace(t *testing.T) {
+	now := time.Now().UTC()
+	resp := controlapi.StatusResponse{
+		Vertexes: []*controlapi.Vertex{{Digest: digest.FromString("a"), Name: "[1/2] FROM alpine", Started: &now, Cached: true}},
+		Statuses: []*controlapi.VertexStatus{{ID: "layer", Vertex: digest.FromString("a"), Current: 10, Total: 100, Timestamp: now}},
+		Logs:     []*controlapi.VertexLog{{Vertex: digest.FromString("a"), Stream: 1, Msg: []byte("hello"), Timestamp: now}},
+	}
+	data, err := resp.Marshal()
+	require.NoError(t, err)
+
+	aux, err := json.Marshal(data)
+	require.NoError(t, err)
+	rawAux := json.RawMessage(aux)
+
+	s, ok := decodeBuildKitTrace(jsonmessage.JSONMessage{ID: buildKitTraceID, Aux: &rawAux})
+	require.True(t, ok)
+	require.Len(t, s.Vertexes, 1)
+	assert.Equal(t, "[1/2] FROM alpine", s.Vertexes[0].Name)
+	assert.True(t, s.Vertexes[0].Cached)
+	require.Len(t, s.Statuses, 1)
+	assert.Equal(t, int64(10), s.Statuses[0].Current)
+	require.Len(t, s.Logs, 1)
+	assert.Equal(t, []byte("hello"), s.Logs[0].Data)
+	assert.Equal(t, 1, s.Logs[0].Stream)
+
+	_, ok = decodeBuildKitTrace(jsonmessage.JSONMessage{ID: "sha256:abc", Aux: &rawAux})
+	assert.False(t, ok)
+
+	_, ok = decodeBuildKitTrace(jsonmessage.JSONMessage{ID: buildKitTraceID})
+	assert.False(t, ok)
+}
+
+func TestRegistryAuth(t *testing.T) {
+	configDir := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", configDir)
+	require.NoError(t, os.WriteFile(filepath.Join(configDir, "config.json"), []byte(`{
+  "auths": {
+    "registry.example.com": {"auth": "`+base64.StdEncoding.EncodeToString([]byte("user:pass"))+`"},
+    "https://index.docker.io/v1/": {"auth": "`+base64.StdEncoding.EncodeToString([]byte("hub-user:hub-pass"))+`"}
+  }
+}`), 0o600))
+
+	tests := map[string]string{
+		"registry.example.com": "user",
+		"docker.io":            "hub-user",
+		"other.example.com":    "",
+	}
+
+	for registry, expectedUsername := range tests {
+		t.Run(registry, func(t *testing.T) {
+			encoded, err := registryAuth(registry)
+			require.NoError(t, err)
+
+			data, err := base64.URLEncoding.DecodeString(encoded)
+			require.NoError(t, err)
+
+			var ac struct {
+				Username string `json:"username"`
+			}
+			require.NoError(t, json.Unmarshal(data, &ac))
+			assert.Equal(t, expectedUsername, ac.Username)
+		})
+	}
+}
+
+func TestDocker_Build_FromContainerFile(t *testing.T) {
+	registryAddress := integrationEnv(t)
+
+	dc, err := NewClient(os.Getenv("DOCKER_HOST"))
+	require.NoError(t, err)
+
+	dockerfile, err := os.ReadFile("../buildkit/testdata/container_file/Dockerfile")
+	require.NoError(t, err)
+
+	var data bytes.Buffer
+	require.NoError(t, util.CompressGZIPFile(context.TODO(), &data, "../buildkit/testdata/container_file/"))
+
+	req := &pb.BuildRequest{
+		Kind:              pb.BuildKind_BUILD_KIND_APP_BUILD_WITH_CONTAINER_FILE,
+		App:               &pb.TsuruApp{Name: "my-app"},
+		DestinationImages: []string{fmt.Sprintf("%s/deploy-agent-integration/docker-my-app:%x", registryAddress, sha256.Sum256([]byte(t.Name())))},
+		Containerfile:     string(dockerfile),
+		Data:              data.Bytes(),
+	}
+
+	appFiles, err := NewDocker(dc, DockerOptions{TempDir: t.TempDir()}).Build(context.TODO(), req, os.Stdout)
+	require.NoError(t, err)
+	assert.Equal(t, "web: /path/to/webserver.sh --port 8888\nworker: /path/to/worker.sh\n", appFiles.Procfile)
+	assert.NotEmpty(t, appFiles.TsuruYaml)
+	assert.Equal(t, &pb.ContainerImageConfig{
+		Cmd:        []string{"/bin/sh"},
+		WorkingDir: "/app/user",
+	}, appFiles.ImageConfig)
+}
+
+func integrationEnv(t *testing.T) string {
+	t.Helper()
+
+	if enabled, _ := strconv.ParseBool(os.Getenv("DEPLOY_AGENT_INTEGRATION")); !enabled {
+		t.Skip("Skipping deploy agent integration tests")
+	}
+
+	if _, found := os.LookupEnv("DOCKER_HOST"); !found {
+		t.Skip("Skipping deploy agent integration tests: missing DOCKER_HOST env var")
+	}
+
+	registryAddress, found := os.LookupEnv("DEPLOY_AGENT_INTEGRATION_REGISTRY_HOST")
+	if !found {
+		t.Skip("Skipping deploy agent integration tests: missing DEPLOY_AGENT_INTEGRATION_REGISTRY_HOST env var")
+	}
+
+	return registryAddress
+}
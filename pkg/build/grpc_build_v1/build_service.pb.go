@@ -136,7 +136,13 @@ type BuildRequest struct {
 	// Job is the Tsuru job which is being deployed, if any.
 	//
 	// NOTE: mandatory field when build kind starts with BUILD_KIND_JOB_.
-	Job           *TsuruJob `protobuf:"bytes,11,opt,name=job,proto3" json:"job,omitempty"`
+	Job *TsuruJob `protobuf:"bytes,11,opt,name=job,proto3" json:"job,omitempty"`
+	// Pool is the Tsuru pool where the app (or job) runs on, if any.
+	Pool string `protobuf:"bytes,12,opt,name=pool,proto3" json:"pool,omitempty"`
+	// ImagesInUse are the container images the app (or job) currently runs on
+	// (e.g. registry.example.com/tsuru/app-my-app:v41), whose tags are never
+	// deleted by the retention of the destination images' repositories.
+	ImagesInUse   []string `protobuf:"bytes,13,rep,name=images_in_use,json=imagesInUse,proto3" json:"images_in_use,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -234,6 +240,20 @@ func (x *BuildRequest) GetJob() *TsuruJob {
 	return nil
 }
 
+func (x *BuildRequest) GetPool() string {
+	if x != nil {
+		return x.Pool
+	}
+	return ""
+}
+
+func (x *BuildRequest) GetImagesInUse() []string {
+	if x != nil {
+		return x.ImagesInUse
+	}
+	return nil
+}
+
 type BuildResponse struct {
 	state protoimpl.MessageState `protogen:"open.v1"`
 	// Types that are valid to be assigned to Data:
@@ -678,7 +698,7 @@ var File_pkg_build_grpc_build_v1_build_service_proto protoreflect.FileDescriptor
 
 const file_pkg_build_grpc_build_v1_build_service_proto_rawDesc = "" +
 	"\n" +
-	"+pkg/build/grpc_build_v1/build_service.proto\x12\rgrpc_build_v1\"\x97\x03\n" +
+	"+pkg/build/grpc_build_v1/build_service.proto\x12\rgrpc_build_v1\"\xcf\x03\n" +
 	"\fBuildRequest\x12,\n" +
 	"\x04kind\x18\x01 \x01(\x0e2\x18.grpc_build_v1.BuildKindR\x04kind\x12)\n" +
 	"\x03app\x18\x02 \x01(\v2\x17.grpc_build_v1.TsuruAppR\x03app\x128\n" +
@@ -689,7 +709,9 @@ const file_pkg_build_grpc_build_v1_build_service_proto_rawDesc = "" +
 	"\rContainerfile\x18\a \x01(\tR\rContainerfile\x12=\n" +
 	"\fpush_options\x18\n" +
 	" \x01(\v2\x1a.grpc_build_v1.PushOptionsR\vpushOptions\x12)\n" +
-	"\x03job\x18\v \x01(\v2\x17.grpc_build_v1.TsuruJobR\x03job\"r\n" +
+	"\x03job\x18\v \x01(\v2\x17.grpc_build_v1.TsuruJobR\x03job\x12\x12\n" +
+	"\x04pool\x18\f \x01(\tR\x04pool\x12\"\n" +
+	"\rimages_in_use\x18\r \x03(\tR\vimagesInUse\"r\n" +
 	"\rBuildResponse\x12\x18\n" +
 	"\x06output\x18\x01 \x01(\tH\x00R\x06output\x12?\n" +
 	"\ftsuru_config\x18\x02 \x01(\v2\x1a.grpc_build_v1.TsuruConfigH\x00R\vtsuruConfigB\x06\n" +
@@ -12,6 +12,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
@@ -20,8 +21,13 @@ import (
 	"text/template"
 
 	"github.com/alessio/shellescape"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sigs.k8s.io/yaml"
 
 	pb "github.com/tsuru/deploy-agent/pkg/build/grpc_build_v1"
+	"github.com/tsuru/deploy-agent/pkg/util"
 )
 
 func IsTsuruYaml(filename string) bool {
@@ -307,3 +313,123 @@ func GetRegistry(image string) string {
 
 	return defaultRegistry
 }
+
+func ParseTsuruYaml(tsuruYAMLContent string) (TsuruYamlData, error) {
+	var tsuruYAML TsuruYamlData
+	if strings.TrimSpace(tsuruYAMLContent) == "" {
+		return TsuruYamlData{}, nil
+	}
+	if err := yaml.Unmarshal([]byte(tsuruYAMLContent), &tsuruYAML); err != nil {
+		return TsuruYamlData{}, err
+	}
+	return tsuruYAML, nil
+}
+
+// FindAndReadTsuruYaml returns the content of the first Tsuru YAML file found
+// in the context dir of a build local dir (see GenerateBuildLocalDir), if any.
+func FindAndReadTsuruYaml(tmpDir string) (string, error) {
+	contextDir := filepath.Join(tmpDir, "context")
+
+	// Try all possible Tsuru YAML filenames
+	for _, filename := range TsuruYamlNames {
+		tsuruYamlPath := filepath.Join(contextDir, filename)
+		if _, err := os.Stat(tsuruYamlPath); err == nil {
+			tsuruYamlData, err := os.ReadFile(tsuruYamlPath)
+			if err != nil {
+				return "", fmt.Errorf("failed to read %s: %w", filename, err)
+			}
+			return string(tsuruYamlData), nil
+		}
+	}
+
+	// No Tsuru YAML file found, return empty string (not an error)
+	return "", nil
+}
+
+// GenerateBuildLocalDir creates the local directory used as input of builds.
+// It returns the root dir along with a function to remove it.
+func GenerateBuildLocalDir(ctx context.Context, baseDir, dockerfile string, appArchiveData io.Reader, envs map[string]string, files io.Reader) (string, func(), error) {
+	noopFunc := func() {}
+
+	if err := ctx.Err(); err != nil {
+		return "", noopFunc, err
+	}
+
+	// Layout design
+	//
+	// ./                       # Root dir
+	//   Dockerfile
+	//   secrets/
+	//     envs.sh              # Tsuru app's env vars
+	//   context/
+	//     application.tar.gz   # Tsuru app's deploy data
+	//     ...
+	//     [other files]
+
+	rootDir, err := os.MkdirTemp(baseDir, "deploy-agent-*")
+	if err != nil {
+		return "", noopFunc, status.Errorf(codes.Internal, "failed to create temp dir: %s", err)
+	}
+
+	contextDir := filepath.Join(rootDir, "context")
+	if err = os.Mkdir(contextDir, 0o755); err != nil {
+		return "", noopFunc, err
+	}
+
+	secretsDir := filepath.Join(rootDir, "secrets")
+	if err = os.Mkdir(secretsDir, 0o700); err != nil {
+		return "", noopFunc, err
+	}
+
+	eg, nctx := errgroup.WithContext(ctx)
+
+	eg.Go(func() error {
+		d, nerr := os.Create(filepath.Join(rootDir, "Dockerfile"))
+		if nerr != nil {
+			return status.Errorf(codes.Internal, "cannot create Dockerfile in %s: %s", rootDir, nerr)
+		}
+		defer d.Close()
+		_, nerr = io.WriteString(d, dockerfile)
+		return nerr
+	})
+
+	eg.Go(func() error {
+		if appArchiveData == nil { // there's no application.tar.gz file, skipping it
+			return nil
+		}
+		appArchive, nerr := os.Create(filepath.Join(contextDir, "application.tar.gz"))
+		if nerr != nil {
+			return status.Errorf(codes.Internal, "cannot create application archive: %s", nerr)
+		}
+		defer appArchive.Close()
+		_, nerr = io.Copy(appArchive, appArchiveData)
+		return nerr
+	})
+
+	eg.Go(func() error {
+		envsFile, nerr := os.Create(filepath.Join(secretsDir, "envs.sh"))
+		if nerr != nil {
+			return nerr
+		}
+		defer envsFile.Close()
+		fmt.Fprintln(envsFile, "# File containing the env vars of Tsuru app. Generated by deploy-agent.")
+		for k, v := range envs {
+			fmt.Fprintf(envsFile, "export %s=%s\n", k, shellescape.Quote(v))
+		}
+		return nil
+	})
+
+	eg.Go(func() error {
+		if files == nil {
+			return nil
+		}
+
+		return util.ExtractGZIPFileToDir(nctx, files, contextDir)
+	})
+
+	if err = eg.Wait(); err != nil {
+		return "", noopFunc, err
+	}
+
+	return rootDir, func() { os.RemoveAll(rootDir) }, nil
+}
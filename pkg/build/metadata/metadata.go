@@ -4,13 +4,33 @@
 
 package metadata
 
+import "strings"
+
 const (
 	DeployAgentLastReplicasAnnotationKey   = "deploy-agent.tsuru.io/last-replicas"
 	DeployAgentLastBuildStartingLabelKey   = "deploy-agent.tsuru.io/last-build-starting-time"
 	DeployAgentLastBuildEndingTimeLabelKey = "deploy-agent.tsuru.io/last-build-ending-time"
+	DeployAgentRecentBuildsAnnotationKey   = "deploy-agent.tsuru.io/recent-builds"
+
+	DeployAgentBuildOwnerAnnotationKey     = "deploy-agent.tsuru.io/build-owner"
+	DeployAgentBuildTeamAnnotationKey      = "deploy-agent.tsuru.io/build-team"
+	DeployAgentBuildKindAnnotationKey      = "deploy-agent.tsuru.io/build-kind"
+	DeployAgentBuildImageAnnotationKey     = "deploy-agent.tsuru.io/build-image"
+	DeployAgentBuildStartedAtAnnotationKey = "deploy-agent.tsuru.io/build-started-at"
 
 	TsuruAppNamespace    = "tsuru"
 	TsuruAppNameLabelKey = "tsuru.io/app-name"
 	TsuruAppTeamLabelKey = "tsuru.io/app-team"
 	TsuruIsBuildLabelKey = "tsuru.io/is-build"
+
+	TsuruJobNameLabelKey      = "tsuru.io/job-name"
+	TsuruJobTeamLabelKey      = "tsuru.io/job-team"
+	TsuruPlatformNameLabelKey = "tsuru.io/platform-name"
 )
+
+// EscapeJSONPointer escapes s to be a reference token of a JSON pointer (e.g.
+// a label key in a JSON patch path), replacing ~ and / by ~0 and ~1.
+// See: https://datatracker.ietf.org/doc/html/rfc6901#section-3
+func EscapeJSONPointer(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~", "~0"), "/", "~1")
+}
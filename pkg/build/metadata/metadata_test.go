@@ -0,0 +1,38 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package metadata
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEscapeJSONPointer(t *testing.T) {
+	t.Run("string with forward slash", func(t *testing.T) {
+		result := EscapeJSONPointer("tsuru.io/app-name")
+		assert.Equal(t, "tsuru.io~1app-name", result)
+	})
+
+	t.Run("string with tilde", func(t *testing.T) {
+		result := EscapeJSONPointer("test~app")
+		assert.Equal(t, "test~0app", result)
+	})
+
+	t.Run("string with both tilde and slash", func(t *testing.T) {
+		result := EscapeJSONPointer("test~/app")
+		assert.Equal(t, "test~0~1app", result)
+	})
+
+	t.Run("string without special characters", func(t *testing.T) {
+		result := EscapeJSONPointer("simple-label")
+		assert.Equal(t, "simple-label", result)
+	})
+
+	t.Run("empty string", func(t *testing.T) {
+		result := EscapeJSONPointer("")
+		assert.Equal(t, "", result)
+	})
+}
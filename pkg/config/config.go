@@ -0,0 +1,549 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package config defines the deploy-agent's configuration file format.
+// The file is a versioned YAML document whose sections (server, builder,
+// BuildKit, discovery, scaler, repository and policies) mirror the command
+// line flags.
+// Some sections are safe to change at runtime and can be reloaded without
+// restarting the agent, see RestartRequired for the ones which are not.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/tools/leaderelection"
+	"sigs.k8s.io/yaml"
+
+	"github.com/tsuru/deploy-agent/pkg/build/buildkit/routing"
+	"github.com/tsuru/deploy-agent/pkg/build/buildkit/scaler"
+	"github.com/tsuru/deploy-agent/pkg/repository"
+)
+
+const Version = "v1"
+
+type Duration time.Duration
+
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string (e.g. 5m, 2h): %w", err)
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(v)
+	return nil
+}
+
+type Config struct {
+	Version    string           `json:"version"`
+	Server     ServerConfig     `json:"server"`
+	Builder    BuilderConfig    `json:"builder"`
+	BuildKit   BuildKitConfig   `json:"buildkit"`
+	Discovery  DiscoveryConfig  `json:"discovery"`
+	Scaler     ScalerConfig     `json:"scaler"`
+	Repository RepositoryConfig `json:"repository"`
+	Policies   PoliciesConfig   `json:"policies"`
+}
+
+type ServerConfig struct {
+	Port           int `json:"port"`
+	MetricsPort    int `json:"metricsPort"`
+	MaxRecvMsgSize int `json:"maxRecvMsgSize"`
+	MaxSendMsgSize int `json:"maxSendMsgSize"`
+	// MetricsTeamLabel fills the team label of build metrics, leaving it
+	// empty bounds their cardinality.
+	MetricsTeamLabel bool `json:"metricsTeamLabel"`
+	// KEDAExternalScaler serves the KEDA External Scaler API along with the
+	// build service, see package keda.
+	KEDAExternalScaler bool `json:"kedaExternalScaler"`
+}
+
+type BuilderConfig struct {
+	// Backend is the name of the build backend (e.g. buildkit, docker).
+	Backend string       `json:"backend"`
+	Docker  DockerConfig `json:"docker"`
+}
+
+type DockerConfig struct {
+	// Host is the Docker Engine daemon address, defaults to DOCKER_HOST env var.
+	Host string `json:"host"`
+}
+
+type BuildKitConfig struct {
+	Address string `json:"address"`
+	// Addresses are several BuildKit endpoints used as a load balanced pool,
+	// mutually exclusive with Address.
+	Addresses           []string `json:"addresses,omitempty"`
+	TmpDir              string   `json:"tmpDir"`
+	HealthCheckInterval Duration `json:"healthCheckInterval"`
+	DetectCPUArch       bool     `json:"detectCPUArch"`
+	// Routes send the builds matching them to other BuildKit targets than the
+	// default one, see the routing package.
+	Routes []routing.Rule `json:"routes,omitempty"`
+	Retry  RetryConfig    `json:"retry"`
+}
+
+// RetryConfig retries the builds failing for transient BuildKit reasons, e.g.
+// its pod being evicted or the connection resetting mid-build, on a newly
+// discovered BuildKit pod.
+type RetryConfig struct {
+	// MaxAttempts is the number of times a build is tried, at most. Builds
+	// aren't retried when it's lower than 2.
+	MaxAttempts int `json:"maxAttempts"`
+	// Backoff is the wait before the first retry, doubling on every retry.
+	Backoff Duration `json:"backoff"`
+}
+
+type DiscoveryConfig struct {
+	KubeConfig string `json:"kubeconfig"`
+	// DNSName discovers BuildKit by resolving DNS records rather than
+	// through the Kubernetes API, see autodiscovery.DNSDiscoverer.
+	DNSName               string      `json:"dnsName"`
+	PodSelector           string      `json:"podSelector"`
+	Namespace             string      `json:"namespace"`
+	LeasePrefix           string      `json:"leasePrefix"`
+	Port                  int         `json:"port"`
+	Timeout               Duration    `json:"timeout"`
+	AffinityWait          Duration    `json:"affinityWait"`
+	Enabled               bool        `json:"enabled"`
+	LoadAware             bool        `json:"loadAware"`
+	SetTsuruAppLabels     bool        `json:"setTsuruAppLabels"`
+	UseSameNamespaceAsApp bool        `json:"useSameNamespaceAsApp"`
+	Lease                 LeaseConfig `json:"lease"`
+	// BuildEvents records Kubernetes Events of each build on its BuildKit
+	// pod and on the tsuru App (or Job) resource.
+	BuildEvents bool `json:"buildEvents"`
+	// BuildRuns creates a BuildRun resource for each app and job build in
+	// their namespaces, see package buildrun.
+	BuildRuns bool `json:"buildRuns"`
+	// BuildRunsHistoryLimit is the number of finished BuildRuns kept for
+	// each app (or job), the older ones are deleted. Zero keeps them all.
+	BuildRunsHistoryLimit int `json:"buildRunsHistoryLimit"`
+}
+
+// IsKubernetes tells whether BuildKit pods are discovered through the
+// Kubernetes API.
+func (c DiscoveryConfig) IsKubernetes() bool {
+	return c.Enabled && c.DNSName == ""
+}
+
+// LeaseConfig tunes the leases which keep each BuildKit pod running a single
+// build. Leases are renewed every retry period while builds run, so longer
+// durations tolerate longer API server outages but keep pods of crashed
+// agents leased for longer.
+type LeaseConfig struct {
+	Duration      Duration `json:"duration"`
+	RenewDeadline Duration `json:"renewDeadline"`
+	RetryPeriod   Duration `json:"retryPeriod"`
+	// AbortOnLoss aborts the builds which lose their lease, otherwise they
+	// go on with a warning.
+	AbortOnLoss bool `json:"abortOnLoss"`
+}
+
+type ScalerConfig struct {
+	Statefulset    string   `json:"statefulset"`
+	GracefulPeriod Duration `json:"gracefulPeriod"`
+	// MaxReplicas enables the horizontal scaling of the statefulset: it's
+	// scaled out up to MaxReplicas when builds wait longer than
+	// ScaleOutThreshold, and scaled in one replica at a time as pods go idle.
+	MaxReplicas       int32    `json:"maxReplicas"`
+	ScaleOutThreshold Duration `json:"scaleOutThreshold"`
+	// Interval between the downscaler runs, which happen only on the agent
+	// replica elected as leader.
+	Interval Duration `json:"interval"`
+	// Schedules hold minimum replicas on the statefulsets while open, the
+	// first open schedule matching a statefulset applies.
+	Schedules []ScheduleConfig `json:"schedules,omitempty"`
+}
+
+type ScheduleConfig struct {
+	Name string `json:"name"`
+	// Namespace restricts the schedule to a namespace, empty matches any.
+	Namespace string `json:"namespace,omitempty"`
+	// Statefulset defaults to the scaler's statefulset.
+	Statefulset string `json:"statefulset,omitempty"`
+	// Cron is a standard cron expression opening the window, optionally
+	// prefixed by its time zone (e.g. CRON_TZ=America/Sao_Paulo 0 8 * * 1-5).
+	Cron        string   `json:"cron"`
+	Duration    Duration `json:"duration"`
+	MinReplicas int32    `json:"minReplicas"`
+}
+
+type RepositoryConfig struct {
+	// Providers are the remote repository providers by registry, in the same
+	// format of the file pointed by Path. They take precedence over the
+	// providers loaded from Path.
+	Providers repository.RemoteRepositoryProvider `json:"providers,omitempty"`
+	Path      string                              `json:"path"`
+	Retention RetentionConfig                     `json:"retention"`
+}
+
+// RetentionConfig deletes the old versions of the apps' (and jobs') images
+// after pushing them, on the registries whose provider supports it.
+type RetentionConfig struct {
+	// KeepLast is the number of latest versions kept, besides the ones in
+	// use. Retention is disabled when zero.
+	KeepLast int `json:"keepLast"`
+}
+
+type PoliciesConfig struct {
+	DisableCache bool `json:"disableCache"`
+}
+
+// Load reads the configuration file at path on top of base, so settings
+// missing in the file keep the base values.
+func Load(path string, base Config) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	return Parse(data, base)
+}
+
+func Parse(data []byte, base Config) (*Config, error) {
+	c := base.DeepCopy()
+	c.Version = ""
+
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	if c.Version == "" {
+		return nil, errors.New("config file must set its version")
+	}
+
+	if c.Version != Version {
+		return nil, fmt.Errorf("unsupported config file version %q (supported: %s)", c.Version, Version)
+	}
+
+	return c, nil
+}
+
+func (c *Config) DeepCopy() *Config {
+	out := *c
+	out.BuildKit.Addresses = append([]string(nil), c.BuildKit.Addresses...)
+	out.Scaler.Schedules = append([]ScheduleConfig(nil), c.Scaler.Schedules...)
+	if c.BuildKit.Routes != nil {
+		out.BuildKit.Routes = make([]routing.Rule, len(c.BuildKit.Routes))
+		for i, r := range c.BuildKit.Routes {
+			r.Match = routing.Match{
+				Apps:       append([]string(nil), r.Match.Apps...),
+				Jobs:       append([]string(nil), r.Match.Jobs...),
+				Teams:      append([]string(nil), r.Match.Teams...),
+				Pools:      append([]string(nil), r.Match.Pools...),
+				Kinds:      append([]string(nil), r.Match.Kinds...),
+				Registries: append([]string(nil), r.Match.Registries...),
+			}
+			out.BuildKit.Routes[i] = r
+		}
+	}
+	if c.Repository.Providers != nil {
+		out.Repository.Providers = make(repository.RemoteRepositoryProvider, len(c.Repository.Providers))
+		for registry, settings := range c.Repository.Providers {
+			s := make(map[string]string, len(settings))
+			for k, v := range settings {
+				s[k] = v
+			}
+			out.Repository.Providers[registry] = s
+		}
+	}
+	return &out
+}
+
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.Version != Version {
+		errs = append(errs, fmt.Errorf("version: unsupported version %q", c.Version))
+	}
+
+	for name, port := range map[string]int{"server.port": c.Server.Port, "server.metricsPort": c.Server.MetricsPort} {
+		if port <= 0 || port > 65535 {
+			errs = append(errs, fmt.Errorf("%s: invalid TCP port %d", name, port))
+		}
+	}
+
+	if c.Server.MaxRecvMsgSize <= 0 {
+		errs = append(errs, errors.New("server.maxRecvMsgSize: must be greater than zero"))
+	}
+
+	if c.Server.MaxSendMsgSize <= 0 {
+		errs = append(errs, errors.New("server.maxSendMsgSize: must be greater than zero"))
+	}
+
+	if c.Builder.Backend == "" {
+		errs = append(errs, errors.New("builder.backend: cannot be empty"))
+	}
+
+	if c.BuildKit.TmpDir == "" {
+		errs = append(errs, errors.New("buildkit.tmpDir: cannot be empty"))
+	}
+
+	if c.BuildKit.Address != "" && len(c.BuildKit.Addresses) > 0 {
+		errs = append(errs, errors.New("buildkit.addresses: cannot be set along with buildkit.address"))
+	}
+
+	if len(c.BuildKit.Addresses) > 0 && c.BuildKit.HealthCheckInterval <= 0 {
+		errs = append(errs, errors.New("buildkit.healthCheckInterval: must be greater than zero"))
+	}
+
+	if c.BuildKit.Retry.MaxAttempts < 0 {
+		errs = append(errs, errors.New("buildkit.retry.maxAttempts: cannot be negative"))
+	}
+
+	if c.BuildKit.Retry.Backoff < 0 {
+		errs = append(errs, errors.New("buildkit.retry.backoff: cannot be negative"))
+	}
+
+	if c.Repository.Retention.KeepLast < 0 {
+		errs = append(errs, errors.New("repository.retention.keepLast: cannot be negative"))
+	}
+
+	if err := routing.Validate(c.BuildKit.Routes, c.Discovery.IsKubernetes()); err != nil {
+		errs = append(errs, fmt.Errorf("buildkit.routes: %w", err))
+	}
+
+	if c.Discovery.Enabled {
+		if c.Discovery.Timeout <= 0 {
+			errs = append(errs, errors.New("discovery.timeout: must be greater than zero"))
+		}
+
+		if c.Discovery.AffinityWait < 0 {
+			errs = append(errs, errors.New("discovery.affinityWait: cannot be negative"))
+		}
+
+		errs = append(errs, c.Discovery.Lease.validate()...)
+
+		if c.Discovery.Port <= 0 || c.Discovery.Port > 65535 {
+			errs = append(errs, fmt.Errorf("discovery.port: invalid TCP port %d", c.Discovery.Port))
+		}
+
+		if c.Discovery.LeasePrefix == "" {
+			errs = append(errs, errors.New("discovery.leasePrefix: cannot be empty"))
+		}
+	}
+
+	if (c.Discovery.BuildEvents || c.Discovery.BuildRuns) && !c.Discovery.IsKubernetes() {
+		errs = append(errs, errors.New("discovery.buildEvents, discovery.buildRuns: require discovery on Kubernetes to be enabled"))
+	}
+
+	if c.Discovery.BuildRunsHistoryLimit < 0 {
+		errs = append(errs, errors.New("discovery.buildRunsHistoryLimit: cannot be negative"))
+	}
+
+	if c.Scaler.MaxReplicas < 0 {
+		errs = append(errs, errors.New("scaler.maxReplicas: cannot be negative"))
+	}
+
+	if c.Scaler.Statefulset != "" {
+		if !c.Discovery.IsKubernetes() {
+			errs = append(errs, errors.New("scaler.statefulset: requires discovery on Kubernetes to be enabled"))
+		}
+
+		if c.Scaler.GracefulPeriod <= 0 {
+			errs = append(errs, errors.New("scaler.gracefulPeriod: must be greater than zero"))
+		}
+
+		if c.Scaler.Interval <= 0 {
+			errs = append(errs, errors.New("scaler.interval: must be greater than zero"))
+		}
+
+		if c.Scaler.MaxReplicas > 0 && c.Scaler.ScaleOutThreshold <= 0 {
+			errs = append(errs, errors.New("scaler.scaleOutThreshold: must be greater than zero"))
+		}
+	}
+
+	if len(c.Scaler.Schedules) > 0 && c.Scaler.Statefulset == "" {
+		errs = append(errs, errors.New("scaler.schedules: requires scaler.statefulset to be set"))
+	}
+
+	for _, s := range c.Scaler.Schedules {
+		if err := s.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("scaler.schedules: schedule %q: %w", s.Name, err))
+		}
+	}
+
+	if _, err := c.Repositories(); err != nil {
+		errs = append(errs, fmt.Errorf("repository: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c LeaseConfig) validate() []error {
+	var errs []error
+
+	for name, d := range map[string]Duration{"duration": c.Duration, "renewDeadline": c.RenewDeadline, "retryPeriod": c.RetryPeriod} {
+		if d <= 0 {
+			errs = append(errs, fmt.Errorf("discovery.lease.%s: must be greater than zero", name))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	// same constraints of leaderelection.NewLeaderElector
+	if c.Duration <= c.RenewDeadline {
+		errs = append(errs, errors.New("discovery.lease.duration: must be greater than renewDeadline"))
+	}
+
+	if float64(c.RenewDeadline) <= leaderelection.JitterFactor*float64(c.RetryPeriod) {
+		errs = append(errs, fmt.Errorf("discovery.lease.renewDeadline: must be greater than %.1f times retryPeriod", leaderelection.JitterFactor))
+	}
+
+	return errs
+}
+
+// Repositories builds the remote repository providers from the file set in
+// repository.path (if any) along with the inline providers.
+func (c *Config) Repositories() (map[string]repository.Repository, error) {
+	providers := make(repository.RemoteRepositoryProvider)
+
+	if c.Repository.Path != "" {
+		data, err := os.ReadFile(c.Repository.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = json.Unmarshal(data, &providers); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", c.Repository.Path, err)
+		}
+	}
+
+	for registry, settings := range c.Repository.Providers {
+		providers[registry] = settings
+	}
+
+	if len(providers) == 0 {
+		return nil, nil
+	}
+
+	return repository.NewRemoteRepositoryFromProvider(providers)
+}
+
+// RestartRequired returns the settings changed from prev to next which cannot
+// be applied at runtime. Repositories (but their path), pod selectors, BuildKit routes, limits
+// (discovery timeout, affinity wait, lease settings, scaler graceful period,
+// max replicas, scale out threshold, interval and schedules) and policies are
+// reloadable.
+func RestartRequired(prev, next *Config) []string {
+	o, n := prev.withoutReloadable(), next.withoutReloadable()
+
+	var changed []string
+	ov, nv := reflect.ValueOf(*o), reflect.ValueOf(*n)
+	for i := 0; i < ov.NumField(); i++ {
+		if reflect.DeepEqual(ov.Field(i).Interface(), nv.Field(i).Interface()) {
+			continue
+		}
+
+		section := ov.Type().Field(i)
+		sv, snv := ov.Field(i), nv.Field(i)
+		if sv.Kind() != reflect.Struct {
+			changed = append(changed, jsonName(section))
+			continue
+		}
+
+		for j := 0; j < sv.NumField(); j++ {
+			if !reflect.DeepEqual(sv.Field(j).Interface(), snv.Field(j).Interface()) {
+				changed = append(changed, jsonName(section)+"."+jsonName(sv.Type().Field(j)))
+			}
+		}
+	}
+
+	return changed
+}
+
+func (s ScheduleConfig) validate() error {
+	var errs []error
+	if s.Name == "" {
+		errs = append(errs, errors.New("name cannot be empty"))
+	}
+
+	if _, err := scaler.ParseWindowSchedule(s.Cron); err != nil {
+		errs = append(errs, fmt.Errorf("invalid cron: %w", err))
+	}
+
+	if s.Duration <= 0 {
+		errs = append(errs, errors.New("duration must be greater than zero"))
+	}
+
+	if s.MinReplicas < 0 {
+		errs = append(errs, errors.New("minReplicas cannot be negative"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// WithReloadable returns a copy of c with the reloadable settings taken from
+// next, i.e. the configuration in effect after reloading next.
+func (c *Config) WithReloadable(next *Config) *Config {
+	out, n := c.DeepCopy(), next.DeepCopy()
+	out.Repository = n.Repository
+	out.Repository.Path = c.Repository.Path
+	out.Policies = n.Policies
+	out.BuildKit.Routes = n.BuildKit.Routes
+	out.BuildKit.Retry = n.BuildKit.Retry
+	out.Discovery.PodSelector = n.Discovery.PodSelector
+	out.Discovery.Timeout = n.Discovery.Timeout
+	out.Discovery.AffinityWait = n.Discovery.AffinityWait
+	out.Discovery.LoadAware = n.Discovery.LoadAware
+	out.Discovery.Lease = n.Discovery.Lease
+	out.Scaler.GracefulPeriod = n.Scaler.GracefulPeriod
+	out.Scaler.MaxReplicas = n.Scaler.MaxReplicas
+	out.Scaler.ScaleOutThreshold = n.Scaler.ScaleOutThreshold
+	out.Scaler.Interval = n.Scaler.Interval
+	out.Scaler.Schedules = n.Scaler.Schedules
+	return out
+}
+
+// withoutReloadable returns a copy of c without the settings WithReloadable
+// takes from the next configuration. The repository path is watched for
+// changes, so it's not reloadable itself.
+func (c *Config) withoutReloadable() *Config {
+	out := c.DeepCopy()
+	out.Repository = RepositoryConfig{Path: c.Repository.Path}
+	out.Policies = PoliciesConfig{}
+	out.BuildKit.Routes = nil
+	out.BuildKit.Retry = RetryConfig{}
+	out.Discovery.PodSelector = ""
+	out.Discovery.Timeout = 0
+	out.Discovery.AffinityWait = 0
+	out.Discovery.LoadAware = false
+	out.Discovery.Lease = LeaseConfig{}
+	out.Scaler.GracefulPeriod = 0
+	out.Scaler.MaxReplicas = 0
+	out.Scaler.ScaleOutThreshold = 0
+	out.Scaler.Interval = 0
+	out.Scaler.Schedules = nil
+	return out
+}
+
+func jsonName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
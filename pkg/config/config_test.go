@@ -0,0 +1,335 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tsuru/deploy-agent/pkg/build/buildkit/routing"
+	"github.com/tsuru/deploy-agent/pkg/repository/fake"
+)
+
+func baseConfig() Config {
+	return Config{
+		Version: Version,
+		Server: ServerConfig{
+			Port:           8080,
+			MetricsPort:    9090,
+			MaxRecvMsgSize: 1024,
+			MaxSendMsgSize: 1024,
+		},
+		Builder:  BuilderConfig{Backend: "buildkit"},
+		BuildKit: BuildKitConfig{TmpDir: "/tmp"},
+		Discovery: DiscoveryConfig{
+			LeasePrefix: "deploy-agent",
+			Port:        80,
+			Timeout:     Duration(5 * time.Minute),
+			Lease: LeaseConfig{
+				Duration:      Duration(5 * time.Second),
+				RenewDeadline: Duration(2 * time.Second),
+				RetryPeriod:   Duration(500 * time.Millisecond),
+			},
+		},
+		Scaler: ScalerConfig{GracefulPeriod: Duration(2 * time.Hour), Interval: Duration(5 * time.Minute)},
+	}
+}
+
+func TestParse(t *testing.T) {
+	c, err := Parse([]byte(`
+version: v1
+server:
+  port: 8000
+buildkit:
+  retry:
+    maxAttempts: 3
+    backoff: 10s
+  routes:
+  - name: premium
+    match:
+      teams: [premium]
+    target:
+      podSelector: app=buildkit-premium
+      namespace: buildkit-premium
+discovery:
+  enabled: true
+  podSelector: app=buildkit
+  namespace: tsuru-system
+  timeout: 1m
+scaler:
+  statefulset: buildkit
+  schedules:
+  - name: business-hours
+    cron: CRON_TZ=America/Sao_Paulo 0 8 * * 1-5
+    duration: 10h
+    minReplicas: 2
+repository:
+  providers:
+    registry.example.com:
+      provider: fake
+  retention:
+    keepLast: 10
+policies:
+  disableCache: true
+`), baseConfig())
+	require.NoError(t, err)
+
+	assert.Equal(t, 8000, c.Server.Port)
+	assert.Equal(t, 9090, c.Server.MetricsPort, "settings missing in the file must keep the base values")
+	assert.True(t, c.Discovery.Enabled)
+	assert.Equal(t, "app=buildkit", c.Discovery.PodSelector)
+	assert.Equal(t, time.Minute, c.Discovery.Timeout.Duration())
+	assert.Equal(t, 2*time.Hour, c.Scaler.GracefulPeriod.Duration())
+	assert.Equal(t, []ScheduleConfig{{Name: "business-hours", Cron: "CRON_TZ=America/Sao_Paulo 0 8 * * 1-5", Duration: Duration(10 * time.Hour), MinReplicas: 2}}, c.Scaler.Schedules)
+	assert.True(t, c.Policies.DisableCache)
+	assert.Equal(t, RetryConfig{MaxAttempts: 3, Backoff: Duration(10 * time.Second)}, c.BuildKit.Retry)
+	assert.Equal(t, 10, c.Repository.Retention.KeepLast)
+	require.Len(t, c.BuildKit.Routes, 1)
+	assert.Equal(t, []string{"premium"}, c.BuildKit.Routes[0].Match.Teams)
+	assert.Equal(t, "app=buildkit-premium", c.BuildKit.Routes[0].Target.PodSelector)
+	require.NoError(t, c.Validate())
+
+	repositories, err := c.Repositories()
+	require.NoError(t, err)
+	assert.Equal(t, &fake.FakeRepository{}, repositories["registry.example.com"])
+}
+
+func TestParse_Errors(t *testing.T) {
+	tests := map[string]struct {
+		data          string
+		expectedError string
+	}{
+		"missing version": {
+			data:          "server:\n  port: 8000\n",
+			expectedError: "config file must set its version",
+		},
+		"unsupported version": {
+			data:          "version: v2\n",
+			expectedError: `unsupported config file version "v2" (supported: v1)`,
+		},
+		"unknown field": {
+			data:          "version: v1\nserver:\n  prot: 8000\n",
+			expectedError: `unknown field "prot"`,
+		},
+		"invalid duration": {
+			data:          "version: v1\ndiscovery:\n  timeout: 10\n",
+			expectedError: "duration must be a string",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.data), baseConfig())
+			assert.ErrorContains(t, err, tt.expectedError)
+		})
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	c := baseConfig()
+	c.Server.Port = 0
+	c.Discovery.Enabled = true
+	c.Discovery.Timeout = 0
+	c.Discovery.Lease.Duration = Duration(time.Second)
+	c.Scaler.Statefulset = "buildkit"
+	c.Scaler.GracefulPeriod = 0
+	c.Scaler.MaxReplicas = 3
+	c.Scaler.Interval = 0
+	c.Repository.Providers = map[string]map[string]string{"registry.example.com": {"provider": "unknown"}}
+	c.BuildKit.Address = "tcp://buildkit:80"
+	c.BuildKit.Addresses = []string{"tcp://buildkit-0:80", "tcp://buildkit-1:80"}
+	c.BuildKit.Routes = []routing.Rule{{Name: "premium", Match: routing.Match{Teams: []string{"premium"}}}}
+	c.BuildKit.Retry = RetryConfig{MaxAttempts: -1, Backoff: Duration(-time.Second)}
+	c.Repository.Retention.KeepLast = -1
+
+	err := c.Validate()
+	require.Error(t, err)
+	assert.ErrorContains(t, err, "server.port: invalid TCP port 0")
+	assert.ErrorContains(t, err, "discovery.timeout: must be greater than zero")
+	assert.ErrorContains(t, err, "discovery.lease.duration: must be greater than renewDeadline")
+	assert.ErrorContains(t, err, "scaler.gracefulPeriod: must be greater than zero")
+	assert.ErrorContains(t, err, "scaler.scaleOutThreshold: must be greater than zero")
+	assert.ErrorContains(t, err, "scaler.interval: must be greater than zero")
+	assert.ErrorContains(t, err, "repository: unknow repositoy provider: unknown")
+	assert.ErrorContains(t, err, "buildkit.addresses: cannot be set along with buildkit.address")
+	assert.ErrorContains(t, err, "buildkit.healthCheckInterval: must be greater than zero")
+	assert.ErrorContains(t, err, `buildkit.routes: rule "premium": target must set either address or podSelector`)
+	assert.ErrorContains(t, err, "buildkit.retry.maxAttempts: cannot be negative")
+	assert.ErrorContains(t, err, "buildkit.retry.backoff: cannot be negative")
+	assert.ErrorContains(t, err, "repository.retention.keepLast: cannot be negative")
+}
+
+func TestConfig_ValidateDNSDiscovery(t *testing.T) {
+	c := baseConfig()
+	c.Discovery.Enabled = true
+	c.Discovery.DNSName = "_buildkit._tcp.buildkit.tsuru-system.svc.cluster.local"
+	require.NoError(t, c.Validate())
+	assert.False(t, c.Discovery.IsKubernetes())
+
+	c.Scaler.Statefulset = "buildkit"
+	c.BuildKit.Routes = []routing.Rule{{Name: "premium", Match: routing.Match{Teams: []string{"premium"}}, Target: routing.Target{PodSelector: "app=buildkit-premium", Namespace: "premium"}}}
+
+	err := c.Validate()
+	require.Error(t, err)
+	assert.ErrorContains(t, err, "scaler.statefulset: requires discovery on Kubernetes to be enabled")
+	assert.ErrorContains(t, err, `buildkit.routes: rule "premium": target podSelector requires discovery on Kubernetes to be enabled`)
+}
+
+func TestConfig_ValidateBuildRuns(t *testing.T) {
+	c := baseConfig()
+	c.Discovery.Enabled = true
+	c.Discovery.BuildEvents = true
+	c.Discovery.BuildRuns = true
+	require.NoError(t, c.Validate())
+
+	c.Discovery.BuildRunsHistoryLimit = -1
+	assert.EqualError(t, c.Validate(), "discovery.buildRunsHistoryLimit: cannot be negative")
+
+	c.Discovery.BuildRunsHistoryLimit = 10
+	c.Discovery.DNSName = "buildkit.tsuru-system.svc.cluster.local"
+	assert.EqualError(t, c.Validate(), "discovery.buildEvents, discovery.buildRuns: require discovery on Kubernetes to be enabled")
+}
+
+func TestConfig_ValidateSchedules(t *testing.T) {
+	c := baseConfig()
+	c.Scaler.Schedules = []ScheduleConfig{
+		{Name: "business-hours", Cron: "0 8 * * 1-5", Duration: Duration(10 * time.Hour), MinReplicas: 2},
+		{Name: "broken", Cron: "0 25 * * *", MinReplicas: -1},
+	}
+
+	err := c.Validate()
+	require.Error(t, err)
+	assert.ErrorContains(t, err, "scaler.schedules: requires scaler.statefulset to be set")
+	assert.ErrorContains(t, err, `scaler.schedules: schedule "broken": invalid cron`)
+	assert.ErrorContains(t, err, "duration must be greater than zero")
+	assert.ErrorContains(t, err, "minReplicas cannot be negative")
+	assert.NotContains(t, err.Error(), "business-hours")
+}
+
+func TestConfig_RepositoriesFromPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "repositories.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"a.example.com": {"provider": "fake"}, "b.example.com": {"provider": "unknown"}}`), 0o600))
+
+	c := baseConfig()
+	c.Repository.Path = path
+	_, err := c.Repositories()
+	assert.EqualError(t, err, "unknow repositoy provider: unknown")
+
+	c.Repository.Providers = map[string]map[string]string{"b.example.com": {"provider": "fake"}}
+	repositories, err := c.Repositories()
+	require.NoError(t, err)
+	assert.Len(t, repositories, 2)
+}
+
+func TestRestartRequired(t *testing.T) {
+	prev := baseConfig()
+
+	next := prev.DeepCopy()
+	next.Discovery.PodSelector = "app=another-buildkit"
+	next.Discovery.Timeout = Duration(time.Minute)
+	next.Discovery.Lease.Duration = Duration(time.Minute)
+	next.Discovery.Lease.AbortOnLoss = true
+	next.Scaler.GracefulPeriod = Duration(time.Hour)
+	next.Scaler.Schedules = []ScheduleConfig{{Name: "freeze", Cron: "0 0 20 12 *", Duration: Duration(24 * time.Hour), MinReplicas: 3}}
+	next.Policies.DisableCache = true
+	next.BuildKit.Retry = RetryConfig{MaxAttempts: 3, Backoff: Duration(time.Second)}
+	next.Repository.Retention.KeepLast = 10
+	next.BuildKit.Routes = []routing.Rule{{Name: "premium", Match: routing.Match{Teams: []string{"premium"}}, Target: routing.Target{Address: "tcp://buildkit-premium:80"}}}
+	assert.Empty(t, RestartRequired(&prev, next))
+
+	next.Server.Port = 8000
+	next.Discovery.Namespace = "tsuru"
+	next.Repository.Path = "/etc/deploy-agent/repositories.json"
+	assert.Equal(t, []string{"server.port", "discovery.namespace", "repository.path"}, RestartRequired(&prev, next))
+}
+
+func TestWithReloadable(t *testing.T) {
+	prev := baseConfig()
+
+	next := prev.DeepCopy()
+	next.Server.Port = 8000
+	next.Repository.Path = "/etc/deploy-agent/repositories.json"
+	next.Repository.Retention.KeepLast = 10
+	next.Scaler.MaxReplicas = 7
+	next.Policies.DisableCache = true
+
+	running := prev.WithReloadable(next)
+	assert.Equal(t, prev.Server.Port, running.Server.Port)
+	assert.Equal(t, prev.Repository.Path, running.Repository.Path)
+	assert.Equal(t, 10, running.Repository.Retention.KeepLast)
+	assert.Equal(t, int32(7), running.Scaler.MaxReplicas)
+	assert.True(t, running.Policies.DisableCache)
+
+	// the settings not applied keep being reported, and reverting them isn't
+	assert.Equal(t, []string{"server.port", "repository.path"}, RestartRequired(running, next))
+	assert.Empty(t, RestartRequired(running, &prev))
+	assert.Equal(t, running, prev.WithReloadable(running), "reloading the same settings is a no-op")
+}
+
+func TestWithReloadable_Validate(t *testing.T) {
+	prev := baseConfig()
+	require.NoError(t, prev.Validate())
+
+	// discovery can't be turned on by a reload, so the routes relying on it
+	// are only valid in the file
+	next := prev.DeepCopy()
+	next.Discovery.Enabled = true
+	next.BuildKit.Routes = []routing.Rule{{Name: "premium", Match: routing.Match{Teams: []string{"premium"}}, Target: routing.Target{PodSelector: "app=buildkit-premium", Namespace: "tsuru"}}}
+	require.NoError(t, next.Validate())
+	assert.ErrorContains(t, prev.WithReloadable(next).Validate(), `buildkit.routes: rule "premium": target podSelector requires discovery on Kubernetes to be enabled`)
+
+	// nor turned off, so they keep being valid in use
+	running := next.DeepCopy()
+	file := running.DeepCopy()
+	file.Discovery.Enabled = false
+	require.Error(t, file.Validate())
+	assert.NoError(t, running.WithReloadable(file).Validate())
+}
+
+func TestWatcher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("version: v1\n"), 0o600))
+
+	changes := make(chan struct{}, 10)
+	w := &Watcher{
+		Paths:    []string{path},
+		Interval: 10 * time.Millisecond,
+		OnChange: func() { changes <- struct{}{} },
+		signals:  make(chan os.Signal, 1),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	select {
+	case <-changes:
+		t.Fatal("unexpected reload without any change")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NoError(t, os.WriteFile(path, []byte("version: v1\nserver:\n  port: 8000\n"), 0o600))
+
+	select {
+	case <-changes:
+	case <-time.After(time.Second):
+		t.Fatal("expected reload after file change")
+	}
+
+	w.signals <- syscall.SIGHUP
+
+	select {
+	case <-changes:
+	case <-time.After(time.Second):
+		t.Fatal("expected reload after SIGHUP")
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package config
+
+import (
+	"context"
+	"maps"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const DefaultWatchInterval = 10 * time.Second
+
+// Watcher calls OnChange whenever the process receives a SIGHUP or any of the
+// watched files changes. Files are polled rather than watched through inotify
+// since ConfigMap volumes swap the whole directory through symlinks.
+type Watcher struct {
+	OnChange func()
+	Paths    []string
+	Interval time.Duration
+
+	signals chan os.Signal
+}
+
+func (w *Watcher) Run(ctx context.Context) {
+	interval := w.Interval
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+
+	if w.signals == nil {
+		w.signals = make(chan os.Signal, 1)
+		signal.Notify(w.signals, syscall.SIGHUP)
+		defer signal.Stop(w.signals)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := w.snapshot()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-w.signals:
+			klog.Infoln("Received SIGHUP, reloading configuration...")
+			last = w.snapshot()
+			w.OnChange()
+
+		case <-ticker.C:
+			current := w.snapshot()
+			if maps.Equal(current, last) {
+				continue
+			}
+
+			klog.Infoln("Configuration files changed, reloading configuration...")
+			last = current
+			w.OnChange()
+		}
+	}
+}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+func (w *Watcher) snapshot() map[string]fileState {
+	s := make(map[string]fileState, len(w.Paths))
+	for _, p := range w.Paths {
+		if p == "" {
+			continue
+		}
+
+		fi, err := os.Stat(p) // follows symlinks, so ConfigMap updates are noticed
+		if err != nil {
+			continue
+		}
+
+		s[p] = fileState{modTime: fi.ModTime(), size: fi.Size()}
+	}
+	return s
+}
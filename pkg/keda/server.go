@@ -0,0 +1,152 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package keda serves the KEDA External Scaler API, so KEDA can scale the
+// BuildKit statefulsets by the builds waiting for and running on them.
+//
+// A ScaledObject points to it with the `external` (or `external-push`)
+// trigger, whose metadata may set:
+//
+//   - namespace: BuildKit namespace, defaults to the ScaledObject's one;
+//   - targetBuilds: builds per BuildKit replica, defaults to 1.
+//
+// The builds are read from the agent's own queue, which isn't shared among
+// agent replicas, so it requires a single agent replica.
+package keda
+
+import (
+	"context"
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/tsuru/deploy-agent/pkg/build/buildkit/metrics"
+	pb "github.com/tsuru/deploy-agent/pkg/keda/externalscaler"
+)
+
+// MetricName is the name of the metric reported to KEDA: the number of builds
+// waiting for or running on BuildKit.
+const MetricName = "deploy-agent-builds"
+
+var _ pb.ExternalScalerServer = (*Server)(nil)
+
+func NewServer(builds *metrics.BuildQueue) *Server {
+	return &Server{builds: builds}
+}
+
+type Server struct {
+	pb.UnimplementedExternalScalerServer
+
+	builds *metrics.BuildQueue
+}
+
+func (s *Server) IsActive(ctx context.Context, ref *pb.ScaledObjectRef) (*pb.IsActiveResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ns, err := buildKitNamespace(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.IsActiveResponse{Result: s.queued(ns) > 0}, nil
+}
+
+func (s *Server) StreamIsActive(ref *pb.ScaledObjectRef, stream pb.ExternalScaler_StreamIsActiveServer) error {
+	ns, err := buildKitNamespace(ref)
+	if err != nil {
+		return err
+	}
+
+	var active, sent bool
+	for {
+		// taken before reading the builds so no change is missed
+		changed := s.builds.Changed()
+
+		if current := s.queued(ns) > 0; !sent || current != active {
+			if err := stream.Send(&pb.IsActiveResponse{Result: current}); err != nil {
+				return err
+			}
+
+			active, sent = current, true
+		}
+
+		select {
+		case <-changed:
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func (s *Server) GetMetricSpec(ctx context.Context, ref *pb.ScaledObjectRef) (*pb.GetMetricSpecResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	target, err := targetBuilds(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.GetMetricSpecResponse{
+		MetricSpecs: []*pb.MetricSpec{{MetricName: MetricName, TargetSize: target}},
+	}, nil
+}
+
+func (s *Server) GetMetrics(ctx context.Context, r *pb.GetMetricsRequest) (*pb.GetMetricsResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ns, err := buildKitNamespace(r.ScaledObjectRef)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.GetMetricsResponse{
+		MetricValues: []*pb.MetricValue{{MetricName: MetricName, MetricValue: s.queued(ns)}},
+	}, nil
+}
+
+func (s *Server) queued(ns string) int64 {
+	waiting, active := s.builds.Get(ns)
+	return waiting + active
+}
+
+func buildKitNamespace(ref *pb.ScaledObjectRef) (string, error) {
+	if ref == nil {
+		return "", status.Error(codes.InvalidArgument, "scaled object ref not provided")
+	}
+
+	if ns := ref.ScalerMetadata["namespace"]; ns != "" {
+		return ns, nil
+	}
+
+	if ref.Namespace == "" {
+		return "", status.Error(codes.InvalidArgument, "namespace not provided")
+	}
+
+	return ref.Namespace, nil
+}
+
+func targetBuilds(ref *pb.ScaledObjectRef) (int64, error) {
+	if ref == nil {
+		return 0, status.Error(codes.InvalidArgument, "scaled object ref not provided")
+	}
+
+	v, found := ref.ScalerMetadata["targetBuilds"]
+	if !found {
+		return 1, nil
+	}
+
+	target, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || target <= 0 {
+		return 0, status.Errorf(codes.InvalidArgument, "targetBuilds must be a positive integer, got %q", v)
+	}
+
+	return target, nil
+}
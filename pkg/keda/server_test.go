@@ -0,0 +1,129 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package keda_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"github.com/tsuru/deploy-agent/pkg/build/buildkit/metrics"
+	. "github.com/tsuru/deploy-agent/pkg/keda"
+	pb "github.com/tsuru/deploy-agent/pkg/keda/externalscaler"
+)
+
+func setupClient(t *testing.T, builds *metrics.BuildQueue) pb.ExternalScalerClient {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := grpc.NewServer()
+	t.Cleanup(func() { s.Stop() })
+
+	pb.RegisterExternalScalerServer(s, NewServer(builds))
+
+	go func() {
+		nerr := s.Serve(l)
+		require.NoError(t, nerr)
+	}()
+
+	conn, err := grpc.NewClient(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return pb.NewExternalScalerClient(conn)
+}
+
+func TestServer_IsActiveAndGetMetrics(t *testing.T) {
+	builds := metrics.NewBuildQueue()
+	c := setupClient(t, builds)
+
+	ref := &pb.ScaledObjectRef{Name: "buildkit", Namespace: "tsuru-system"}
+
+	resp, err := c.IsActive(context.TODO(), ref)
+	require.NoError(t, err)
+	assert.False(t, resp.Result)
+
+	builds.AddWaiting("tsuru-system", 2)
+	builds.AddActive("tsuru-system", 1)
+	builds.AddActive("other", 5)
+
+	resp, err = c.IsActive(context.TODO(), ref)
+	require.NoError(t, err)
+	assert.True(t, resp.Result)
+
+	metricsResp, err := c.GetMetrics(context.TODO(), &pb.GetMetricsRequest{ScaledObjectRef: ref, MetricName: MetricName})
+	require.NoError(t, err)
+	require.Len(t, metricsResp.MetricValues, 1)
+	assert.Equal(t, MetricName, metricsResp.MetricValues[0].MetricName)
+	assert.Equal(t, int64(3), metricsResp.MetricValues[0].MetricValue)
+
+	// BuildKit namespace set in the trigger metadata
+	metricsResp, err = c.GetMetrics(context.TODO(), &pb.GetMetricsRequest{
+		ScaledObjectRef: &pb.ScaledObjectRef{Name: "buildkit", Namespace: "tsuru-system", ScalerMetadata: map[string]string{"namespace": "other"}},
+		MetricName:      MetricName,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), metricsResp.MetricValues[0].MetricValue)
+
+	_, err = c.IsActive(context.TODO(), &pb.ScaledObjectRef{Name: "buildkit"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestServer_GetMetricSpec(t *testing.T) {
+	c := setupClient(t, metrics.NewBuildQueue())
+
+	resp, err := c.GetMetricSpec(context.TODO(), &pb.ScaledObjectRef{Name: "buildkit", Namespace: "tsuru-system"})
+	require.NoError(t, err)
+	require.Len(t, resp.MetricSpecs, 1)
+	assert.Equal(t, MetricName, resp.MetricSpecs[0].MetricName)
+	assert.Equal(t, int64(1), resp.MetricSpecs[0].TargetSize)
+
+	resp, err = c.GetMetricSpec(context.TODO(), &pb.ScaledObjectRef{Name: "buildkit", Namespace: "tsuru-system", ScalerMetadata: map[string]string{"targetBuilds": "2"}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), resp.MetricSpecs[0].TargetSize)
+
+	_, err = c.GetMetricSpec(context.TODO(), &pb.ScaledObjectRef{Name: "buildkit", Namespace: "tsuru-system", ScalerMetadata: map[string]string{"targetBuilds": "0"}})
+	assert.EqualError(t, err, status.Error(codes.InvalidArgument, `targetBuilds must be a positive integer, got "0"`).Error())
+}
+
+func TestServer_StreamIsActive(t *testing.T) {
+	builds := metrics.NewBuildQueue()
+	c := setupClient(t, builds)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := c.StreamIsActive(ctx, &pb.ScaledObjectRef{Name: "buildkit", Namespace: "tsuru-system"})
+	require.NoError(t, err)
+
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	assert.False(t, resp.Result, "current state must be sent first")
+
+	builds.AddActive("other", 1) // no change on tsuru-system
+	builds.AddWaiting("tsuru-system", 1)
+
+	resp, err = stream.Recv()
+	require.NoError(t, err)
+	assert.True(t, resp.Result)
+
+	builds.AddActive("tsuru-system", 1)
+	builds.AddWaiting("tsuru-system", -1) // still active, not sent
+	builds.AddActive("tsuru-system", -1)
+
+	resp, err = stream.Recv()
+	require.NoError(t, err)
+	assert.False(t, resp.Result)
+}
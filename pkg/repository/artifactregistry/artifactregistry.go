@@ -0,0 +1,279 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package artifactregistry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+
+	"github.com/tsuru/deploy-agent/pkg/repository/jsonapi"
+)
+
+const (
+	defaultEndpoint = "https://artifactregistry.googleapis.com"
+	registrySuffix  = "-docker.pkg.dev"
+	cloudPlatform   = "https://www.googleapis.com/auth/cloud-platform"
+)
+
+var (
+	operationPollInterval = time.Second
+	// operationTimeout bounds the wait for a repository to be created.
+	operationTimeout = time.Minute
+)
+
+// ArtifactRegistry creates the missing Docker repositories on Google
+// Artifact Registry, whose images are named as
+// LOCATION-docker.pkg.dev/PROJECT/REPOSITORY/IMAGE. The settings below only
+// apply to the repositories it creates.
+type ArtifactRegistry struct {
+	m sync.Mutex
+	// client sends the authenticated requests to endpoint.
+	client   *http.Client
+	endpoint string
+
+	// Credentials is the service account JSON key, or CredentialsFile its
+	// path, falling back to the Application Default Credentials (e.g. GKE
+	// Workload Identity) when both are empty.
+	Credentials     string
+	CredentialsFile string
+	// CleanupPolicies is the JSON object of the cleanup policies set on new
+	// repositories (keyed by policy ID), if any.
+	CleanupPolicies     string
+	CleanupPolicyDryRun bool
+}
+
+func NewArtifactRegistry(data map[string]string) (*ArtifactRegistry, error) {
+	r := &ArtifactRegistry{
+		endpoint:        defaultEndpoint,
+		Credentials:     data["credentials"],
+		CredentialsFile: data["credentialsFile"],
+		CleanupPolicies: data["cleanupPolicies"],
+	}
+
+	if v := data["cleanupPolicyDryRun"]; v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid artifactregistry cleanupPolicyDryRun: %w", err)
+		}
+		r.CleanupPolicyDryRun = b
+	}
+
+	if r.Credentials != "" && !json.Valid([]byte(r.Credentials)) {
+		return nil, errors.New("invalid artifactregistry credentials: must be a JSON document")
+	}
+
+	if r.CleanupPolicies != "" {
+		var policies map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(r.CleanupPolicies), &policies); err != nil {
+			return nil, errors.New("invalid artifactregistry cleanupPolicies: must be a JSON object")
+		}
+	}
+
+	return r, nil
+}
+
+func (r *ArtifactRegistry) Ensure(ctx context.Context, name string) error {
+	location, project, repository, err := parseImage(name)
+	if err != nil {
+		return err
+	}
+
+	client, err := r.auth(ctx)
+	if err != nil {
+		return err
+	}
+
+	parent := fmt.Sprintf("projects/%s/locations/%s", project, location)
+	exists, err := r.exists(ctx, client, parent+"/repositories/"+repository)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return r.create(ctx, client, parent, repository)
+	}
+	return nil
+}
+
+func (r *ArtifactRegistry) auth(ctx context.Context) (*http.Client, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.client != nil {
+		return r.client, nil
+	}
+
+	var (
+		creds *google.Credentials
+		err   error
+	)
+	// the client outlives the build which created it, so its requests (and
+	// the token ones) are bounded by the base client timeout instead
+	ctx = context.WithValue(context.WithoutCancel(ctx), oauth2.HTTPClient, &http.Client{Timeout: 30 * time.Second})
+	switch {
+	case r.Credentials != "":
+		creds, err = google.CredentialsFromJSON(ctx, []byte(r.Credentials), cloudPlatform)
+	case r.CredentialsFile != "":
+		var data []byte
+		data, err = os.ReadFile(r.CredentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read artifactregistry credentials: %w", err)
+		}
+		creds, err = google.CredentialsFromJSON(ctx, data, cloudPlatform)
+	default:
+		creds, err = google.FindDefaultCredentials(ctx, cloudPlatform)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load artifactregistry credentials: %w", err)
+	}
+
+	r.client = oauth2.NewClient(ctx, creds.TokenSource)
+	return r.client, nil
+}
+
+func (r *ArtifactRegistry) exists(ctx context.Context, client *http.Client, repository string) (bool, error) {
+	resp, err := r.do(ctx, client, http.MethodGet, "/v1/"+repository, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("failed to get repository %s: %w", repository, responseError(resp))
+}
+
+func (r *ArtifactRegistry) create(ctx context.Context, client *http.Client, parent, repository string) error {
+	body := map[string]any{"format": "DOCKER"}
+	if r.CleanupPolicies != "" {
+		body["cleanupPolicies"] = json.RawMessage(r.CleanupPolicies)
+		body["cleanupPolicyDryRun"] = r.CleanupPolicyDryRun
+	}
+
+	resp, err := r.do(ctx, client, http.MethodPost, "/v1/"+parent+"/repositories?repositoryId="+url.QueryEscape(repository), body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusConflict:
+		// it was created after the lookup, by another agent replica or
+		// outside the agent
+		return nil
+	default:
+		return fmt.Errorf("failed to create repository %s: %w", repository, responseError(resp))
+	}
+
+	var op operation
+	if err := json.NewDecoder(resp.Body).Decode(&op); err != nil {
+		return err
+	}
+
+	if err := r.wait(ctx, client, op); err != nil {
+		return fmt.Errorf("failed to create repository %s: %w", repository, err)
+	}
+	return nil
+}
+
+// operation is the long-running operation creating a repository.
+type operation struct {
+	Name  string `json:"name"`
+	Done  bool   `json:"done"`
+	Error *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// wait polls op until it's done, so the repository exists by the push, for
+// up to operationTimeout.
+func (r *ArtifactRegistry) wait(ctx context.Context, client *http.Client, op operation) error {
+	ctx, cancel := context.WithTimeout(ctx, operationTimeout)
+	defer cancel()
+
+	for !op.Done {
+		select {
+		case <-time.After(operationPollInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("operation %s not done: %w", op.Name, ctx.Err())
+		}
+
+		resp, err := r.do(ctx, client, http.MethodGet, "/v1/"+op.Name, nil)
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			err = responseError(resp)
+		} else {
+			err = json.NewDecoder(resp.Body).Decode(&op)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if op.Error != nil {
+		return errors.New(op.Error.Message)
+	}
+	return nil
+}
+
+func (r *ArtifactRegistry) do(ctx context.Context, client *http.Client, method, path string, body any) (*http.Response, error) {
+	req, err := jsonapi.NewRequest(ctx, method, r.endpoint+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.Do(req)
+}
+
+// errorBody is the body of failed Google API responses.
+type errorBody struct {
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (b *errorBody) Message() string { return b.Error.Message }
+
+// responseError returns the error of a failed Artifact Registry API
+// response, made of the message in its body (if any).
+func responseError(resp *http.Response) error {
+	return jsonapi.ResponseError(resp, &errorBody{})
+}
+
+// parseImage returns the location, project and repository of the image,
+// named as LOCATION-docker.pkg.dev/PROJECT/REPOSITORY/IMAGE.
+func parseImage(image string) (string, string, string, error) {
+	parts := strings.Split(image, "/")
+	if len(parts) < 4 || !strings.HasSuffix(parts[0], registrySuffix) || parts[1] == "" || parts[2] == "" {
+		return "", "", "", fmt.Errorf("invalid image format %s", image)
+	}
+
+	location := strings.TrimSuffix(parts[0], registrySuffix)
+	if location == "" {
+		return "", "", "", fmt.Errorf("invalid image format %s", image)
+	}
+	return location, parts[1], parts[2], nil
+}
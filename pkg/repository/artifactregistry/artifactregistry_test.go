@@ -0,0 +1,228 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package artifactregistry
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeArtifactRegistry is a stand-in of the Artifact Registry v1 API
+// endpoints used by ArtifactRegistry, along with the OAuth2 token endpoint.
+type fakeArtifactRegistry struct {
+	m            sync.Mutex
+	repositories map[string]map[string]any
+	operations   map[string]int
+	failCreate   string
+	hangCreate   bool
+	tokens       []string
+	endpoint     string
+}
+
+func (f *fakeArtifactRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	if r.URL.Path == "/token" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"t0k3n","token_type":"Bearer","expires_in":3600}`))
+		return
+	}
+	f.tokens = append(f.tokens, r.Header.Get("Authorization"))
+
+	path, found := strings.CutPrefix(r.URL.Path, "/v1/")
+	switch {
+	case !found:
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":{"code":500,"message":"internal error"}}`))
+
+	case r.Method == http.MethodGet && strings.Contains(path, "/operations/"):
+		if !f.hangCreate {
+			f.operations[path]--
+		}
+		done := f.operations[path] <= 0
+		if done && f.failCreate != "" {
+			json.NewEncoder(w).Encode(map[string]any{"name": path, "done": true, "error": map[string]any{"code": 7, "message": f.failCreate}})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"name": path, "done": done})
+
+	case r.Method == http.MethodGet:
+		repo, ok := f.repositories[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"code":404,"message":"Requested entity was not found.","status":"NOT_FOUND"}}`))
+			return
+		}
+		json.NewEncoder(w).Encode(repo)
+
+	case r.Method == http.MethodPost && strings.HasSuffix(path, "/repositories"):
+		name := path + "/" + r.URL.Query().Get("repositoryId")
+		if _, ok := f.repositories[name]; ok {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"error":{"code":409,"message":"the repository already exists","status":"ALREADY_EXISTS"}}`))
+			return
+		}
+		var repo map[string]any
+		json.NewDecoder(r.Body).Decode(&repo)
+		if f.repositories == nil {
+			f.repositories = make(map[string]map[string]any)
+			f.operations = make(map[string]int)
+		}
+		f.repositories[name] = repo
+		op := strings.TrimSuffix(path, "/repositories") + "/operations/create-" + r.URL.Query().Get("repositoryId")
+		f.operations[op] = 2
+		json.NewEncoder(w).Encode(map[string]any{"name": op})
+	}
+}
+
+func newTestArtifactRegistry(t *testing.T, data map[string]string) (*ArtifactRegistry, *fakeArtifactRegistry) {
+	f := &fakeArtifactRegistry{}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	f.endpoint = srv.URL
+
+	operationPollInterval = time.Millisecond
+	t.Cleanup(func() { operationPollInterval = time.Second })
+	previousTimeout := operationTimeout
+	t.Cleanup(func() { operationTimeout = previousTimeout })
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	credentials, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "my-project",
+		"private_key_id": "1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		"client_email":   "tsuru@my-project.iam.gserviceaccount.com",
+		"token_uri":      srv.URL + "/token",
+	})
+	require.NoError(t, err)
+	credentialsFile := filepath.Join(t.TempDir(), "credentials.json")
+	require.NoError(t, os.WriteFile(credentialsFile, credentials, 0600))
+
+	if data == nil {
+		data = map[string]string{}
+	}
+	data["credentialsFile"] = credentialsFile
+
+	r, err := NewArtifactRegistry(data)
+	require.NoError(t, err)
+	r.endpoint = srv.URL
+	return r, f
+}
+
+func TestArtifactRegistry_Ensure(t *testing.T) {
+	policies := `{"keep-latest":{"action":"KEEP","mostRecentVersions":{"keepCount":20}},"delete-old":{"action":"DELETE","condition":{"olderThan":"2592000s"}}}`
+	r, f := newTestArtifactRegistry(t, map[string]string{"cleanupPolicies": policies, "cleanupPolicyDryRun": "true"})
+
+	ctx := context.TODO()
+	err := r.Ensure(ctx, "us-central1-docker.pkg.dev/my-project/tsuru/app-my-app:v1")
+	require.NoError(t, err)
+
+	name := "projects/my-project/locations/us-central1/repositories/tsuru"
+	require.Contains(t, f.repositories, name)
+	var expectedPolicies map[string]any
+	require.NoError(t, json.Unmarshal([]byte(policies), &expectedPolicies))
+	assert.Equal(t, map[string]any{"format": "DOCKER", "cleanupPolicies": expectedPolicies, "cleanupPolicyDryRun": true}, f.repositories[name])
+	assert.Equal(t, 0, f.operations["projects/my-project/locations/us-central1/operations/create-tsuru"])
+
+	// requests are authenticated by the service account
+	require.NotEmpty(t, f.tokens)
+	for _, token := range f.tokens {
+		assert.Equal(t, "Bearer t0k3n", token)
+	}
+
+	// existing repositories are left untouched
+	f.repositories[name] = map[string]any{"format": "DOCKER"}
+	err = r.Ensure(ctx, "us-central1-docker.pkg.dev/my-project/tsuru/app-other-app@sha256:abc")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"format": "DOCKER"}, f.repositories[name])
+}
+
+func TestArtifactRegistry_EnsureDefaults(t *testing.T) {
+	r, f := newTestArtifactRegistry(t, nil)
+
+	// inline credentials
+	credentials, err := os.ReadFile(r.CredentialsFile)
+	require.NoError(t, err)
+	r, err = NewArtifactRegistry(map[string]string{"credentials": string(credentials)})
+	require.NoError(t, err)
+	r.endpoint = f.endpoint
+
+	err = r.Ensure(context.TODO(), "europe-west1-docker.pkg.dev/my-project/tsuru/team/app-my-app:v1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"format": "DOCKER"}, f.repositories["projects/my-project/locations/europe-west1/repositories/tsuru"])
+}
+
+func TestArtifactRegistry_EnsureErrors(t *testing.T) {
+	r, f := newTestArtifactRegistry(t, nil)
+	f.failCreate = "permission denied on cleanup policies"
+
+	err := r.Ensure(context.TODO(), "us-central1-docker.pkg.dev/my-project/tsuru/app-my-app:v1")
+	assert.EqualError(t, err, "failed to create repository tsuru: permission denied on cleanup policies")
+
+	f.failCreate = ""
+	f.hangCreate = true
+	operationTimeout = 20 * time.Millisecond
+	err = r.Ensure(context.TODO(), "us-central1-docker.pkg.dev/my-project/hung/app-my-app:v1")
+	assert.ErrorContains(t, err, "failed to create repository hung: ")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	r.endpoint += "/broken"
+	err = r.Ensure(context.TODO(), "us-central1-docker.pkg.dev/my-project/other/app-my-app:v1")
+	assert.EqualError(t, err, "failed to get repository projects/my-project/locations/us-central1/repositories/other: 500 Internal Server Error: internal error")
+
+	err = r.Ensure(context.TODO(), "gcr.io/my-project/app-my-app:v1")
+	assert.EqualError(t, err, "invalid image format gcr.io/my-project/app-my-app:v1")
+
+	r, err = NewArtifactRegistry(map[string]string{"credentialsFile": "/non/existent.json"})
+	require.NoError(t, err)
+	err = r.Ensure(context.TODO(), "us-central1-docker.pkg.dev/my-project/tsuru/app-my-app:v1")
+	assert.ErrorContains(t, err, "failed to read artifactregistry credentials")
+}
+
+func TestNewArtifactRegistry_Errors(t *testing.T) {
+	_, err := NewArtifactRegistry(map[string]string{"cleanupPolicyDryRun": "maybe"})
+	assert.EqualError(t, err, `invalid artifactregistry cleanupPolicyDryRun: strconv.ParseBool: parsing "maybe": invalid syntax`)
+
+	_, err = NewArtifactRegistry(map[string]string{"credentials": "/path/to/credentials.json"})
+	assert.EqualError(t, err, "invalid artifactregistry credentials: must be a JSON document")
+
+	_, err = NewArtifactRegistry(map[string]string{"cleanupPolicies": `[{"action":"KEEP"}]`})
+	assert.EqualError(t, err, "invalid artifactregistry cleanupPolicies: must be a JSON object")
+}
+
+func TestParseImage(t *testing.T) {
+	location, project, repository, err := parseImage("southamerica-east1-docker.pkg.dev/my-project/tsuru/app-my-app:v1")
+	require.NoError(t, err)
+	assert.Equal(t, "southamerica-east1", location)
+	assert.Equal(t, "my-project", project)
+	assert.Equal(t, "tsuru", repository)
+
+	for _, image := range []string{
+		"us-central1-docker.pkg.dev/my-project/app-my-app:v1",
+		"-docker.pkg.dev/my-project/tsuru/app-my-app:v1",
+		"registry.example.com/my-project/tsuru/app-my-app:v1",
+	} {
+		_, _, _, err = parseImage(image)
+		assert.EqualError(t, err, "invalid image format "+image)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repository
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// DefaultExistingTTL is how long a repository is known to exist once
+// ensured, before asking its provider again.
+const DefaultExistingTTL = 10 * time.Minute
+
+// DefaultEnsureTimeout bounds a shared ensure, which no caller can cancel.
+const DefaultEnsureTimeout = 2 * time.Minute
+
+// existing caches the repositories known to exist, shared across builds.
+var existing = newExistingCache(DefaultExistingTTL)
+
+// existingCache remembers the repositories ensured in the last ttl. Failures
+// are never cached, so a missing repository is always checked again.
+type existingCache struct {
+	ttl     time.Duration
+	timeout time.Duration
+	now     func() time.Time
+
+	m       sync.Mutex
+	expires map[string]time.Time
+
+	// ensuring collapses the concurrent ensures of a repository into one.
+	ensuring singleflight.Group
+}
+
+func newExistingCache(ttl time.Duration) *existingCache {
+	return &existingCache{ttl: ttl, timeout: DefaultEnsureTimeout, now: time.Now, expires: make(map[string]time.Time)}
+}
+
+// ensure calls provider.Ensure for the image, unless its repository is
+// known to exist.
+func (c *existingCache) ensure(ctx context.Context, provider Repository, repository, image string) error {
+	if c.exists(repository) {
+		return nil
+	}
+
+	ch := c.ensuring.DoChan(repository, func() (any, error) {
+		// the ensure is shared, so it must outlive the caller's cancellation,
+		// but not hold the repository forever if the provider hangs
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), c.timeout)
+		defer cancel()
+
+		if err := provider.Ensure(ctx, image); err != nil {
+			return nil, err
+		}
+
+		c.add(repository)
+		return nil, nil
+	})
+
+	select {
+	case res := <-ch:
+		return res.Err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *existingCache) exists(repository string) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	expires, ok := c.expires[repository]
+	if !ok {
+		return false
+	}
+
+	if !c.now().Before(expires) {
+		delete(c.expires, repository)
+		return false
+	}
+
+	return true
+}
+
+func (c *existingCache) add(repository string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.expires[repository] = c.now().Add(c.ttl)
+}
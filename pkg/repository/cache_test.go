@@ -0,0 +1,175 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repository
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingRepository counts the ensures by image, blocking each one until
+// release is closed (when set).
+type countingRepository struct {
+	m       sync.Mutex
+	ensures map[string]int
+	err     error
+
+	started chan string
+	release chan struct{}
+}
+
+func (r *countingRepository) Ensure(ctx context.Context, name string) error {
+	r.m.Lock()
+	if r.ensures == nil {
+		r.ensures = make(map[string]int)
+	}
+	r.ensures[name]++
+	r.m.Unlock()
+
+	if r.started != nil {
+		r.started <- name
+	}
+	if r.release != nil {
+		select {
+		case <-r.release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return r.err
+}
+
+func (r *countingRepository) count(name string) int {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.ensures[name]
+}
+
+func withExistingCache(t *testing.T, ttl time.Duration) *existingCache {
+	t.Helper()
+
+	previous := existing
+	existing = newExistingCache(ttl)
+	t.Cleanup(func() { existing = previous })
+	return existing
+}
+
+func TestEnsureImages(t *testing.T) {
+	withExistingCache(t, time.Minute)
+
+	r := &countingRepository{started: make(chan string, 3), release: make(chan struct{})}
+	providers := map[string]Repository{"registry.example.com": r}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- EnsureImages(context.TODO(), providers, []string{
+			"registry.example.com/tsuru/app-my-app:v1",
+			"registry.example.com/tsuru/app-my-app:latest",
+			"registry.example.com/tsuru/app-other-app:v1",
+			"other.example.com/tsuru/app-my-app:v1",
+		})
+	}()
+
+	// both repositories are ensured at the same time
+	var started []string
+	for range 2 {
+		select {
+		case name := <-r.started:
+			started = append(started, name)
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "repositories not ensured in parallel")
+		}
+	}
+	close(r.release)
+	require.NoError(t, <-errCh)
+
+	assert.ElementsMatch(t, []string{"registry.example.com/tsuru/app-my-app:v1", "registry.example.com/tsuru/app-other-app:v1"}, started)
+	assert.Equal(t, 0, r.count("registry.example.com/tsuru/app-my-app:latest"))
+
+	// known to exist, even by another build
+	require.NoError(t, EnsureImages(context.TODO(), providers, []string{"registry.example.com/tsuru/app-my-app:v2"}))
+	assert.Equal(t, 0, r.count("registry.example.com/tsuru/app-my-app:v2"))
+}
+
+func TestEnsureImages_Error(t *testing.T) {
+	withExistingCache(t, time.Minute)
+
+	r := &countingRepository{err: errors.New("quota exceeded")}
+	providers := map[string]Repository{"registry.example.com": r}
+	images := []string{"registry.example.com/tsuru/app-my-app:v1"}
+
+	assert.EqualError(t, EnsureImages(context.TODO(), providers, images), "quota exceeded")
+
+	// failures are never cached
+	r.err = nil
+	require.NoError(t, EnsureImages(context.TODO(), providers, images))
+	assert.Equal(t, 2, r.count("registry.example.com/tsuru/app-my-app:v1"))
+}
+
+func TestExistingCache_TTL(t *testing.T) {
+	c := withExistingCache(t, time.Minute)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	r := &countingRepository{}
+	image := "registry.example.com/tsuru/app-my-app:v1"
+
+	require.NoError(t, c.ensure(context.TODO(), r, "registry.example.com/tsuru/app-my-app", image))
+	now = now.Add(59 * time.Second)
+	require.NoError(t, c.ensure(context.TODO(), r, "registry.example.com/tsuru/app-my-app", image))
+	assert.Equal(t, 1, r.count(image))
+
+	now = now.Add(time.Second)
+	require.NoError(t, c.ensure(context.TODO(), r, "registry.example.com/tsuru/app-my-app", image))
+	assert.Equal(t, 2, r.count(image))
+}
+
+func TestExistingCache_Singleflight(t *testing.T) {
+	c := withExistingCache(t, time.Minute)
+
+	r := &countingRepository{started: make(chan string, 1), release: make(chan struct{})}
+	image := "registry.example.com/tsuru/app-my-app:v1"
+
+	first := make(chan error, 1)
+	go func() { first <- c.ensure(context.TODO(), r, "registry.example.com/tsuru/app-my-app", image) }()
+	<-r.started
+
+	// a canceled waiter neither waits for nor cancels the shared ensure
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	assert.ErrorIs(t, c.ensure(ctx, r, "registry.example.com/tsuru/app-my-app", image), context.Canceled)
+
+	second := make(chan error, 1)
+	go func() { second <- c.ensure(context.TODO(), r, "registry.example.com/tsuru/app-my-app", image) }()
+
+	close(r.release)
+	require.NoError(t, <-first)
+	require.NoError(t, <-second)
+	assert.Equal(t, 1, r.count(image))
+}
+
+func TestExistingCache_Timeout(t *testing.T) {
+	c := withExistingCache(t, time.Minute)
+	c.timeout = 10 * time.Millisecond
+
+	// never released, so it only returns once the shared ensure times out
+	r := &countingRepository{release: make(chan struct{})}
+	image := "registry.example.com/tsuru/app-my-app:v1"
+
+	err := c.ensure(context.TODO(), r, "registry.example.com/tsuru/app-my-app", image)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.False(t, c.exists("registry.example.com/tsuru/app-my-app"))
+
+	// the repository is not held by the hung ensure
+	r.release = nil
+	require.NoError(t, c.ensure(context.TODO(), r, "registry.example.com/tsuru/app-my-app", image))
+	assert.Equal(t, 2, r.count(image))
+}
@@ -0,0 +1,244 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ecr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	awsecr "github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/ecr/types"
+)
+
+type ECRRequiredMethods interface {
+	CreateRepository(ctx context.Context, params *awsecr.CreateRepositoryInput, optFns ...func(*awsecr.Options)) (*awsecr.CreateRepositoryOutput, error)
+	DescribeRepositories(ctx context.Context, params *awsecr.DescribeRepositoriesInput, optFns ...func(*awsecr.Options)) (*awsecr.DescribeRepositoriesOutput, error)
+	GetLifecyclePolicy(ctx context.Context, params *awsecr.GetLifecyclePolicyInput, optFns ...func(*awsecr.Options)) (*awsecr.GetLifecyclePolicyOutput, error)
+	PutLifecyclePolicy(ctx context.Context, params *awsecr.PutLifecyclePolicyInput, optFns ...func(*awsecr.Options)) (*awsecr.PutLifecyclePolicyOutput, error)
+}
+
+// ECR creates the missing repositories on Amazon Elastic Container Registry.
+// The settings below only apply to the repositories it creates, except for
+// the lifecycle policy, which is also set on existing repositories without
+// one.
+type ECR struct {
+	m      sync.Mutex
+	client ECRRequiredMethods
+
+	// Region defaults to the one in the registry host (e.g.
+	// 123456789012.dkr.ecr.us-east-1.amazonaws.com), falling back to the
+	// AWS SDK defaults.
+	Region  string
+	Profile string
+	// RegistryID defaults to the account of the registry host.
+	RegistryID string
+	// LifecyclePolicy is the JSON text of the lifecycle policy set on the
+	// repositories without one, if any.
+	LifecyclePolicy string
+	ScanOnPush      bool
+	ImmutableTags   bool
+}
+
+func NewECR(data map[string]string) (*ECR, error) {
+	r := &ECR{
+		Region:          data["region"],
+		Profile:         data["profile"],
+		RegistryID:      data["registryID"],
+		LifecyclePolicy: data["lifecyclePolicy"],
+	}
+
+	for key, value := range map[string]*bool{"scanOnPush": &r.ScanOnPush, "immutableTags": &r.ImmutableTags} {
+		if data[key] == "" {
+			continue
+		}
+
+		b, err := strconv.ParseBool(data[key])
+		if err != nil {
+			return nil, fmt.Errorf("invalid ecr %s: %w", key, err)
+		}
+		*value = b
+	}
+
+	if r.LifecyclePolicy != "" && !json.Valid([]byte(r.LifecyclePolicy)) {
+		return nil, errors.New("invalid ecr lifecyclePolicy: must be a JSON document")
+	}
+
+	return r, nil
+}
+
+func (r *ECR) Ensure(ctx context.Context, name string) error {
+	registry, repository, err := parseImage(name)
+	if err != nil {
+		return err
+	}
+
+	client, err := r.auth(ctx, registry)
+	if err != nil {
+		return err
+	}
+
+	exists, err := r.exists(ctx, client, registry, repository)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return r.create(ctx, client, registry, repository)
+	}
+	return r.ensureLifecyclePolicy(ctx, client, registry, repository)
+}
+
+func (r *ECR) auth(ctx context.Context, registry string) (ECRRequiredMethods, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.client != nil {
+		return r.client, nil
+	}
+
+	var opts []func(*config.LoadOptions) error
+	if region := r.region(registry); region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	if r.Profile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(r.Profile))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	r.client = awsecr.NewFromConfig(cfg)
+	return r.client, nil
+}
+
+func (r *ECR) create(ctx context.Context, client ECRRequiredMethods, registry, repository string) error {
+	mutability := types.ImageTagMutabilityMutable
+	if r.ImmutableTags {
+		mutability = types.ImageTagMutabilityImmutable
+	}
+
+	_, err := client.CreateRepository(ctx, &awsecr.CreateRepositoryInput{
+		RepositoryName:             aws.String(repository),
+		RegistryId:                 r.registryID(registry),
+		ImageTagMutability:         mutability,
+		ImageScanningConfiguration: &types.ImageScanningConfiguration{ScanOnPush: r.ScanOnPush},
+	})
+
+	var alreadyExists *types.RepositoryAlreadyExistsException
+	if errors.As(err, &alreadyExists) {
+		// another agent replica (or anyone else) created it after it was
+		// described
+		return r.ensureLifecyclePolicy(ctx, client, registry, repository)
+	}
+	if err != nil {
+		return err
+	}
+
+	return r.putLifecyclePolicy(ctx, client, registry, repository)
+}
+
+// ensureLifecyclePolicy sets the lifecycle policy of an existing repository
+// without one, such as a repository whose policy failed to be set right
+// after it was created.
+func (r *ECR) ensureLifecyclePolicy(ctx context.Context, client ECRRequiredMethods, registry, repository string) error {
+	if r.LifecyclePolicy == "" {
+		return nil
+	}
+
+	_, err := client.GetLifecyclePolicy(ctx, &awsecr.GetLifecyclePolicyInput{
+		RepositoryName: aws.String(repository),
+		RegistryId:     r.registryID(registry),
+	})
+
+	var notFound *types.LifecyclePolicyNotFoundException
+	if errors.As(err, &notFound) {
+		return r.putLifecyclePolicy(ctx, client, registry, repository)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get the lifecycle policy of repository %s: %w", repository, err)
+	}
+	return nil
+}
+
+func (r *ECR) putLifecyclePolicy(ctx context.Context, client ECRRequiredMethods, registry, repository string) error {
+	if r.LifecyclePolicy == "" {
+		return nil
+	}
+
+	_, err := client.PutLifecyclePolicy(ctx, &awsecr.PutLifecyclePolicyInput{
+		RepositoryName:      aws.String(repository),
+		RegistryId:          r.registryID(registry),
+		LifecyclePolicyText: aws.String(r.LifecyclePolicy),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set the lifecycle policy of repository %s: %w", repository, err)
+	}
+	return nil
+}
+
+func (r *ECR) exists(ctx context.Context, client ECRRequiredMethods, registry, repository string) (bool, error) {
+	_, err := client.DescribeRepositories(ctx, &awsecr.DescribeRepositoriesInput{
+		RepositoryNames: []string{repository},
+		RegistryId:      r.registryID(registry),
+	})
+
+	var notFound *types.RepositoryNotFoundException
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *ECR) region(registry string) string {
+	if r.Region != "" {
+		return r.Region
+	}
+
+	// <account>.dkr.ecr.<region>.amazonaws.com[.cn]
+	parts := strings.Split(registry, ".")
+	if len(parts) >= 6 && parts[1] == "dkr" && parts[2] == "ecr" {
+		return parts[3]
+	}
+	return ""
+}
+
+func (r *ECR) registryID(registry string) *string {
+	if r.RegistryID != "" {
+		return aws.String(r.RegistryID)
+	}
+
+	account, _, found := strings.Cut(registry, ".dkr.ecr.")
+	if !found {
+		return nil
+	}
+	return aws.String(account)
+}
+
+// parseImage splits the image into its registry and repository, which is
+// the path after the registry host without tag nor digest.
+func parseImage(image string) (string, string, error) {
+	registry, repository, found := strings.Cut(image, "/")
+	if !found || repository == "" {
+		return "", "", fmt.Errorf("invalid image format %s", image)
+	}
+
+	repository, _, _ = strings.Cut(repository, "@")
+	if i := strings.LastIndex(repository, ":"); i > strings.LastIndex(repository, "/") {
+		repository = repository[:i]
+	}
+
+	return registry, repository, nil
+}
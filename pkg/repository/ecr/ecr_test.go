@@ -0,0 +1,189 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	awsecr "github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type FakeECRClient struct {
+	repo     map[string]*awsecr.CreateRepositoryInput
+	policies map[string]string
+	putErr   error
+}
+
+func (m *FakeECRClient) CreateRepository(ctx context.Context, params *awsecr.CreateRepositoryInput, optFns ...func(*awsecr.Options)) (*awsecr.CreateRepositoryOutput, error) {
+	if _, ok := m.repo[*params.RepositoryName]; ok {
+		return nil, &types.RepositoryAlreadyExistsException{Message: params.RepositoryName}
+	}
+	if m.repo == nil {
+		m.repo = make(map[string]*awsecr.CreateRepositoryInput)
+	}
+	m.repo[*params.RepositoryName] = params
+	return &awsecr.CreateRepositoryOutput{}, nil
+}
+
+func (m *FakeECRClient) DescribeRepositories(ctx context.Context, params *awsecr.DescribeRepositoriesInput, optFns ...func(*awsecr.Options)) (*awsecr.DescribeRepositoriesOutput, error) {
+	var repos []types.Repository
+	for _, name := range params.RepositoryNames {
+		if _, ok := m.repo[name]; !ok {
+			return nil, &types.RepositoryNotFoundException{}
+		}
+		repos = append(repos, types.Repository{RepositoryName: &name})
+	}
+	return &awsecr.DescribeRepositoriesOutput{Repositories: repos}, nil
+}
+
+func (m *FakeECRClient) GetLifecyclePolicy(ctx context.Context, params *awsecr.GetLifecyclePolicyInput, optFns ...func(*awsecr.Options)) (*awsecr.GetLifecyclePolicyOutput, error) {
+	if _, ok := m.repo[*params.RepositoryName]; !ok {
+		return nil, &types.RepositoryNotFoundException{}
+	}
+	policy, ok := m.policies[*params.RepositoryName]
+	if !ok {
+		return nil, &types.LifecyclePolicyNotFoundException{}
+	}
+	return &awsecr.GetLifecyclePolicyOutput{RepositoryName: params.RepositoryName, LifecyclePolicyText: &policy}, nil
+}
+
+func (m *FakeECRClient) PutLifecyclePolicy(ctx context.Context, params *awsecr.PutLifecyclePolicyInput, optFns ...func(*awsecr.Options)) (*awsecr.PutLifecyclePolicyOutput, error) {
+	if _, ok := m.repo[*params.RepositoryName]; !ok {
+		return nil, &types.RepositoryNotFoundException{}
+	}
+	if m.putErr != nil {
+		return nil, m.putErr
+	}
+	if m.policies == nil {
+		m.policies = make(map[string]string)
+	}
+	m.policies[*params.RepositoryName] = *params.LifecyclePolicyText
+	return &awsecr.PutLifecyclePolicyOutput{}, nil
+}
+
+func TestECR_Ensure(t *testing.T) {
+	policy := `{"rules":[{"rulePriority":1,"selection":{"tagStatus":"any","countType":"imageCountMoreThan","countNumber":10},"action":{"type":"expire"}}]}`
+
+	fakeClient := new(FakeECRClient)
+	r, err := NewECR(map[string]string{"scanOnPush": "true", "immutableTags": "true", "lifecyclePolicy": policy})
+	require.NoError(t, err)
+	r.client = fakeClient
+
+	ctx := context.TODO()
+	name := "123456789012.dkr.ecr.us-east-1.amazonaws.com/tsuru/app-my-app:v1"
+	exists, err := r.exists(ctx, fakeClient, "123456789012.dkr.ecr.us-east-1.amazonaws.com", "tsuru/app-my-app")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	err = r.Ensure(ctx, name)
+	require.NoError(t, err)
+
+	require.Contains(t, fakeClient.repo, "tsuru/app-my-app")
+	created := fakeClient.repo["tsuru/app-my-app"]
+	assert.Equal(t, "123456789012", *created.RegistryId)
+	assert.Equal(t, types.ImageTagMutabilityImmutable, created.ImageTagMutability)
+	assert.True(t, created.ImageScanningConfiguration.ScanOnPush)
+	assert.Equal(t, map[string]string{"tsuru/app-my-app": policy}, fakeClient.policies)
+
+	// existing repositories keep their lifecycle policy
+	fakeClient.policies["tsuru/app-my-app"] = `{"rules":[]}`
+	err = r.Ensure(ctx, "123456789012.dkr.ecr.us-east-1.amazonaws.com/tsuru/app-my-app:v2")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"tsuru/app-my-app": `{"rules":[]}`}, fakeClient.policies)
+
+	// created meanwhile by someone else
+	err = r.create(ctx, fakeClient, "123456789012.dkr.ecr.us-east-1.amazonaws.com", "tsuru/app-my-app")
+	assert.NoError(t, err)
+}
+
+func TestECR_EnsureLifecyclePolicyFailed(t *testing.T) {
+	policy := `{"rules":[]}`
+
+	fakeClient := &FakeECRClient{putErr: errors.New("throttled")}
+	r, err := NewECR(map[string]string{"lifecyclePolicy": policy})
+	require.NoError(t, err)
+	r.client = fakeClient
+
+	ctx := context.TODO()
+	name := "123456789012.dkr.ecr.us-east-1.amazonaws.com/tsuru/app-my-app:v1"
+	err = r.Ensure(ctx, name)
+	assert.EqualError(t, err, "failed to set the lifecycle policy of repository tsuru/app-my-app: throttled")
+	require.Contains(t, fakeClient.repo, "tsuru/app-my-app")
+	assert.Nil(t, fakeClient.policies)
+
+	// the repository is found next time, and gets the missing policy
+	fakeClient.putErr = nil
+	err = r.Ensure(ctx, name)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"tsuru/app-my-app": policy}, fakeClient.policies)
+}
+
+func TestECR_EnsureDefaults(t *testing.T) {
+	fakeClient := new(FakeECRClient)
+	r, err := NewECR(map[string]string{"registryID": "210987654321"})
+	require.NoError(t, err)
+	r.client = fakeClient
+
+	err = r.Ensure(context.TODO(), "registry.example.com/app-my-app@sha256:0123456789abcdef")
+	require.NoError(t, err)
+
+	require.Contains(t, fakeClient.repo, "app-my-app")
+	created := fakeClient.repo["app-my-app"]
+	assert.Equal(t, "210987654321", *created.RegistryId)
+	assert.Equal(t, types.ImageTagMutabilityMutable, created.ImageTagMutability)
+	assert.False(t, created.ImageScanningConfiguration.ScanOnPush)
+	assert.Nil(t, fakeClient.policies)
+}
+
+func TestNewECR_Errors(t *testing.T) {
+	_, err := NewECR(map[string]string{"scanOnPush": "yes please"})
+	assert.ErrorContains(t, err, "invalid ecr scanOnPush")
+
+	_, err = NewECR(map[string]string{"lifecyclePolicy": "{rules: []"})
+	assert.EqualError(t, err, "invalid ecr lifecyclePolicy: must be a JSON document")
+}
+
+func TestECR_Region(t *testing.T) {
+	r := &ECR{}
+	assert.Equal(t, "us-east-1", r.region("123456789012.dkr.ecr.us-east-1.amazonaws.com"))
+	assert.Equal(t, "cn-north-1", r.region("123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn"))
+	assert.Equal(t, "", r.region("registry.example.com"))
+
+	r.Region = "sa-east-1"
+	assert.Equal(t, "sa-east-1", r.region("123456789012.dkr.ecr.us-east-1.amazonaws.com"))
+}
+
+func TestParseImage(t *testing.T) {
+	tests := []struct {
+		image              string
+		expectedRegistry   string
+		expectedRepository string
+		expectedErr        bool
+	}{
+		{image: "image", expectedErr: true},
+		{image: "registry/", expectedErr: true},
+		{image: "registry/image", expectedRegistry: "registry", expectedRepository: "image"},
+		{image: "registry:5000/namespace/image:tag", expectedRegistry: "registry:5000", expectedRepository: "namespace/image"},
+		{image: "registry/namespace/image@sha256:abc", expectedRegistry: "registry", expectedRepository: "namespace/image"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			registry, repository, err := parseImage(tt.image)
+			if tt.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedRegistry, registry)
+			assert.Equal(t, tt.expectedRepository, repository)
+		})
+	}
+}
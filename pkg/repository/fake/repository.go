@@ -7,11 +7,18 @@ package fake
 import (
 	"context"
 	"errors"
+	"slices"
+	"strings"
+	"sync"
 )
 
 type FakeRepository struct {
+	m sync.Mutex
+
 	CreatedRepos map[string]bool
 	RepoExists   map[string]bool
+	// Tags are the tags by repository (e.g. registry.example.com/tsuru/app-my-app).
+	Tags map[string][]string
 }
 
 func (f *FakeRepository) create(name string) error {
@@ -38,6 +45,9 @@ func (f *FakeRepository) exists(name string) (bool, error) {
 }
 
 func (f *FakeRepository) Ensure(ctx context.Context, name string) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+
 	exists, err := f.exists(name)
 	if err != nil {
 		return err
@@ -47,3 +57,17 @@ func (f *FakeRepository) Ensure(ctx context.Context, name string) error {
 	}
 	return nil
 }
+
+func (f *FakeRepository) ListTags(ctx context.Context, repository string) ([]string, error) {
+	return f.Tags[repository], nil
+}
+
+func (f *FakeRepository) DeleteTag(ctx context.Context, image string) error {
+	i := strings.LastIndex(image, ":")
+	repository, tag := image[:i], image[i+1:]
+	if !slices.Contains(f.Tags[repository], tag) {
+		return errors.New("tag not found")
+	}
+	f.Tags[repository] = slices.DeleteFunc(f.Tags[repository], func(t string) bool { return t == tag })
+	return nil
+}
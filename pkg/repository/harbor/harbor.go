@@ -0,0 +1,275 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package harbor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/tsuru/deploy-agent/pkg/repository/jsonapi"
+)
+
+const defaultRetentionSchedule = "0 0 0 * * *"
+
+// Harbor creates the missing projects on Harbor, through its v2 REST API,
+// authenticating as a robot account. The project of an image is the first
+// segment of its path (e.g. tsuru in harbor.example.com/tsuru/app-my-app).
+// The settings below only apply to the projects it creates, except for the
+// retention which is added to any project missing one.
+type Harbor struct {
+	client *http.Client
+
+	// URL of Harbor, defaults to https://<registry host>.
+	URL         string
+	RobotName   string
+	RobotSecret string
+	// StorageLimit is the storage quota of new projects in bytes, unlimited
+	// when zero.
+	StorageLimit int64
+	AutoScan     bool
+	// RetainLatest adds a retention rule to new projects keeping the latest
+	// pushed artifacts of each repository, disabled when zero. Harbor doesn't
+	// know the images in use by tsuru, so older images still running are
+	// deleted as well.
+	RetainLatest int
+	// RetentionSchedule is the cron of the retention runs, daily by default.
+	RetentionSchedule string
+}
+
+func NewHarbor(data map[string]string) (*Harbor, error) {
+	h := &Harbor{
+		client:            &http.Client{Timeout: 30 * time.Second},
+		URL:               strings.TrimRight(data["url"], "/"),
+		RobotName:         data["robotName"],
+		RobotSecret:       data["robotSecret"],
+		RetentionSchedule: data["retentionSchedule"],
+	}
+
+	if v := data["storageLimit"]; v != "" {
+		q, err := resource.ParseQuantity(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid harbor storageLimit: %w", err)
+		}
+		h.StorageLimit = q.Value()
+	}
+
+	if v := data["autoScan"]; v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid harbor autoScan: %w", err)
+		}
+		h.AutoScan = b
+	}
+
+	if v := data["retainLatest"]; v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid harbor retainLatest: %q", v)
+		}
+		h.RetainLatest = n
+	}
+
+	if h.RetentionSchedule == "" {
+		h.RetentionSchedule = defaultRetentionSchedule
+	}
+
+	return h, nil
+}
+
+func (h *Harbor) Ensure(ctx context.Context, name string) error {
+	registry, project, err := parseProject(name)
+	if err != nil {
+		return err
+	}
+
+	baseURL := h.URL
+	if baseURL == "" {
+		baseURL = "https://" + registry
+	}
+
+	exists, err := h.exists(ctx, baseURL, project)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := h.create(ctx, baseURL, project); err != nil {
+			return err
+		}
+	}
+
+	if h.RetainLatest == 0 {
+		return nil
+	}
+
+	// the retention is checked on existing projects too, since setting it
+	// may have failed after their creation
+	if err := h.ensureRetention(ctx, baseURL, project); err != nil {
+		return fmt.Errorf("failed to set the retention of harbor project %s: %w", project, err)
+	}
+	return nil
+}
+
+func (h *Harbor) exists(ctx context.Context, baseURL, project string) (bool, error) {
+	resp, err := h.do(ctx, http.MethodHead, baseURL+"/api/v2.0/projects?project_name="+url.QueryEscape(project), nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("failed to check harbor project %s: %w", project, responseError(resp))
+}
+
+func (h *Harbor) create(ctx context.Context, baseURL, project string) error {
+	body := map[string]any{
+		"project_name": project,
+		"metadata": map[string]string{
+			"public":    "false",
+			"auto_scan": strconv.FormatBool(h.AutoScan),
+		},
+	}
+	if h.StorageLimit > 0 {
+		body["storage_limit"] = h.StorageLimit
+	}
+
+	resp, err := h.do(ctx, http.MethodPost, baseURL+"/api/v2.0/projects", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+	case http.StatusConflict:
+		// another agent replica (or someone else) created it since the
+		// check, so it keeps the quota and auto-scan it was created with
+	default:
+		return fmt.Errorf("failed to create harbor project %s: %w", project, responseError(resp))
+	}
+	return nil
+}
+
+// ensureRetention creates the retention policy of the project, unless it
+// already has one.
+func (h *Harbor) ensureRetention(ctx context.Context, baseURL, project string) error {
+	resp, err := h.do(ctx, http.MethodGet, baseURL+"/api/v2.0/projects/"+url.PathEscape(project), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+
+	var p struct {
+		ProjectID int64             `json:"project_id"`
+		Metadata  map[string]string `json:"metadata"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		return err
+	}
+
+	// Harbor sets it on the project along with its retention policy
+	if p.Metadata["retention_id"] != "" {
+		return nil
+	}
+
+	policy := map[string]any{
+		"algorithm": "or",
+		"rules": []any{
+			map[string]any{
+				"action":   "retain",
+				"template": "latestPushedK",
+				"params":   map[string]any{"latestPushedK": h.RetainLatest},
+				"tag_selectors": []any{
+					map[string]any{"kind": "doublestar", "decoration": "matches", "pattern": "**"},
+				},
+				"scope_selectors": map[string]any{
+					"repository": []any{
+						map[string]any{"kind": "doublestar", "decoration": "repoMatches", "pattern": "**"},
+					},
+				},
+			},
+		},
+		"trigger": map[string]any{
+			"kind":     "Schedule",
+			"settings": map[string]any{"cron": h.RetentionSchedule},
+		},
+		"scope": map[string]any{"level": "project", "ref": p.ProjectID},
+	}
+
+	rresp, err := h.do(ctx, http.MethodPost, baseURL+"/api/v2.0/retentions", policy)
+	if err != nil {
+		return err
+	}
+	defer rresp.Body.Close()
+
+	if rresp.StatusCode != http.StatusCreated {
+		return responseError(rresp)
+	}
+	return nil
+}
+
+func (h *Harbor) do(ctx context.Context, method, url string, body any) (*http.Response, error) {
+	req, err := jsonapi.NewRequest(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	// project names are taken as is, rather than as IDs
+	req.Header.Set("X-Is-Resource-Name", "true")
+	if h.RobotName != "" {
+		req.SetBasicAuth(h.RobotName, h.RobotSecret)
+	}
+
+	return h.client.Do(req)
+}
+
+// errorBody is the body of failed Harbor API responses, which may hold
+// several errors.
+type errorBody struct {
+	Errors []struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+func (b *errorBody) Message() string {
+	messages := make([]string, 0, len(b.Errors))
+	for _, e := range b.Errors {
+		messages = append(messages, e.Message)
+	}
+	return strings.Join(messages, "; ")
+}
+
+// responseError returns the error of a failed Harbor API response, made of
+// the messages in its body (if any).
+func responseError(resp *http.Response) error {
+	return jsonapi.ResponseError(resp, &errorBody{})
+}
+
+// parseProject returns the registry and project of the image, which is the
+// first segment of its path.
+func parseProject(image string) (string, string, error) {
+	parts := strings.Split(image, "/")
+	if len(parts) < 3 || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid image format %s", image)
+	}
+	return parts[0], parts[1], nil
+}
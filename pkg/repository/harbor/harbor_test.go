@@ -0,0 +1,239 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package harbor
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeHarbor is a stand-in of the Harbor v2 API endpoints used by Harbor.
+type fakeHarbor struct {
+	m          sync.Mutex
+	projects   map[string]map[string]any
+	retentions []map[string]any
+	requests   []string
+	// retentionsBroken fails the creation of retention policies.
+	retentionsBroken bool
+}
+
+func (f *fakeHarbor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+
+	if user, pass, ok := r.BasicAuth(); !ok || user != "robot$tsuru" || pass != "s3cr3t" {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"errors":[{"code":"UNAUTHORIZED","message":"unauthorized"}]}`))
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodHead && r.URL.Path == "/api/v2.0/projects":
+		if _, ok := f.projects[r.URL.Query().Get("project_name")]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+		}
+
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v2.0/projects":
+		var p map[string]any
+		json.NewDecoder(r.Body).Decode(&p)
+		name := p["project_name"].(string)
+		if _, ok := f.projects[name]; ok {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"errors":[{"code":"CONFLICT","message":"The project named ` + name + ` already exists"}]}`))
+			return
+		}
+		if f.projects == nil {
+			f.projects = make(map[string]map[string]any)
+		}
+		p["project_id"] = float64(len(f.projects) + 1)
+		f.projects[name] = p
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/api/v2.0/projects/"):
+		p, ok := f.projects[strings.TrimPrefix(r.URL.Path, "/api/v2.0/projects/")]
+		if !ok || r.Header.Get("X-Is-Resource-Name") != "true" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(p)
+
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v2.0/retentions" && !f.retentionsBroken:
+		var policy map[string]any
+		json.NewDecoder(r.Body).Decode(&policy)
+		f.retentions = append(f.retentions, policy)
+
+		ref := policy["scope"].(map[string]any)["ref"]
+		for _, p := range f.projects {
+			if p["project_id"] == ref {
+				metadata, _ := p["metadata"].(map[string]any)
+				if metadata == nil {
+					metadata = make(map[string]any)
+					p["metadata"] = metadata
+				}
+				metadata["retention_id"] = strconv.Itoa(len(f.retentions))
+			}
+		}
+		w.WriteHeader(http.StatusCreated)
+
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"errors":[{"code":"UNKNOWN","message":"internal server error"}]}`))
+	}
+}
+
+func newTestHarbor(t *testing.T, data map[string]string) (*Harbor, *fakeHarbor) {
+	f := &fakeHarbor{}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	if data == nil {
+		data = map[string]string{}
+	}
+	data["url"] = srv.URL + "/"
+	data["robotName"] = "robot$tsuru"
+	data["robotSecret"] = "s3cr3t"
+
+	h, err := NewHarbor(data)
+	require.NoError(t, err)
+	return h, f
+}
+
+func TestHarbor_Ensure(t *testing.T) {
+	h, f := newTestHarbor(t, map[string]string{
+		"storageLimit": "10Gi",
+		"autoScan":     "true",
+		"retainLatest": "20",
+	})
+
+	ctx := context.TODO()
+	err := h.Ensure(ctx, "harbor.example.com/tsuru/app-my-app:v1")
+	require.NoError(t, err)
+
+	require.Contains(t, f.projects, "tsuru")
+	project := f.projects["tsuru"]
+	assert.Equal(t, float64(10<<30), project["storage_limit"])
+	assert.Equal(t, map[string]any{"public": "false", "auto_scan": "true", "retention_id": "1"}, project["metadata"])
+
+	require.Len(t, f.retentions, 1)
+	retention := f.retentions[0]
+	assert.Equal(t, map[string]any{"level": "project", "ref": float64(1)}, retention["scope"])
+	assert.Equal(t, map[string]any{"kind": "Schedule", "settings": map[string]any{"cron": "0 0 0 * * *"}}, retention["trigger"])
+	rule := retention["rules"].([]any)[0].(map[string]any)
+	assert.Equal(t, "latestPushedK", rule["template"])
+	assert.Equal(t, map[string]any{"latestPushedK": float64(20)}, rule["params"])
+
+	// existing projects with a retention are left untouched
+	f.requests = nil
+	err = h.Ensure(ctx, "harbor.example.com/tsuru/app-other-app@sha256:abc")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"HEAD /api/v2.0/projects", "GET /api/v2.0/projects/tsuru"}, f.requests)
+	assert.Len(t, f.retentions, 1)
+}
+
+func TestHarbor_EnsureDefaults(t *testing.T) {
+	h, f := newTestHarbor(t, nil)
+
+	err := h.Ensure(context.TODO(), "harbor.example.com/tsuru/app-my-app:v1")
+	require.NoError(t, err)
+
+	require.Contains(t, f.projects, "tsuru")
+	assert.NotContains(t, f.projects["tsuru"], "storage_limit")
+	assert.Equal(t, map[string]any{"public": "false", "auto_scan": "false"}, f.projects["tsuru"]["metadata"])
+	assert.Empty(t, f.retentions)
+}
+
+func TestHarbor_EnsureCreatedElsewhere(t *testing.T) {
+	h, f := newTestHarbor(t, map[string]string{"retainLatest": "5"})
+	f.projects = map[string]map[string]any{"tsuru": {"project_name": "tsuru", "project_id": float64(1)}}
+
+	// e.g. created by another agent replica after checking it was missing
+	err := h.create(context.TODO(), h.URL, "tsuru")
+	require.NoError(t, err)
+	assert.Empty(t, f.retentions)
+	assert.NotContains(t, f.projects["tsuru"], "storage_limit")
+}
+
+func TestHarbor_EnsureRetentionFailed(t *testing.T) {
+	h, f := newTestHarbor(t, map[string]string{"retainLatest": "5"})
+	f.retentionsBroken = true
+
+	err := h.Ensure(context.TODO(), "harbor.example.com/tsuru/app-my-app:v1")
+	assert.EqualError(t, err, "failed to set the retention of harbor project tsuru: 500 Internal Server Error: internal server error")
+	assert.Contains(t, f.projects, "tsuru", "projects are never deleted")
+
+	// the retention is set on the project found by the next ensure
+	f.retentionsBroken = false
+	err = h.Ensure(context.TODO(), "harbor.example.com/tsuru/app-my-app:v1")
+	require.NoError(t, err)
+	require.Len(t, f.retentions, 1)
+	assert.Equal(t, map[string]any{"level": "project", "ref": float64(1)}, f.retentions[0]["scope"])
+}
+
+func TestHarbor_EnsureErrors(t *testing.T) {
+	h, _ := newTestHarbor(t, nil)
+	h.RobotSecret = "wrong"
+
+	err := h.Ensure(context.TODO(), "harbor.example.com/tsuru/app-my-app:v1")
+	assert.EqualError(t, err, "failed to check harbor project tsuru: 401 Unauthorized")
+
+	h, _ = newTestHarbor(t, nil)
+	h.URL += "/broken"
+	err = h.Ensure(context.TODO(), "harbor.example.com/tsuru/app-my-app:v1")
+	assert.EqualError(t, err, "failed to check harbor project tsuru: 500 Internal Server Error")
+
+	err = h.Ensure(context.TODO(), "harbor.example.com/app-my-app:v1")
+	assert.EqualError(t, err, "invalid image format harbor.example.com/app-my-app:v1")
+}
+
+func TestNewHarbor(t *testing.T) {
+	h, err := NewHarbor(map[string]string{"url": "https://harbor.example.com/", "storageLimit": "1073741824"})
+	require.NoError(t, err)
+	assert.Equal(t, "https://harbor.example.com", h.URL)
+	assert.Equal(t, int64(1<<30), h.StorageLimit)
+	assert.Equal(t, defaultRetentionSchedule, h.RetentionSchedule)
+
+	tests := map[string]struct {
+		data          map[string]string
+		expectedError string
+	}{
+		"invalid storageLimit": {
+			data:          map[string]string{"storageLimit": "lots"},
+			expectedError: "invalid harbor storageLimit: quantities must match the regular expression '^([+-]?[0-9.]+)([eEinumkKMGTP]*[-+]?[0-9]*)$'",
+		},
+		"invalid autoScan": {
+			data:          map[string]string{"autoScan": "yes please"},
+			expectedError: `invalid harbor autoScan: strconv.ParseBool: parsing "yes please": invalid syntax`,
+		},
+		"negative retainLatest": {
+			data:          map[string]string{"retainLatest": "-1"},
+			expectedError: `invalid harbor retainLatest: "-1"`,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewHarbor(tt.data)
+			assert.EqualError(t, err, tt.expectedError)
+		})
+	}
+}
+
+func TestParseProject(t *testing.T) {
+	registry, project, err := parseProject("harbor.example.com:8443/tsuru/team/app-my-app:v1")
+	require.NoError(t, err)
+	assert.Equal(t, "harbor.example.com:8443", registry)
+	assert.Equal(t, "tsuru", project)
+}
@@ -0,0 +1,60 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package jsonapi holds what the repository providers talking to JSON REST
+// APIs (e.g. Harbor and Artifact Registry) have in common.
+package jsonapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// maxErrorBody is the most read from the body of failed responses.
+const maxErrorBody = 64 << 10
+
+// ErrorBody is the JSON body of failed responses, which differs by API.
+type ErrorBody interface {
+	// Message returns the error message held by the body, if any.
+	Message() string
+}
+
+// NewRequest returns the request to url, sending body as JSON unless it's
+// nil.
+func NewRequest(ctx context.Context, method, url string, body any) (*http.Request, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, r)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// ResponseError returns the error of the failed resp, made of its status and
+// the message decoded into body (if any).
+func ResponseError(resp *http.Response, body ErrorBody) error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	if err := json.Unmarshal(data, body); err != nil || body.Message() == "" {
+		return errors.New(resp.Status)
+	}
+	return fmt.Errorf("%s: %s", resp.Status, body.Message())
+}
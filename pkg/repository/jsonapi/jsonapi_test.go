@@ -0,0 +1,56 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jsonapi
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testErrorBody struct {
+	Error string `json:"error"`
+}
+
+func (b *testErrorBody) Message() string { return b.Error }
+
+func TestNewRequest(t *testing.T) {
+	req, err := NewRequest(context.TODO(), http.MethodPost, "https://example.com/things", map[string]string{"name": "thing"})
+	require.NoError(t, err)
+	assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+	assert.Equal(t, "application/json", req.Header.Get("Accept"))
+
+	data, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"name":"thing"}`, string(data))
+
+	req, err = NewRequest(context.TODO(), http.MethodGet, "https://example.com/things", nil)
+	require.NoError(t, err)
+	assert.Empty(t, req.Header.Get("Content-Type"))
+	assert.Nil(t, req.Body)
+}
+
+func TestResponseError(t *testing.T) {
+	tests := map[string]struct {
+		body          string
+		expectedError string
+	}{
+		"with message":    {body: `{"error":"thing already exists"}`, expectedError: "409 Conflict: thing already exists"},
+		"without message": {body: `{}`, expectedError: "409 Conflict"},
+		"not JSON":        {body: `<html>conflict</html>`, expectedError: "409 Conflict"},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			resp := &http.Response{Status: "409 Conflict", Body: io.NopCloser(strings.NewReader(tt.body))}
+			assert.EqualError(t, ResponseError(resp, &testErrorBody{}), tt.expectedError)
+		})
+	}
+}
@@ -8,29 +8,81 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"sync"
 
 	"github.com/oracle/oci-go-sdk/v65/artifacts"
 	"github.com/oracle/oci-go-sdk/v65/common"
+	"github.com/oracle/oci-go-sdk/v65/common/auth"
 )
 
 type OCIRequiredMethods interface {
 	CreateContainerRepository(ctx context.Context, request artifacts.CreateContainerRepositoryRequest) (response artifacts.CreateContainerRepositoryResponse, err error)
 	ListContainerRepositories(ctx context.Context, request artifacts.ListContainerRepositoriesRequest) (response artifacts.ListContainerRepositoriesResponse, err error)
+	ListContainerImages(ctx context.Context, request artifacts.ListContainerImagesRequest) (response artifacts.ListContainerImagesResponse, err error)
+	GetContainerImage(ctx context.Context, request artifacts.GetContainerImageRequest) (response artifacts.GetContainerImageResponse, err error)
+	RemoveContainerVersion(ctx context.Context, request artifacts.RemoveContainerVersionRequest) (response artifacts.RemoveContainerVersionResponse, err error)
+}
+
+// The authentication types of the OCI provider.
+const (
+	// AuthConfig authenticates with the API key of a profile in the OCI
+	// config file.
+	AuthConfig = "config"
+	// AuthInstancePrincipal authenticates as the compute instance the agent
+	// runs on.
+	AuthInstancePrincipal = "instancePrincipal"
+	// AuthResourcePrincipal authenticates as the resource the agent runs on,
+	// from the OCI_RESOURCE_PRINCIPAL_* env vars.
+	AuthResourcePrincipal = "resourcePrincipal"
+	// AuthWorkloadIdentity authenticates as the Kubernetes service account
+	// of the agent pod, through OKE workload identity.
+	AuthWorkloadIdentity = "workloadIdentity"
+)
+
+// newArtifactsClient creates the client from the configuration provider, so
+// tests can replace it.
+var newArtifactsClient = func(configProvider common.ConfigurationProvider, region string) (OCIRequiredMethods, error) {
+	client, err := artifacts.NewArtifactsClientWithConfigurationProvider(configProvider)
+	if err != nil {
+		return nil, err
+	}
+	if region != "" {
+		client.SetRegion(region)
+	}
+	return &client, nil
 }
 
 type OCI struct {
+	m             sync.Mutex
 	client        OCIRequiredMethods
 	CompartmentID string
-	Profile       string
-	ConfigPath    string
+	// AuthType is one of AuthConfig (the default), AuthInstancePrincipal,
+	// AuthResourcePrincipal or AuthWorkloadIdentity.
+	AuthType string
+	// Profile and ConfigPath select the OCI config file profile, with
+	// AuthConfig.
+	Profile    string
+	ConfigPath string
+	// Region overrides the region of the authentication, if set.
+	Region string
 }
 
-func NewOCI(data map[string]string) *OCI {
-	return &OCI{
+func NewOCI(data map[string]string) (*OCI, error) {
+	r := &OCI{
 		CompartmentID: data["compartmentID"],
+		AuthType:      data["authType"],
 		Profile:       data["profile"],
 		ConfigPath:    data["configPath"],
+		Region:        data["region"],
 	}
+
+	switch r.AuthType {
+	case "", AuthConfig, AuthInstancePrincipal, AuthResourcePrincipal, AuthWorkloadIdentity:
+	default:
+		return nil, fmt.Errorf("invalid oci authType: %s", r.AuthType)
+	}
+
+	return r, nil
 }
 
 func (r *OCI) Ensure(ctx context.Context, name string) error {
@@ -49,18 +101,40 @@ func (r *OCI) Ensure(ctx context.Context, name string) error {
 }
 
 func (r *OCI) auth() error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
 	if r.client != nil {
 		return nil
 	}
-	configProvider := common.CustomProfileConfigProvider(r.ConfigPath, r.Profile)
-	client, err := artifacts.NewArtifactsClientWithConfigurationProvider(configProvider)
-	r.client = &client
+	configProvider, err := r.configurationProvider()
+	if err != nil {
+		return err
+	}
+	client, err := newArtifactsClient(configProvider, r.Region)
 	if err != nil {
 		return err
 	}
+	r.client = client
 	return nil
 }
 
+func (r *OCI) configurationProvider() (common.ConfigurationProvider, error) {
+	switch r.AuthType {
+	case AuthInstancePrincipal:
+		if r.Region != "" {
+			return auth.InstancePrincipalConfigurationProviderForRegion(common.StringToRegion(r.Region))
+		}
+		return auth.InstancePrincipalConfigurationProvider()
+	case AuthResourcePrincipal:
+		return auth.ResourcePrincipalConfigurationProvider()
+	case AuthWorkloadIdentity:
+		return auth.OkeWorkloadIdentityConfigurationProvider()
+	default:
+		return common.CustomProfileConfigProvider(r.ConfigPath, r.Profile), nil
+	}
+}
+
 func (r *OCI) create(ctx context.Context, name string) error {
 	name, err := parserRegistryRepository(name)
 	if err != nil {
@@ -98,6 +172,78 @@ func (r *OCI) exists(ctx context.Context, name string) (bool, error) {
 	return true, nil
 }
 
+// ListTags returns the versions of every image in the repository.
+func (r *OCI) ListTags(ctx context.Context, repository string) ([]string, error) {
+	err := r.auth()
+	if err != nil {
+		return nil, err
+	}
+	name, err := parserRegistryRepository(repository)
+	if err != nil {
+		return nil, err
+	}
+	request := artifacts.ListContainerImagesRequest{
+		CompartmentId:  &r.CompartmentID,
+		RepositoryName: common.String(name),
+	}
+	var tags []string
+	for {
+		response, err := r.client.ListContainerImages(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range response.Items {
+			image, err := r.client.GetContainerImage(ctx, artifacts.GetContainerImageRequest{ImageId: item.Id})
+			if err != nil {
+				return nil, err
+			}
+			for _, version := range image.Versions {
+				tags = append(tags, *version.Version)
+			}
+		}
+		if response.OpcNextPage == nil {
+			return tags, nil
+		}
+		request.Page = response.OpcNextPage
+	}
+}
+
+// DeleteTag removes the version from its image, leaving the image (and its
+// other versions) in place.
+func (r *OCI) DeleteTag(ctx context.Context, image string) error {
+	err := r.auth()
+	if err != nil {
+		return err
+	}
+	name, err := parserRegistryRepository(image)
+	if err != nil {
+		return err
+	}
+	i := strings.LastIndex(image, ":")
+	if i < strings.LastIndex(image, "/") {
+		return fmt.Errorf("image %s has no tag", image)
+	}
+	version := image[i+1:]
+	response, err := r.client.ListContainerImages(ctx, artifacts.ListContainerImagesRequest{
+		CompartmentId:  &r.CompartmentID,
+		RepositoryName: common.String(name),
+		Version:        common.String(version),
+	})
+	if err != nil {
+		return err
+	}
+	for _, item := range response.Items {
+		_, err = r.client.RemoveContainerVersion(ctx, artifacts.RemoveContainerVersionRequest{
+			ImageId:                       item.Id,
+			RemoveContainerVersionDetails: artifacts.RemoveContainerVersionDetails{Version: common.String(version)},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func parserRegistryRepository(image string) (string, error) {
 	parts := strings.Split(image, "/")
 	if len(parts) < 3 {
@@ -7,6 +7,8 @@ package oci
 import (
 	"context"
 	"errors"
+	"slices"
+	"strconv"
 	"testing"
 
 	"github.com/oracle/oci-go-sdk/v65/artifacts"
@@ -15,7 +17,8 @@ import (
 )
 
 type FakeArtifactsClient struct {
-	repo map[string]bool
+	repo   map[string]bool
+	images []artifacts.ContainerImage
 	artifacts.ArtifactsClient
 }
 
@@ -43,6 +46,59 @@ func (m *FakeArtifactsClient) ListContainerRepositories(ctx context.Context, req
 	}, nil
 }
 
+func (m *FakeArtifactsClient) ListContainerImages(ctx context.Context, request artifacts.ListContainerImagesRequest) (response artifacts.ListContainerImagesResponse, err error) {
+	var items []artifacts.ContainerImageSummary
+	for _, image := range m.images {
+		if *image.RepositoryName != *request.RepositoryName {
+			continue
+		}
+		if request.Version != nil && !slices.ContainsFunc(image.Versions, func(v artifacts.ContainerVersion) bool { return *v.Version == *request.Version }) {
+			continue
+		}
+		items = append(items, artifacts.ContainerImageSummary{Id: image.Id})
+	}
+	// one image per page
+	var page int
+	if request.Page != nil {
+		page, _ = strconv.Atoi(*request.Page)
+	}
+	if page >= len(items) {
+		return artifacts.ListContainerImagesResponse{}, nil
+	}
+	response.Items = items[page : page+1]
+	if page+1 < len(items) {
+		response.OpcNextPage = common.String(strconv.Itoa(page + 1))
+	}
+	return response, nil
+}
+
+func (m *FakeArtifactsClient) GetContainerImage(ctx context.Context, request artifacts.GetContainerImageRequest) (response artifacts.GetContainerImageResponse, err error) {
+	for _, image := range m.images {
+		if *image.Id == *request.ImageId {
+			return artifacts.GetContainerImageResponse{ContainerImage: image}, nil
+		}
+	}
+	return artifacts.GetContainerImageResponse{}, errors.New("image not found")
+}
+
+func (m *FakeArtifactsClient) RemoveContainerVersion(ctx context.Context, request artifacts.RemoveContainerVersionRequest) (response artifacts.RemoveContainerVersionResponse, err error) {
+	for i, image := range m.images {
+		if *image.Id == *request.ImageId {
+			m.images[i].Versions = slices.DeleteFunc(image.Versions, func(v artifacts.ContainerVersion) bool { return *v.Version == *request.Version })
+			return artifacts.RemoveContainerVersionResponse{}, nil
+		}
+	}
+	return artifacts.RemoveContainerVersionResponse{}, errors.New("image not found")
+}
+
+func fakeContainerImage(id, repository string, versions ...string) artifacts.ContainerImage {
+	image := artifacts.ContainerImage{Id: common.String(id), RepositoryName: common.String(repository)}
+	for _, v := range versions {
+		image.Versions = append(image.Versions, artifacts.ContainerVersion{Version: common.String(v)})
+	}
+	return image
+}
+
 func TestOCI_Ensure(t *testing.T) {
 	fakeClient := new(FakeArtifactsClient)
 	oci := &OCI{
@@ -63,6 +119,67 @@ func TestOCI_Ensure(t *testing.T) {
 	assert.ErrorContains(t, err, "repository already exists")
 }
 
+func TestOCI_Tags(t *testing.T) {
+	fakeClient := &FakeArtifactsClient{images: []artifacts.ContainerImage{
+		fakeContainerImage("image1", "tsuru/app-my-app", "v1"),
+		fakeContainerImage("image2", "tsuru/app-other-app", "v1"),
+		fakeContainerImage("image3", "tsuru/app-my-app", "v2", "latest"),
+	}}
+	oci := &OCI{client: fakeClient}
+	ctx := context.TODO()
+
+	tags, err := oci.ListTags(ctx, "gru.ocir.io/namespace/tsuru/app-my-app")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"v1", "v2", "latest"}, tags)
+
+	err = oci.DeleteTag(ctx, "gru.ocir.io/namespace/tsuru/app-my-app:v2")
+	assert.NoError(t, err)
+	tags, err = oci.ListTags(ctx, "gru.ocir.io/namespace/tsuru/app-my-app")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"v1", "latest"}, tags)
+
+	err = oci.DeleteTag(ctx, "gru.ocir.io/namespace/tsuru/app-my-app")
+	assert.EqualError(t, err, "image gru.ocir.io/namespace/tsuru/app-my-app has no tag")
+}
+
+func TestNewOCI(t *testing.T) {
+	r, err := NewOCI(map[string]string{"compartmentID": "123", "authType": "workloadIdentity", "region": "sa-saopaulo-1"})
+	assert.NoError(t, err)
+	assert.Equal(t, &OCI{CompartmentID: "123", AuthType: AuthWorkloadIdentity, Region: "sa-saopaulo-1"}, r)
+
+	_, err = NewOCI(map[string]string{"authType": "password"})
+	assert.EqualError(t, err, "invalid oci authType: password")
+}
+
+func TestOCI_auth(t *testing.T) {
+	previous := newArtifactsClient
+	t.Cleanup(func() { newArtifactsClient = previous })
+
+	fakeClient := new(FakeArtifactsClient)
+	var calls int
+	newArtifactsClient = func(configProvider common.ConfigurationProvider, region string) (OCIRequiredMethods, error) {
+		calls++
+		if calls == 1 {
+			return nil, errors.New("can not create client, bad configuration")
+		}
+		return fakeClient, nil
+	}
+
+	oci := &OCI{CompartmentID: "123"}
+	err := oci.Ensure(context.TODO(), "registry/namespace/test-repo")
+	assert.EqualError(t, err, "can not create client, bad configuration")
+	assert.Nil(t, oci.client, "failed clients are not cached")
+
+	err = oci.Ensure(context.TODO(), "registry/namespace/test-repo")
+	assert.NoError(t, err)
+	assert.Equal(t, fakeClient, oci.client)
+	assert.True(t, fakeClient.repo["test-repo"])
+
+	err = oci.Ensure(context.TODO(), "registry/namespace/test-repo")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+}
+
 func TestParserRegistryRepository(t *testing.T) {
 	tests := []struct {
 		name        string
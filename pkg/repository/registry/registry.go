@@ -0,0 +1,171 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+
+	"github.com/tsuru/deploy-agent/pkg/repository/retention"
+)
+
+// Registry applies the retention on registries speaking the Docker Registry
+// HTTP API v2 (e.g. registry:2), which create repositories on push. Deleting
+// tags requires the registry to allow deletes (e.g.
+// REGISTRY_STORAGE_DELETE_ENABLED=true on registry:2).
+type Registry struct {
+	// Username and Password authenticate on the registry, falling back to
+	// the Docker config credentials when empty.
+	Username string
+	Password string
+	// Insecure talks to the registry over plain HTTP.
+	Insecure bool
+}
+
+func NewRegistry(data map[string]string) (*Registry, error) {
+	r := &Registry{
+		Username: data["username"],
+		Password: data["password"],
+	}
+
+	if v := data["insecure"]; v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid registry insecure: %w", err)
+		}
+		r.Insecure = b
+	}
+
+	return r, nil
+}
+
+// Ensure is a no-op, since repositories are created on push.
+func (r *Registry) Ensure(ctx context.Context, name string) error {
+	return nil
+}
+
+func (r *Registry) ListTags(ctx context.Context, repository string) ([]string, error) {
+	repo, err := name.NewRepository(repository, r.nameOptions()...)
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := remote.List(repo, r.remoteOptions(ctx)...)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	return tags, err
+}
+
+// DeleteTag deletes the manifest of the image, along with every other tag
+// sharing its digest.
+func (r *Registry) DeleteTag(ctx context.Context, image string) error {
+	tag, err := name.NewTag(image, r.nameOptions()...)
+	if err != nil {
+		return err
+	}
+
+	desc, err := remote.Head(tag, r.remoteOptions(ctx)...)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return r.delete(ctx, tag.Digest(desc.Digest.String()))
+}
+
+// ApplyRetention deletes the manifests of the expired tags, except for the
+// ones shared with the kept tags (e.g. latest).
+func (r *Registry) ApplyRetention(ctx context.Context, repository string, policy retention.Policy) error {
+	tags, err := r.ListTags(ctx, repository)
+	if err != nil {
+		return err
+	}
+
+	expired := policy.Expired(tags)
+	if len(expired) == 0 {
+		return nil
+	}
+
+	isExpired := make(map[string]bool, len(expired))
+	for _, tag := range expired {
+		isExpired[tag] = true
+	}
+
+	repo, err := name.NewRepository(repository, r.nameOptions()...)
+	if err != nil {
+		return err
+	}
+
+	digests := make(map[string]string, len(tags))
+	kept := make(map[string]bool)
+	for _, tag := range tags {
+		desc, err := remote.Head(repo.Tag(tag), r.remoteOptions(ctx)...)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		digests[tag] = desc.Digest.String()
+		if !isExpired[tag] {
+			kept[desc.Digest.String()] = true
+		}
+	}
+
+	deleted := make(map[string]bool)
+	for _, tag := range expired {
+		digest, ok := digests[tag]
+		if !ok || kept[digest] || deleted[digest] {
+			continue
+		}
+
+		if err := r.delete(ctx, repo.Digest(digest)); err != nil {
+			return err
+		}
+		deleted[digest] = true
+	}
+
+	return nil
+}
+
+func (r *Registry) delete(ctx context.Context, digest name.Digest) error {
+	err := remote.Delete(digest, r.remoteOptions(ctx)...)
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (r *Registry) nameOptions() []name.Option {
+	if r.Insecure {
+		return []name.Option{name.Insecure}
+	}
+	return nil
+}
+
+func (r *Registry) remoteOptions(ctx context.Context) []remote.Option {
+	opts := []remote.Option{remote.WithContext(ctx)}
+	if r.Username != "" {
+		return append(opts, remote.WithAuth(&authn.Basic{Username: r.Username, Password: r.Password}))
+	}
+	return append(opts, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+}
+
+func isNotFound(err error) bool {
+	var terr *transport.Error
+	return errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound
+}
@@ -0,0 +1,122 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package registry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tsuru/deploy-agent/pkg/repository/retention"
+)
+
+// testRegistry returns the registry:2 set in the
+// DEPLOY_AGENT_INTEGRATION_REGISTRY_HOST env var (which must allow deletes),
+// falling back to an in-memory registry.
+func testRegistry(t *testing.T) (string, *Registry) {
+	if host, found := os.LookupEnv("DEPLOY_AGENT_INTEGRATION_REGISTRY_HOST"); found {
+		insecure, _ := strconv.ParseBool(os.Getenv("DEPLOY_AGENT_INTEGRATION_REGISTRY_HTTP"))
+		return host, &Registry{Insecure: insecure}
+	}
+
+	srv := httptest.NewServer(ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0))))
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://"), &Registry{Insecure: true}
+}
+
+func push(t *testing.T, r *Registry, repository string, tags ...string) v1.Hash {
+	img, err := random.Image(64, 1)
+	require.NoError(t, err)
+
+	digest, err := img.Digest()
+	require.NoError(t, err)
+
+	for _, tag := range tags {
+		ref, err := name.ParseReference(repository+":"+tag, r.nameOptions()...)
+		require.NoError(t, err)
+		require.NoError(t, remote.Write(ref, img, r.remoteOptions(context.TODO())...))
+	}
+
+	return digest
+}
+
+func exists(t *testing.T, r *Registry, repository string, digest v1.Hash) bool {
+	ref, err := name.ParseReference(repository+"@"+digest.String(), r.nameOptions()...)
+	require.NoError(t, err)
+
+	_, err = remote.Head(ref, r.remoteOptions(context.TODO())...)
+	if isNotFound(err) {
+		return false
+	}
+	require.NoError(t, err)
+	return true
+}
+
+func TestRegistry_ApplyRetention(t *testing.T) {
+	host, r := testRegistry(t)
+	repository := fmt.Sprintf("%s/tsuru/app-retention-%d", host, time.Now().UnixNano())
+
+	v1Digest := push(t, r, repository, "v1")
+	v2Digest := push(t, r, repository, "v2")
+	v3Digest := push(t, r, repository, "v3")
+	v4Digest := push(t, r, repository, "v4", "latest")
+	v5Digest := push(t, r, repository, "v5")
+	v6Digest := push(t, r, repository, "v6")
+
+	tags, err := r.ListTags(context.TODO(), repository)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"v1", "v2", "v3", "v4", "v5", "v6", "latest"}, tags)
+
+	err = r.ApplyRetention(context.TODO(), repository, retention.Policy{KeepLast: 1, InUse: []string{"v2", "v6"}})
+	require.NoError(t, err)
+
+	assert.False(t, exists(t, r, repository, v1Digest))
+	assert.True(t, exists(t, r, repository, v2Digest), "in use")
+	assert.False(t, exists(t, r, repository, v3Digest))
+	assert.True(t, exists(t, r, repository, v4Digest), "shared with latest")
+	assert.False(t, exists(t, r, repository, v5Digest))
+	assert.True(t, exists(t, r, repository, v6Digest), "latest version")
+}
+
+func TestRegistry_DeleteTag(t *testing.T) {
+	host, r := testRegistry(t)
+	repository := fmt.Sprintf("%s/tsuru/app-delete-%d", host, time.Now().UnixNano())
+
+	digest := push(t, r, repository, "v1")
+
+	require.NoError(t, r.DeleteTag(context.TODO(), repository+":v1"))
+	assert.False(t, exists(t, r, repository, digest))
+
+	// missing tags and repositories are ignored
+	require.NoError(t, r.DeleteTag(context.TODO(), repository+":v1"))
+	tags, err := r.ListTags(context.TODO(), host+"/tsuru/app-missing")
+	require.NoError(t, err)
+	assert.Empty(t, tags)
+}
+
+func TestNewRegistry(t *testing.T) {
+	r, err := NewRegistry(map[string]string{"username": "tsuru", "password": "s3cr3t", "insecure": "true"})
+	require.NoError(t, err)
+	assert.Equal(t, &Registry{Username: "tsuru", Password: "s3cr3t", Insecure: true}, r)
+	assert.NoError(t, r.Ensure(context.TODO(), "registry.example.com/tsuru/app-my-app:v1"))
+
+	_, err = NewRegistry(map[string]string{"insecure": "please"})
+	assert.EqualError(t, err, `invalid registry insecure: strconv.ParseBool: parsing "please": invalid syntax`)
+}
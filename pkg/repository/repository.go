@@ -7,22 +7,166 @@ package repository
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 
+	"github.com/tsuru/deploy-agent/pkg/build"
+	"github.com/tsuru/deploy-agent/pkg/repository/artifactregistry"
+	"github.com/tsuru/deploy-agent/pkg/repository/ecr"
 	"github.com/tsuru/deploy-agent/pkg/repository/fake"
+	"github.com/tsuru/deploy-agent/pkg/repository/harbor"
 	"github.com/tsuru/deploy-agent/pkg/repository/oci"
+	"github.com/tsuru/deploy-agent/pkg/repository/registry"
+	"github.com/tsuru/deploy-agent/pkg/repository/retention"
+	"golang.org/x/sync/errgroup"
 )
 
 type Repository interface {
 	Ensure(ctx context.Context, name string) error
 }
 
+// TagLister is implemented by the providers which list the tags of a
+// repository, named as the image without tag (e.g.
+// registry.example.com/tsuru/app-my-app).
+type TagLister interface {
+	ListTags(ctx context.Context, repository string) ([]string, error)
+}
+
+// TagDeleter is implemented by the providers which delete a tag of an
+// image (e.g. registry.example.com/tsuru/app-my-app:v1).
+type TagDeleter interface {
+	DeleteTag(ctx context.Context, image string) error
+}
+
+// RetentionApplier is implemented by the providers which apply the
+// retention policy on their own, rather than deleting each expired tag (e.g.
+// because deleting a tag also deletes the tags sharing its digest).
+type RetentionApplier interface {
+	ApplyRetention(ctx context.Context, repository string, policy retention.Policy) error
+}
+
 type RemoteRepositoryProvider map[string]map[string]string
 
+// EnsureImages ensures the repositories of images exist, using the provider
+// of each image's registry. Images from registries without provider are skipped.
+// The repositories are ensured in parallel, and the ones ensured in the last
+// DefaultExistingTTL (by any build) are skipped. Each repository gives up
+// after DefaultEnsureTimeout, even if ctx has a later deadline.
+func EnsureImages(ctx context.Context, providers map[string]Repository, images []string) error {
+	g, ctx := errgroup.WithContext(ctx)
+	ensured := make(map[string]bool)
+	for _, image := range images {
+		provider, ok := providers[build.GetRegistry(image)]
+		if !ok {
+			continue
+		}
+
+		repository, _ := splitTag(image)
+		if ensured[repository] {
+			continue
+		}
+		ensured[repository] = true
+
+		g.Go(func() error {
+			return existing.ensure(ctx, provider, repository, image)
+		})
+	}
+	return g.Wait()
+}
+
+// ApplyRetention deletes the versions older than the keepLast latest ones
+// from the repositories of the images just pushed, using the provider of each
+// image's registry. The tags of the pushed images and of the images in use
+// are always kept. Images from registries whose provider supports neither
+// RetentionApplier nor TagLister and TagDeleter are skipped.
+func ApplyRetention(ctx context.Context, providers map[string]Repository, images, inUse []string, keepLast int) error {
+	if keepLast <= 0 {
+		return nil
+	}
+
+	var repositories []string
+	kept := make(map[string][]string)
+	for _, image := range images {
+		repository, tag := splitTag(image)
+		if _, ok := kept[repository]; !ok {
+			repositories = append(repositories, repository)
+		}
+		kept[repository] = append(kept[repository], tag)
+	}
+
+	for _, image := range inUse {
+		repository, tag := splitTag(image)
+		kept[repository] = append(kept[repository], tag)
+	}
+
+	var errs []error
+	for _, repository := range repositories {
+		provider, ok := providers[build.GetRegistry(repository)]
+		if !ok {
+			continue
+		}
+
+		policy := retention.Policy{KeepLast: keepLast, InUse: kept[repository]}
+		if err := applyRetention(ctx, provider, repository, policy); err != nil {
+			errs = append(errs, fmt.Errorf("failed to apply the retention on %s: %w", repository, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func applyRetention(ctx context.Context, provider Repository, repository string, policy retention.Policy) error {
+	if applier, ok := provider.(RetentionApplier); ok {
+		return applier.ApplyRetention(ctx, repository, policy)
+	}
+
+	lister, ok := provider.(TagLister)
+	if !ok {
+		return nil
+	}
+
+	deleter, ok := provider.(TagDeleter)
+	if !ok {
+		return nil
+	}
+
+	tags, err := lister.ListTags(ctx, repository)
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range policy.Expired(tags) {
+		if err := deleter.DeleteTag(ctx, repository+":"+tag); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// splitTag splits the image into its repository and tag, if any. Digests
+// are dropped.
+func splitTag(image string) (string, string) {
+	image, _, _ = strings.Cut(image, "@")
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i], image[i+1:]
+	}
+	return image, ""
+}
+
 func repositoryProvider(providerType string, data map[string]string) (Repository, error) {
 	switch providerType {
 	case "oci":
-		return oci.NewOCI(data), nil
+		return oci.NewOCI(data)
+	case "ecr":
+		return ecr.NewECR(data)
+	case "harbor":
+		return harbor.NewHarbor(data)
+	case "artifactregistry":
+		return artifactregistry.NewArtifactRegistry(data)
+	case "registry":
+		return registry.NewRegistry(data)
 	case "fake":
 		return &fake.FakeRepository{}, nil
 	default:
@@ -36,6 +180,10 @@ func NewRemoteRepository(data []byte) (map[string]Repository, error) {
 	if err != nil {
 		return nil, err
 	}
+	return NewRemoteRepositoryFromProvider(remoteRepositoryProvider)
+}
+
+func NewRemoteRepositoryFromProvider(remoteRepositoryProvider RemoteRepositoryProvider) (map[string]Repository, error) {
 	var repositoryMap = make(map[string]Repository)
 	for k, v := range remoteRepositoryProvider {
 		if p, ok := v["provider"]; ok {
@@ -5,10 +5,15 @@
 package repository
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tsuru/deploy-agent/pkg/repository/artifactregistry"
+	"github.com/tsuru/deploy-agent/pkg/repository/ecr"
 	"github.com/tsuru/deploy-agent/pkg/repository/fake"
+	"github.com/tsuru/deploy-agent/pkg/repository/harbor"
 	"github.com/tsuru/deploy-agent/pkg/repository/oci"
 )
 
@@ -21,15 +26,34 @@ func TestNewRemoteRepository(t *testing.T) {
 	},
 	"faker.com": {
 				"provider": "fake"
+	},
+	"123456789012.dkr.ecr.us-east-1.amazonaws.com": {
+				"provider": "ecr",
+				"scanOnPush": "true"
+	},
+	"harbor.example.com": {
+				"provider": "harbor",
+				"robotName": "robot$tsuru",
+				"autoScan": "true"
+	},
+	"us-central1-docker.pkg.dev": {
+				"provider": "artifactregistry",
+				"credentialsFile": "/etc/tsuru/gcp.json"
 	}
 	}`)
 	repositoryMap, err := NewRemoteRepository(data)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	assert.Len(t, repositoryMap, 2)
-	assert.Equal(t, oci.NewOCI(map[string]string{"compartmentID": "123", "profile": "dev"}), repositoryMap["test.com"])
+	assert.Len(t, repositoryMap, 5)
+	assert.Equal(t, &oci.OCI{CompartmentID: "123", Profile: "dev"}, repositoryMap["test.com"])
 	assert.Equal(t, &fake.FakeRepository{}, repositoryMap["faker.com"].(*fake.FakeRepository))
+	assert.Equal(t, &ecr.ECR{ScanOnPush: true}, repositoryMap["123456789012.dkr.ecr.us-east-1.amazonaws.com"])
+	require.IsType(t, &harbor.Harbor{}, repositoryMap["harbor.example.com"])
+	assert.Equal(t, "robot$tsuru", repositoryMap["harbor.example.com"].(*harbor.Harbor).RobotName)
+	assert.True(t, repositoryMap["harbor.example.com"].(*harbor.Harbor).AutoScan)
+	require.IsType(t, &artifactregistry.ArtifactRegistry{}, repositoryMap["us-central1-docker.pkg.dev"])
+	assert.Equal(t, "/etc/tsuru/gcp.json", repositoryMap["us-central1-docker.pkg.dev"].(*artifactregistry.ArtifactRegistry).CredentialsFile)
 }
 
 func TestNewRepositoryInvalidProvider(t *testing.T) {
@@ -42,3 +66,72 @@ func TestNewRepositoryInvalidProvider(t *testing.T) {
 	assert.Error(t, err)
 	assert.Equal(t, "unknow repositoy provider: invalid", err.Error())
 }
+
+func TestNewRepositoryInvalidECRSettings(t *testing.T) {
+	data := []byte(`{
+	"123456789012.dkr.ecr.us-east-1.amazonaws.com": {
+				"provider": "ecr",
+				"immutableTags": "sure"
+	}
+	}`)
+	_, err := NewRemoteRepository(data)
+	assert.ErrorContains(t, err, "invalid ecr immutableTags")
+}
+
+func TestNewRepositoryInvalidOCISettings(t *testing.T) {
+	data := []byte(`{
+	"gru.ocir.io": {
+				"provider": "oci",
+				"authType": "password"
+	}
+	}`)
+	_, err := NewRemoteRepository(data)
+	assert.ErrorContains(t, err, "invalid oci authType")
+}
+
+func TestApplyRetention(t *testing.T) {
+	myApp := &fake.FakeRepository{Tags: map[string][]string{
+		"registry.example.com/tsuru/app-my-app":    {"v1", "v2", "v3", "v4", "v5", "latest"},
+		"registry.example.com/tsuru/app-other-app": {"v1", "v2", "v3"},
+	}}
+	providers := map[string]Repository{
+		"registry.example.com": myApp,
+		"nocleanup.com":        &ecr.ECR{},
+	}
+
+	images := []string{
+		"registry.example.com/tsuru/app-my-app:v5",
+		"registry.example.com/tsuru/app-my-app:latest",
+		"nocleanup.com/tsuru/app-my-app:v5",
+		"other.example.com/tsuru/app-my-app:v5",
+	}
+	inUse := []string{
+		"registry.example.com/tsuru/app-my-app:v2",
+		"registry.example.com/tsuru/app-other-app:v1",
+	}
+
+	err := ApplyRetention(context.TODO(), providers, images, inUse, 0)
+	require.NoError(t, err)
+	assert.Len(t, myApp.Tags["registry.example.com/tsuru/app-my-app"], 6)
+
+	err = ApplyRetention(context.TODO(), providers, images, inUse, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"v2", "v4", "v5", "latest"}, myApp.Tags["registry.example.com/tsuru/app-my-app"])
+	assert.Equal(t, []string{"v1", "v2", "v3"}, myApp.Tags["registry.example.com/tsuru/app-other-app"])
+
+	err = ApplyRetention(context.TODO(), providers, []string{"registry.example.com/tsuru/app-my-app:v6"}, nil, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"v5", "latest"}, myApp.Tags["registry.example.com/tsuru/app-my-app"])
+}
+
+func TestSplitTag(t *testing.T) {
+	for image, expected := range map[string][2]string{
+		"registry.example.com/tsuru/app-my-app:v1":          {"registry.example.com/tsuru/app-my-app", "v1"},
+		"registry.example.com:5000/tsuru/app-my-app":        {"registry.example.com:5000/tsuru/app-my-app", ""},
+		"registry.example.com:5000/tsuru/app-my-app:v1":     {"registry.example.com:5000/tsuru/app-my-app", "v1"},
+		"registry.example.com/tsuru/app-my-app@sha256:abcd": {"registry.example.com/tsuru/app-my-app", ""},
+	} {
+		repository, tag := splitTag(image)
+		assert.Equal(t, expected, [2]string{repository, tag}, image)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package retention decides which tags of an image repository are deleted
+// after a push. Tsuru tags the images of every deploy as vN (e.g. v42), so
+// the versions older than the latest ones are deleted, unless in use. Other
+// tags (e.g. latest) are never deleted.
+package retention
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Policy tells which tags of a repository are kept.
+type Policy struct {
+	// KeepLast is the number of latest versions kept, retention is disabled
+	// when zero.
+	KeepLast int
+	// InUse are the tags kept regardless of KeepLast, e.g. the ones of the
+	// running units and of the images just pushed.
+	InUse []string
+}
+
+// Expired returns the tags which the policy deletes, from the oldest to the
+// newest version.
+func (p Policy) Expired(tags []string) []string {
+	if p.KeepLast <= 0 {
+		return nil
+	}
+
+	type version struct {
+		tag string
+		n   int
+	}
+
+	var versions []version
+	for _, tag := range tags {
+		if n, ok := Version(tag); ok {
+			versions = append(versions, version{tag, n})
+		}
+	}
+
+	if len(versions) <= p.KeepLast {
+		return nil
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return versions[i].n < versions[j].n })
+
+	inUse := make(map[string]bool, len(p.InUse))
+	for _, tag := range p.InUse {
+		inUse[tag] = true
+	}
+
+	var expired []string
+	for _, v := range versions[:len(versions)-p.KeepLast] {
+		if !inUse[v.tag] {
+			expired = append(expired, v.tag)
+		}
+	}
+
+	return expired
+}
+
+// Version returns the number of a vN tag.
+func Version(tag string) (int, bool) {
+	s, found := strings.CutPrefix(tag, "v")
+	if !found || s == "" || strings.TrimLeft(s, "0123456789") != "" {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
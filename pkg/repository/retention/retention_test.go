@@ -0,0 +1,52 @@
+// Copyright 2026 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package retention
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicy_Expired(t *testing.T) {
+	tags := []string{"latest", "v10", "v2", "v9", "v1", "v11", "v3", "staging", "v4-rc1"}
+
+	tests := map[string]struct {
+		policy   Policy
+		expected []string
+	}{
+		"disabled": {
+			policy: Policy{},
+		},
+		"keeps the latest versions": {
+			policy:   Policy{KeepLast: 3},
+			expected: []string{"v1", "v2", "v3"},
+		},
+		"keeps the versions in use": {
+			policy:   Policy{KeepLast: 2, InUse: []string{"v2", "v10", "latest"}},
+			expected: []string{"v1", "v3", "v9"},
+		},
+		"fewer versions than kept": {
+			policy: Policy{KeepLast: 6},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.policy.Expired(tags))
+		})
+	}
+}
+
+func TestVersion(t *testing.T) {
+	n, ok := Version("v42")
+	assert.True(t, ok)
+	assert.Equal(t, 42, n)
+
+	for _, tag := range []string{"latest", "v", "42", "v4-rc1", "v+4", "version1"} {
+		_, ok = Version(tag)
+		assert.False(t, ok, tag)
+	}
+}